@@ -55,7 +55,7 @@ type CPD struct {
 
 func syncMembers() {
 
-	xi, err := generic.GetIDs(ds, "member", "")
+	xi, err := generic.GetIDs(ds, "member", nil)
 	if err != nil {
 		log.Fatalln("mysql err", err)
 	}
@@ -13,7 +13,10 @@ import (
 	"time"
 
 	"github.com/34South/envr"
+	"github.com/cardiacsociety/web-services/internal/auth"
+	"github.com/cardiacsociety/web-services/internal/cpd"
 	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+	"github.com/cardiacsociety/web-services/internal/platform/s3"
 	"github.com/cardiacsociety/web-services/internal/resource"
 	"github.com/pkg/errors"
 	"gopkg.in/mgo.v2"
@@ -63,7 +66,7 @@ var backdays int
 // tasksFlag flag is used to specify specific functions to run, comma-separated
 var tasksFlag string
 
-var validTasks = []string{"fixResources", "pubmedData"}
+var validTasks = []string{"fixResources", "pubmedData", "purgeActivities", "migrateRecurring", "wrapPasswords"}
 
 var DS datastore.Datastore
 
@@ -130,6 +133,49 @@ func main() {
 			fmt.Println("Running task:", v)
 			updatePubmedData()
 		}
+
+		if v == "purgeActivities" {
+			fmt.Println("Running task:", v)
+			n, files, err := cpd.Purge(DS)
+			if err != nil {
+				fmt.Println(errors.Cause(err))
+				os.Exit(1)
+			}
+			fmt.Println("Purged", n, "deleted cpd activities")
+			var removed int
+			for _, f := range files {
+				err := s3.DeleteObject(f.Key, f.Volume)
+				if err != nil {
+					fmt.Println("Could not remove attachment", f.Volume+f.Key, "-", err)
+					continue
+				}
+				removed++
+			}
+			fmt.Println("Removed", removed, "of", len(files), "attachments from storage")
+			fmt.Println("--- done")
+		}
+
+		if v == "migrateRecurring" {
+			fmt.Println("Running task:", v)
+			n, err := cpd.MigrateRecurring(DS)
+			if err != nil {
+				fmt.Println(errors.Cause(err))
+				os.Exit(1)
+			}
+			fmt.Println("Migrated", n, "recurring activity docs")
+			fmt.Println("--- done")
+		}
+
+		if v == "wrapPasswords" {
+			fmt.Println("Running task:", v)
+			n, err := auth.WrapPasswords(DS)
+			if err != nil {
+				fmt.Println(errors.Cause(err))
+				os.Exit(1)
+			}
+			fmt.Println("Wrapped", n, "legacy password hashes")
+			fmt.Println("--- done")
+		}
 	}
 }
 
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/34South/envr"
+	"github.com/cardiacsociety/web-services/internal/member"
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+)
+
+// Import file
+var file string
+
+// Insert the rows, rather than only checking them
+var commit bool
+
+// Excel error report
+var report string
+
+// Datastore
+var store datastore.Datastore
+
+func init() {
+
+	envr.New("importrEnv", []string{
+		"MAPPCPD_MONGO_DBNAME",
+		"MAPPCPD_MONGO_DESC",
+		"MAPPCPD_MONGO_URL",
+		"MAPPCPD_MYSQL_DESC",
+		"MAPPCPD_MYSQL_URL",
+	}).Auto()
+
+	flag.StringVar(&file, "f", "", "Specify the CSV or XLSX file to import")
+	flag.BoolVar(&commit, "commit", false, "Insert the rows - without this flag the file is only checked")
+	flag.StringVar(&report, "o", "import-errors.xlsx", "Specify the file for the excel error report")
+
+	var err error
+	store, err = datastore.FromEnv()
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func main() {
+
+	err := flagCheck()
+	if err != nil {
+		log.Fatalf("flagCheck() err = %s", err)
+	}
+	log.Printf("Running importr on file: %s, commit: %v", file, commit)
+
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatalf("os.Open() err = %s", err)
+	}
+	defer f.Close()
+
+	format := strings.ToLower(strings.TrimPrefix(filepath.Ext(file), "."))
+	im, err := member.ReadImport(store, f, format)
+	if err != nil {
+		log.Fatalf("member.ReadImport() err = %s", err)
+	}
+
+	err = im.ErrorReport().SaveAs(report)
+	if err != nil {
+		log.Fatalf("SaveAs() err = %s", err)
+	}
+	log.Printf("Read %d rows, %d with errors - report saved to %s", len(im.Rows), im.ErrorCount(), report)
+
+	if !commit {
+		return
+	}
+
+	ids, err := im.Commit(store)
+	if err != nil {
+		log.Fatalf("Commit() err = %s", err)
+	}
+	log.Printf("Imported %d members, ids %v", len(ids), ids)
+}
+
+func flagCheck() error {
+	flag.Parse()
+	if file == "" {
+		return errors.New("Import file (-f) required, -h for help")
+	}
+	return nil
+}
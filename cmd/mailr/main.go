@@ -98,7 +98,6 @@ var cfg = campaignConfig{}
 
 var httpClient = &http.Client{Timeout: 30 * time.Second}
 var api string
-var apiAuth string
 var apiActiveMembers string
 var apiResources string
 var token string
@@ -107,14 +106,12 @@ var recipients []recipient
 func init() {
 
 	envr.New("mongrEnv", []string{
-		"MAPPCPD_ADMIN_USER",
-		"MAPPCPD_ADMIN_PASS",
+		"MAPPCPD_API_KEY",
 		"MAPPCPD_API_URL",
 		"SENDGRID_API_KEY",
 	}).Auto()
 
 	api = os.Getenv("MAPPCPD_API_URL")
-	apiAuth = api + "/v1/auth/admin"
 	apiActiveMembers = api + "/v1/a/members"
 	apiResources = api + "/v1/a/resources"
 
@@ -330,31 +327,12 @@ func (cc *campaignConfig) read(configFile string) error {
 	return nil
 }
 
-// auth fetches an admin token from the MappCPD API
+// auth sets the token to the API key for mailr, which needs the members:read permission
 func auth() error {
 
-	type AuthResponse struct {
-		Status  int
-		Message string
-		Data    struct {
-			Token     string
-			IssuedAt  time.Time
-			ExpiresAt time.Time
-		}
-	}
-
-	auth := AuthResponse{}
-	b := `{"login": "` + os.Getenv("MAPPCPD_ADMIN_USER") + `","password": "` + os.Getenv("MAPPCPD_ADMIN_PASS") + `"}`
-	res, err := httpClient.Post(apiAuth, "application/json", strings.NewReader(b))
-	if err != nil {
-		return err
-	}
-	defer res.Body.Close()
-
-	json.NewDecoder(res.Body).Decode(&auth)
-	token = auth.Data.Token
+	token = os.Getenv("MAPPCPD_API_KEY")
 	if len(token) == 0 {
-		return errors.New("Encoded has no length")
+		return errors.New("MAPPCPD_API_KEY has no length")
 	}
 
 	return nil
@@ -27,7 +27,7 @@ const pubMedFetch = "https://eutils.ncbi.nlm.nih.gov/entrez/eutils/efetch.fcgi?d
 // The id of the resource type (ol_resource_type table) for journal articles
 const resourceTypeID = 80
 
-var api, apiAuth, apiResource string
+var api, apiResource string
 
 type PubMedSearch struct {
 	Header map[string]string  `json:"header"`
@@ -120,24 +120,12 @@ type PubDate struct {
 	RealPubDate bool `json:"realPubDate" bson:"realPubDate"`
 }
 
-type AuthRequest struct {
-	Status  int
-	Message string
-	Data    AuthData
-}
-type AuthData struct {
-	Token     string
-	IssuedAt  time.Time
-	ExpiresAt time.Time
-}
-
 var token string
 var batchSize int
 
 func init() {
 	envr.New("pubmedrEnv", []string{
-		"MAPPCPD_ADMIN_USER",
-		"MAPPCPD_ADMIN_PASS",
+		"MAPPCPD_API_KEY",
 		"MAPPCPD_API_URL",
 		"MAPPCPD_PUBMED_RETMAX",
 		"MAPPCPD_PUBMED_BATCH_FILE",
@@ -150,7 +138,6 @@ func init() {
 	}
 
 	api = os.Getenv("MAPPCPD_API_URL")
-	apiAuth = api + "/v1/auth/admin"
 	apiResource = api + "/v1/a/batch/resources"
 }
 
@@ -274,19 +261,12 @@ func testAPI() {
 	fmt.Printf("%v\n", res.Status)
 }
 
+// authAPI sets the token to the API key for pubmedr, which needs the resources:write permission
 func authAPI() {
-	fmt.Print("Authenticate and get token... ")
-	a := AuthRequest{}
-	b := `{"login": "` + os.Getenv("MAPPCPD_ADMIN_USER") + `","password": "` + os.Getenv("MAPPCPD_ADMIN_PASS") + `"}`
-	res, err := httpClient.Post(apiAuth, "application/json", strings.NewReader(b))
-	if err != nil {
-		log.Fatalln(err)
-	}
-	defer res.Body.Close()
-	json.NewDecoder(res.Body).Decode(&a)
-	token = a.Data.Token
+	fmt.Print("Authenticate with API key... ")
+	token = os.Getenv("MAPPCPD_API_KEY")
 	if token == "" {
-		fmt.Println("Failed to authenticate witht the API")
+		fmt.Println("MAPPCPD_API_KEY is not set")
 		os.Exit(1)
 	}
 
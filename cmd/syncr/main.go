@@ -45,7 +45,7 @@ var backdays int
 var collection string
 
 // sql clause
-var clause string
+var clause *datastore.Clause
 
 // Datastore
 var store datastore.Datastore
@@ -99,11 +99,11 @@ func flagCheck() error {
 
 // sqlClause returns an sql clause for selection of records with an updated_at
 // date >= current date - backdays.
-func sqlClause() string {
+func sqlClause() *datastore.Clause {
 	// MySQL timestamp
 	t := time.Now().AddDate(0, 0, -backdays).Format("2006-01-02 15:04:05")
 
-	return fmt.Sprintf("WHERE updated_at >= '%s'", t)
+	return datastore.NewClause().GreaterOrEqual("updated_at", t)
 }
 
 func sync() error {
@@ -2,10 +2,8 @@ package graphql
 
 import (
 	"fmt"
-	"os"
 
 	"github.com/cardiacsociety/web-services/internal/cpd"
-	"github.com/cardiacsociety/web-services/internal/platform/jwt"
 	"github.com/graphql-go/graphql"
 	"github.com/pkg/errors"
 )
@@ -24,13 +22,11 @@ var activitySave = &graphql.Field{
 	},
 	Resolve: func(p graphql.ResolveParams) (interface{}, error) {
 
-		// Always extract the member id from the token, available thus:
-		token := p.Info.VariableValues["token"]
-		at, err := jwt.Decode(token.(string), os.Getenv("MAPPCPD_JWT_SIGNING_KEY"))
+		// Member id comes from the parent member node, which was authenticated by the token
+		memberID, err := sourceMemberID(p)
 		if err != nil {
 			return nil, err
 		}
-		memberID := at.Claims.ID
 
 		maObj, ok := p.Args["obj"].(map[string]interface{})
 		if ok {
@@ -117,7 +113,7 @@ var activityInputType = graphql.NewInputObject(graphql.InputObjectConfig{
 
 // activityDelete handles mutation (add / update) of a member activity
 var activityDelete = &graphql.Field{
-	Description: "Delete an activity that belongs to the member identified by the token",
+	Description: "Delete an activity that belongs to the member identified by the token. It can be restored with restoreActivity until it is purged.",
 	Type:        graphql.String, // this type will be returned this operation
 	Args: graphql.FieldConfigArgument{
 		"id": &graphql.ArgumentConfig{
@@ -127,13 +123,11 @@ var activityDelete = &graphql.Field{
 	},
 	Resolve: func(p graphql.ResolveParams) (interface{}, error) {
 
-		// Always extract the member id from the token, available thus:
-		token := p.Info.VariableValues["token"]
-		at, err := jwt.Decode(token.(string), os.Getenv("MAPPCPD_JWT_SIGNING_KEY"))
+		// Member id comes from the parent member node, which was authenticated by the token
+		memberID, err := sourceMemberID(p)
 		if err != nil {
 			return nil, err
 		}
-		memberID := at.Claims.ID
 
 		activityID, ok := p.Args["id"].(int)
 		if ok {
@@ -142,3 +136,29 @@ var activityDelete = &graphql.Field{
 		return nil, nil
 	},
 }
+
+// activityRestore handles undoing the deletion of a member activity
+var activityRestore = &graphql.Field{
+	Description: "Restore an activity, deleted by the member identified by the token, that has not yet been purged",
+	Type:        graphql.String,
+	Args: graphql.FieldConfigArgument{
+		"id": &graphql.ArgumentConfig{
+			Type:        graphql.Int,
+			Description: "The id of the record to be restored",
+		},
+	},
+	Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+
+		// Member id comes from the parent member node, which was authenticated by the token
+		memberID, err := sourceMemberID(p)
+		if err != nil {
+			return nil, err
+		}
+
+		activityID, ok := p.Args["id"].(int)
+		if ok {
+			return "CPD restored", cpd.Restore(DS, memberID, activityID)
+		}
+		return nil, nil
+	},
+}
@@ -1,11 +1,8 @@
 package graphql
 
 import (
-	"os"
-
 	"github.com/cardiacsociety/web-services/internal/attachments"
 	"github.com/cardiacsociety/web-services/internal/date"
-	"github.com/cardiacsociety/web-services/internal/platform/jwt"
 	"github.com/graphql-go/graphql"
 )
 
@@ -21,13 +18,11 @@ var activityQuery = &graphql.Field{
 	},
 	Resolve: func(p graphql.ResolveParams) (interface{}, error) {
 
-		// Always extract the member id from the token, available thus:
-		token := p.Info.VariableValues["token"]
-		at, err := jwt.Decode(token.(string), os.Getenv("MAPPCPD_JWT_SIGNING_KEY"))
+		// Member id comes from the parent member node, which was authenticated by the token
+		memberID, err := sourceMemberID(p)
 		if err != nil {
 			return nil, err
 		}
-		memberID := at.Claims.ID
 
 		activityID, ok := p.Args["activityId"].(int)
 		if ok {
@@ -58,13 +53,11 @@ var activitiesQuery = &graphql.Field{
 	},
 	Resolve: func(p graphql.ResolveParams) (interface{}, error) {
 
-		// Extract member id from the token, available thus:
-		token := p.Info.VariableValues["token"]
-		at, err := jwt.Decode(token.(string), os.Getenv("MAPPCPD_JWT_SIGNING_KEY"))
+		// Member id comes from the parent member node, which was authenticated by the token
+		memberID, err := sourceMemberID(p)
 		if err != nil {
 			return nil, err
 		}
-		memberID := at.Claims.ID
 
 		// Filter arguments
 		f := make(map[string]interface{})
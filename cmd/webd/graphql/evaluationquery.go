@@ -1,9 +1,6 @@
 package graphql
 
 import (
-	"os"
-
-	"github.com/cardiacsociety/web-services/internal/platform/jwt"
 	"github.com/graphql-go/graphql"
 )
 
@@ -13,13 +10,11 @@ var currentEvaluationQuery = &graphql.Field{
 	Type:        evaluationType,
 	Resolve: func(p graphql.ResolveParams) (interface{}, error) {
 
-		// Extract member id from the token, available thus:
-		token := p.Info.VariableValues["token"]
-		at, err := jwt.Decode(token.(string), os.Getenv("MAPPCPD_JWT_SIGNING_KEY"))
+		// Member id comes from the parent member node, which was authenticated by the token
+		memberID, err := sourceMemberID(p)
 		if err != nil {
 			return nil, err
 		}
-		memberID := at.Claims.ID
 
 		return currentEvaluation(memberID)
 	},
@@ -31,13 +26,11 @@ var evaluationsQuery = &graphql.Field{
 	Type:        graphql.NewList(evaluationType),
 	Resolve: func(p graphql.ResolveParams) (interface{}, error) {
 
-		// Extract member id from the token, available thus:
-		token := p.Info.VariableValues["token"]
-		at, err := jwt.Decode(token.(string), os.Getenv("MAPPCPD_JWT_SIGNING_KEY"))
+		// Member id comes from the parent member node, which was authenticated by the token
+		memberID, err := sourceMemberID(p)
 		if err != nil {
 			return nil, err
 		}
-		memberID := at.Claims.ID
 
 		return evaluations(memberID)
 	},
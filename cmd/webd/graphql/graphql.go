@@ -1,6 +1,7 @@
 package graphql
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/cardiacsociety/web-services/internal/platform/datastore"
@@ -11,8 +12,15 @@ import (
 // DS represents the global datastore passed to internal packages by the handlers
 var DS datastore.Datastore
 
-// Server returns a handler for the GraphQL server
-func Server(ds datastore.Datastore) http.Handler {
+// contextKey is the type of context keys defined in this package
+type contextKey int
+
+// clientIPKey is the context key for the ip address of the client
+const clientIPKey contextKey = 0
+
+// Server returns a handler for the GraphQL server. The clientIP func returns the ip address of the client
+// making a request, which is added to the context passed to resolvers.
+func Server(ds datastore.Datastore, clientIP func(*http.Request) string) http.Handler {
 
 	DS = ds
 
@@ -32,7 +40,24 @@ func Server(ds datastore.Datastore) http.Handler {
 		AllowedOrigins: []string{"*"},
 		AllowedMethods: []string{"GET", "POST", "OPTIONS"},
 		AllowedHeaders: []string{"Authorization", "Content-Type"},
-	}).Handler(h)
+	}).Handler(withClientIP(h, clientIP))
 
 	return ch
 }
+
+// withClientIP adds the ip address of the client to the request context
+func withClientIP(h http.Handler, clientIP func(*http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPKey, clientIP(r))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientIPFromContext returns the ip address of the client added by withClientIP, or an empty string
+func clientIPFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	ip, _ := ctx.Value(clientIPKey).(string)
+	return ip
+}
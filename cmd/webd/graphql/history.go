@@ -0,0 +1,54 @@
+package graphql
+
+import (
+	"github.com/cardiacsociety/web-services/internal/history"
+)
+
+// changeData represents a change to one of the member's records
+type changeData struct {
+	ID        int         `json:"id"`
+	CreatedAt string      `json:"createdAt"`
+	Table     string      `json:"table"`
+	Action    string      `json:"action"`
+	Message   string      `json:"message"`
+	UserType  string      `json:"userType"`
+	Fields    []fieldData `json:"fields"`
+}
+
+// fieldData represents the value of a field before and after a change
+type fieldData struct {
+	Name   string `json:"name"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// changes fetches the change history of a member and maps to local changeData values
+func changes(memberID int) ([]changeData, error) {
+
+	var xcd []changeData
+
+	xc, err := history.ByMember(DS, memberID)
+	for _, c := range xc {
+		xcd = append(xcd, mapChangeData(c))
+	}
+
+	return xcd, err
+}
+
+// mapChangeData maps a history.Change to a local changeData value
+func mapChangeData(c history.Change) changeData {
+
+	cd := changeData{
+		ID:        c.ID,
+		CreatedAt: c.CreatedAt.Format("2006-01-02 15:04:05"),
+		Table:     c.Table,
+		Action:    c.Action,
+		Message:   c.Message,
+		UserType:  c.UserType,
+	}
+	for _, f := range c.Fields {
+		cd.Fields = append(cd.Fields, fieldData{Name: f.Name, Before: f.Before, After: f.After})
+	}
+
+	return cd
+}
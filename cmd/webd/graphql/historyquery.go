@@ -0,0 +1,77 @@
+package graphql
+
+import (
+	"github.com/graphql-go/graphql"
+)
+
+// historyQuery resolves queries for the change history of a member's records
+var historyQuery = &graphql.Field{
+	Description: "Fetches the history of changes to the member's records, most recent first",
+	Type:        graphql.NewList(changeType),
+	Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+
+		// Member id comes from the parent member node, which was authenticated by the token
+		memberID, err := sourceMemberID(p)
+		if err != nil {
+			return nil, err
+		}
+
+		return changes(memberID)
+	},
+}
+
+// changeType defines fields for a change to a member record
+var changeType = graphql.NewObject(graphql.ObjectConfig{
+	Name:        "change",
+	Description: "A change to one of the member's records, with the value of each field before and after the change.",
+	Fields: graphql.Fields{
+		"id": &graphql.Field{
+			Type:        graphql.Int,
+			Description: "The id of the change",
+		},
+		"createdAt": &graphql.Field{
+			Type:        graphql.String,
+			Description: "The date and time of the change",
+		},
+		"table": &graphql.Field{
+			Type:        graphql.String,
+			Description: "The table that was changed",
+		},
+		"action": &graphql.Field{
+			Type:        graphql.String,
+			Description: "The type of change - insert, update or delete",
+		},
+		"message": &graphql.Field{
+			Type:        graphql.String,
+			Description: "A description of the change",
+		},
+		"userType": &graphql.Field{
+			Type:        graphql.String,
+			Description: "The type of user that made the change - admin, member or service",
+		},
+		"fields": &graphql.Field{
+			Type:        graphql.NewList(fieldChangeType),
+			Description: "The fields that were changed",
+		},
+	},
+})
+
+// fieldChangeType defines fields for the change to a single field
+var fieldChangeType = graphql.NewObject(graphql.ObjectConfig{
+	Name:        "fieldChange",
+	Description: "The value of a field before and after a change. Before is empty for an insert, and after is empty for a delete.",
+	Fields: graphql.Fields{
+		"name": &graphql.Field{
+			Type:        graphql.String,
+			Description: "The name of the field",
+		},
+		"before": &graphql.Field{
+			Type:        graphql.String,
+			Description: "The value before the change",
+		},
+		"after": &graphql.Field{
+			Type:        graphql.String,
+			Description: "The value after the change",
+		},
+	},
+})
@@ -1,7 +1,11 @@
 package graphql
 
 import (
+	"errors"
+
+	"github.com/cardiacsociety/web-services/internal/history"
 	"github.com/cardiacsociety/web-services/internal/member"
+	"github.com/graphql-go/graphql"
 )
 
 // memberData is a local representation of member.Member
@@ -20,6 +24,9 @@ type memberData struct {
 	Locations      []member.Location      `json:"locations"`
 	Qualifications []member.Qualification `json:"qualifications"`
 	Positions      []member.Position      `json:"positions"`
+
+	// actor is the user making changes, which is the member or an admin viewing the system as the member
+	actor history.Actor
 }
 
 // mapMemberData fetches a member record by id, and maps field values to the local memberData type
@@ -46,6 +53,17 @@ func mapMemberData(id int) (memberData, error) {
 	return m, nil
 }
 
+// sourceMemberID returns the member id from the parent member node. The root member query and mutation
+// decode the token argument for each request, so child nodes take the member id from there rather than
+// decoding the token again.
+func sourceMemberID(p graphql.ResolveParams) (int, error) {
+	m, ok := p.Source.(memberData)
+	if !ok || m.ID == 0 {
+		return 0, errors.New("Could not determine member id from parent node")
+	}
+	return m.ID, nil
+}
+
 // memberActivityAttachmentRequest requests a signed URL for uploading to S3
 //func memberActivityAttachmentRequest(memberID int) string {
 //
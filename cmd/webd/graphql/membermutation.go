@@ -1,9 +1,6 @@
 package graphql
 
 import (
-	"os"
-
-	"github.com/cardiacsociety/web-services/internal/platform/jwt"
 	"github.com/graphql-go/graphql"
 )
 
@@ -21,7 +18,7 @@ var Mutation = &graphql.Field{
 		token, ok := p.Args["token"].(string)
 		if ok {
 
-			at, err := jwt.Decode(token, os.Getenv("MAPPCPD_JWT_SIGNING_KEY"))
+			at, err := memberToken(p.Context, token)
 			if err != nil {
 				return nil, err
 			}
@@ -31,11 +28,8 @@ var Mutation = &graphql.Field{
 			if err != nil {
 				return nil, err
 			}
-
-			m.Token, err = freshToken(token)
-			if err != nil {
-				return m, err
-			}
+			m.Token = token
+			m.actor = tokenActor(at)
 
 			return m, nil
 		}
@@ -55,9 +49,11 @@ var memberInputType = graphql.NewObject(graphql.ObjectConfig{
 		},
 		"token": &graphql.Field{
 			Type:        graphql.String,
-			Description: "A fresh token",
+			Description: "The token used for the request",
 		},
-		"saveActivity":   activitySave,
-		"deleteActivity": activityDelete,
+		"saveActivity":    activitySave,
+		"deleteActivity":  activityDelete,
+		"restoreActivity": activityRestore,
+		"saveProfile":     profileSave,
 	},
 })
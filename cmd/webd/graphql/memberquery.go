@@ -1,9 +1,6 @@
 package graphql
 
 import (
-	"os"
-
-	"github.com/cardiacsociety/web-services/internal/platform/jwt"
 	"github.com/graphql-go/graphql"
 )
 
@@ -23,7 +20,7 @@ var Query = &graphql.Field{
 		token, ok := p.Args["token"].(string)
 		if ok {
 
-			at, err := jwt.Decode(token, os.Getenv("MAPPCPD_JWT_SIGNING_KEY"))
+			at, err := memberToken(p.Context, token)
 			if err != nil {
 				return nil, err
 			}
@@ -33,11 +30,7 @@ var Query = &graphql.Field{
 			if err != nil {
 				return nil, err
 			}
-
-			m.Token, err = freshToken(token)
-			if err != nil {
-				return m, err
-			}
+			m.Token = token
 
 			return m, nil
 		}
@@ -57,7 +50,7 @@ var memberType = graphql.NewObject(graphql.ObjectConfig{
 		},
 		"token": &graphql.Field{
 			Type:        graphql.String,
-			Description: "A fresh token",
+			Description: "The token used for the request",
 		},
 		"active": &graphql.Field{
 			Type:        graphql.Boolean,
@@ -113,6 +106,7 @@ var memberType = graphql.NewObject(graphql.ObjectConfig{
 		"activities":  activitiesQuery,
 		"evaluation":  currentEvaluationQuery,
 		"evaluations": evaluationsQuery,
+		"history":     historyQuery,
 	},
 })
 
@@ -0,0 +1,136 @@
+package graphql
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/cardiacsociety/web-services/internal/member"
+	"github.com/graphql-go/graphql"
+)
+
+// profileSave handles mutation of the fields a member may change in their own profile
+var profileSave = &graphql.Field{
+	Description: "Update the profile of the member identified by the token. Only the fields present in the argument " +
+		"object are changed, and a list that is present replaces the existing list. Each change is recorded as a note " +
+		"on the member.",
+	Type: memberType, // this type will be returned this operation
+	Args: graphql.FieldConfigArgument{
+		"obj": &graphql.ArgumentConfig{
+			Type:        profileInputType, // this is the type required as the arg
+			Description: "An object containing the profile fields to change",
+		},
+	},
+	Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+
+		// Member comes from the parent member node, which was authenticated by the token
+		m, ok := p.Source.(memberData)
+		if !ok || m.ID == 0 {
+			return nil, errors.New("Could not determine member id from parent node")
+		}
+
+		obj, ok := p.Args["obj"].(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+
+		// input fields have the same names as the JSON fields of member.Profile
+		xb, err := json.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		pf, err := member.ProfileFromJSON(xb)
+		if err != nil {
+			return nil, err
+		}
+		_, err = pf.Save(DS, m.ID, m.actor)
+		if err != nil {
+			return nil, err
+		}
+
+		// the member doc in MongoDB is a copy of the MySQL record
+		mp, err := member.ByID(DS, m.ID)
+		if err != nil {
+			return nil, err
+		}
+		err = mp.SaveDocDB(DS)
+		if err != nil {
+			return nil, err
+		}
+
+		md, err := mapMemberData(m.ID)
+		md.Token = m.Token
+		md.actor = m.actor
+		return md, err
+	},
+}
+
+// profileInputType defines the fields a member may change in their own profile
+var profileInputType = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name:        "profileSaveInput",
+	Description: "An input object type used as an argument for updating a member profile",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"postNominal": &graphql.InputObjectFieldConfig{
+			Type:        graphql.String,
+			Description: "Post-nominal letters displayed after the member's name",
+		},
+		"consentDirectory": &graphql.InputObjectFieldConfig{
+			Type:        graphql.Boolean,
+			Description: "Consent to be listed in the member directory",
+		},
+		"consentContact": &graphql.InputObjectFieldConfig{
+			Type:        graphql.Boolean,
+			Description: "Consent for contact details to be given to third parties where appropriate",
+		},
+		"contacts": &graphql.InputObjectFieldConfig{
+			Type:        graphql.NewList(contactInputType),
+			Description: "Contact locations, which replace the existing locations",
+		},
+		"interests": &graphql.InputObjectFieldConfig{
+			Type:        graphql.NewList(specialityInputType),
+			Description: "Specialities in order of preference, which replace the existing specialities",
+		},
+	},
+})
+
+// contactInputType defines fields for a contact location
+var contactInputType = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name:        "contactSaveInput",
+	Description: "A contact location",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"contactTypeId": &graphql.InputObjectFieldConfig{
+			Type:        &graphql.NonNull{OfType: graphql.Int},
+			Description: "ID of the contact type, eg mail or directory",
+		},
+		"phone":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"fax":       &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"email":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"web":       &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"address1":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"address2":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"address3":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"locality":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"state":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"postcode":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"countryId": &graphql.InputObjectFieldConfig{Type: graphql.Int},
+	},
+})
+
+// specialityInputType defines fields for a member speciality
+var specialityInputType = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name:        "specialitySaveInput",
+	Description: "A speciality or area of interest",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"specialityId": &graphql.InputObjectFieldConfig{
+			Type:        &graphql.NonNull{OfType: graphql.Int},
+			Description: "ID of the speciality",
+		},
+		"preference": &graphql.InputObjectFieldConfig{
+			Type:        graphql.Int,
+			Description: "Order of preference, 1 being the highest",
+		},
+		"comment": &graphql.InputObjectFieldConfig{
+			Type:        graphql.String,
+			Description: "Optional comment",
+		},
+	},
+})
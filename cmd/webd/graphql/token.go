@@ -1,45 +1,60 @@
 package graphql
 
 import (
+	"context"
 	"os"
-	"strconv"
 
+	"github.com/cardiacsociety/web-services/internal/auth"
+	"github.com/cardiacsociety/web-services/internal/history"
 	"github.com/cardiacsociety/web-services/internal/platform/jwt"
 	"github.com/pkg/errors"
 )
 
-// freshToken will validate a JWT, and return a fresh token if all ok
-func freshToken(currentToken string) (string, error) {
+// memberToken decodes and validates a member JWT. Tokens are no longer refreshed here as that allowed
+// any valid token to be renewed indefinitely - clients use a refresh token at /v1/auth/refresh. Queries made
+// by an admin viewing the system as a member are logged, with the client ip address from the context.
+func memberToken(ctx context.Context, token string) (jwt.Token, error) {
 
-	iss := os.Getenv("MAPPCPD_API_URL")
-	key := os.Getenv("MAPPCPD_JWT_SIGNING_KEY")
-	ttl, err := strconv.Atoi(os.Getenv("MAPPCPD_JWT_TTL_HOURS"))
+	at, err := jwt.Decode(token, os.Getenv("MAPPCPD_JWT_SIGNING_KEY"))
 	if err != nil {
-		return "", errors.Wrap(err, "Could not convert hours string to int")
+		return at, err
 	}
 
-	// Validate current token
-	ct, err := jwt.Decode(currentToken, key)
-	if err != nil {
-		return "", errors.New("Cannot refresh token as current token is invalid: - " + err.Error())
+	// Make sure the token has "member" role
+	if at.Claims.Role != "member" {
+		return at, errors.New("Member token required")
 	}
 
-	// Make sure the current token has "member" role
-	if ct.Claims.Role != "member" {
-		return "", errors.New("Cannot refresh non-member token")
+	revoked, err := auth.Revoked(DS, at)
+	if err != nil {
+		return at, errors.Wrap(err, "Could not check token revocation")
 	}
-
-	// custom claims
-	c := map[string]interface{}{
-		"id":   ct.Claims.ID,
-		"name": ct.Claims.Name,
-		"role": ct.Claims.Role,
+	if revoked {
+		return at, errors.New("Token has been revoked")
 	}
 
-	t, err := jwt.New(iss, key, ttl).CustomClaims(c).Encode()
-	if err != nil {
-		return "", errors.New("Error creating new token -  " + err.Error())
+	if at.Claims.Act != nil {
+		err := auth.LogImpersonation(DS, auth.Impersonation{
+			AdminID:  at.Claims.Act.ID,
+			MemberID: at.Claims.ID,
+			TokenID:  at.Claims.Id,
+			Method:   "POST",
+			Path:     "/graphql",
+			IP:       clientIPFromContext(ctx),
+		})
+		if err != nil {
+			return at, errors.Wrap(err, "Could not log request made as a member")
+		}
 	}
 
-	return t.Encoded, nil
+	return at, nil
+}
+
+// tokenActor returns the user making changes with a member token. A change made by an admin viewing the
+// system as a member is attributed to the admin.
+func tokenActor(at jwt.Token) history.Actor {
+	if at.Claims.Act != nil {
+		return history.Actor{ID: at.Claims.Act.ID, Type: at.Claims.Act.Role}
+	}
+	return history.Actor{ID: at.Claims.ID, Type: at.Claims.Role}
 }
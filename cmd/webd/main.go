@@ -25,7 +25,6 @@ func init() {
 		"MAILGUN_DOMAIN",
 		"MAILGUN_API_KEY",
 		"MAPPCPD_API_URL",
-		"MAPPCPD_JWT_TTL_HOURS",
 		"MAPPCPD_JWT_SIGNING_KEY",
 		"MAPPCPD_MYSQL_DESC",
 		"MAPPCPD_MYSQL_URL",
@@ -10,6 +10,7 @@ import (
 
 	"github.com/cardiacsociety/web-services/internal/activity"
 	"github.com/cardiacsociety/web-services/internal/attachments"
+	"github.com/cardiacsociety/web-services/internal/audit"
 	"github.com/cardiacsociety/web-services/internal/cpd"
 	"github.com/cardiacsociety/web-services/internal/fileset"
 	"github.com/cardiacsociety/web-services/internal/platform/s3"
@@ -20,9 +21,9 @@ import (
 )
 
 // Activities fetches list of activity types
-func Activities(w http.ResponseWriter, _ *http.Request) {
+func Activities(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	al, err := activity.All(DS)
 	if err != nil {
@@ -44,7 +45,7 @@ func Activities(w http.ResponseWriter, _ *http.Request) {
 // ActivitiesID fetches a single activity type by ID
 func ActivitiesID(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	// Request - convert id from string to int type
 	v := mux.Vars(r)
@@ -72,7 +73,8 @@ func ActivitiesID(w http.ResponseWriter, r *http.Request) {
 // MembersActivitiesID fetches a single activity record by id
 func MembersActivitiesID(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	at := userAuthToken(r)
+	p := NewResponder()
 
 	// Request - convert id from string to int type
 	v := mux.Vars(r)
@@ -95,7 +97,7 @@ func MembersActivitiesID(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Authorization - need  owner of the record
-	if UserAuthToken.Claims.ID != a.MemberID {
+	if at.Claims.ID != a.MemberID {
 		p.Message = Message{http.StatusUnauthorized, "failed", "Encoded does not belong to the owner of resource"}
 		p.Send(w)
 		return
@@ -110,11 +112,12 @@ func MembersActivitiesID(w http.ResponseWriter, r *http.Request) {
 // MembersActivitiesAdd adds a new activity for the logged in member
 func MembersActivitiesAdd(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	at := userAuthToken(r)
+	p := NewResponder()
 
 	// Decode JSON body into ActivityAttachment value
 	a := cpd.Input{}
-	a.MemberID = UserAuthToken.Claims.ID
+	a.MemberID = at.Claims.ID
 	err := json.NewDecoder(r.Body).Decode(&a)
 	if err != nil {
 		msg := "Error decoding JSON: " + err.Error() + ". Decode the format of request body."
@@ -130,6 +133,8 @@ func MembersActivitiesAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	audit.AddEntity(r.Context(), "activities", int(aid))
+
 	// Fetch the new record for return
 	ar, err := cpd.ByID(DS, int(aid))
 	if err != nil {
@@ -139,7 +144,7 @@ func MembersActivitiesAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	msg := fmt.Sprintf("Added a new activity (id: %v) for member (id: %v)", aid, UserAuthToken.Claims.ID)
+	msg := fmt.Sprintf("Added a new activity (id: %v) for member (id: %v)", aid, at.Claims.ID)
 	p.Message = Message{http.StatusCreated, "success", msg}
 	p.Data = ar
 	p.Send(w)
@@ -151,7 +156,8 @@ func MembersActivitiesAdd(w http.ResponseWriter, r *http.Request) {
 // update one to many fields.
 func MembersActivitiesUpdate(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	at := userAuthToken(r)
+	p := NewResponder()
 
 	// Get activity id from path... and make it an int
 	v := mux.Vars(r)
@@ -174,7 +180,7 @@ func MembersActivitiesUpdate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Authorization - need  owner of the record
-	if UserAuthToken.Claims.ID != a.MemberID {
+	if at.Claims.ID != a.MemberID {
 		p.Message = Message{http.StatusUnauthorized, "failed", "Encoded does not belong to the owner of resource"}
 		p.Send(w)
 		return
@@ -231,18 +237,117 @@ func MembersActivitiesUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	msg := fmt.Sprintf("Updated activity (id: %v) for member (id: %v)", id, UserAuthToken.Claims.ID)
+	msg := fmt.Sprintf("Updated activity (id: %v) for member (id: %v)", id, at.Claims.ID)
 	p.Message = Message{http.StatusOK, "success", msg}
 	p.Data = ur
 	p.Send(w)
 }
 
+// MembersActivitiesDelete deletes an activity belonging to the logged in member. The activity, and its
+// attachments, can be restored with MembersActivitiesRestore until it is purged.
+func MembersActivitiesDelete(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := NewResponder()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	// the member id ensures ownership, so a record that belongs to someone else is not found
+	err = cpd.Delete(DS, at.Claims.ID, id)
+	switch {
+	case err == sql.ErrNoRows:
+		p.Message = Message{http.StatusNotFound, "failed", err.Error()}
+		p.Send(w)
+		return
+	case err != nil:
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	audit.AddEntity(r.Context(), "activities", id)
+
+	msg := fmt.Sprintf("Deleted activity (id: %v) for member (id: %v) - it can be restored within %v days", id,
+		at.Claims.ID, cpd.RetentionDays)
+	p.Message = Message{http.StatusOK, "success", msg}
+	p.Send(w)
+}
+
+// MembersActivitiesDeleted fetches the activities deleted by the logged in member that can still be restored
+func MembersActivitiesDeleted(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := NewResponder()
+
+	xa, err := cpd.Deleted(DS, at.Claims.ID)
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	p.Message = Message{http.StatusOK, "success", "Data retrieved from MySQL"}
+	p.Meta = map[string]int{"count": len(xa), "retentionDays": cpd.RetentionDays}
+	p.Data = xa
+	p.Send(w)
+}
+
+// MembersActivitiesRestore undoes the deletion of an activity belonging to the logged in member
+func MembersActivitiesRestore(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := NewResponder()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	err = cpd.Restore(DS, at.Claims.ID, id)
+	switch {
+	case err == sql.ErrNoRows:
+		msg := fmt.Sprintf("No deleted activity (id: %v) that can be restored - it may have been deleted more than %v days ago",
+			id, cpd.RetentionDays)
+		p.Message = Message{http.StatusNotFound, "failed", msg}
+		p.Send(w)
+		return
+	case err != nil:
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	audit.AddEntity(r.Context(), "activities", id)
+
+	// restored record - fetch for response
+	a, err := cpd.ByID(DS, id)
+	if err != nil {
+		msg := "Could not fetch the restored record"
+		p.Message = Message{http.StatusInternalServerError, "failure", msg + " " + err.Error()}
+		p.Send(w)
+		return
+	}
+
+	msg := fmt.Sprintf("Restored activity (id: %v) for member (id: %v)", id, at.Claims.ID)
+	p.Message = Message{http.StatusOK, "success", msg}
+	p.Data = a
+	p.Send(w)
+}
+
 // MembersActivitiesRecurring fetches the member's recurring activities (if any) stored in MongoDB
-func MembersActivitiesRecurring(w http.ResponseWriter, _ *http.Request) {
+func MembersActivitiesRecurring(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	at := userAuthToken(r)
+	p := NewResponder()
 
-	ra, err := cpd.MemberRecurring(DS, UserAuthToken.Claims.ID)
+	ra, err := cpd.MemberRecurring(DS, at.Claims.ID)
 	if err != nil {
 		p.Message = Message{http.StatusInternalServerError, "failed", "Failed to initialise a value of type MemberRecurring -" + err.Error()}
 		p.Send(w)
@@ -259,10 +364,11 @@ func MembersActivitiesRecurring(w http.ResponseWriter, _ *http.Request) {
 // Note that this function reads and writes only to MongoDB
 func MembersActivitiesRecurringAdd(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	at := userAuthToken(r)
+	p := NewResponder()
 
 	// Get user id from token
-	id := UserAuthToken.Claims.ID
+	id := at.Claims.ID
 
 	// Fetch the recurring activity doc for this user first
 	ra, err := cpd.MemberRecurring(DS, id)
@@ -289,6 +395,32 @@ func MembersActivitiesRecurringAdd(w http.ResponseWriter, r *http.Request) {
 	b.CreatedAt = time.Now()
 	b.UpdatedAt = time.Now()
 
+	// The series starts on the date in next, or today, and next is set to the first occurrence of the rule
+	err = b.Validate()
+	if err != nil {
+		msg := "MembersActivitiesRecurringAdd() invalid recurring activity - " + err.Error()
+		p.Message = Message{http.StatusBadRequest, "failed", msg}
+		p.Send(w)
+		return
+	}
+	from := b.Next
+	if from.IsZero() {
+		from = time.Now()
+	}
+	err = b.Schedule(from)
+	if err != nil {
+		msg := "MembersActivitiesRecurringAdd() invalid recurring activity - " + err.Error()
+		p.Message = Message{http.StatusBadRequest, "failed", msg}
+		p.Send(w)
+		return
+	}
+	if b.Finished {
+		msg := "MembersActivitiesRecurringAdd() recurring activity has no occurrences on or after " + from.Format("2006-01-02")
+		p.Message = Message{http.StatusBadRequest, "failed", msg}
+		p.Send(w)
+		return
+	}
+
 	// Add the new recurring activity to the list...
 	ra.Activities = append(ra.Activities, b)
 
@@ -310,10 +442,11 @@ func MembersActivitiesRecurringAdd(w http.ResponseWriter, r *http.Request) {
 // doc in the collection, only one element from the array of recurring activities in the doc that belongs to the member
 func MembersActivitiesRecurringRemove(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	at := userAuthToken(r)
+	p := NewResponder()
 
 	// Get user id from token
-	id := UserAuthToken.Claims.ID
+	id := at.Claims.ID
 
 	// Fetch the recurring activity doc for this user first
 	ra, err := cpd.MemberRecurring(DS, id)
@@ -350,12 +483,13 @@ func MembersActivitiesRecurringRemove(w http.ResponseWriter, r *http.Request) {
 // If ?slip=1 is passed on the url then it will
 func MembersActivitiesRecurringRecorder(w http.ResponseWriter, r *http.Request) {
 
+	at := userAuthToken(r)
 	p := Payload{}
 
 	// Get the member's recurring activities. Strictly speaking we don't need the member id to do this
 	// as we can select the document based on the recurring activity id. However, this ensures that the recurring
 	// activity belongs to the member - however slim the chances of guessing an ObjectID!
-	id := UserAuthToken.Claims.ID
+	id := at.Claims.ID
 	ra, err := cpd.MemberRecurring(DS, id)
 	if err != nil {
 		msg := "MembersActivitiesRecurringAdd() Failed to initialise a value of type Recurring -" + err.Error()
@@ -394,7 +528,8 @@ func MembersActivitiesRecurringRecorder(w http.ResponseWriter, r *http.Request)
 // MembersActivitiesAttachmentRequest handles request for a signed URL to upload an attachment for a CPD activity
 func MembersActivitiesAttachmentRequest(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	at := userAuthToken(r)
+	p := NewResponder()
 
 	upload := struct {
 		SignedRequest  string `json:"signedRequest"`
@@ -437,7 +572,7 @@ func MembersActivitiesAttachmentRequest(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Authorization - need  owner of the record
-	if UserAuthToken.Claims.ID != a.MemberID {
+	if at.Claims.ID != a.MemberID {
 		p.Message = Message{http.StatusUnauthorized, "failed", "Encoded does not belong to the owner of resource"}
 		p.Send(w)
 		return
@@ -476,11 +611,12 @@ func MembersActivitiesAttachmentRequest(w http.ResponseWriter, r *http.Request)
 // MembersActivitiesAttachmentRegister registers an uploaded file in the database.
 func MembersActivitiesAttachmentRegister(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	at := userAuthToken(r)
+	p := NewResponder()
 
 	a := attachments.New()
 	// not required for this type of attachment but stick it on for good measure :)
-	a.UserID = UserAuthToken.Claims.ID
+	a.UserID = at.Claims.ID
 
 	// Get the entity ID from URL path... This is admin so validate record exists but not ownership
 	v := mux.Vars(r)
@@ -508,7 +644,7 @@ func MembersActivitiesAttachmentRegister(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	// CHECK OWNER!!
-	if UserAuthToken.Claims.ID != activity.MemberID {
+	if at.Claims.ID != activity.MemberID {
 		p.Message = Message{http.StatusUnauthorized, "failed", "Encoded does not belong to the owner of this resource"}
 		p.Data = a
 		p.Send(w)
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cardiacsociety/web-services/internal/cpd"
+	"github.com/gorilla/mux"
+)
+
+// MembersActivitiesExport responds with the cpd diary of the logged in member as a file. The query parameter
+// format is csv, the default, json or ics, and the query parameters from and to restrict the dates of the
+// activities, in the format yyyy-mm-dd.
+func MembersActivitiesExport(w http.ResponseWriter, r *http.Request) {
+	at := userAuthToken(r)
+	activitiesExport(w, r, []int{at.Claims.ID}, fmt.Sprintf("cpd-%d", at.Claims.ID))
+}
+
+// AdminMembersActivitiesExport responds with the cpd diary of a member as a file, with the same query
+// parameters as MembersActivitiesExport
+func AdminMembersActivitiesExport(w http.ResponseWriter, r *http.Request) {
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		p := NewResponder()
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	activitiesExport(w, r, []int{id}, fmt.Sprintf("cpd-%d", id))
+}
+
+// AdminActivitiesExport responds with the cpd diaries of a cohort of members as a single file. The request
+// body is a list of member ids, and the query parameters are the same as MembersActivitiesExport.
+func AdminActivitiesExport(w http.ResponseWriter, r *http.Request) {
+
+	var memberIDs []int
+	err := json.NewDecoder(r.Body).Decode(&memberIDs)
+	if err != nil {
+		p := NewResponder()
+		msg := fmt.Sprintf("Could not decode list of member ids in body - %s", err)
+		p.Message = Message{http.StatusBadRequest, "failed", msg}
+		p.Send(w)
+		return
+	}
+
+	activitiesExport(w, r, memberIDs, "cpd")
+}
+
+// activitiesExport writes the cpd records of the members in the format in the query parameter format. A json
+// export is a normal response, and csv and ics exports are files named with the prefix and the date.
+func activitiesExport(w http.ResponseWriter, r *http.Request, memberIDs []int, prefix string) {
+
+	p := NewResponder()
+
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = cpd.ExportCSV
+	}
+	f := cpd.ExportFilter{MemberIDs: memberIDs, From: q.Get("from"), To: q.Get("to")}
+	for _, d := range []string{f.From, f.To} {
+		if _, err := time.Parse("2006-01-02", d); d != "" && err != nil {
+			p.Message = Message{http.StatusBadRequest, "failed", "from and to should be in the format yyyy-mm-dd"}
+			p.Send(w)
+			return
+		}
+	}
+
+	var write func(io.Writer, []cpd.ExportRecord) error
+	var contentType string
+	switch format {
+	case cpd.ExportJSON:
+		// sent as a normal response below
+	case cpd.ExportCSV:
+		write = cpd.WriteCSV
+		contentType = "text/csv; charset=utf-8"
+	case cpd.ExportICS:
+		write = cpd.WriteICS
+		contentType = "text/calendar; charset=utf-8"
+	default:
+		msg := fmt.Sprintf("format should be %s, %s or %s", cpd.ExportCSV, cpd.ExportJSON, cpd.ExportICS)
+		p.Message = Message{http.StatusBadRequest, "failed", msg}
+		p.Send(w)
+		return
+	}
+
+	xr, err := cpd.Export(DS, f)
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	if write == nil {
+		p.Message = Message{http.StatusOK, "success", "Data retrieved from MySQL"}
+		p.Meta = map[string]interface{}{"count": len(xr), "from": f.From, "to": f.To}
+		p.Data = xr
+		p.Send(w)
+		return
+	}
+
+	// write to a buffer first so an error can still be sent as a normal response
+	var b bytes.Buffer
+	err = write(&b, xr)
+	if err != nil {
+		msg := fmt.Sprintf("Could not write %s file - err = %s", format, err)
+		p.Message = Message{http.StatusInternalServerError, "failed", msg}
+		p.Send(w)
+		return
+	}
+
+	filename := prefix + "-" + time.Now().Format("20060102") + "." + format
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Access-Control-Allow-Origin", `*`)
+	b.WriteTo(w)
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cardiacsociety/web-services/internal/audit"
+	"github.com/cardiacsociety/web-services/internal/cpd"
+)
+
+// MembersActivitiesImport handles a POST request to import activities for the logged in member from a CSV or
+// iCalendar file, which is the request body. The query parameter format is csv, the default, or ics. The
+// query parameters activityCode and type are used for rows that do not specify an activity code or type, and
+// for iCalendar events without a matching category. By default the file is only checked, and the response
+// has each row with its errors and the id of any record it duplicates. With commit=true the rows selected by
+// the query parameter rows, a comma separated list of line numbers, are inserted in a single transaction. If
+// rows is empty all rows without errors or duplicates are inserted.
+func MembersActivitiesImport(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := NewResponder()
+
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = cpd.ImportCSV
+	}
+	commit := q.Get("commit") == "true"
+	d := cpd.ImportDefaults{ActivityCode: q.Get("activityCode"), Type: q.Get("type")}
+
+	var lines []int
+	if q.Get("rows") != "" {
+		for _, s := range strings.Split(q.Get("rows"), ",") {
+			l, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				p.Message = Message{http.StatusBadRequest, "failed", "rows should be a comma separated list of line numbers"}
+				p.Send(w)
+				return
+			}
+			lines = append(lines, l)
+		}
+	}
+
+	im, err := cpd.ReadImport(DS, at.Claims.ID, r.Body, format, d)
+	if err != nil {
+		msg := fmt.Sprintf("Could not read import file - %s", err)
+		p.Message = Message{http.StatusBadRequest, "failed", msg}
+		p.Send(w)
+		return
+	}
+
+	p.Meta = map[string]int{
+		"rows":       len(im.Rows),
+		"errors":     im.ErrorCount(),
+		"duplicates": im.DuplicateCount(),
+	}
+
+	if !commit {
+		p.Message = Message{http.StatusOK, "success", "Preview of the import file, select rows to commit with rows=line,line"}
+		p.Data = im.Rows
+		p.Send(w)
+		return
+	}
+
+	ids, err := im.Commit(DS, lines)
+	switch {
+	case err == cpd.ErrImportSelection:
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+		p.Data = im.Rows
+	case err != nil:
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+	default:
+		audit.AddEntity(r.Context(), "activities", ids...)
+		msg := fmt.Sprintf("Imported %d activities for member (id: %v)", len(ids), at.Claims.ID)
+		p.Message = Message{http.StatusCreated, "success", msg}
+		p.Data = ids
+	}
+	p.Send(w)
+}
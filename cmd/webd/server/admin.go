@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	uuid "github.com/hashicorp/go-uuid"
@@ -16,22 +17,26 @@ import (
 
 	"github.com/cardiacsociety/web-services/internal/application"
 	"github.com/cardiacsociety/web-services/internal/attachments"
+	"github.com/cardiacsociety/web-services/internal/audit"
+	"github.com/cardiacsociety/web-services/internal/auth"
 	"github.com/cardiacsociety/web-services/internal/fileset"
 	"github.com/cardiacsociety/web-services/internal/generic"
+	"github.com/cardiacsociety/web-services/internal/history"
 	"github.com/cardiacsociety/web-services/internal/invoice"
 	"github.com/cardiacsociety/web-services/internal/member"
 	"github.com/cardiacsociety/web-services/internal/note"
 	"github.com/cardiacsociety/web-services/internal/notification"
 	"github.com/cardiacsociety/web-services/internal/payment"
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
 	"github.com/cardiacsociety/web-services/internal/platform/s3"
 	"github.com/cardiacsociety/web-services/internal/position"
 	"github.com/cardiacsociety/web-services/internal/resource"
 )
 
 // AdminTest is a test endpoint
-func AdminTest(w http.ResponseWriter, _ *http.Request) {
+func AdminTest(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 	p.Message = Message{http.StatusOK, "success", "Hi Admin!"}
 	p.Send(w)
 }
@@ -44,7 +49,7 @@ func AdminTest(w http.ResponseWriter, _ *http.Request) {
 // API is for DB access at this stage.
 func AdminMembersSearch(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	var err error
 	var query map[string]interface{}
@@ -92,7 +97,7 @@ func AdminMembersSearchPost(w http.ResponseWriter, r *http.Request) {
 		Query map[string]interface{} `json:"query"`
 	}
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	// Pull the JSON body out of the request
 	decoder := json.NewDecoder(r.Body)
@@ -124,7 +129,7 @@ func AdminMembersSearchPost(w http.ResponseWriter, r *http.Request) {
 // AdminMembersNotes fetches all Notes belonging to a Member
 func AdminMembersNotes(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	// Request - convert id from string to int type
 	v := mux.Vars(r)
@@ -151,7 +156,7 @@ func AdminMembersNotes(w http.ResponseWriter, r *http.Request) {
 // AdminNotes fetches a single Note record by Note ID
 func AdminNotes(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	// Request - convert id from string to int type
 	v := mux.Vars(r)
@@ -178,7 +183,7 @@ func AdminNotes(w http.ResponseWriter, r *http.Request) {
 // AdminMembersID fetches a member record from the MySQLConnection DB, by id
 func AdminMembersID(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	// Request - convert id from string to int type
 	v := mux.Vars(r)
@@ -207,25 +212,232 @@ func AdminMembersID(w http.ResponseWriter, r *http.Request) {
 	p.Send(w)
 }
 
-// AdminIDList fetches a list of all member ids from MySQL
+// AdminMembersUpdate handles PUT and PATCH requests to update a member record. The body is a member row, as
+// for a membership application. A PUT body is the complete record, and any collection that is missing, eg
+// qualifications, is cleared. A PATCH body has only the fields to change, and any collection that is missing
+// is left as it is. A collection that is present replaces the member's existing rows. A new primary email is
+// not saved until the member follows the verification link sent to the new address.
+func AdminMembersUpdate(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := NewResponder()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	current, err := member.RowByID(DS, id)
+	switch {
+	case err == sql.ErrNoRows:
+		p.Message = Message{http.StatusNotFound, "failed", err.Error()}
+		p.Send(w)
+		return
+	case err != nil:
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	// empty, rather than nil, collections are cleared if they are missing from the body
+	row := current
+	if r.Method == http.MethodPut {
+		row = member.Row{
+			Qualifications: []member.QualificationRow{},
+			Specialities:   []member.SpecialityRow{},
+			Positions:      []member.PositionRow{},
+			Accreditations: []member.AccreditationRow{},
+			Tags:           []member.TagRow{},
+			Contacts:       []member.ContactRow{},
+		}
+	}
+	err = json.NewDecoder(r.Body).Decode(&row)
+	if err != nil {
+		msg := fmt.Sprintf("Could not read request body - %s", err)
+		p.Message = Message{http.StatusBadRequest, "failed", msg}
+		p.Send(w)
+		return
+	}
+	row.ID = id
+
+	err = row.Validate()
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	audit.AddEntity(r.Context(), "members", id)
+
+	// the new email is checked, and a token issued, before the update, but the token is only emailed once the
+	// update has been saved
+	var rcp auth.Recipient
+	msg := "Member record updated"
+	emailChanged := !strings.EqualFold(strings.TrimSpace(row.PrimaryEmail), current.PrimaryEmail)
+	if emailChanged {
+		rcp, err = startEmailChange(id, row.PrimaryEmail)
+		switch {
+		case err == auth.ErrInvalidEmail:
+			p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+		case err == auth.ErrEmailInUse:
+			p.Message = Message{http.StatusConflict, "failed", err.Error()}
+		case err == errEmailVerifyNotConfigured:
+			p.Message = Message{http.StatusServiceUnavailable, "failed", err.Error()}
+		case err != nil:
+			p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+		}
+		if err != nil {
+			p.Send(w)
+			return
+		}
+		msg += " - a verification link has been sent to the new email address"
+	}
+
+	err = withHistory(at, map[int]string{id: "Updated by admin"}, row.UpdateTx)
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+	if emailChanged {
+		sendEmailVerification(rcp)
+	}
+
+	// the member doc in MongoDB is a copy of the MySQL record
+	m, err := member.ByID(DS, id)
+	if err == nil {
+		err = m.SaveDocDB(DS)
+	}
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failed",
+			fmt.Sprintf("Member record updated but could not be synced to the document database - %s", err)}
+		p.Send(w)
+		return
+	}
+
+	p.Message = Message{http.StatusOK, "success", msg}
+	p.Data = m
+	p.Send(w)
+}
+
+// AdminMembersImpersonation handles a POST request to view the system as a member sees it, for support. It
+// returns a short-lived member token with an act claim that identifies the admin. There is no refresh token.
+func AdminMembersImpersonation(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := NewResponder()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	name, err := auth.MemberName(DS, id)
+	if err == sql.ErrNoRows {
+		p.Message = Message{http.StatusNotFound, "failed", "No member found with id " + strconv.Itoa(id)}
+		p.Send(w)
+		return
+	}
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	mt, err := impersonationToken(id, name, at)
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	// the issue of the token is logged along with every request made with it
+	err = auth.LogImpersonation(DS, auth.Impersonation{
+		AdminID:  at.Claims.ID,
+		MemberID: id,
+		TokenID:  mt.Claims.Id,
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		IP:       clientIP(r),
+	})
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	p.Message = Message{http.StatusCreated, "success", "Viewing as " + name + " until the token expires"}
+	p.Data = mt
+	p.Send(w)
+}
+
+// idListTables are the tables available at /idlist, and the permission required for each
+var idListTables = map[string]string{
+	"member":             auth.PermMembersRead,
+	"ms_m_application":   auth.PermMembersRead,
+	"ms_m_status":        auth.PermMembersRead,
+	"ms_m_title":         auth.PermMembersRead,
+	"mp_m_contact":       auth.PermMembersRead,
+	"mp_m_position":      auth.PermMembersRead,
+	"mp_m_qualification": auth.PermMembersRead,
+	"mp_m_speciality":    auth.PermMembersRead,
+	"ce_m_activity":      auth.PermMembersRead,
+	"wf_note":            auth.PermMembersRead,
+	"wf_issue":           auth.PermMembersRead,
+	"fn_m_invoice":       auth.PermReportsFinance,
+	"fn_m_subscription":  auth.PermReportsFinance,
+	"fn_payment":         auth.PermReportsFinance,
+	"ol_resource":        auth.PermResourcesWrite,
+	"ol_module":          auth.PermResourcesWrite,
+	"ad_user":            auth.PermAdminUsers,
+}
+
+// AdminIDList fetches a list of all ids from a MySQL table. Only the tables in idListTables are available,
+// each with its own permission.
 func AdminIDList(w http.ResponseWriter, req *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	// Request - requires at least the 't' query to specify the table name
-	// and can have the option 'f' as raw HTML filter
+	// and can have the option 'f' as a filter in the form f=col1:value1,col2:value2
 	t := req.FormValue("t")
 	if t == "" {
-		p.Message = Message{http.StatusBadRequest, "failed", "Requires ?t=[table_name], optional &f=[sql_filter]"}
+		p.Message = Message{http.StatusBadRequest, "failed", "Requires ?t=[table_name], optional &f=[col1:value1,col2:value2]"}
+		p.Send(w)
+		return
+	}
+	perm, ok := idListTables[t]
+	if !ok {
+		p.Message = Message{http.StatusForbidden, "failed", "Ids are not available for table " + t}
+		p.Send(w)
+		return
+	}
+	if at := userAuthToken(req); !at.HasScope(perm) {
+		p.Message = Message{http.StatusForbidden, "failed", "Permission Required: token does not have the '" + perm + "' permission"}
 		p.Send(w)
 		return
 	}
 
-	// Optional filter
-	f := req.FormValue("f")
+	// Optional filter, each name-value pair is an equality condition
+	c := datastore.NewClause()
+	if f := req.FormValue("f"); f != "" {
+		q, err := queryParams(f)
+		if err != nil {
+			p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+			p.Send(w)
+			return
+		}
+		for k, v := range q {
+			c.Equal(k, v)
+		}
+	}
 
 	// Get the Member record
-	ii, err := generic.GetIDs(DS, t, f)
+	ii, err := generic.GetIDs(DS, t, c)
 	// Response
 	switch {
 	case err == sql.ErrNoRows:
@@ -252,7 +464,7 @@ func AdminBatchResourcesPost(w http.ResponseWriter, r *http.Request) {
 	}
 	b := batch{}
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	// Pull the JSON body out of the request
 	decoder := json.NewDecoder(r.Body)
@@ -304,7 +516,7 @@ func AdminBatchResourcesPost(w http.ResponseWriter, r *http.Request) {
 // AdminNotesAttachmentRequest handles a request for a signed url to upload a notes attachment
 func AdminNotesAttachmentRequest(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	upload := struct {
 		SignedRequest  string `json:"signedRequest"`
@@ -379,10 +591,11 @@ func AdminNotesAttachmentRequest(w http.ResponseWriter, r *http.Request) {
 // AdminNotesAttachmentRegister registers a file attachment for a note.
 func AdminNotesAttachmentRegister(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	at := userAuthToken(r)
+	p := NewResponder()
 
 	a := attachments.New()
-	a.UserID = UserAuthToken.Claims.ID
+	a.UserID = at.Claims.ID
 
 	// Get the entity ID from URL path... This is admin so validate record exists but not ownership
 	v := mux.Vars(r)
@@ -440,7 +653,7 @@ func AdminNotesAttachmentRegister(w http.ResponseWriter, r *http.Request) {
 // AdminResourcesAttachmentRequest handles a request for a signed url to upload a resource attachment
 func AdminResourcesAttachmentRequest(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	upload := struct {
 		SignedRequest  string `json:"signedRequest"`
@@ -516,10 +729,11 @@ func AdminResourcesAttachmentRequest(w http.ResponseWriter, r *http.Request) {
 // url then the resource file is designated as a thumbnail by setting thumbnail flag to 1 in db.
 func AdminResourcesAttachmentRegister(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	at := userAuthToken(r)
+	p := NewResponder()
 
 	a := attachments.New()
-	a.UserID = UserAuthToken.Claims.ID
+	a.UserID = at.Claims.ID
 
 	// Get the entity ID from URL path... This is admin so validate record exists but not ownership
 	v := mux.Vars(r)
@@ -583,7 +797,7 @@ func AdminResourcesAttachmentRegister(w http.ResponseWriter, r *http.Request) {
 // AdminReportApplicationExcel responds with an excel application report
 func AdminReportApplicationExcel(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	// A list of application ids should be posted in
 	var applicationIDs []int
@@ -622,7 +836,7 @@ func AdminReportApplicationExcel(w http.ResponseWriter, r *http.Request) {
 // AdminReportMemberExcel responds with an excel member report
 func AdminReportMemberExcel(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	// A list of member ids should be posted in
 	var memberIDs []int
@@ -677,7 +891,7 @@ func AdminReportMemberExcel(w http.ResponseWriter, r *http.Request) {
 // It is used as a report for journal recipients.
 func AdminReportMemberJournalExcel(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	var memberIDs []int
 	err := json.NewDecoder(r.Body).Decode(&memberIDs)
@@ -716,7 +930,7 @@ func AdminReportMemberJournalExcel(w http.ResponseWriter, r *http.Request) {
 // AdminReportPaymentExcel responds with an excel payment report
 func AdminReportPaymentExcel(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	// A list of payments ids should be posted in
 	var paymentIDs []int
@@ -755,7 +969,7 @@ func AdminReportPaymentExcel(w http.ResponseWriter, r *http.Request) {
 // AdminReportInvoiceExcel responds with an excel invoice report
 func AdminReportInvoiceExcel(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	// A list of invoice ids should be posted in
 	var invoiceIDs []int
@@ -794,7 +1008,7 @@ func AdminReportInvoiceExcel(w http.ResponseWriter, r *http.Request) {
 // AdminReportPositionExcel responds with an excel position report
 func AdminReportPositionExcel(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	// A list of member position ids should be posted in
 	var positionIDs []int
@@ -832,7 +1046,7 @@ func AdminReportPositionExcel(w http.ResponseWriter, r *http.Request) {
 
 // AdminNewMembershipApplication processes a request to create a new membership application
 func AdminNewMembershipApplication(w http.ResponseWriter, r *http.Request) {
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	xb, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -850,6 +1064,9 @@ func AdminNewMembershipApplication(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	audit.AddEntity(r.Context(), "members", data.ID)
+	recordHistory(history.Empty(data.ID), userAuthToken(r), "Membership application")
+
 	p.Message = Message{http.StatusAccepted, "accepted", "membership application data has been created"}
 	p.Data = data
 	p.Send(w)
@@ -857,7 +1074,7 @@ func AdminNewMembershipApplication(w http.ResponseWriter, r *http.Request) {
 
 // AdminLapseMembers processes a request to lapse members
 func AdminLapseMembers(w http.ResponseWriter, r *http.Request) {
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	// body should be a JSON array of member ids
 	memberIDs := []int{}
@@ -869,6 +1086,8 @@ func AdminLapseMembers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	audit.AddEntity(r.Context(), "members", memberIDs...)
+
 	// collect any errors as a message
 	messages := []string{}
 	// lapse each of the ids
@@ -878,7 +1097,7 @@ func AdminLapseMembers(w http.ResponseWriter, r *http.Request) {
 			messages = append(messages, fmt.Sprintf("Could not get member id %v", id))
 			continue
 		}
-		if err := m.Lapse(DS); err != nil {
+		if err := withHistory(userAuthToken(r), map[int]string{id: "Lapsed by admin"}, m.LapseTx); err != nil {
 			messages = append(messages, fmt.Sprintf("Error lapsing member id %v - %s", id, err))
 			continue
 		}
@@ -891,9 +1110,72 @@ func AdminLapseMembers(w http.ResponseWriter, r *http.Request) {
 	p.Send(w)
 }
 
+// AdminReinstateMembers processes a request to reinstate lapsed members
+func AdminReinstateMembers(w http.ResponseWriter, r *http.Request) {
+	p := NewResponder()
+
+	// body should be a JSON array of member ids, each with the details of the reinstatement
+	var body []struct {
+		MemberID int `json:"memberId"`
+		member.Reinstatement
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		msg := fmt.Sprintf("Could not read request body - %s", err)
+		p.Message = Message{http.StatusBadRequest, "failed", msg}
+		p.Send(w)
+		return
+	}
+
+	memberIDs := make([]int, len(body))
+	for i, b := range body {
+		memberIDs[i] = b.MemberID
+	}
+	audit.AddEntity(r.Context(), "members", memberIDs...)
+
+	// collect any errors as a message
+	messages := []string{}
+	// reinstate each of the ids
+	for _, b := range body {
+		id := b.MemberID
+		m, err := member.ByID(DS, id)
+		if err != nil {
+			messages = append(messages, fmt.Sprintf("Could not get member id %v", id))
+			continue
+		}
+		var invoiceID int
+		err = withHistory(userAuthToken(r), map[int]string{id: "Reinstated by admin"}, func(ex datastore.Execer) error {
+			var err error
+			invoiceID, err = m.ReinstateTx(ex, b.Reinstatement)
+			return err
+		})
+		if err != nil {
+			messages = append(messages, fmt.Sprintf("Error reinstating member id %v - %s", id, err))
+			continue
+		}
+		msg := fmt.Sprintf("Successfully reinstated member id %v", id)
+		if invoiceID > 0 {
+			msg += fmt.Sprintf(" - arrears invoice id %v", invoiceID)
+		}
+		m, err = member.ByID(DS, id)
+		if err == nil {
+			err = m.SaveDocDB(DS)
+		}
+		if err != nil {
+			msg += fmt.Sprintf(" - could not sync to the document database - %s", err)
+		}
+		messages = append(messages, msg)
+	}
+
+	p.Meta = map[string]int{"count": len(body)}
+	p.Message = Message{http.StatusOK, "success", "Check data field for any errors"}
+	p.Data = messages
+	p.Send(w)
+}
+
 // AdminSendNotifications sends email notifications
 func AdminSendNotifications(w http.ResponseWriter, r *http.Request) {
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	type recipient struct {
 		Name  string `json:"name"`
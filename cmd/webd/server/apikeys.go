@@ -0,0 +1,125 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/cardiacsociety/web-services/internal/auth"
+	"github.com/gorilla/mux"
+)
+
+// AdminAPIKeys handles a GET request for all API keys. The keys themselves are not included, only a hint.
+func AdminAPIKeys(w http.ResponseWriter, r *http.Request) {
+
+	p := NewResponder()
+
+	xk, err := auth.APIKeys(DS)
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	p.Message = Message{http.StatusOK, "success", "Data retrieved from MySQL"}
+	p.Meta = map[string]int{"count": len(xk)}
+	p.Data = xk
+	p.Send(w)
+}
+
+// AdminAPIKeyCreate handles a POST request to create an API key for a service account. The body has the
+// name of the account, the scopes for the key and, optionally, the number of days until the key expires.
+// An admin can only grant scopes they have themselves. The response includes the key, which is not
+// available again.
+func AdminAPIKeyCreate(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := NewResponder()
+
+	type NewKey struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expiresInDays"`
+	}
+	k := NewKey{}
+
+	err := json.NewDecoder(r.Body).Decode(&k)
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	for _, s := range k.Scopes {
+		if !at.HasScope(s) {
+			p.Message = Message{http.StatusForbidden, "failure", "Cannot grant the '" + s + "' permission as the token does not have it"}
+			p.Send(w)
+			return
+		}
+	}
+
+	key, err := auth.NewAPIKey(DS, k.Name, k.Scopes, k.ExpiresInDays, at.Claims.ID)
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	p.Message = Message{http.StatusCreated, "success", "Created API key - store it securely as it cannot be retrieved again"}
+	p.Data = key
+	p.Send(w)
+}
+
+// AdminAPIKeyRotate handles a PUT request to replace an API key with a new key that has the same name,
+// scopes and expiry. The old key is revoked immediately, so the new key should be deployed straight away.
+func AdminAPIKeyRotate(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := NewResponder()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	key, err := auth.RotateAPIKey(DS, id, at.Claims.ID)
+	switch {
+	case err == sql.ErrNoRows:
+		p.Message = Message{http.StatusNotFound, "failure", "No active API key found with id " + strconv.Itoa(id)}
+	case err != nil:
+		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
+	default:
+		p.Message = Message{http.StatusOK, "success", "Rotated API key - store it securely as it cannot be retrieved again"}
+		p.Data = key
+	}
+
+	p.Send(w)
+}
+
+// AdminAPIKeyRevoke handles a DELETE request to revoke an API key
+func AdminAPIKeyRevoke(w http.ResponseWriter, r *http.Request) {
+
+	p := NewResponder()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	err = auth.RevokeAPIKey(DS, id)
+	switch {
+	case err == sql.ErrNoRows:
+		p.Message = Message{http.StatusNotFound, "failure", "No active API key found with id " + strconv.Itoa(id)}
+	case err != nil:
+		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
+	default:
+		p.Message = Message{http.StatusOK, "success", "Revoked API key " + strconv.Itoa(id)}
+	}
+
+	p.Send(w)
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cardiacsociety/web-services/internal/audit"
+	uuid "github.com/hashicorp/go-uuid"
+)
+
+// AdminAudit handles a GET request to search the audit log. The query parameters are all optional:
+// actorId and role select the user that made the requests, entity and entityId select the records that
+// were targeted, eg entity=members&entityId=123, and from and to select a range of dates, inclusive, in the
+// format yyyy-mm-dd. The most recent entries are returned first, up to limit, default 100, after skipping
+// offset entries.
+func AdminAudit(w http.ResponseWriter, r *http.Request) {
+
+	p := NewResponder()
+
+	f, err := auditFilter(r)
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	xe, err := audit.Query(DS, f)
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	p.Message = Message{http.StatusOK, "success", "Data retrieved from MySQL"}
+	p.Meta = map[string]int{"count": len(xe), "limit": f.Limit, "offset": f.Offset}
+	p.Data = xe
+	p.Send(w)
+}
+
+// AdminReportAuditExcel responds with an excel audit log report. The body is a JSON filter with the same
+// fields as the query parameters for AdminAudit, eg {"entity": "members", "entityId": 123, "from": "2019-01-01"}.
+func AdminReportAuditExcel(w http.ResponseWriter, r *http.Request) {
+
+	p := NewResponder()
+
+	var body struct {
+		ActorID  int    `json:"actorId"`
+		Role     string `json:"role"`
+		Entity   string `json:"entity"`
+		EntityID int    `json:"entityId"`
+		From     string `json:"from"`
+		To       string `json:"to"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		msg := fmt.Sprintf("Could not decode audit filter in body - %s", err)
+		p.Message = Message{http.StatusBadRequest, "failed", msg}
+		p.Send(w)
+		return
+	}
+
+	f := audit.Filter{ActorID: body.ActorID, Role: body.Role, EntityType: body.Entity, EntityID: body.EntityID}
+	f.From, f.To, err = auditDates(body.From, body.To)
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	// send 202 now, before the heavy lifting starts
+	cacheID, _ := uuid.GenerateUUID()
+	msg := fmt.Sprintf("Report has been queued, pickup url below")
+	p.Message = Message{http.StatusAccepted, "accepted", msg}
+	url := os.Getenv("MAPPCPD_API_URL") + "/v1/r/excel/" + cacheID
+	p.Data = map[string]string{"url": url}
+	p.Send(w)
+
+	// generate the report
+	go func() {
+		xe, err := audit.Query(DS, f)
+		if err != nil {
+			log.Printf("audit.Query() err = %s\n", err)
+		}
+
+		excelFile, err := audit.ExcelReport(xe)
+		if err != nil {
+			log.Printf("audit.ExcelReport() err = %s\n", err)
+		}
+
+		DS.Cache.SetDefault(cacheID, excelFile)
+	}()
+}
+
+// Number of audit entries returned by AdminAudit, by default and at most
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// auditFilter returns the audit.Filter from the query parameters of a request to AdminAudit
+func auditFilter(r *http.Request) (audit.Filter, error) {
+
+	q := r.URL.Query()
+	f := audit.Filter{Role: q.Get("role"), EntityType: q.Get("entity"), Limit: defaultAuditLimit}
+
+	var err error
+	for k, v := range map[string]*int{"actorId": &f.ActorID, "entityId": &f.EntityID, "limit": &f.Limit, "offset": &f.Offset} {
+		if q.Get(k) == "" {
+			continue
+		}
+		*v, err = strconv.Atoi(q.Get(k))
+		if err != nil || *v < 0 {
+			return f, fmt.Errorf("%s should be a number", k)
+		}
+	}
+	if f.Limit < 1 || f.Limit > maxAuditLimit {
+		return f, fmt.Errorf("limit should be between 1 and %d", maxAuditLimit)
+	}
+
+	f.From, f.To, err = auditDates(q.Get("from"), q.Get("to"))
+	return f, err
+}
+
+// auditDates parses an inclusive range of dates in the format yyyy-mm-dd, either of which may be empty, and
+// returns the start of the from date and the start of the day after the to date
+func auditDates(from, to string) (time.Time, time.Time, error) {
+
+	var f, t time.Time
+	var err error
+	if from != "" {
+		f, err = time.Parse("2006-01-02", from)
+		if err != nil {
+			return f, t, fmt.Errorf("from should be a date in the format yyyy-mm-dd")
+		}
+	}
+	if to != "" {
+		t, err = time.Parse("2006-01-02", to)
+		if err != nil {
+			return f, t, fmt.Errorf("to should be a date in the format yyyy-mm-dd")
+		}
+		t = t.AddDate(0, 0, 1)
+	}
+
+	return f, t, nil
+}
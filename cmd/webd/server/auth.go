@@ -3,13 +3,43 @@ package server
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cardiacsociety/web-services/internal/auth"
+	"github.com/cardiacsociety/web-services/internal/member"
+	"github.com/cardiacsociety/web-services/internal/notification"
 	"github.com/cardiacsociety/web-services/internal/platform/jwt"
+	"github.com/pkg/errors"
 )
 
+// errEmailVerifyNotConfigured is returned when an email change is requested but MAPPCPD_MEMBER_VERIFY_URL
+// is not set
+var errEmailVerifyNotConfigured = errors.New("email verification is not configured")
+
+// A successful admin password login, for an admin with two-factor authentication, returns a challenge token
+// in place of the admin token. It has its own role so that it is not accepted anywhere else, and is revoked
+// after mfaChallengeAttempts failed codes, so the password must be entered again.
+const (
+	mfaChallengeRole     = "admin-mfa"
+	mfaChallengeTTL      = 5 * time.Minute
+	mfaChallengeAttempts = 3
+)
+
+// defaultMFAIssuer is the name shown in authenticator apps if MAPPCPD_MFA_ISSUER is not set
+const defaultMFAIssuer = "MappCPD"
+
+// defaultNotifyFromEmail is the sender of password reset and verification emails if MAPPCPD_NOTIFY_FROM_EMAIL
+// is not set
+const defaultNotifyFromEmail = "system@mappcpd.com"
+
 // AuthMemberLogin handles a authenticates a user by login and password, against
 // the db. Scope can also be passed in for admin access.
 func AuthMemberLogin(w http.ResponseWriter, r *http.Request) {
@@ -35,19 +65,61 @@ func AuthMemberLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// AuthMember returns ID and Name which we pass to the token generator
-	id, name, err := auth.AuthMember(DS, a.Login, a.Password)
+	// Login returns ID and Name which we pass to the token generator
+	id, name, err := auth.Login(DS, auth.UserMember, a.Login, a.Password, clientIP(r))
+	if err != nil {
+		loginFailed(w, err)
+		return
+	}
+
+	at, err := newSession(id, name, "member", false)
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	// All good
+	p.Message = Message{http.StatusOK, "success", "Authentication successful!"}
+	p.Data = at
+	p.Send(w)
+}
+
+// AuthMemberExchange handles a POST request from a trusted application, such as the legacy member app, that
+// presents a short-lived member token signed with the shared exchange key, and issues a regular member token
+// in its place.
+func AuthMemberExchange(w http.ResponseWriter, r *http.Request) {
+
+	// create a binding struct for the JSON request body
+	type Exchange struct {
+		Token string `json:"token"`
+	}
+	e := Exchange{}
+
+	// Response
+	p := Payload{}
+
+	// Pull the JSON body out of the request
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&e)
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	id, name, err := auth.ExchangeMember(DS, e.Token, os.Getenv("MAPPCPD_EXCHANGE_KEY"))
 	if err != nil {
-		msg := err.Error()
+		msg := "Token exchange failed: " + err.Error()
 		if err == sql.ErrNoRows {
-			msg = "Login failed"
+			msg = "Token exchange failed"
 		}
 		p.Message = Message{http.StatusUnauthorized, "failure", msg}
 		p.Send(w)
 		return
 	}
 
-	at, err := freshToken(id, name, "member")
+	at, err := newSession(id, name, "member", false)
 	if err != nil {
 		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
 		p.Send(w)
@@ -55,7 +127,7 @@ func AuthMemberLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// All good
-	p.Message = Message{http.StatusOK, "success", "Authentication successful!"}
+	p.Message = Message{http.StatusOK, "success", "Token exchange successful!"}
 	p.Data = at
 	p.Send(w)
 }
@@ -87,151 +159,783 @@ func AuthMemberCheckHandler(w http.ResponseWriter, r *http.Request) {
 	p.Send(w)
 }
 
-// MembersToken handles a GET request which validates the current token
-// and issue a fresh one, so the consumer can update it at their end
+// MembersToken used to issue a fresh token in exchange for any valid token, which meant a stolen token
+// could be renewed forever. Clients now use a refresh token at /v1/auth/refresh.
 func MembersToken(w http.ResponseWriter, r *http.Request) {
+	p := Payload{}
+	p.Message = Message{http.StatusGone, "failure", "Token renewal has moved - use a refresh token at POST /v1/auth/refresh"}
+	p.Send(w)
+}
 
-	p := NewResponder(UserAuthToken.Encoded)
+// AuthAdminLogin handles a authenticates an admin user by login and password, against
+// the db. Requires an explicit 'scope' property requesting admin access.
+func AuthAdminLogin(w http.ResponseWriter, r *http.Request) {
 
-	// Get the token from the auth header, 'Bearer' seems useless but this is an OAuth2 standard
-	// Authorization: Bearer [jwt]
-	a := r.Header.Get("Authorization")
-	t, err := jwt.FromHeader(a)
+	// create a binding struct for the JSON request body
+	// ie. this is what we are expecting -CAPS for field names!!!
+	type Auth struct {
+		Login    string   `json:"login"`
+		Password string   `json:"password"`
+		Scope    []string `json:"scope"`
+	}
+	a := Auth{}
+
+	// Response
+	p := Payload{}
+
+	// Pull the JSON body out of the request
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&a)
 	if err != nil {
 		p.Message = Message{http.StatusBadRequest, "failure", err.Error()}
 		p.Send(w)
 		return
 	}
 
-	// Decode current token first
-	at, err := jwt.Decode(t, os.Getenv("MAPPCPD_JWT_SIGNING_KEY"))
+	// Login returns ID and Name which we pass to the token generator
+	id, name, err := auth.Login(DS, auth.UserAdmin, a.Login, a.Password, clientIP(r))
 	if err != nil {
-		p.Message = Message{http.StatusUnauthorized, "failure", "Cannot refresh token as current token is invalid: " + err.Error()}
-		p.Send(w)
+		loginFailed(w, err)
 		return
 	}
 
-	// Make sure the current token has "member" scope to prevent switch from admin token
-	if at.Claims.Role != "member" {
-		p.Message = Message{http.StatusUnauthorized, "failure", "Cannot refresh non-member token"}
+	// With two-factor authentication the admin token is only issued once a TOTP code is verified
+	enabled, err := auth.MFAEnabled(DS, id)
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+	if enabled {
+		ct, err := jwt.New(os.Getenv("MAPPCPD_API_URL"), os.Getenv("MAPPCPD_JWT_SIGNING_KEY"), 0).SetTTL(mfaChallengeTTL).
+			CustomClaims(map[string]interface{}{"id": id, "name": name, "role": mfaChallengeRole}).Encode()
+		if err != nil {
+			p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
+			p.Send(w)
+			return
+		}
+		p.Message = Message{http.StatusAccepted, "success", "Password accepted - authentication code required at POST /v1/auth/admin/mfa"}
+		p.Data = map[string]interface{}{"mfaRequired": true, "challenge": ct.Encoded, "expiresAt": ct.ExpiresAt}
 		p.Send(w)
 		return
 	}
 
-	nt, err := freshToken(at.Claims.ID, at.Claims.Name, at.Claims.Role)
+	at, err := newSession(id, name, "admin", false)
 	if err != nil {
 		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
 		p.Send(w)
 		return
 	}
 
-	// All clear
-	p.Message = Message{http.StatusOK, "success", "Current token is valid, fresh token supplied in data.new.token"}
-
-	// Data payload will contain the current and a fresh token
-	data := make(map[string]jwt.Token)
-	data["current"] = at
-	data["new"] = nt
-	p.Data = data
+	// All good
+	p.Message = Message{http.StatusOK, "success", "Authentication successful!"}
+	p.Data = at
 	p.Send(w)
 }
 
-// AuthAdminLogin handles a authenticates an admin user by login and password, against
-// the db. Requires an explicit 'scope' property requesting admin access.
-func AuthAdminLogin(w http.ResponseWriter, r *http.Request) {
+// AuthAdminMFA handles the second step of an admin login for an admin with two-factor authentication. It
+// expects the challenge token returned by AuthAdminLogin and a TOTP code, or a recovery code, and issues
+// the admin token with the mfa claim set. Each challenge can only be used once, and is revoked after
+// mfaChallengeAttempts failed codes.
+func AuthAdminMFA(w http.ResponseWriter, r *http.Request) {
 
-	// create a binding struct for the JSON request body
-	// ie. this is what we are expecting -CAPS for field names!!!
-	type Auth struct {
-		Login    string   `json:"login"`
-		Password string   `json:"password"`
-		Scope    []string `json:"scope"`
+	type MFA struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
 	}
-	a := Auth{}
+	m := MFA{}
 
 	// Response
 	p := Payload{}
 
-	// Pull the JSON body out of the request
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&a)
+	err := json.NewDecoder(r.Body).Decode(&m)
 	if err != nil {
 		p.Message = Message{http.StatusBadRequest, "failure", err.Error()}
 		p.Send(w)
 		return
 	}
 
-	// PostAdminAuth returns ID and Name which we pass to the token generator
-	id, name, err := auth.AdminAuth(DS, a.Login, a.Password)
+	ct, err := jwt.Decode(m.Challenge, os.Getenv("MAPPCPD_JWT_SIGNING_KEY"))
+	if err != nil || ct.Claims.Role != mfaChallengeRole {
+		p.Message = Message{http.StatusUnauthorized, "failure", "Login failed - challenge is invalid or has expired"}
+		p.Send(w)
+		return
+	}
+	revoked, err := tokenRevoked(ct)
 	if err != nil {
-		msg := err.Error()
-		if err == sql.ErrNoRows {
-			msg = "Login failed"
+		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+	if revoked {
+		p.Message = Message{http.StatusUnauthorized, "failure", "Login failed - challenge has already been used"}
+		p.Send(w)
+		return
+	}
+
+	err = auth.LoginMFA(DS, ct.Claims.ID, m.Code, clientIP(r))
+	if err == auth.ErrInvalidMFACode {
+		n, cerr := auth.MFAFailures(DS, ct.Claims.ID, ct.IssuedAt)
+		if cerr == nil && n >= mfaChallengeAttempts {
+			cerr = auth.RevokeAccessToken(DS, ct)
 		}
-		p.Message = Message{http.StatusUnauthorized, "failure", msg}
+		if cerr != nil {
+			log.Printf("Could not check the attempts for MFA challenge %s - %s", ct.Claims.Id, cerr)
+		}
+	}
+	if err != nil {
+		loginFailed(w, err)
+		return
+	}
+
+	err = auth.RevokeAccessToken(DS, ct)
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
 		p.Send(w)
 		return
 	}
 
-	at, err := freshToken(id, name, "admin")
+	at, err := newSession(ct.Claims.ID, ct.Claims.Name, "admin", true)
 	if err != nil {
 		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
 		p.Send(w)
 		return
 	}
 
-	// All good
 	p.Message = Message{http.StatusOK, "success", "Authentication successful!"}
 	p.Data = at
 	p.Send(w)
 }
 
-// AuthAdminRefreshHandler handles a GET request which validates the current token
-// and issues a fresh one so the consumer can extend validity to the maximum time.
-// The only difference between this func and GetAuthRefresh is the function call to set scope claims.
-func AuthAdminRefreshHandler(w http.ResponseWriter, r *http.Request) {
+// AuthRefresh handles a POST request with a refresh token, and issues a new access token along with a
+// new refresh token. The refresh token that was presented cannot be used again.
+func AuthRefresh(w http.ResponseWriter, r *http.Request) {
 
+	type Refresh struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	rt := Refresh{}
+
+	// Response
 	p := Payload{}
 
-	// Get the token from the auth header, 'Bearer' seems useless but this is an OAuth2 standard
-	// Authorization: Bearer [jwt]
-	a := r.Header.Get("Authorization")
-	t, err := jwt.FromHeader(a)
+	err := json.NewDecoder(r.Body).Decode(&rt)
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	res, err := auth.RotateRefreshToken(DS, rt.RefreshToken, refreshTTL())
+	switch {
+	case err == auth.ErrInvalidRefreshToken, err == auth.ErrRefreshTokenReused,
+		err == auth.ErrAccountInactive, err == auth.ErrAccountLocked:
+		p.Message = Message{http.StatusUnauthorized, "failure", "Refresh failed - " + err.Error()}
+		p.Send(w)
+		return
+	case err != nil:
+		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	at, err := freshToken(res.UserID, res.Name, res.UserType, res.MFA)
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	p.Message = Message{http.StatusOK, "success", "Refresh successful!"}
+	p.Data = authTokens{Token: at, RefreshToken: res.Token, RefreshExpiresAt: res.ExpiresAt}
+	p.Send(w)
+}
+
+// AuthLogout handles a POST request to end the current session. The access token in the Authorization
+// header is revoked, along with the refresh token in the body, if one is supplied.
+func AuthLogout(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := Payload{}
+
+	if at.Claims.Role == roleService {
+		p.Message = Message{http.StatusBadRequest, "failure", "An API key has no session, it is revoked at DELETE /v1/a/apikeys/{id}"}
+		p.Send(w)
+		return
+	}
+
+	type Logout struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	l := Logout{}
+
+	// body is optional
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&l)
+		if err != nil {
+			p.Message = Message{http.StatusBadRequest, "failure", err.Error()}
+			p.Send(w)
+			return
+		}
+	}
+
+	err := auth.RevokeAccessToken(DS, at)
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	if l.RefreshToken != "" {
+		err = auth.RevokeRefreshToken(DS, l.RefreshToken)
+		if err != nil {
+			p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
+			p.Send(w)
+			return
+		}
+	}
+
+	p.Message = Message{http.StatusOK, "success", "Logged out"}
+	p.Send(w)
+}
+
+// AuthLogoutAll handles a POST request to end all sessions for the user identified by the access token in
+// the Authorization header. All refresh tokens, and all access tokens issued up to now, are revoked.
+func AuthLogoutAll(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := Payload{}
+
+	if at.Claims.Role == roleService {
+		p.Message = Message{http.StatusBadRequest, "failure", "An API key has no session, it is revoked at DELETE /v1/a/apikeys/{id}"}
+		p.Send(w)
+		return
+	}
+
+	err := auth.RevokeAll(DS, at.Claims.Role, at.Claims.ID, accessTTL())
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	p.Message = Message{http.StatusOK, "success", "Logged out of all sessions"}
+	p.Send(w)
+}
+
+// AdminAuthUnlock handles a PUT request to clear the lockout on a member or admin login, after too many
+// failed login attempts. For an admin this also clears the locked flag on the account. Alternatively, the
+// body can have an ip address to clear the lockout on that address.
+func AdminAuthUnlock(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := NewResponder()
+
+	// expecting a JSON body with the login and the user type, 'member' or 'admin', or with the ip address
+	type Unlock struct {
+		Login    string `json:"login"`
+		UserType string `json:"userType"`
+		IP       string `json:"ip"`
+	}
+	u := Unlock{}
+
+	err := json.NewDecoder(r.Body).Decode(&u)
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	if u.IP != "" {
+		if u.Login != "" {
+			p.Message = Message{http.StatusBadRequest, "failure", "Requires either a login or an ip, not both"}
+			p.Send(w)
+			return
+		}
+		err = auth.UnlockIP(DS, u.IP, at.Claims.ID)
+		if err != nil {
+			p.Message = Message{http.StatusBadRequest, "failure", err.Error()}
+			p.Send(w)
+			return
+		}
+		p.Message = Message{http.StatusOK, "success", "Unlocked ip " + u.IP}
+		p.Send(w)
+		return
+	}
+
+	if u.Login == "" || (u.UserType != auth.UserMember && u.UserType != auth.UserAdmin) {
+		p.Message = Message{http.StatusBadRequest, "failure", "Requires login and a userType of 'member' or 'admin', or an ip"}
+		p.Send(w)
+		return
+	}
+
+	err = auth.Unlock(DS, u.UserType, u.Login, at.Claims.ID)
+	switch {
+	case err == sql.ErrNoRows:
+		p.Message = Message{http.StatusNotFound, "failure", "No " + u.UserType + " found with login " + u.Login}
+	case err != nil:
+		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
+	default:
+		p.Message = Message{http.StatusOK, "success", "Unlocked " + u.UserType + " login " + u.Login}
+	}
+
+	p.Send(w)
+}
+
+// AdminAuthMFAEnrol handles a POST request to start enrolment of a TOTP authenticator for the admin
+// identified in the token. It returns the secret and an otpauth:// uri to show as a QR code, and the
+// enrolment is confirmed with a code from the authenticator at PUT /v1/a/auth/mfa.
+func AdminAuthMFAEnrol(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := NewResponder()
+
+	issuer := os.Getenv("MAPPCPD_MFA_ISSUER")
+	if issuer == "" {
+		issuer = defaultMFAIssuer
+	}
+
+	e, err := auth.EnrolMFA(DS, at.Claims.ID, issuer)
+	switch {
+	case err == auth.ErrMFAEnabled:
+		p.Message = Message{http.StatusConflict, "failure", err.Error()}
+	case err != nil:
+		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
+	default:
+		p.Message = Message{http.StatusOK, "success", "Scan the QR code and confirm with a code from the authenticator"}
+		p.Data = e
+	}
+
+	p.Send(w)
+}
+
+// AdminAuthMFAConfirm handles a PUT request with a code from the authenticator being enrolled, and enables
+// two-factor authentication for the admin. The response includes recovery codes, which are not available
+// again. The admin must log in again to get a token with the mfa claim.
+func AdminAuthMFAConfirm(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := NewResponder()
+
+	c, err := mfaCode(r)
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	codes, err := auth.ConfirmMFA(DS, at.Claims.ID, c)
+	switch {
+	case err == auth.ErrInvalidMFACode:
+		p.Message = Message{http.StatusBadRequest, "failure", err.Error()}
+	case err == auth.ErrMFAEnabled, err == auth.ErrMFANotEnabled:
+		p.Message = Message{http.StatusConflict, "failure", err.Error()}
+	case err != nil:
+		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
+	default:
+		p.Message = Message{http.StatusOK, "success", "Two-factor authentication enabled - store the recovery codes somewhere safe"}
+		p.Data = map[string]interface{}{"recoveryCodes": codes}
+	}
+
+	p.Send(w)
+}
+
+// AdminAuthMFARecoveryCodes handles a POST request, with a current code, to replace the recovery codes for
+// the admin identified in the token
+func AdminAuthMFARecoveryCodes(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := NewResponder()
+
+	c, err := mfaCode(r)
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	err = auth.VerifyMFA(DS, at.Claims.ID, c)
+	if err == auth.ErrInvalidMFACode || err == auth.ErrMFANotEnabled {
+		p.Message = Message{http.StatusBadRequest, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	codes, err := auth.NewRecoveryCodes(DS, at.Claims.ID)
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	p.Message = Message{http.StatusOK, "success", "Recovery codes replaced - store them somewhere safe"}
+	p.Data = map[string]interface{}{"recoveryCodes": codes}
+	p.Send(w)
+}
+
+// AdminAuthMFADisable handles a DELETE request, with a current code, to remove the TOTP authenticator for
+// the admin identified in the token
+func AdminAuthMFADisable(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := NewResponder()
+
+	c, err := mfaCode(r)
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	err = auth.VerifyMFA(DS, at.Claims.ID, c)
+	if err == auth.ErrInvalidMFACode || err == auth.ErrMFANotEnabled {
+		p.Message = Message{http.StatusBadRequest, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	err = auth.DisableMFA(DS, at.Claims.ID)
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	p.Message = Message{http.StatusOK, "success", "Two-factor authentication disabled"}
+	p.Send(w)
+}
+
+// mfaCode reads a TOTP or recovery code from a JSON request body
+func mfaCode(r *http.Request) (string, error) {
+
+	var body struct {
+		Code string `json:"code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return "", err
+	}
+	if body.Code == "" {
+		return "", errors.New("Requires a code")
+	}
+
+	return body.Code, nil
+}
+
+// AuthPasswordForgot handles a POST request with the email address of a member that has forgotten their
+// password, and emails them a link to reset it. The response is the same whether or not the address belongs
+// to a member, and the work is done after responding so the timing does not give it away either. Requests
+// are throttled, per email address and ip address, in the same way as logins.
+func AuthPasswordForgot(w http.ResponseWriter, r *http.Request) {
+
+	type Forgot struct {
+		Email string `json:"email"`
+	}
+	f := Forgot{}
+
+	// Response
+	p := Payload{}
+
+	err := json.NewDecoder(r.Body).Decode(&f)
 	if err != nil {
 		p.Message = Message{http.StatusBadRequest, "failure", err.Error()}
 		p.Send(w)
 		return
 	}
 
-	// Decode current token first
-	at, err := jwt.Decode(t, os.Getenv("MAPPCPD_JWT_SIGNING_KEY"))
+	resetURL := os.Getenv("MAPPCPD_MEMBER_RESET_URL")
+	if resetURL == "" {
+		p.Message = Message{http.StatusServiceUnavailable, "failure", "Password reset is not configured"}
+		p.Send(w)
+		return
+	}
+
+	email := strings.TrimSpace(f.Email)
+	err = auth.ResetRequest(DS, email, clientIP(r))
+	if te, ok := err.(*auth.ThrottledError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(te.Wait.Seconds())+1))
+		p.Message = Message{http.StatusTooManyRequests, "failure", "Password reset failed - " + te.Error()}
+		p.Send(w)
+		return
+	}
 	if err != nil {
-		p.Message = Message{http.StatusUnauthorized, "failure", "Cannot refresh token as current token is invalid: " + err.Error()}
+		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
 		p.Send(w)
 		return
 	}
 
-	// Make sure the current token has admin scope to prevent a normal user token upgrading to admin!
-	if at.Claims.Role != "admin" {
-		p.Message = Message{http.StatusUnauthorized, "failure", "Cannot refresh non-admin token"}
+	go func(email string) {
+		rcp, err := auth.ForgotPassword(DS, email, auth.ResetTokenTTL)
+		if err == sql.ErrNoRows {
+			return
+		}
+		if err != nil {
+			log.Printf("auth.ForgotPassword() err = %s", err)
+			return
+		}
+
+		text := fmt.Sprintf("Hi %s,\n\nA request was made to reset the password for your account. To choose a new "+
+			"password, follow the link below within %s:\n\n%s\n\nIf you did not request a password reset you can "+
+			"ignore this email, your password has not been changed.\n", rcp.Name, auth.ResetTokenTTL, tokenLink(resetURL, rcp.Token))
+		err = memberEmail(rcp, "Reset your password", text).Send()
+		if err != nil {
+			log.Printf("notification.Send() err = %s, sending password reset to member id %d", err, rcp.MemberID)
+		}
+	}(email)
+
+	p.Message = Message{http.StatusAccepted, "success", "If the email address is registered a password reset link has been sent to it"}
+	p.Send(w)
+}
+
+// AuthPasswordReset handles a POST request with a password reset token, and a new password. The token can
+// only be used once, and all existing sessions for the member are ended.
+func AuthPasswordReset(w http.ResponseWriter, r *http.Request) {
+
+	type Reset struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	rs := Reset{}
+
+	// Response
+	p := Payload{}
+
+	err := json.NewDecoder(r.Body).Decode(&rs)
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failure", err.Error()}
 		p.Send(w)
 		return
 	}
 
-	nt, err := freshToken(at.Claims.ID, at.Claims.Name, "admin")
+	_, err = auth.ResetPassword(DS, rs.Token, rs.Password, accessTTL())
+	switch {
+	case err == auth.ErrPasswordTooShort, err == auth.ErrInvalidMemberToken:
+		p.Message = Message{http.StatusBadRequest, "failure", "Password reset failed - " + err.Error()}
+	case err != nil:
+		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
+	default:
+		p.Message = Message{http.StatusOK, "success", "Password has been reset - please log in with the new password"}
+	}
+
+	p.Send(w)
+}
+
+// AuthEmailVerify handles a POST request with the token that was emailed to a member's new address, and
+// completes the change of their primary email.
+func AuthEmailVerify(w http.ResponseWriter, r *http.Request) {
+
+	type Verify struct {
+		Token string `json:"token"`
+	}
+	v := Verify{}
+
+	// Response
+	p := Payload{}
+
+	err := json.NewDecoder(r.Body).Decode(&v)
 	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failure", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	id, err := auth.VerifyEmail(DS, v.Token)
+	switch {
+	case err == auth.ErrInvalidMemberToken:
+		p.Message = Message{http.StatusBadRequest, "failure", "Verification failed - " + err.Error()}
+		p.Send(w)
+		return
+	case err == auth.ErrEmailInUse:
+		p.Message = Message{http.StatusConflict, "failure", "Verification failed - " + err.Error()}
+		p.Send(w)
+		return
+	case err != nil:
 		p.Message = Message{http.StatusInternalServerError, "failure", err.Error()}
 		p.Send(w)
 		return
 	}
 
-	// All clear
-	p.Message = Message{http.StatusOK, "success", "Current token is valid, fresh token supplied in data.new.token"}
+	// update the member doc with the new email
+	go func() {
+		m, err := member.ByID(DS, id)
+		if err != nil {
+			log.Printf("member.ByID() err = %s", err)
+			return
+		}
+		err = m.SaveDocDB(DS)
+		if err != nil {
+			log.Printf("SaveDocDB() err = %s", err)
+		}
+	}()
+
+	p.Message = Message{http.StatusOK, "success", "Email address has been verified - please use it to log in"}
+	p.Send(w)
+}
+
+// startEmailChange issues a token to verify a change of primary email for a member, and returns the
+// recipient of the token, which should be sent to the new address with sendEmailVerification. The member's
+// email is not changed until the token is presented to AuthEmailVerify.
+func startEmailChange(memberID int, email string) (auth.Recipient, error) {
+
+	if os.Getenv("MAPPCPD_MEMBER_VERIFY_URL") == "" {
+		return auth.Recipient{}, errEmailVerifyNotConfigured
+	}
+
+	return auth.ChangeEmail(DS, memberID, email, auth.VerifyTokenTTL)
+}
+
+// sendEmailVerification emails the token issued by startEmailChange to the new address. It only needs to be
+// sent once any other changes made with the request have been saved, as the token cannot be used without it.
+func sendEmailVerification(rcp auth.Recipient) {
+
+	verifyURL := os.Getenv("MAPPCPD_MEMBER_VERIFY_URL")
+
+	go func() {
+		text := fmt.Sprintf("Hi %s,\n\nA request was made to change the email address for your account to this "+
+			"address. To confirm the change, follow the link below within %s:\n\n%s\n\nIf you did not request "+
+			"this change you can ignore this email.\n", rcp.Name, auth.VerifyTokenTTL, tokenLink(verifyURL, rcp.Token))
+		err := memberEmail(rcp, "Verify your email address", text).Send()
+		if err != nil {
+			log.Printf("notification.Send() err = %s, sending email verification to member id %d", err, rcp.MemberID)
+		}
+	}()
+}
+
+// memberEmail returns an email notification to a member, from the sender set by MAPPCPD_NOTIFY_FROM_NAME
+// and MAPPCPD_NOTIFY_FROM_EMAIL
+func memberEmail(rcp auth.Recipient, subject, text string) notification.Email {
+
+	e := notification.Email{
+		FromName:     os.Getenv("MAPPCPD_NOTIFY_FROM_NAME"),
+		FromEmail:    os.Getenv("MAPPCPD_NOTIFY_FROM_EMAIL"),
+		ToName:       rcp.Name,
+		ToEmail:      rcp.Email,
+		Subject:      subject,
+		PlainContent: text,
+	}
+	if e.FromEmail == "" {
+		e.FromEmail = defaultNotifyFromEmail
+	}
+
+	return e
+}
+
+// tokenLink adds a single-use token to a link url as the 'token' query parameter
+func tokenLink(link, token string) string {
 
-	// Data payload will contain the current and a fresh token
-	data := make(map[string]jwt.Token)
-	data["current"] = at
-	data["new"] = nt
-	p.Data = data
+	u, err := url.Parse(link)
+	if err != nil {
+		return link + "?token=" + url.QueryEscape(token)
+	}
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
+
+// loginFailed sends the response for a failed login
+func loginFailed(w http.ResponseWriter, err error) {
+
+	p := Payload{}
+
+	if te, ok := err.(*auth.ThrottledError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(te.Wait.Seconds())+1))
+		p.Message = Message{http.StatusTooManyRequests, "failure", "Login failed - " + te.Error()}
+		p.Send(w)
+		return
+	}
+
+	msg := err.Error()
+	switch err {
+	case sql.ErrNoRows:
+		msg = "Login failed"
+	case auth.ErrAccountInactive, auth.ErrAccountLocked, auth.ErrInvalidMFACode, auth.ErrMFANotEnabled:
+		msg = "Login failed - " + err.Error()
+	}
+	p.Message = Message{http.StatusUnauthorized, "failure", msg}
 	p.Send(w)
 }
+
+// clientIP returns the ip address of the client. The X-Forwarded-For header is only used when the request
+// comes from a trusted proxy, set by MAPPCPD_TRUSTED_PROXIES. The header is then read from the end, as each
+// proxy appends the address it received the request from, and the first address that is not a trusted
+// proxy is the client. Earlier entries are supplied by the client and not trusted.
+func clientIP(r *http.Request) string {
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	proxies := trustedProxies()
+	if !isTrustedProxy(ip, proxies) {
+		return ip
+	}
+
+	xs := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(xs) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(xs[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(ip, proxies) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// trustedProxies returns the networks set by MAPPCPD_TRUSTED_PROXIES, a comma-separated list of ip
+// addresses or CIDR ranges, eg "10.0.0.0/8". Entries that are not valid are ignored.
+func trustedProxies() []*net.IPNet {
+
+	var xn []*net.IPNet
+	for _, v := range strings.Split(os.Getenv("MAPPCPD_TRUSTED_PROXIES"), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if strings.Contains(v, ":") {
+				v += "/128"
+			} else {
+				v += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			continue
+		}
+		xn = append(xn, n)
+	}
+
+	return xn
+}
+
+// isTrustedProxy returns true if the ip address is in one of the trusted networks
+func isTrustedProxy(ip string, proxies []*net.IPNet) bool {
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range proxies {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	cases := []struct {
+		proxies    string
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{"", "192.0.2.1:1234", "", "192.0.2.1"},
+		{"", "192.0.2.1:1234", "203.0.113.7", "192.0.2.1"},
+		{"10.0.0.0/8", "192.0.2.1:1234", "203.0.113.7", "192.0.2.1"},
+		{"10.0.0.0/8", "10.1.2.3:1234", "", "10.1.2.3"},
+		{"10.0.0.0/8", "10.1.2.3:1234", "203.0.113.7", "203.0.113.7"},
+		{"10.0.0.0/8", "10.1.2.3:1234", "198.51.100.1, 203.0.113.7", "203.0.113.7"},
+		{"10.0.0.0/8", "10.1.2.3:1234", "203.0.113.7, 10.9.9.9", "203.0.113.7"},
+		{"10.0.0.0/8", "10.1.2.3:1234", "spoofed, 10.9.9.9", "10.9.9.9"},
+		{"192.0.2.1", "192.0.2.1:1234", "203.0.113.7", "203.0.113.7"},
+		{"", "[2001:db8::1]:443", "", "2001:db8::1"},
+	}
+
+	defer os.Unsetenv("MAPPCPD_TRUSTED_PROXIES")
+	for _, c := range cases {
+		os.Setenv("MAPPCPD_TRUSTED_PROXIES", c.proxies)
+		r := httptest.NewRequest("POST", "/v1/auth/member", nil)
+		r.RemoteAddr = c.remoteAddr
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		got := clientIP(r)
+		if got != c.want {
+			t.Errorf("clientIP() with proxies %q, remote %s and X-Forwarded-For %q = %q, want %q", c.proxies, c.remoteAddr, c.xff, got, c.want)
+		}
+	}
+}
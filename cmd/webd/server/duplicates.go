@@ -0,0 +1,112 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/cardiacsociety/web-services/internal/audit"
+	"github.com/cardiacsociety/web-services/internal/member"
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+	"github.com/gorilla/mux"
+)
+
+// AdminMembersDuplicates responds with pairs of members that may be the same person, highest score first.
+// The optional query parameter minScore, from 1 to 100, sets the lowest score included.
+func AdminMembersDuplicates(w http.ResponseWriter, r *http.Request) {
+
+	p := NewResponder()
+
+	minScore := member.DefaultMinDuplicateScore
+	if v := r.URL.Query().Get("minScore"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			p.Message = Message{http.StatusBadRequest, "failed", "minScore must be a number from 1 to 100"}
+			p.Send(w)
+			return
+		}
+		minScore = n
+	}
+
+	xc, err := member.Duplicates(DS, minScore)
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	p.Message = Message{http.StatusOK, "success", "Data retrieved from MySQL"}
+	p.Meta = map[string]int{"count": len(xc)}
+	p.Data = xc
+	p.Send(w)
+}
+
+// AdminMembersMerge handles a POST request to merge a duplicate member into the member in the path. The
+// body is {"duplicateId": 123}. The duplicate's activities, invoices, payments, notes, issues, status and
+// title history, evaluation periods and subscriptions are moved to the surviving member, and the duplicate is
+// deactivated. The changes to both members are recorded in their history.
+func AdminMembersMerge(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := NewResponder()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	var body struct {
+		DuplicateID int `json:"duplicateId"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.DuplicateID == 0 {
+		p.Message = Message{http.StatusBadRequest, "failed", "Body must be a JSON object with a duplicateId"}
+		p.Send(w)
+		return
+	}
+
+	audit.AddEntity(r.Context(), "members", id, body.DuplicateID)
+
+	messages := map[int]string{
+		body.DuplicateID: fmt.Sprintf("Merged into member id %d", id),
+		id:               fmt.Sprintf("Merged with duplicate member id %d", body.DuplicateID),
+	}
+	err = withHistory(at, messages, func(ex datastore.Execer) error {
+		return member.MergeTx(ex, id, body.DuplicateID)
+	})
+	switch {
+	case err == member.ErrMergeSelf:
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+	case err == sql.ErrNoRows:
+		p.Message = Message{http.StatusNotFound, "failed", "Member not found"}
+	case err != nil:
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+	}
+	if err != nil {
+		p.Send(w)
+		return
+	}
+
+	// both member docs in MongoDB have changed
+	var survivor *member.Member
+	for _, mid := range []int{body.DuplicateID, id} {
+		survivor, err = member.ByID(DS, mid)
+		if err == nil {
+			err = survivor.SaveDocDB(DS)
+		}
+		if err != nil {
+			p.Message = Message{http.StatusInternalServerError, "failed",
+				fmt.Sprintf("Members merged but could not be synced to the document database - %s", err)}
+			p.Send(w)
+			return
+		}
+	}
+
+	p.Message = Message{http.StatusOK, "success", fmt.Sprintf("Member id %d merged into member id %d", body.DuplicateID, id)}
+	p.Data = survivor
+	p.Send(w)
+}
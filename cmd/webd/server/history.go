@@ -0,0 +1,98 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/cardiacsociety/web-services/internal/history"
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+	"github.com/cardiacsociety/web-services/internal/platform/jwt"
+	"github.com/gorilla/mux"
+)
+
+// AdminMembersHistory responds with the change history of a member's records, most recent first
+func AdminMembersHistory(w http.ResponseWriter, r *http.Request) {
+
+	p := NewResponder()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	xc, err := history.ByMember(DS, id)
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	p.Message = Message{http.StatusOK, "success", "Data retrieved from MySQL"}
+	p.Meta = map[string]int{"count": len(xc)}
+	p.Data = xc
+	p.Send(w)
+}
+
+// historyActor returns the user making a change on behalf of the token. A change made by an admin viewing
+// the system as a member is attributed to the admin. A change made with an API key is recorded with the key
+// id and the user type 'service', so it is not mistaken for an admin user.
+func historyActor(at jwt.Token) history.Actor {
+	if at.Claims.Act != nil {
+		return history.Actor{ID: at.Claims.Act.ID, Type: at.Claims.Act.Role}
+	}
+	return history.Actor{ID: at.Claims.ID, Type: at.Claims.Role}
+}
+
+// withHistory makes a change to members' records, and records the history of the change, in a single
+// transaction. Each member's rows are read with a locking read before the change, so no other write can come
+// between the snapshot and the record. The messages, keyed by member id, describe the change for each
+// member. The change should go ahead even if its history cannot be recorded, so those errors are logged.
+func withHistory(at jwt.Token, messages map[int]string, change func(datastore.Execer) error) error {
+
+	// lock the members in the same order every time
+	var ids []int
+	for id := range messages {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	return DS.MySQL.InTx(func(ex datastore.Execer) error {
+
+		var xs []history.Snapshot
+		for _, id := range ids {
+			s, err := history.TakeTx(ex, id, history.MemberTables...)
+			if err != nil {
+				log.Printf("Could not take history snapshot for member %d - %s", id, err)
+				continue
+			}
+			xs = append(xs, s)
+		}
+
+		err := change(ex)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range xs {
+			_, err := s.RecordTx(ex, historyActor(at), messages[s.MemberID], history.MemberTables...)
+			if err != nil {
+				log.Printf("Could not record history for member %d - %s", s.MemberID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// recordHistory records the changes made to a member's records since the snapshot was taken, for a member
+// that has just been created with an Empty snapshot. The member has already been created, so any error is
+// logged rather than returned.
+func recordHistory(s history.Snapshot, at jwt.Token, message string) {
+	_, err := s.Record(DS, historyActor(at), message, history.MemberTables...)
+	if err != nil {
+		log.Printf("Could not record history for member %d - %s", s.MemberID, err)
+	}
+}
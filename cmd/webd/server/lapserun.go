@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/cardiacsociety/web-services/internal/audit"
+	"github.com/cardiacsociety/web-services/internal/auth"
+	"github.com/cardiacsociety/web-services/internal/member"
+	"github.com/cardiacsociety/web-services/internal/notification"
+	uuid "github.com/hashicorp/go-uuid"
+)
+
+// lapseNoticeSenders is the number of lapse notices that are sent at the same time
+const lapseNoticeSenders = 4
+
+// AdminMembersLapseRun handles a POST request to lapse the members selected by criteria, eg unpaid
+// subscription invoices more than daysOverdue days past due. By default the run is only a preview, and the
+// response lists the selected members and the reason for each, with the url of an excel report of the same.
+// With execute=true the body must have the memberIds listed by the preview. Each of those members that is
+// still selected by the criteria is lapsed, an issue is raised against their oldest overdue invoice and the
+// notice is emailed to them. The notice subject and text are templates, and default to a standard notice. The
+// response is sent once every notice has been tried, and the message for each member says if theirs was sent.
+func AdminMembersLapseRun(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := NewResponder()
+
+	execute := r.URL.Query().Get("execute") == "true"
+
+	var body struct {
+		member.LapseCriteria
+		Notice member.LapseNotice `json:"notice"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		msg := fmt.Sprintf("Could not read request body - %s", err)
+		p.Message = Message{http.StatusBadRequest, "failed", msg}
+		p.Send(w)
+		return
+	}
+	if execute && len(body.MemberIDs) == 0 {
+		msg := "memberIds is required to execute a lapse run - use the ids listed by the preview"
+		p.Message = Message{http.StatusBadRequest, "failed", msg}
+		p.Send(w)
+		return
+	}
+
+	xc, err := member.LapseCandidates(DS, body.LapseCriteria)
+	if err == member.ErrLapseCriteria {
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	// render every notice first, so that a bad template is found before anyone is lapsed
+	notices := make([]notification.Email, len(xc))
+	for i, c := range xc {
+		subject, text, err := body.Notice.Render(c)
+		if err != nil {
+			p.Message = Message{http.StatusBadRequest, "failed", fmt.Sprintf("Could not render notice - %s", err)}
+			p.Send(w)
+			return
+		}
+		notices[i] = memberEmail(auth.Recipient{MemberID: c.MemberID, Name: c.Name, Email: c.Email}, subject, text)
+	}
+
+	if !execute {
+		cacheID, _ := uuid.GenerateUUID()
+		DS.Cache.SetDefault(cacheID, member.LapseReport(xc))
+		p.Meta = map[string]int{"count": len(xc)}
+		p.Message = Message{http.StatusOK, "success", "Preview only, no members have been lapsed"}
+		memberIDs := make([]int, len(xc))
+		for i, c := range xc {
+			memberIDs[i] = c.MemberID
+		}
+		p.Data = struct {
+			URL       string                  `json:"url"`
+			MemberIDs []int                   `json:"memberIds"`
+			Members   []member.LapseCandidate `json:"members"`
+		}{
+			URL:       os.Getenv("MAPPCPD_API_URL") + "/v1/r/excel/" + cacheID,
+			MemberIDs: memberIDs,
+			Members:   xc,
+		}
+		p.Send(w)
+		return
+	}
+
+	selected := map[int]bool{}
+	memberIDs := make([]int, len(xc))
+	for i, c := range xc {
+		memberIDs[i] = c.MemberID
+		selected[c.MemberID] = true
+	}
+	audit.AddEntity(r.Context(), "members", memberIDs...)
+
+	// collect any errors as a message
+	messages := []string{}
+	for _, id := range body.MemberIDs {
+		if !selected[id] {
+			messages = append(messages, fmt.Sprintf("Member id %v is no longer selected by the criteria and was not lapsed", id))
+		}
+	}
+
+	// sends are the notices to send, and sent are the indexes of the messages for each of them
+	var sends []notification.Email
+	var sent []int
+	for i, c := range xc {
+		if err := withHistory(at, map[int]string{c.MemberID: "Lapsed by lapse run"}, c.LapseTx); err != nil {
+			messages = append(messages, fmt.Sprintf("Error lapsing member id %v - %s", c.MemberID, err))
+			continue
+		}
+
+		msg := fmt.Sprintf("Successfully lapsed member id %v", c.MemberID)
+		if c.Email == "" {
+			msg += " - no email address to send the notice to"
+		} else {
+			sends = append(sends, notices[i])
+			sent = append(sent, len(messages))
+		}
+
+		m, err := member.ByID(DS, c.MemberID)
+		if err == nil {
+			err = m.SaveDocDB(DS)
+		}
+		if err != nil {
+			msg += fmt.Sprintf(" - could not sync to the document database - %s", err)
+		}
+		messages = append(messages, msg)
+	}
+
+	for i, err := range sendLapseNotices(sends) {
+		if err != nil {
+			messages[sent[i]] += fmt.Sprintf(" - could not send the notice - %s", err)
+			continue
+		}
+		messages[sent[i]] += " - notice sent"
+	}
+
+	p.Meta = map[string]int{"count": len(xc)}
+	p.Message = Message{http.StatusOK, "success", "Check data field for any errors"}
+	p.Data = messages
+	p.Send(w)
+}
+
+// sendLapseNotices sends the lapse notices, no more than lapseNoticeSenders at a time, and returns the error,
+// if any, from sending each one
+func sendLapseNotices(xe []notification.Email) []error {
+
+	errs := make([]error, len(xe))
+	ch := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < lapseNoticeSenders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				errs[i] = xe[i].Send()
+				if errs[i] != nil {
+					log.Printf("notification.Send() err = %s, sending lapse notice to %s", errs[i], xe[i].ToEmail)
+				}
+			}
+		}()
+	}
+
+	for i := range xe {
+		ch <- i
+	}
+	close(ch)
+	wg.Wait()
+
+	return errs
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/cardiacsociety/web-services/internal/audit"
+	"github.com/cardiacsociety/web-services/internal/history"
+	"github.com/cardiacsociety/web-services/internal/member"
+	uuid "github.com/hashicorp/go-uuid"
+)
+
+// AdminMembersImport handles a POST request to import new members from a CSV or XLSX file, which is the
+// request body. The query parameter format is csv, the default, or xlsx. By default the file is only checked,
+// and the response has the number of rows, the number with errors or warnings and the url of an excel report
+// of the problems with each line. With commit=true the rows are inserted in a single transaction, but only if
+// none of them have errors. A warning, such as a name shared with an existing member, does not stop a commit.
+// Committed members are also saved to the document database.
+func AdminMembersImport(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := NewResponder()
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = member.ImportCSV
+	}
+	commit := r.URL.Query().Get("commit") == "true"
+
+	im, err := member.ReadImport(DS, r.Body, format)
+	if err != nil {
+		msg := fmt.Sprintf("Could not read import file - %s", err)
+		p.Message = Message{http.StatusBadRequest, "failed", msg}
+		p.Send(w)
+		return
+	}
+
+	cacheID, _ := uuid.GenerateUUID()
+	DS.Cache.SetDefault(cacheID, im.ErrorReport())
+	data := struct {
+		Rows     int    `json:"rows"`
+		Errors   int    `json:"errors"`
+		Warnings int    `json:"warnings"`
+		URL      string `json:"url"`
+		IDs      []int  `json:"ids,omitempty"`
+	}{
+		Rows:     len(im.Rows),
+		Errors:   im.ErrorCount(),
+		Warnings: im.WarningCount(),
+		URL:      os.Getenv("MAPPCPD_API_URL") + "/v1/r/excel/" + cacheID,
+	}
+	p.Data = &data
+
+	switch {
+	case !commit && data.Errors > 0:
+		p.Message = Message{http.StatusOK, "success", "Dry run found rows with errors, see the report at the url below"}
+	case !commit && data.Warnings > 0:
+		p.Message = Message{http.StatusOK, "success", "Dry run found no errors, but check the warnings in the report at the url below before committing"}
+	case !commit:
+		p.Message = Message{http.StatusOK, "success", "Dry run found no errors, the file can be committed"}
+	case data.Errors > 0:
+		p.Message = Message{http.StatusBadRequest, "failed", member.ErrImportInvalid.Error()}
+	default:
+		data.IDs, err = im.Commit(DS)
+		if err != nil {
+			p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+			break
+		}
+		audit.AddEntity(r.Context(), "members", data.IDs...)
+		for _, id := range data.IDs {
+			recordHistory(history.Empty(id), at, "Imported from file")
+			m, err := member.ByID(DS, id)
+			if err == nil {
+				err = m.SaveDocDB(DS)
+			}
+			if err != nil {
+				log.Printf("Could not sync imported member id %d to the document database - %s", id, err)
+			}
+		}
+		p.Message = Message{http.StatusCreated, "success", fmt.Sprintf("Imported %d members", len(data.IDs))}
+	}
+
+	p.Send(w)
+}
@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"net/http"
 
+	"github.com/cardiacsociety/web-services/internal/auth"
 	"github.com/cardiacsociety/web-services/internal/cpd"
 	"github.com/cardiacsociety/web-services/internal/member"
 	"github.com/cardiacsociety/web-services/internal/notification"
@@ -16,12 +17,13 @@ import (
 )
 
 // MembersProfile fetches a member record by id
-func MembersProfile(w http.ResponseWriter, _ *http.Request) {
+func MembersProfile(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	at := userAuthToken(r)
+	p := NewResponder()
 
 	// Get user id from token
-	id := UserAuthToken.Claims.ID
+	id := at.Claims.ID
 
 	// Get the Member record
 	m, err := member.ByID(DS, id)
@@ -43,12 +45,107 @@ func MembersProfile(w http.ResponseWriter, _ *http.Request) {
 	p.Send(w)
 }
 
+// MembersProfileUpdate handles a PATCH request from a member to change their own profile. The body has only
+// the fields to change, and may include postNominal, consentDirectory, consentContact, contacts and interests.
+// Any other field, eg title or status, is rejected. Each change is recorded as a note on the member.
+func MembersProfileUpdate(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := NewResponder()
+
+	xb, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	pf, err := member.ProfileFromJSON(xb)
+	if _, ok := err.(member.ProtectedFieldError); ok {
+		p.Message = Message{http.StatusForbidden, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Could not read request body - %s", err)
+		p.Message = Message{http.StatusBadRequest, "failed", msg}
+		p.Send(w)
+		return
+	}
+
+	changes, err := pf.Save(DS, at.Claims.ID, historyActor(at))
+	if _, ok := err.(member.RowError); ok {
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	// the member doc in MongoDB is a copy of the MySQL record
+	m, err := member.ByID(DS, at.Claims.ID)
+	if err == nil {
+		err = m.SaveDocDB(DS)
+	}
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failed",
+			fmt.Sprintf("Profile updated but could not be synced to the document database - %s", err)}
+		p.Send(w)
+		return
+	}
+
+	p.Message = Message{http.StatusOK, "success", "Profile updated"}
+	p.Meta = map[string]int{"count": len(changes)}
+	p.Data = changes
+	p.Send(w)
+}
+
+// MembersEmail handles a PUT request to change the primary email of the member identified in the token. A
+// verification link is emailed to the new address, and the change takes effect when it is followed. The
+// response does not disclose whether the address is already in use by another member.
+func MembersEmail(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := NewResponder()
+
+	var body struct {
+		Email string `json:"email"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	rcp, err := startEmailChange(at.Claims.ID, body.Email)
+	switch {
+	case err == auth.ErrInvalidEmail:
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+	case err == errEmailVerifyNotConfigured:
+		p.Message = Message{http.StatusServiceUnavailable, "failed", err.Error()}
+	case err != nil && err != auth.ErrEmailInUse:
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+	default:
+		if err == nil {
+			sendEmailVerification(rcp)
+		}
+		p.Message = Message{http.StatusAccepted, "success", "A verification link has been sent to the new email address"}
+	}
+
+	p.Send(w)
+}
+
 // MembersActivities fetches activity records for a member
-func MembersActivities(w http.ResponseWriter, _ *http.Request) {
+func MembersActivities(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	at := userAuthToken(r)
+	p := NewResponder()
 
-	a, err := cpd.ByMemberID(DS, UserAuthToken.Claims.ID)
+	a, err := cpd.ByMemberID(DS, at.Claims.ID)
 
 	// Response
 	switch {
@@ -71,12 +168,13 @@ func MembersActivities(w http.ResponseWriter, _ *http.Request) {
 
 // MembersEvaluation created reports for each evaluation period
 // by gathering the CPD activities within the dates, adding them up, applying caps etc
-func MembersEvaluation(w http.ResponseWriter, _ *http.Request) {
+func MembersEvaluation(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	at := userAuthToken(r)
+	p := NewResponder()
 
 	// Collect the evaluation periods
-	es, err := cpd.MemberActivityReports(DS, UserAuthToken.Claims.ID)
+	es, err := cpd.MemberActivityReports(DS, at.Claims.ID)
 	// Response
 	switch {
 	case err == sql.ErrNoRows:
@@ -97,10 +195,11 @@ func MembersEvaluation(w http.ResponseWriter, _ *http.Request) {
 }
 
 // CurrentActivityReport
-func CurrentActivityReport(w http.ResponseWriter, _ *http.Request) {
+func CurrentActivityReport(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
-	reportData, err := cpd.CurrentEvaluationPeriodReport(DS, UserAuthToken.Claims.ID)
+	at := userAuthToken(r)
+	p := NewResponder()
+	reportData, err := cpd.CurrentEvaluationPeriodReport(DS, at.Claims.ID)
 	if err != nil {
 		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
 		p.Send(w)
@@ -114,10 +213,11 @@ func CurrentActivityReport(w http.ResponseWriter, _ *http.Request) {
 }
 
 // EmailCurrentActivityReport
-func EmailCurrentActivityReport(w http.ResponseWriter, _ *http.Request) {
+func EmailCurrentActivityReport(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
-	reportData, err := cpd.CurrentEvaluationPeriodReport(DS, UserAuthToken.Claims.ID)
+	at := userAuthToken(r)
+	p := NewResponder()
+	reportData, err := cpd.CurrentEvaluationPeriodReport(DS, at.Claims.ID)
 	if err != nil {
 		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
 		p.Send(w)
@@ -149,7 +249,7 @@ func EmailCurrentActivityReport(w http.ResponseWriter, _ *http.Request) {
 	e.HTMLContent = "Please find you report attached"
 	e.PlainContent = "Please find you report attached"
 	e.Attachments = []email.Attachment{
-		{"application/pdf", "cpdReport.pdf", reportAttachment},
+		{MIMEType: "application/pdf", FileName: "cpdReport.pdf", Base64Content: reportAttachment},
 	}
 	err = e.Send()
 	if err != nil {
@@ -167,12 +267,13 @@ func EmailCurrentActivityReport(w http.ResponseWriter, _ *http.Request) {
 
 // MemberSendNotification sends an email to the member identified in the token
 func MemberSendNotification(w http.ResponseWriter, r *http.Request) {
-	p := NewResponder(UserAuthToken.Encoded)
+	at := userAuthToken(r)
+	p := NewResponder()
 
 	// member record id in token
-	mem, err := member.ByID(DS, UserAuthToken.Claims.ID)
+	mem, err := member.ByID(DS, at.Claims.ID)
 	if err != nil {
-		msg := fmt.Sprintf("Could not find member record with id %v", UserAuthToken.Claims.ID)
+		msg := fmt.Sprintf("Could not find member record with id %v", at.Claims.ID)
 		p.Message = Message{http.StatusBadRequest, "failed", msg}
 		p.Send(w)
 		return
@@ -1,22 +1,28 @@
 package server
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
 
+	"github.com/cardiacsociety/web-services/internal/audit"
+	"github.com/cardiacsociety/web-services/internal/auth"
 	"github.com/cardiacsociety/web-services/internal/platform/jwt"
 )
 
-// UserAuthToken is a global Encoded that is set up by the middleware for convenience
-var UserAuthToken jwt.Token
+// roleService is the role given to requests made with an API key, which are treated as coming from an admin
+// with only the scopes granted to the key
+const roleService = "service"
 
-// ValidateToken validate the JSON web token passed in the Authorization header. For now
-// a POST request to /auth simply returns, without checking the token, as this is
-// a request to authenticate and get a new token.
+// ValidateToken validates the JSON web token passed in the Authorization header and adds the decoded token to
+// the request context, see userAuthToken(). An API key for a service account may be passed in place of a
+// token, see apiKeyToken(). Tokens that have been revoked by a logout are rejected, and every request made
+// with a token issued to an admin viewing the system as a member is logged, see impersonationToken().
 func ValidateToken(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 
 	// pass through when request is preflight http OPTIONS
@@ -38,23 +44,108 @@ func ValidateToken(w http.ResponseWriter, r *http.Request, next http.HandlerFunc
 		return
 	}
 
-	// Set the global Encoded
-	UserAuthToken, err = jwt.Decode(t, os.Getenv("MAPPCPD_JWT_SIGNING_KEY"))
+	if strings.HasPrefix(t, auth.APIKeyPrefix) {
+		at, err := apiKeyToken(t)
+		if err != nil {
+			p.Message = Message{http.StatusUnauthorized, "failure", "Authorization failed: " + err.Error()}
+			p.Send(w)
+			return
+		}
+		next(w, r.WithContext(jwt.NewContext(r.Context(), at)))
+		return
+	}
+
+	at, err := jwt.Decode(t, os.Getenv("MAPPCPD_JWT_SIGNING_KEY"))
 	if err != nil {
 		p.Message = Message{http.StatusUnauthorized, "failure", "Authorization failed: " + err.Error()}
 		p.Send(w)
 		return
 	}
 
-	next(w, r)
+	// a challenge token from the first step of a two-factor login is only accepted by AuthAdminMFA
+	if at.Claims.Role == mfaChallengeRole {
+		p.Message = Message{http.StatusUnauthorized, "failure", "Authorization failed: login has not been completed"}
+		p.Send(w)
+		return
+	}
+
+	revoked, err := tokenRevoked(at)
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failure", "Could not check token revocation: " + err.Error()}
+		p.Send(w)
+		return
+	}
+	if revoked {
+		p.Message = Message{http.StatusUnauthorized, "failure", "Authorization failed: token has been revoked"}
+		p.Send(w)
+		return
+	}
+
+	if at.Claims.Act != nil {
+		err := impersonationLog(auth.Impersonation{
+			AdminID:  at.Claims.Act.ID,
+			MemberID: at.Claims.ID,
+			TokenID:  at.Claims.Id,
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			IP:       clientIP(r),
+		})
+		if err != nil {
+			p.Message = Message{http.StatusInternalServerError, "failure", "Could not log request made as a member: " + err.Error()}
+			p.Send(w)
+			return
+		}
+	}
+
+	// Pass the decoded token down the chain in the request context
+	next(w, r.WithContext(jwt.NewContext(r.Context(), at)))
+}
+
+// tokenRevoked checks the revocation list for a decoded token
+var tokenRevoked = func(t jwt.Token) (bool, error) {
+	return auth.Revoked(DS, t)
 }
 
-// AdminScope checks that the auth token belongs to an admin
+// impersonationLog records a request made by an admin viewing the system as a member
+var impersonationLog = func(i auth.Impersonation) error {
+	return auth.LogImpersonation(DS, i)
+}
+
+// apiKeyCheck looks up an API key, and records that it was used
+var apiKeyCheck = func(key string) (auth.APIKey, error) {
+	return auth.CheckAPIKey(DS, key)
+}
+
+// apiKeyToken returns a token for a request made with an API key, with the service role and the scopes
+// granted to the key. The key is not a signed token, so it is not included in the token.
+func apiKeyToken(key string) (jwt.Token, error) {
+
+	k, err := apiKeyCheck(key)
+	if err != nil {
+		return jwt.Token{}, err
+	}
+
+	var at jwt.Token
+	at.Claims.ID = k.ID
+	at.Claims.Name = k.Name
+	at.Claims.Role = roleService
+	at.Claims.Scopes = k.Scopes
+	return at, nil
+}
+
+// userAuthToken returns the decoded token set in the request context by ValidateToken. If the
+// request did not pass through ValidateToken the zero value is returned, which has no role or id.
+func userAuthToken(r *http.Request) jwt.Token {
+	t, _ := jwt.FromContext(r.Context())
+	return t
+}
+
+// AdminScope checks that the auth token belongs to an admin, or to a service account using an API key
 func AdminScope(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 
 	p := Payload{}
 
-	if UserAuthToken.Claims.Role != "admin" {
+	if role := userAuthToken(r).Claims.Role; role != "admin" && role != roleService {
 		p.Message = Message{http.StatusUnauthorized, "failed", "Admin Scope Required: token does not belong to an admin user"}
 		p.Send(w)
 		return
@@ -63,7 +154,160 @@ func AdminScope(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 	next(w, r)
 }
 
-// MemberScope checks that the auth token belongs to an admin
+// requirePermission wraps a handler for an admin route so that it can only be used with a token that has
+// the permission in its scopes
+func requirePermission(permission string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		at := userAuthToken(r)
+		if !at.HasScope(permission) {
+			p := Payload{}
+			p.Message = Message{http.StatusForbidden, "failed", "Permission Required: token does not have the '" + permission + "' permission"}
+			p.Send(w)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// adminUserOnly wraps a handler for an admin route that acts on the admin's own account, issues
+// credentials, or records the admin user id against the change, so that it cannot be used with an API key.
+// The id in a service token is an API key id, which must not be stored as an ad_user id.
+func adminUserOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if userAuthToken(r).Claims.Role == roleService {
+			p := Payload{}
+			p.Message = Message{http.StatusForbidden, "failed", "Admin User Required: this resource cannot be accessed with an API key"}
+			p.Send(w)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// notImpersonated wraps a handler that changes a member's credentials or sessions, so that it cannot be used
+// by an admin viewing the system as the member
+func notImpersonated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if userAuthToken(r).Claims.Act != nil {
+			p := Payload{}
+			p.Message = Message{http.StatusForbidden, "failed", "Not available when viewing as a member"}
+			p.Send(w)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Values of MAPPCPD_ADMIN_MFA_REQUIRED. Two-factor authentication is optional if it is not set, so it can
+// be required for sensitive routes first, and then for all admin routes once everyone has enrolled.
+const (
+	mfaRequiredSensitive = "sensitive"
+	mfaRequiredAll       = "all"
+)
+
+// AdminMFA requires that an admin verified a TOTP code at login when MAPPCPD_ADMIN_MFA_REQUIRED is 'all'.
+// Routes for enrolling an authenticator are exempt, so that an admin without one can still enrol. Requests
+// made with an API key are also exempt, as a service account has no authenticator.
+func AdminMFA(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+
+	at := userAuthToken(r)
+	if os.Getenv("MAPPCPD_ADMIN_MFA_REQUIRED") != mfaRequiredAll || at.Claims.MFA || at.Claims.Role == roleService ||
+		strings.HasPrefix(r.URL.Path, v1AdminBase+"/auth/mfa") {
+		next(w, r)
+		return
+	}
+
+	p := Payload{}
+	p.Message = Message{http.StatusForbidden, "failed", "Two-factor authentication required: enrol an authenticator at POST /v1/a/auth/mfa and log in again"}
+	p.Send(w)
+}
+
+// requireMFA wraps a handler for a sensitive route, such as member personal information or financial
+// reports, so that it requires a token issued after a TOTP code was verified when
+// MAPPCPD_ADMIN_MFA_REQUIRED is set. An API key is limited by its scopes instead.
+func requireMFA(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		at := userAuthToken(r)
+		req := os.Getenv("MAPPCPD_ADMIN_MFA_REQUIRED")
+		if (req == mfaRequiredSensitive || req == mfaRequiredAll) && !at.Claims.MFA && at.Claims.Role != roleService {
+			p := Payload{}
+			p.Message = Message{http.StatusForbidden, "failed", "Two-factor authentication required: log in with an authentication code to access this resource"}
+			p.Send(w)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Audit records every mutating request, that is anything other than GET, HEAD or OPTIONS, with the actor
+// from the token, the target entities, a digest of the request body and the response status. The entities
+// in the path are added here, and handlers add any others with audit.AddEntity(). It must follow
+// ValidateToken. A request that cannot be recorded has already been handled, so the error is only logged.
+func Audit(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+		next(w, r)
+		return
+	}
+
+	// the body is held in memory so it can be both digested and handled, so it is limited in size
+	xb, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAuditBody))
+	if err != nil {
+		p := Payload{}
+		p.Message = Message{http.StatusBadRequest, "failure", "Could not read request body: " + err.Error()}
+		if int64(len(xb)) >= maxAuditBody {
+			p.Message = Message{http.StatusRequestEntityTooLarge, "failure", fmt.Sprintf("Request body is larger than %d bytes", maxAuditBody)}
+		}
+		p.Send(w)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(xb))
+
+	at := userAuthToken(r)
+	e := audit.Entry{
+		ActorID:    at.Claims.ID,
+		ActorName:  at.Claims.Name,
+		Role:       at.Claims.Role,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		BodyDigest: audit.Digest(xb),
+		IP:         clientIP(r),
+		Entities:   audit.PathEntities(r.URL.Path),
+	}
+	if at.Claims.Act != nil {
+		e.AdminID = at.Claims.Act.ID
+	}
+
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	next(sw, r.WithContext(audit.NewContext(r.Context(), &e)))
+
+	e.Status = sw.status
+	if err := auditRecord(e); err != nil {
+		log.Printf("Could not record audit entry for %s %s by %s %d - %s", e.Method, e.Path, e.Role, e.ActorID, err)
+	}
+}
+
+// maxAuditBody is the largest request body accepted by a mutating request, see Audit
+const maxAuditBody = 10 << 20
+
+// auditRecord saves an audit log entry
+var auditRecord = func(e audit.Entry) error {
+	return audit.Record(DS, e)
+}
+
+// statusWriter records the status code written to a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.status = code
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+// MemberScope checks that the auth token belongs to a member, which includes a token issued to an admin to
+// view the system as the member
 func MemberScope(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 
 	// pass through when request is preflight http OPTIONS
@@ -75,7 +319,8 @@ func MemberScope(w http.ResponseWriter, r *http.Request, next http.HandlerFunc)
 
 	p := Payload{}
 
-	if UserAuthToken.Claims.Role != "member" {
+	at := userAuthToken(r)
+	if at.Claims.Role != "member" {
 		p.Message = Message{http.StatusUnauthorized, "failed", "Member Scope Required: token does not belong to a member user"}
 		p.Send(w)
 		return
@@ -101,7 +346,7 @@ func MemberScope(w http.ResponseWriter, r *http.Request, next http.HandlerFunc)
 					p.Send(w)
 					return
 				}
-				if UserAuthToken.Claims.ID != int(mid) {
+				if at.Claims.ID != int(mid) {
 					p.Message = Message{http.StatusUnauthorized, "failed", "Member id in path does not match token"}
 					p.Send(w)
 					return
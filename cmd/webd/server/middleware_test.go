@@ -0,0 +1,463 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cardiacsociety/web-services/internal/audit"
+	"github.com/cardiacsociety/web-services/internal/auth"
+	"github.com/cardiacsociety/web-services/internal/platform/jwt"
+	"github.com/urfave/negroni"
+)
+
+// setTokenEnv sets up the env for issuing tokens, and replaces the revocation check, which requires a
+// database, with one that revokes the listed token ids. Admin tokens are issued with adminScopes, and
+// audit entries are kept in audited.
+func setTokenEnv(t *testing.T, revoked ...string) {
+	t.Helper()
+	os.Setenv("MAPPCPD_API_URL", "https://test.api")
+	os.Setenv("MAPPCPD_JWT_SIGNING_KEY", "testSigningKey")
+	os.Setenv("MAPPCPD_JWT_TTL_MINUTES", "15")
+	adminPermissions = func(id int) ([]string, error) {
+		return adminScopes, nil
+	}
+	audited = nil
+	auditRecord = func(e audit.Entry) error {
+		audited = append(audited, e)
+		return nil
+	}
+	tokenRevoked = func(tk jwt.Token) (bool, error) {
+		for _, jti := range revoked {
+			if tk.Claims.Id == jti {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
+// adminScopes are the permissions for admin tokens issued in tests
+var adminScopes = []string{"members:read"}
+
+// audited are the audit entries recorded in tests
+var audited []audit.Entry
+
+// TestMemberClaimsConcurrent ensures that concurrent requests from different members each see their
+// own token claims, and never those of another request that is in flight at the same time.
+func TestMemberClaimsConcurrent(t *testing.T) {
+	setTokenEnv(t)
+
+	tokens := map[int]string{}
+	for _, id := range []int{1, 2} {
+		tk, err := freshToken(id, "Member "+strconv.Itoa(id), "member", false)
+		if err != nil {
+			t.Fatalf("freshToken() err = %s", err)
+		}
+		tokens[id] = tk.Encoded
+	}
+
+	// Handler responds with the member id from the request context
+	h := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strconv.Itoa(userAuthToken(r).Claims.ID)))
+	}
+
+	n := negroni.New()
+	n.Use(negroni.HandlerFunc(ValidateToken))
+	n.Use(negroni.HandlerFunc(MemberScope))
+	n.UseHandlerFunc(h)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		for id, tk := range tokens {
+			wg.Add(1)
+			go func(id int, tk string) {
+				defer wg.Done()
+				req := httptest.NewRequest("GET", "/v1/m/profile", nil)
+				req.Header.Set("Authorization", "Bearer "+tk)
+				rec := httptest.NewRecorder()
+				n.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					t.Errorf("member %d status = %d, want %d", id, rec.Code, http.StatusOK)
+					return
+				}
+				if got := rec.Body.String(); got != strconv.Itoa(id) {
+					t.Errorf("member %d saw claims for member %s", id, got)
+				}
+			}(id, tk)
+		}
+	}
+	wg.Wait()
+}
+
+func TestAdminScopeRejectsMember(t *testing.T) {
+	setTokenEnv(t)
+
+	tk, err := freshToken(1, "Member 1", "member", false)
+	if err != nil {
+		t.Fatalf("freshToken() err = %s", err)
+	}
+
+	n := negroni.New()
+	n.Use(negroni.HandlerFunc(ValidateToken))
+	n.Use(negroni.HandlerFunc(AdminScope))
+	n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	req := httptest.NewRequest("GET", "/v1/a/test", nil)
+	req.Header.Set("Authorization", "Bearer "+tk.Encoded)
+	rec := httptest.NewRecorder()
+	n.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("AdminScope() status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestValidateTokenRevoked(t *testing.T) {
+	setTokenEnv(t)
+
+	tk, err := freshToken(1, "Member 1", "member", false)
+	if err != nil {
+		t.Fatalf("freshToken() err = %s", err)
+	}
+	setTokenEnv(t, tk.Claims.Id)
+
+	n := negroni.New()
+	n.Use(negroni.HandlerFunc(ValidateToken))
+	n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	req := httptest.NewRequest("GET", "/v1/m/profile", nil)
+	req.Header.Set("Authorization", "Bearer "+tk.Encoded)
+	rec := httptest.NewRecorder()
+	n.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("ValidateToken() status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAccessTTL(t *testing.T) {
+	setTokenEnv(t)
+
+	tk, err := freshToken(1, "Member 1", "member", false)
+	if err != nil {
+		t.Fatalf("freshToken() err = %s", err)
+	}
+	got := tk.ExpiresAt.Sub(tk.IssuedAt)
+	want := 15 * time.Minute
+	if got != want {
+		t.Errorf("freshToken() ttl = %s, want %s", got, want)
+	}
+	if tk.Claims.Id == "" {
+		t.Errorf("freshToken() jti claim is empty")
+	}
+}
+
+func TestAccessTTLLegacy(t *testing.T) {
+	setTokenEnv(t)
+	os.Unsetenv("MAPPCPD_JWT_TTL_MINUTES")
+	os.Setenv("MAPPCPD_JWT_TTL_HOURS", "2")
+	defer os.Unsetenv("MAPPCPD_JWT_TTL_HOURS")
+
+	got := accessTTL()
+	want := defaultAccessTTL
+	if got != want {
+		t.Errorf("accessTTL() with MAPPCPD_JWT_TTL_HOURS = %s, want %s", got, want)
+	}
+
+	os.Setenv("MAPPCPD_JWT_TTL_MINUTES", "30")
+	got = accessTTL()
+	want = 30 * time.Minute
+	if got != want {
+		t.Errorf("accessTTL() with both set = %s, want %s", got, want)
+	}
+}
+
+func TestValidateTokenRejectsChallenge(t *testing.T) {
+	setTokenEnv(t)
+
+	tk, err := freshToken(1, "Admin 1", mfaChallengeRole, false)
+	if err != nil {
+		t.Fatalf("freshToken() err = %s", err)
+	}
+
+	n := negroni.New()
+	n.Use(negroni.HandlerFunc(ValidateToken))
+	n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	req := httptest.NewRequest("GET", "/v1/g/activities", nil)
+	req.Header.Set("Authorization", "Bearer "+tk.Encoded)
+	rec := httptest.NewRecorder()
+	n.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("ValidateToken() status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAdminMFA(t *testing.T) {
+	setTokenEnv(t)
+	defer os.Unsetenv("MAPPCPD_ADMIN_MFA_REQUIRED")
+
+	cases := []struct {
+		required  string
+		mfa       bool
+		path      string
+		sensitive bool
+		want      int
+	}{
+		{"", false, "/v1/a/members/1", true, http.StatusOK},
+		{mfaRequiredSensitive, false, "/v1/a/test", false, http.StatusOK},
+		{mfaRequiredSensitive, false, "/v1/a/members/1", true, http.StatusForbidden},
+		{mfaRequiredSensitive, true, "/v1/a/members/1", true, http.StatusOK},
+		{mfaRequiredAll, false, "/v1/a/test", false, http.StatusForbidden},
+		{mfaRequiredAll, false, "/v1/a/auth/mfa", false, http.StatusOK},
+		{mfaRequiredAll, true, "/v1/a/test", false, http.StatusOK},
+	}
+
+	for _, c := range cases {
+		os.Setenv("MAPPCPD_ADMIN_MFA_REQUIRED", c.required)
+
+		tk, err := freshToken(1, "Admin 1", "admin", c.mfa)
+		if err != nil {
+			t.Fatalf("freshToken() err = %s", err)
+		}
+
+		h := func(w http.ResponseWriter, r *http.Request) {}
+		if c.sensitive {
+			h = requireMFA(h)
+		}
+		n := negroni.New()
+		n.Use(negroni.HandlerFunc(ValidateToken))
+		n.Use(negroni.HandlerFunc(AdminScope))
+		n.Use(negroni.HandlerFunc(AdminMFA))
+		n.UseHandlerFunc(h)
+
+		req := httptest.NewRequest("GET", c.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tk.Encoded)
+		rec := httptest.NewRecorder()
+		n.ServeHTTP(rec, req)
+		if rec.Code != c.want {
+			t.Errorf("required = %q, mfa = %v, path = %s, status = %d, want %d", c.required, c.mfa, c.path, rec.Code, c.want)
+		}
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	setTokenEnv(t)
+
+	tk, err := freshToken(1, "Admin 1", "admin", false)
+	if err != nil {
+		t.Fatalf("freshToken() err = %s", err)
+	}
+
+	// the admin sub router checks the permission table before any handler is called
+	n := AdminMiddleware(AdminSubRouter(v1AdminBase))
+
+	cases := []struct {
+		method string
+		path   string
+		want   int
+		perm   string
+	}{
+		{"GET", "/v1/a/test", http.StatusOK, ""},
+		{"PUT", "/v1/a/lapsedmembers", http.StatusForbidden, auth.PermMembersLapse},
+		{"POST", "/v1/a/reports/payment", http.StatusForbidden, auth.PermReportsFinance},
+		{"POST", "/v1/a/notifications", http.StatusForbidden, auth.PermNotificationsSend},
+		{"POST", "/v1/a/members/1/impersonation", http.StatusForbidden, auth.PermMembersImpersonate},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tk.Encoded)
+		rec := httptest.NewRecorder()
+		n.ServeHTTP(rec, req)
+		if rec.Code != c.want {
+			t.Errorf("%s %s status = %d, want %d", c.method, c.path, rec.Code, c.want)
+		}
+		if c.perm != "" && !strings.Contains(rec.Body.String(), c.perm) {
+			t.Errorf("%s %s message = %s, want it to name %q", c.method, c.path, rec.Body.String(), c.perm)
+		}
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	setTokenEnv(t)
+	defer os.Unsetenv("MAPPCPD_ADMIN_MFA_REQUIRED")
+	os.Setenv("MAPPCPD_ADMIN_MFA_REQUIRED", mfaRequiredAll)
+
+	key := auth.APIKeyPrefix + "testKey"
+	apiKeyCheck = func(k string) (auth.APIKey, error) {
+		if k != key {
+			return auth.APIKey{}, auth.ErrInvalidAPIKey
+		}
+		return auth.APIKey{ID: 1, Name: "pubmedr", Scopes: []string{auth.PermMembersRead, auth.PermResourcesWrite, auth.PermAdminUsers}}, nil
+	}
+
+	n := AdminMiddleware(AdminSubRouter(v1AdminBase))
+
+	cases := []struct {
+		method string
+		path   string
+		key    string
+		want   int
+	}{
+		{"GET", "/v1/a/test", key, http.StatusOK},
+		{"GET", "/v1/a/test", auth.APIKeyPrefix + "wrongKey", http.StatusUnauthorized},
+		{"PUT", "/v1/a/lapsedmembers", key, http.StatusForbidden},
+		{"POST", "/v1/a/auth/mfa", key, http.StatusForbidden},
+		{"GET", "/v1/a/idlist?t=fn_payment", key, http.StatusForbidden},
+		{"PUT", "/v1/a/resources/1/attachments", key, http.StatusForbidden},
+		{"PUT", "/v1/a/auth/unlock", key, http.StatusForbidden},
+		{"GET", "/v1/a/idlist?t=auth_api_key", key, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		req.Header.Set("Authorization", "Bearer "+c.key)
+		rec := httptest.NewRecorder()
+		n.ServeHTTP(rec, req)
+		if rec.Code != c.want {
+			t.Errorf("%s %s status = %d, want %d", c.method, c.path, rec.Code, c.want)
+		}
+	}
+}
+
+func TestImpersonation(t *testing.T) {
+	setTokenEnv(t)
+
+	var logged []auth.Impersonation
+	impersonationLog = func(i auth.Impersonation) error {
+		logged = append(logged, i)
+		return nil
+	}
+
+	admin, err := freshToken(1, "Admin 1", "admin", false)
+	if err != nil {
+		t.Fatalf("freshToken() err = %s", err)
+	}
+	tk, err := impersonationToken(2, "Member 2", admin)
+	if err != nil {
+		t.Fatalf("impersonationToken() err = %s", err)
+	}
+	if got := tk.ExpiresAt.Sub(tk.IssuedAt); got != auth.ImpersonationTTL {
+		t.Errorf("impersonationToken() ttl = %s, want %s", got, auth.ImpersonationTTL)
+	}
+
+	// the member sub router, with a stand-in for a handler that would need the database
+	rm := MemberSubRouter(v1MemberBase)
+	rm.Methods("GET").Path("/test").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strconv.Itoa(userAuthToken(r).Claims.ID)))
+	})
+	n := MemberMiddleware(rm)
+
+	cases := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{"GET", "/v1/m/test", http.StatusOK},
+		{"PUT", "/v1/m/email", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tk.Encoded)
+		rec := httptest.NewRecorder()
+		n.ServeHTTP(rec, req)
+		if rec.Code != c.want {
+			t.Errorf("%s %s status = %d, want %d", c.method, c.path, rec.Code, c.want)
+		}
+	}
+
+	if len(logged) != len(cases) {
+		t.Fatalf("logged %d requests, want %d", len(logged), len(cases))
+	}
+	want := auth.Impersonation{AdminID: 1, MemberID: 2, TokenID: tk.Claims.Id, Method: "GET", Path: "/v1/m/test", IP: "192.0.2.1"}
+	if logged[0] != want {
+		t.Errorf("logged %+v, want %+v", logged[0], want)
+	}
+
+	// a request that cannot be logged does not go ahead
+	impersonationLog = func(i auth.Impersonation) error {
+		return errors.New("no database")
+	}
+	req := httptest.NewRequest("GET", "/v1/m/test", nil)
+	req.Header.Set("Authorization", "Bearer "+tk.Encoded)
+	rec := httptest.NewRecorder()
+	n.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("GET /v1/m/test status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	setTokenEnv(t)
+
+	tk, err := freshToken(1, "Admin 1", "admin", false)
+	if err != nil {
+		t.Fatalf("freshToken() err = %s", err)
+	}
+
+	// a handler that reads the body, adds an entity and responds with a status
+	h := func(w http.ResponseWriter, r *http.Request) {
+		var ids []int
+		json.NewDecoder(r.Body).Decode(&ids)
+		audit.AddEntity(r.Context(), "members", ids...)
+		w.WriteHeader(http.StatusAccepted)
+	}
+
+	n := negroni.New()
+	n.Use(negroni.HandlerFunc(ValidateToken))
+	n.Use(negroni.HandlerFunc(Audit))
+	n.UseHandlerFunc(h)
+
+	for _, method := range []string{"GET", "PUT"} {
+		req := httptest.NewRequest(method, "/v1/a/notes/5/attachments", strings.NewReader("[1, 2]"))
+		req.Header.Set("Authorization", "Bearer "+tk.Encoded)
+		n.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// only the PUT is recorded
+	if len(audited) != 1 {
+		t.Fatalf("recorded %d audit entries, want 1", len(audited))
+	}
+	e := audited[0]
+	if e.ActorID != 1 || e.Role != "admin" || e.Method != "PUT" || e.Status != http.StatusAccepted {
+		t.Errorf("audit entry = %+v", e)
+	}
+	if e.BodyDigest != audit.Digest([]byte("[1, 2]")) {
+		t.Errorf("audit entry body digest = %s, want digest of the body", e.BodyDigest)
+	}
+	want := []audit.Entity{{Type: "notes", ID: 5}, {Type: "members", ID: 1}, {Type: "members", ID: 2}}
+	if !reflect.DeepEqual(e.Entities, want) {
+		t.Errorf("audit entry entities = %v, want %v", e.Entities, want)
+	}
+}
+
+func TestAuditBodyTooLarge(t *testing.T) {
+	setTokenEnv(t)
+
+	tk, err := freshToken(1, "Admin 1", "admin", false)
+	if err != nil {
+		t.Fatalf("freshToken() err = %s", err)
+	}
+
+	n := negroni.New()
+	n.Use(negroni.HandlerFunc(ValidateToken))
+	n.Use(negroni.HandlerFunc(Audit))
+	n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("handler called for a request body over the limit")
+	})
+
+	req := httptest.NewRequest("POST", "/v1/a/resources", strings.NewReader(strings.Repeat("x", maxAuditBody+1)))
+	req.Header.Set("Authorization", "Bearer "+tk.Encoded)
+	rec := httptest.NewRecorder()
+	n.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Audit() status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
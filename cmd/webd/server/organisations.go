@@ -10,9 +10,9 @@ import (
 )
 
 // AllOrganisations handles requests for Organisation records
-func AllOrganisations(w http.ResponseWriter, _ *http.Request) {
+func AllOrganisations(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	l, err := organisation.All(DS)
 	if err != nil {
@@ -34,7 +34,7 @@ func AllOrganisations(w http.ResponseWriter, _ *http.Request) {
 // OrganisationByID handles requests for a single Organisation record
 func OrganisationByID(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	v := mux.Vars(r)
 	id, err := strconv.Atoi(v["id"])
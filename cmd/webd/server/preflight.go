@@ -25,7 +25,7 @@ func Preflight(w http.ResponseWriter, _ *http.Request) {
 	fmt.Println("Preflight() is handling an OPTIONS request...")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Headers", "Authorization,Content-Type")
-	w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE")
+	w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE")
 	w.Header().Set("Content-Type", "text/plain")
 	io.WriteString(w, "Cabin crew, please arm doors and crosscheck :)")
 }
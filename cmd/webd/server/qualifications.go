@@ -12,9 +12,9 @@ import (
 )
 
 // Qualifications fetches list of Qualifications
-func Qualifications(w http.ResponseWriter, _ *http.Request) {
+func Qualifications(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	xq, err := qualification.All(DS)
 	if err != nil {
@@ -33,9 +33,9 @@ func Qualifications(w http.ResponseWriter, _ *http.Request) {
 }
 
 // Specialities fetches list of Specialities (areas of interest)
-func Specialities(w http.ResponseWriter, _ *http.Request) {
+func Specialities(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	xq, err := speciality.All(DS)
 	if err != nil {
@@ -56,7 +56,7 @@ func Specialities(w http.ResponseWriter, _ *http.Request) {
 // Organisations fetches list of Organisations and can include a typeId on the url.
 func Organisations(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	v := mux.Vars(r)
 	// endpoint .../organisations/ with no type returns 404, so this will never run
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cardiacsociety/web-services/internal/audit"
+	"github.com/cardiacsociety/web-services/internal/cpd"
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MembersActivitiesRecurringDue lists the occurrences of a recurring activity that are due today or earlier,
+// each with the id of any existing cpd record that is the same
+func MembersActivitiesRecurringDue(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := NewResponder()
+
+	_id := mux.Vars(r)["_id"]
+	ra, ok := memberRecurring(w, p, at.Claims.ID, _id)
+	if !ok {
+		return
+	}
+
+	xo, err := ra.Due(DS, _id, time.Now())
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	p.Message = Message{http.StatusOK, "success", "Data retrieved from MongoDB"}
+	p.Meta = map[string]int{"count": len(xo)}
+	p.Data = xo
+	p.Send(w)
+}
+
+// MembersActivitiesRecurringCatchUp records or skips the due occurrences of a recurring activity in bulk. The
+// body has the dates to record and the dates to skip, in the format yyyy-mm-dd, eg:
+//
+//	{"record": ["2019-01-08", "2019-01-22"], "skip": ["2019-01-15"]}
+//
+// or "all": "record" or "skip" for every occurrence that is due. One cpd record is created for each date
+// recorded, unless the same record exists, so a repeated request has no further effect.
+func MembersActivitiesRecurringCatchUp(w http.ResponseWriter, r *http.Request) {
+
+	at := userAuthToken(r)
+	p := NewResponder()
+
+	_id := mux.Vars(r)["_id"]
+	ra, ok := memberRecurring(w, p, at.Claims.ID, _id)
+	if !ok {
+		return
+	}
+
+	body := struct {
+		Record []string `json:"record"`
+		Skip   []string `json:"skip"`
+		All    string   `json:"all"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		msg := "Error decoding JSON: " + err.Error() + ". Decode the format of request body."
+		p.Message = Message{http.StatusBadRequest, "failed", msg}
+		p.Send(w)
+		return
+	}
+
+	if body.All != "" && body.All != "record" && body.All != "skip" {
+		p.Message = Message{http.StatusBadRequest, "failed", "all should be record or skip"}
+		p.Send(w)
+		return
+	}
+	if body.All != "" {
+		xo, err := ra.Due(DS, _id, time.Now())
+		if err != nil {
+			p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+			p.Send(w)
+			return
+		}
+		for _, o := range xo {
+			if body.All == "record" {
+				body.Record = append(body.Record, o.Date)
+			} else {
+				body.Skip = append(body.Skip, o.Date)
+			}
+		}
+	}
+
+	ids, err := ra.CatchUp(DS, _id, body.Record, body.Skip)
+	if err == cpd.ErrCatchUp {
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	audit.AddEntity(r.Context(), "activities", ids...)
+
+	msg := fmt.Sprintf("Recorded %d activities for member (id: %v)", len(ids), at.Claims.ID)
+	p.Message = Message{http.StatusOK, "success", msg}
+	p.Meta = map[string]interface{}{"count": len(ra.Activities), "ids": ids}
+	p.Data = ra
+	p.Send(w)
+}
+
+// memberRecurring fetches the recurring activities of a member, and checks that the recurring activity _id
+// belongs to the member. If not, a failed response is sent and ok is false.
+func memberRecurring(w http.ResponseWriter, p *Payload, memberID int, _id string) (*cpd.Recurring, bool) {
+
+	ra, err := cpd.MemberRecurring(DS, memberID)
+	if err != nil {
+		msg := "Failed to initialise a value of type Recurring -" + err.Error()
+		p.Message = Message{http.StatusInternalServerError, "failed", msg}
+		p.Send(w)
+		return nil, false
+	}
+
+	if !bson.IsObjectIdHex(_id) {
+		p.Message = Message{http.StatusNotFound, "failed", "No recurring activity with id " + _id}
+		p.Send(w)
+		return nil, false
+	}
+	if _, err := ra.GetActivity(_id); err != nil {
+		p.Message = Message{http.StatusNotFound, "failed", err.Error()}
+		p.Send(w)
+		return nil, false
+	}
+
+	return ra, true
+}
@@ -13,17 +13,17 @@ import (
 )
 
 // ReportsTest handles a request to test the reports route
-func ReportsTest(w http.ResponseWriter, _ *http.Request) {
+func ReportsTest(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 	p.Message = Message{http.StatusOK, "success", "Request to reports test handler successful!"}
 	p.Send(w)
 }
 
 // ReportsModulesByDate fetches data on modules by year-month
-func ReportsModulesByDate(w http.ResponseWriter, _ *http.Request) {
+func ReportsModulesByDate(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	report, err := reports.ReportModulesByDate(DS)
 	if err != nil {
@@ -45,9 +45,9 @@ func ReportsModulesByDate(w http.ResponseWriter, _ *http.Request) {
 // ReportsPointsByRecordDate fetches data on cpd activity (points) recorded by year-month
 // according to WHEN they were recoded - so it is a measure of system activity. Actual activity
 // dates are reported by ReportsPointsByActivityDate
-func ReportsPointsByRecordDate(w http.ResponseWriter, _ *http.Request) {
+func ReportsPointsByRecordDate(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	report, err := reports.ReportPointsByRecordDate(DS)
 	if err != nil {
@@ -68,9 +68,9 @@ func ReportsPointsByRecordDate(w http.ResponseWriter, _ *http.Request) {
 
 // ReportsPointsByActivityDate fetches data showing the cpd activity (points)
 // according to the date of the activity itself - that is CPD Activity as opposed to system activity (above)
-func ReportsPointsByActivityDate(w http.ResponseWriter, _ *http.Request) {
+func ReportsPointsByActivityDate(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	report, err := reports.ReportPointsByActivityDate(DS)
 	if err != nil {
@@ -92,7 +92,7 @@ func ReportsPointsByActivityDate(w http.ResponseWriter, _ *http.Request) {
 // ReportsExcel handles requests for cached excel reports
 func ReportsExcel(w http.ResponseWriter, r *http.Request) {
 
-	p := NewResponder(UserAuthToken.Encoded)
+	p := NewResponder()
 
 	v := mux.Vars(r)
 	cacheID := v["id"]
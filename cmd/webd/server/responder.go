@@ -2,14 +2,24 @@ package server
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/cardiacsociety/web-services/internal/auth"
 	"github.com/cardiacsociety/web-services/internal/platform/jwt"
 	"github.com/pkg/errors"
 )
 
+// Default token lifetimes, if not set in the environment
+const (
+	defaultAccessTTL  = 15 * time.Minute
+	defaultRefreshTTL = 30 * 24 * time.Hour
+)
+
 // Payload represents a standard JSON format for ALL responses
 // Message - the "header" part of the response (see below)
 // Encoded - wherever possible, return a fresh token
@@ -45,26 +55,11 @@ type MongoMeta struct {
 	Query interface{} `json:"query" bson:"query"`
 }
 
-// New returns a pointer to a new Payload value. It received a token string which it will
-// check for validity and if ok will set a refresh token as part of the payload.
-func NewResponder(ts string) *Payload {
-
-	p := Payload{}
-
-	// if universal UserAuthToken value is present, use this to set fresh token
-	t, err := jwt.Decode(ts, os.Getenv("MAPPCPD_JWT_SIGNING_KEY"))
-	if err != nil {
-		// No panic here, we'll just not do a fresh token
-		return &p
-	}
-
-	ft, err := freshToken(t.Claims.ID, t.Claims.Name, t.Claims.Role)
-	if err != nil {
-		return &p
-	}
-	p.Data = ft
-
-	return &p
+// NewResponder returns a pointer to a new Payload value. It used to set a fresh token as part of the
+// payload, but that allowed any valid token to be renewed indefinitely. Clients now use a refresh
+// token at /v1/auth/refresh.
+func NewResponder() *Payload {
+	return &Payload{}
 }
 
 // Send will; send the payload back to the requester
@@ -74,7 +69,7 @@ func (p Payload) Send(w http.ResponseWriter) error {
 	// CORS this single responder should handle all cases...
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Headers", "Authorization,Content-Type")
-	w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE")
+	w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE")
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(p.Message.Status) // the http status code is part of the payload message
 
@@ -86,23 +81,108 @@ func (p Payload) Send(w http.ResponseWriter) error {
 	return nil
 }
 
-// freshToken issues a new token and adds custom claims id (member id) and name (member name) and well as custom scope
-func freshToken(id int, name string, role string) (jwt.Token, error) {
+// authTokens is the response to a successful login or refresh - a short-lived access token, with the same
+// fields as before, plus an opaque refresh token that is used to obtain the next access token.
+type authTokens struct {
+	jwt.Token
+	RefreshToken     string    `json:"refreshToken"`
+	RefreshExpiresAt time.Time `json:"refreshExpiresAt"`
+}
 
-	var t jwt.Token
+// freshToken issues a new token and adds custom claims id (member id) and name (member name) and well as custom scope.
+// The mfa claim is set for an admin that verified a TOTP code at login. An admin token also has the current
+// permissions of the admin as scopes, so a change in permissions takes effect when the token is refreshed.
+func freshToken(id int, name string, role string, mfa bool) (jwt.Token, error) {
 
 	iss := os.Getenv("MAPPCPD_API_URL")
 	key := os.Getenv("MAPPCPD_JWT_SIGNING_KEY")
-	ttl, err := strconv.Atoi(os.Getenv("MAPPCPD_JWT_TTL_HOURS"))
-	if err != nil {
-		return t, errors.Wrap(err, "Could not convert hours string to int")
-	}
 
 	c := map[string]interface{}{
 		"id":   id,
 		"name": name,
 		"role": role,
+		"mfa":  mfa,
+	}
+
+	if role == "admin" {
+		xp, err := adminPermissions(id)
+		if err != nil {
+			return jwt.Token{}, errors.Wrap(err, "Could not get admin permissions")
+		}
+		c["scopes"] = xp
+	}
+
+	return jwt.New(iss, key, 0).SetTTL(accessTTL()).CustomClaims(c).Encode()
+}
+
+// impersonationToken issues a member token for an admin to view the system as the member sees it. The act
+// claim identifies the admin, so that requests made with the token are logged and cannot change the
+// member's credentials, see ValidateToken.
+func impersonationToken(memberID int, name string, admin jwt.Token) (jwt.Token, error) {
+
+	iss := os.Getenv("MAPPCPD_API_URL")
+	key := os.Getenv("MAPPCPD_JWT_SIGNING_KEY")
+
+	c := map[string]interface{}{
+		"id":   memberID,
+		"name": name,
+		"role": "member",
+		"act":  jwt.Actor{ID: admin.Claims.ID, Name: admin.Claims.Name, Role: admin.Claims.Role},
+	}
+
+	return jwt.New(iss, key, 0).SetTTL(auth.ImpersonationTTL).CustomClaims(c).Encode()
+}
+
+// adminPermissions fetches the permissions for an admin user
+var adminPermissions = func(id int) ([]string, error) {
+	return auth.AdminPermissions(DS, id)
+}
+
+// newSession issues an access token and a new refresh token for a user that has just logged in
+func newSession(id int, name string, role string, mfa bool) (authTokens, error) {
+
+	var s authTokens
+
+	at, err := freshToken(id, name, role, mfa)
+	if err != nil {
+		return s, err
 	}
 
-	return jwt.New(iss, key, ttl).CustomClaims(c).Encode()
+	rt, err := auth.NewRefreshToken(DS, role, id, mfa, refreshTTL())
+	if err != nil {
+		return s, errors.Wrap(err, "Could not issue refresh token")
+	}
+
+	s.Token = at
+	s.RefreshToken = rt
+	s.RefreshExpiresAt = time.Now().Add(refreshTTL())
+	return s, nil
+}
+
+// accessTTL returns the lifetime of an access token, set by MAPPCPD_JWT_TTL_MINUTES. The old setting,
+// MAPPCPD_JWT_TTL_HOURS, is ignored as it was sized for tokens that could not be refreshed.
+func accessTTL() time.Duration {
+	if os.Getenv("MAPPCPD_JWT_TTL_HOURS") != "" {
+		legacyTTLWarning.Do(func() {
+			log.Println("MAPPCPD_JWT_TTL_HOURS is no longer used, set MAPPCPD_JWT_TTL_MINUTES for the lifetime of access tokens")
+		})
+	}
+	return durationEnv("MAPPCPD_JWT_TTL_MINUTES", time.Minute, defaultAccessTTL)
+}
+
+// legacyTTLWarning logs that MAPPCPD_JWT_TTL_HOURS is set, once
+var legacyTTLWarning sync.Once
+
+// refreshTTL returns the lifetime of a refresh token, set by MAPPCPD_JWT_REFRESH_TTL_HOURS
+func refreshTTL() time.Duration {
+	return durationEnv("MAPPCPD_JWT_REFRESH_TTL_HOURS", time.Hour, defaultRefreshTTL)
+}
+
+// durationEnv returns the value of an env var as a number of units, or the default if not set or invalid
+func durationEnv(name string, unit time.Duration, def time.Duration) time.Duration {
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || n < 1 {
+		return def
+	}
+	return time.Duration(n) * unit
 }
@@ -1,6 +1,9 @@
 package server
 
 import (
+	"net/http"
+
+	"github.com/cardiacsociety/web-services/internal/auth"
 	"github.com/gorilla/mux"
 	"github.com/urfave/negroni"
 )
@@ -12,63 +15,126 @@ func AuthSubRouter(prefix string) *mux.Router {
 	auth := r.PathPrefix(prefix).Subrouter()
 	auth.Methods("OPTIONS").Path("/").HandlerFunc(Preflight)
 	auth.Methods("POST").Path("/member").HandlerFunc(AuthMemberLogin)
+	auth.Methods("POST").Path("/member/exchange").HandlerFunc(AuthMemberExchange)
 	auth.Methods("POST").Path("/admin").HandlerFunc(AuthAdminLogin)
+	auth.Methods("POST").Path("/admin/mfa").HandlerFunc(AuthAdminMFA)
+	auth.Methods("POST").Path("/refresh").HandlerFunc(AuthRefresh)
+	auth.Methods("POST").Path("/password/forgot").HandlerFunc(AuthPasswordForgot)
+	auth.Methods("POST").Path("/password/reset").HandlerFunc(AuthPasswordReset)
+	auth.Methods("POST").Path("/email/verify").HandlerFunc(AuthEmailVerify)
+
+	// logout requires the current access token
+	auth.Methods("POST").Path("/logout").Handler(negroni.New(negroni.HandlerFunc(ValidateToken), negroni.WrapFunc(AuthLogout)))
+	auth.Methods("POST").Path("/logout/all").Handler(negroni.New(negroni.HandlerFunc(ValidateToken), negroni.WrapFunc(notImpersonated(AuthLogoutAll))))
 
 	return auth
 }
 
-// AdminSubRouter adds end points for admin, and appropriate middleware
-func AdminSubRouter(prefix string) *mux.Router {
-
-	r := mux.NewRouter().StrictSlash(true)
-	admin := r.PathPrefix(prefix).Subrouter()
+// adminRoute is an admin end point and the permission required to use it. An empty permission means the
+// route is available to any admin.
+type adminRoute struct {
+	Method     string
+	Path       string
+	Permission string
+	Handler    http.HandlerFunc
+}
 
-	admin.Methods("GET").Path("/test").HandlerFunc(AdminTest)
-	admin.Methods("GET").Path("/idlist").HandlerFunc(AdminIDList)
-	admin.Methods("GET").Path("/members").HandlerFunc(AdminMembersSearch)
-	admin.Methods("POST").Path("/members").HandlerFunc(AdminMembersSearchPost)
-	admin.Methods("GET").Path("/members/{id:[0-9]+}").HandlerFunc(AdminMembersID)
-	//admin.Methods("POST").Path("/members/{id:[0-9]+}").HandlerFunc(AdminMembersUpdate)
-	admin.Methods("GET").Path("/members/{id:[0-9]+}/notes").HandlerFunc(AdminMembersNotes)
-	admin.Methods("GET").Path("/notes/{id:[0-9]+}").HandlerFunc(AdminNotes)
-	admin.Methods("GET").Path("/organisations").HandlerFunc(AllOrganisations)
-	admin.Methods("GET").Path("/organisations/{id:[0-9]+}").HandlerFunc(OrganisationByID)
+// adminRoutes is the permission table for the admin end points. Handlers for sensitive routes, such as
+// member personal information and financial reports, are wrapped with requireMFA.
+var adminRoutes = []adminRoute{
+	{"GET", "/test", "", AdminTest},
+	{"GET", "/idlist", "", AdminIDList}, // permission is checked per table
+	{"PUT", "/auth/unlock", auth.PermAdminUsers, adminUserOnly(AdminAuthUnlock)},
+
+	// Two-factor authentication enrolment
+	{"POST", "/auth/mfa", "", adminUserOnly(AdminAuthMFAEnrol)},
+	{"PUT", "/auth/mfa", "", adminUserOnly(AdminAuthMFAConfirm)},
+	{"DELETE", "/auth/mfa", "", adminUserOnly(AdminAuthMFADisable)},
+	{"POST", "/auth/mfa/recoverycodes", "", adminUserOnly(AdminAuthMFARecoveryCodes)},
+
+	// API keys for service accounts
+	{"GET", "/apikeys", auth.PermAPIKeys, adminUserOnly(requireMFA(AdminAPIKeys))},
+	{"POST", "/apikeys", auth.PermAPIKeys, adminUserOnly(requireMFA(AdminAPIKeyCreate))},
+	{"PUT", "/apikeys/{id:[0-9]+}/rotation", auth.PermAPIKeys, adminUserOnly(requireMFA(AdminAPIKeyRotate))},
+	{"DELETE", "/apikeys/{id:[0-9]+}", auth.PermAPIKeys, adminUserOnly(requireMFA(AdminAPIKeyRevoke))},
+
+	// Members
+	{"GET", "/members", auth.PermMembersRead, requireMFA(AdminMembersSearch)},
+	{"POST", "/members", auth.PermMembersRead, requireMFA(AdminMembersSearchPost)},
+	{"GET", "/members/{id:[0-9]+}", auth.PermMembersRead, requireMFA(AdminMembersID)},
+	{"POST", "/members/{id:[0-9]+}/impersonation", auth.PermMembersImpersonate, adminUserOnly(requireMFA(AdminMembersImpersonation))},
+	{"PUT", "/members/{id:[0-9]+}", auth.PermMembersWrite, requireMFA(AdminMembersUpdate)},
+	{"PATCH", "/members/{id:[0-9]+}", auth.PermMembersWrite, requireMFA(AdminMembersUpdate)},
+	{"GET", "/members/{id:[0-9]+}/notes", auth.PermMembersRead, requireMFA(AdminMembersNotes)},
+	{"GET", "/members/{id:[0-9]+}/history", auth.PermMembersRead, requireMFA(AdminMembersHistory)},
+	{"GET", "/members/{id:[0-9]+}/state", auth.PermMembersRead, requireMFA(AdminMembersState)},
+	{"GET", "/members/counts", auth.PermMembersRead, requireMFA(AdminMembersCounts)},
+	{"POST", "/members/import", auth.PermMembersWrite, requireMFA(AdminMembersImport)},
+	{"GET", "/members/duplicates", auth.PermMembersRead, requireMFA(AdminMembersDuplicates)},
+	{"POST", "/members/{id:[0-9]+}/merge", auth.PermMembersWrite, requireMFA(AdminMembersMerge)},
+	{"GET", "/members/{id:[0-9]+}/activities/export", auth.PermMembersRead, requireMFA(AdminMembersActivitiesExport)},
+	{"POST", "/members/activities/export", auth.PermReportsMembers, requireMFA(AdminActivitiesExport)},
+	{"GET", "/notes/{id:[0-9]+}", auth.PermMembersRead, requireMFA(AdminNotes)},
+	{"GET", "/organisations", "", AllOrganisations},
+	{"GET", "/organisations/{id:[0-9]+}", "", OrganisationByID},
 
 	// these routes are available in the 'general' endpoints and are included here just for convenience
-	admin.Methods("GET").Path("/resources/{id:[0-9]+}").HandlerFunc(ResourcesID)
-	admin.Methods("POST").Path("/resources").HandlerFunc(ResourcesCollection)
-	admin.Methods("GET").Path("/modules/{id:[0-9]+}").HandlerFunc(ModulesID)
-	admin.Methods("POST").Path("/modules").HandlerFunc(ModulesCollection)
+	{"GET", "/resources/{id:[0-9]+}", "", ResourcesID},
+	{"POST", "/resources", "", ResourcesCollection},
+	{"GET", "/modules/{id:[0-9]+}", "", ModulesID},
+	{"POST", "/modules", "", ModulesCollection},
 
 	// Note Attachments
-	admin.Methods("OPTIONS").Path("/notes/{id:[0-9]+}/attachments/request").HandlerFunc(Preflight)
-	admin.Methods("GET").Path("/notes/{id:[0-9]+}/attachments/request").HandlerFunc(AdminNotesAttachmentRequest)
-	admin.Methods("PUT").Path("/notes/{id:[0-9]+}/attachments").HandlerFunc(AdminNotesAttachmentRegister)
+	{"OPTIONS", "/notes/{id:[0-9]+}/attachments/request", "", Preflight},
+	{"GET", "/notes/{id:[0-9]+}/attachments/request", auth.PermMembersWrite, AdminNotesAttachmentRequest},
+	{"PUT", "/notes/{id:[0-9]+}/attachments", auth.PermMembersWrite, adminUserOnly(AdminNotesAttachmentRegister)},
 
 	// Resource Attachments
-	admin.Methods("OPTIONS").Path("/resources/{id:[0-9]+}/attachments/request").HandlerFunc(Preflight)
-	admin.Methods("GET").Path("/resources/{id:[0-9]+}/attachments/request").HandlerFunc(AdminResourcesAttachmentRequest)
-	admin.Methods("PUT").Path("/resources/{id:[0-9]+}/attachments").HandlerFunc(AdminResourcesAttachmentRegister)
+	{"OPTIONS", "/resources/{id:[0-9]+}/attachments/request", "", Preflight},
+	{"GET", "/resources/{id:[0-9]+}/attachments/request", auth.PermResourcesWrite, AdminResourcesAttachmentRequest},
+	{"PUT", "/resources/{id:[0-9]+}/attachments", auth.PermResourcesWrite, adminUserOnly(AdminResourcesAttachmentRegister)},
 
 	// Batch routes for bulk uploading
-	admin.Methods("POST").Path("/batch/resources").HandlerFunc(AdminBatchResourcesPost)
+	{"POST", "/batch/resources", auth.PermResourcesWrite, AdminBatchResourcesPost},
 
 	// Report routes
-	admin.Methods("POST").Path("/reports/application").HandlerFunc(AdminReportApplicationExcel)
-	admin.Methods("POST").Path("/reports/member").HandlerFunc(AdminReportMemberExcel)
-	admin.Methods("POST").Path("/reports/journal").HandlerFunc(AdminReportMemberJournalExcel)
-	admin.Methods("POST").Path("/reports/invoice").HandlerFunc(AdminReportInvoiceExcel)
-	admin.Methods("POST").Path("/reports/payment").HandlerFunc(AdminReportPaymentExcel)
-	admin.Methods("POST").Path("/reports/position").HandlerFunc(AdminReportPositionExcel)
+	{"POST", "/reports/application", auth.PermReportsMembers, requireMFA(AdminReportApplicationExcel)},
+	{"POST", "/reports/member", auth.PermReportsMembers, requireMFA(AdminReportMemberExcel)},
+	{"POST", "/reports/journal", auth.PermReportsMembers, requireMFA(AdminReportMemberJournalExcel)},
+	{"POST", "/reports/invoice", auth.PermReportsFinance, requireMFA(AdminReportInvoiceExcel)},
+	{"POST", "/reports/payment", auth.PermReportsFinance, requireMFA(AdminReportPaymentExcel)},
+	{"POST", "/reports/position", auth.PermReportsMembers, requireMFA(AdminReportPositionExcel)},
 
 	// Membership application
-	admin.Methods("POST").Path("/applications").HandlerFunc(AdminNewMembershipApplication)
-	
-	// Lapse members
-	admin.Methods("PUT").Path("/lapsedmembers").HandlerFunc(AdminLapseMembers)
+	{"POST", "/applications", auth.PermMembersWrite, AdminNewMembershipApplication},
+
+	// Lapse and reinstate members
+	{"PUT", "/lapsedmembers", auth.PermMembersLapse, AdminLapseMembers},
+	{"PUT", "/reinstatedmembers", auth.PermMembersLapse, AdminReinstateMembers},
+	{"POST", "/members/lapserun", auth.PermMembersLapse, requireMFA(AdminMembersLapseRun)},
 
 	// Notifications
-	admin.Methods("POST").Path("/notifications").HandlerFunc(AdminSendNotifications)
+	{"POST", "/notifications", auth.PermNotificationsSend, AdminSendNotifications},
+
+	// Audit log
+	{"GET", "/audit", auth.PermAuditRead, requireMFA(AdminAudit)},
+	{"POST", "/reports/audit", auth.PermAuditRead, requireMFA(AdminReportAuditExcel)},
+}
+
+// AdminSubRouter adds end points for admin, and appropriate middleware. Each route is checked against the
+// permissions in the admin token, see adminRoutes.
+func AdminSubRouter(prefix string) *mux.Router {
+
+	r := mux.NewRouter().StrictSlash(true)
+	admin := r.PathPrefix(prefix).Subrouter()
+
+	for _, ar := range adminRoutes {
+		h := ar.Handler
+		if ar.Permission != "" {
+			h = requirePermission(ar.Permission, h)
+		}
+		admin.Methods(ar.Method).Path(ar.Path).HandlerFunc(h)
+	}
 
 	return admin
 }
@@ -84,6 +150,8 @@ func AdminMiddleware(r *mux.Router) *negroni.Negroni {
 	n.Use(recovery)
 	n.Use(negroni.HandlerFunc(ValidateToken))
 	n.Use(negroni.HandlerFunc(AdminScope))
+	n.Use(negroni.HandlerFunc(AdminMFA))
+	n.Use(negroni.HandlerFunc(Audit))
 	n.Use(negroni.NewLogger())
 	n.Use(negroni.Wrap(r))
 
@@ -148,12 +216,27 @@ func MemberSubRouter(prefix string) *mux.Router {
 	members.Methods("GET").Path("/token").HandlerFunc(MembersToken)
 	members.Methods("OPTIONS").Path("/token").HandlerFunc(Preflight)
 	members.Methods("GET").Path("/profile").HandlerFunc(MembersProfile)
+	members.Methods("PATCH").Path("/profile").HandlerFunc(MembersProfileUpdate)
+	members.Methods("OPTIONS").Path("/profile").HandlerFunc(Preflight)
+	members.Methods("PUT").Path("/email").HandlerFunc(notImpersonated(MembersEmail))
 
 	members.Methods("GET").Path("/activities").HandlerFunc(MembersActivities)
 	members.Methods("POST").Path("/activities").HandlerFunc(MembersActivitiesAdd)
 
+	// Import from a CSV or iCalendar file, previewed before it is committed
+	members.Methods("POST").Path("/activities/import").HandlerFunc(MembersActivitiesImport)
+	members.Methods("OPTIONS").Path("/activities/import").HandlerFunc(Preflight)
+	members.Methods("GET").Path("/activities/export").HandlerFunc(MembersActivitiesExport)
+
 	members.Methods("GET").Path("/activities/{id:[0-9]+}").HandlerFunc(MembersActivitiesID)
 	members.Methods("PUT").Path("/activities/{id:[0-9]+}").HandlerFunc(MembersActivitiesUpdate)
+	members.Methods("DELETE").Path("/activities/{id:[0-9]+}").HandlerFunc(MembersActivitiesDelete)
+	members.Methods("OPTIONS").Path("/activities/{id:[0-9]+}").HandlerFunc(Preflight)
+
+	// Deleted activities can be restored until they are purged
+	members.Methods("GET").Path("/activities/deleted").HandlerFunc(MembersActivitiesDeleted)
+	members.Methods("POST").Path("/activities/{id:[0-9]+}/restore").HandlerFunc(MembersActivitiesRestore)
+	members.Methods("OPTIONS").Path("/activities/{id:[0-9]+}/restore").HandlerFunc(Preflight)
 
 	// Attachments
 	members.Methods("OPTIONS").Path("/activities/{id:[0-9]+}/attachments/request").HandlerFunc(Preflight)
@@ -170,6 +253,11 @@ func MemberSubRouter(prefix string) *mux.Router {
 	members.Methods("OPTIONS").Path("/activities/recurring/{_id}/recorder").HandlerFunc(Preflight)
 	members.Methods("POST").Path("/activities/recurring/{_id}/recorder").HandlerFunc(MembersActivitiesRecurringRecorder)
 
+	// Catch up on missed occurrences, in bulk
+	members.Methods("GET").Path("/activities/recurring/{_id}/due").HandlerFunc(MembersActivitiesRecurringDue)
+	members.Methods("OPTIONS").Path("/activities/recurring/{_id}/catchup").HandlerFunc(Preflight)
+	members.Methods("POST").Path("/activities/recurring/{_id}/catchup").HandlerFunc(MembersActivitiesRecurringCatchUp)
+
 	members.Methods("GET").Path("/evaluations").HandlerFunc(MembersEvaluation)
 
 	members.Methods("POST").Path("/notifications").HandlerFunc(MemberSendNotification)
@@ -192,6 +280,7 @@ func MemberMiddleware(r *mux.Router) *negroni.Negroni {
 	n.Use(recovery)
 	n.Use(negroni.HandlerFunc(ValidateToken))
 	n.Use(negroni.HandlerFunc(MemberScope))
+	n.Use(negroni.HandlerFunc(Audit))
 	n.Use(negroni.NewLogger())
 	n.Use(negroni.Wrap(r))
 
@@ -57,7 +57,7 @@ func Router(ds datastore.Datastore) http.Handler {
 	r.PathPrefix(v1GeneralBase).Handler(rGeneralMiddleware)
 
 	// GraphQL
-	rGraphQL := graphql.Server(ds)
+	rGraphQL := graphql.Server(ds, clientIP)
 	r.PathPrefix(graphQLBase).Handler(rGraphQL)
 
 	// CORS handler - needed to add OptionsPassThrough for preflight requests which use OPTIONS http method
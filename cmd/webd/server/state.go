@@ -0,0 +1,88 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cardiacsociety/web-services/internal/member"
+	"github.com/gorilla/mux"
+)
+
+// AdminMembersState responds with the membership status and title of a member as at the date in the query
+// parameter date, in the format yyyy-mm-dd, which defaults to today
+func AdminMembersState(w http.ResponseWriter, r *http.Request) {
+
+	p := NewResponder()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	date, err := stateDate(r.URL.Query().Get("date"))
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	s, err := member.StateAt(DS, id, date)
+	switch {
+	case err == sql.ErrNoRows:
+		p.Message = Message{http.StatusNotFound, "failed", err.Error()}
+	case err != nil:
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+	default:
+		p.Message = Message{http.StatusOK, "success", "Data retrieved from MySQL"}
+		p.Data = s
+	}
+	p.Send(w)
+}
+
+// AdminMembersCounts responds with the number of members with each title and status as at the date in the
+// query parameter date, in the format yyyy-mm-dd, which defaults to today
+func AdminMembersCounts(w http.ResponseWriter, r *http.Request) {
+
+	p := NewResponder()
+
+	date, err := stateDate(r.URL.Query().Get("date"))
+	if err != nil {
+		p.Message = Message{http.StatusBadRequest, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	xc, err := member.CountsAt(DS, date)
+	if err != nil {
+		p.Message = Message{http.StatusInternalServerError, "failed", err.Error()}
+		p.Send(w)
+		return
+	}
+
+	var total int
+	for _, c := range xc {
+		total += c.Count
+	}
+
+	p.Message = Message{http.StatusOK, "success", "Data retrieved from MySQL"}
+	p.Meta = map[string]interface{}{"date": date.Format("2006-01-02"), "total": total}
+	p.Data = xc
+	p.Send(w)
+}
+
+// stateDate parses a date in the format yyyy-mm-dd, and returns today if it is empty
+func stateDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Now(), nil
+	}
+	d, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return d, errors.New("date should be in the format yyyy-mm-dd")
+	}
+	return d, nil
+}
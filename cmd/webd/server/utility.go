@@ -24,7 +24,7 @@ func queryParams(s string) (map[string]interface{}, error) {
 		fv := strings.Split(v, ":")
 
 		//if we don't get 2 decent strings then the param is malformed
-		if len(fv[0]) < 1 || len(fv[1]) < 1 {
+		if len(fv) != 2 || len(fv[0]) < 1 || len(fv[1]) < 1 {
 			return q, errors.New("query parameters incorrect - should be ?q=name1:value1,name2:value2 etc")
 		}
 
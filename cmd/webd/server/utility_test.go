@@ -0,0 +1,30 @@
+package server
+
+import "testing"
+
+func TestQueryParams(t *testing.T) {
+
+	cases := []struct {
+		arg   string
+		valid bool
+	}{
+		{"all", true},
+		{"name:smith", true},
+		{"name:smith,id:1", true},
+		{"name", false},
+		{"name:", false},
+		{":smith", false},
+		{"name:smith,id", false},
+		{"time:10:30", false},
+	}
+
+	for _, c := range cases {
+		_, err := queryParams(c.arg)
+		if c.valid && err != nil {
+			t.Errorf("queryParams(%q) err = %s", c.arg, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("queryParams(%q) err = nil, want an error", c.arg)
+		}
+	}
+}
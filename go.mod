@@ -25,6 +25,7 @@ require (
 	github.com/leodido/go-urn v1.1.0 // indirect
 	github.com/mailgun/mailgun-go/v3 v3.3.3 // indirect
 	github.com/mailru/easyjson v0.0.0-20190403194419-1ea4449da983 // indirect
+	github.com/matryer/is v1.4.1
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/pkg/errors v0.8.1
 	github.com/rogpeppe/go-internal v1.3.0 // indirect
@@ -32,9 +33,7 @@ require (
 	github.com/sendgrid/sendgrid-go v3.4.1+incompatible
 	github.com/stretchr/objx v0.2.0 // indirect
 	github.com/urfave/negroni v1.0.0
-	golang.org/x/crypto v0.0.0-20190411191339-88737f569e3a // indirect
-	golang.org/x/net v0.0.0-20190415214537-1da14a5a36f2 // indirect
-	golang.org/x/sys v0.0.0-20190415145633-3fd5a3612ccd // indirect
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
 	gopkg.in/go-playground/validator.v9 v9.28.0
 	gopkg.in/mgo.v2 v2.0.0-20180705113604-9856a29383ce
 )
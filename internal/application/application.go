@@ -4,7 +4,6 @@ package application
 import (
 	"database/sql"
 	"fmt"
-	"strings"
 	"time"
 
 	"github.com/cardiacsociety/web-services/internal/platform/datastore"
@@ -31,8 +30,7 @@ type Application struct {
 // ByID fetches an application record by id. This returns an error if no result is found.
 func ByID(ds datastore.Datastore, applicationID int) (Application, error) {
 	var a Application
-	q := fmt.Sprintf(queries["select-application-by-id"], applicationID)
-	r, err := execute(ds, q)
+	r, err := execute(ds, queries["select-application-by-id"], applicationID)
 	if err != nil {
 		return a, err
 	}
@@ -45,27 +43,27 @@ func ByID(ds datastore.Datastore, applicationID int) (Application, error) {
 
 // ByIDs fetches a set of applications by IDs.
 func ByIDs(ds datastore.Datastore, applicationIDs []int) ([]Application, error) {
-	idList := strings.Trim(strings.Join(strings.Fields(fmt.Sprint(applicationIDs)), ","), "[]")
-	clause := fmt.Sprintf(" AND ma.id IN (%s)", idList)
-	return Query(ds, clause)
+	return Query(ds, datastore.NewClause().In("ma.id", applicationIDs))
 }
 
 // ByMemberID fetches application records by member id. This does not return an error if no results are found, only an empty slice.
 func ByMemberID(ds datastore.Datastore, memberID int) ([]Application, error) {
-	q := fmt.Sprintf(queries["select-applications-by-memberid"], memberID)
-	return execute(ds, q)
+	return execute(ds, queries["select-applications-by-memberid"], memberID)
 }
 
-// Query runs a select query with the given clause
-func Query(ds datastore.Datastore, clause string) ([]Application, error) {
-	q := fmt.Sprintf(queries["select-applications"]+" %s", clause)
-	return execute(ds, q)
+// Query runs a select query with the filter clause c, which may be nil
+func Query(ds datastore.Datastore, c *datastore.Clause) ([]Application, error) {
+	clause, args, err := c.And()
+	if err != nil {
+		return nil, err
+	}
+	return execute(ds, queries["select-applications"]+" "+clause, args...)
 }
 
-func execute(ds datastore.Datastore, query string) ([]Application, error) {
+func execute(ds datastore.Datastore, query string, args ...interface{}) ([]Application, error) {
 	var xa []Application
 
-	rows, err := ds.MySQL.Session.Query(query)
+	rows, err := ds.MySQL.Session.Query(query, args...)
 	if err != nil {
 		return xa, fmt.Errorf("Query() err = %s", err)
 	}
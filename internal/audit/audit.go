@@ -0,0 +1,235 @@
+// Package audit records the mutating requests made to the api, by admins and members, so that there is a
+// trail of who did what, to which records, and when
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+)
+
+// Entry is a single audited request
+type Entry struct {
+	ID        int       `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	ActorID   int       `json:"actorId"`
+	ActorName string    `json:"actorName"`
+	Role      string    `json:"role"`
+	// AdminID is set when the actor is a member and the request was made by an admin viewing the system as
+	// the member
+	AdminID    int      `json:"adminId,omitempty"`
+	Method     string   `json:"method"`
+	Path       string   `json:"path"`
+	BodyDigest string   `json:"bodyDigest"`
+	Status     int      `json:"status"`
+	IP         string   `json:"ip"`
+	Entities   []Entity `json:"entities"`
+}
+
+// Entity identifies a record that was the target of a request, such as member 123. The type is the name of
+// the resource in the api path, eg "members", "notes".
+type Entity struct {
+	Type string `json:"type"`
+	ID   int    `json:"id"`
+}
+
+// Filter selects entries for Query. Zero values are ignored, so a zero Limit returns all of the matching
+// entries. Offset skips that many of the most recent entries, for paging through them with Limit.
+type Filter struct {
+	ActorID    int       `json:"actorId"`
+	Role       string    `json:"role"`
+	EntityType string    `json:"entityType"`
+	EntityID   int       `json:"entityId"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	Limit      int       `json:"limit"`
+	Offset     int       `json:"offset"`
+}
+
+// contextKey is unexported to prevent collisions with context keys defined in other packages
+type contextKey int
+
+// entryKey is the context key for the Entry being recorded for a request
+const entryKey contextKey = 0
+
+// NewContext returns a copy of ctx that carries the Entry being recorded for a request, so that handlers can
+// add the entities that were targeted, see AddEntity
+func NewContext(ctx context.Context, e *Entry) context.Context {
+	return context.WithValue(ctx, entryKey, e)
+}
+
+// AddEntity adds target entities to the Entry carried by ctx. It does nothing if the request is not being
+// audited, so handlers can call it regardless.
+func AddEntity(ctx context.Context, entityType string, ids ...int) {
+	e, ok := ctx.Value(entryKey).(*Entry)
+	if !ok {
+		return
+	}
+	for _, id := range ids {
+		e.Entities = append(e.Entities, Entity{Type: entityType, ID: id})
+	}
+}
+
+// Digest returns the hex SHA-256 digest of a request body, so that the content of a request can be matched
+// later without storing personal information in the log
+func Digest(body []byte) string {
+	xb := sha256.Sum256(body)
+	return hex.EncodeToString(xb[:])
+}
+
+// PathEntities returns the entities identified in an api path, being each resource name that is followed by
+// a numeric id. For example, /v1/a/members/123/notes/45 targets members 123 and notes 45.
+func PathEntities(path string) []Entity {
+	var xe []Entity
+	xs := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 1; i < len(xs); i++ {
+		id, err := strconv.Atoi(xs[i])
+		if err != nil || xs[i-1] == "" {
+			continue
+		}
+		if _, err := strconv.Atoi(xs[i-1]); err == nil {
+			continue
+		}
+		xe = append(xe, Entity{Type: xs[i-1], ID: id})
+	}
+	return xe
+}
+
+// Record saves an Entry and its entities
+func Record(ds datastore.Datastore, e Entry) error {
+
+	var adminID interface{}
+	if e.AdminID > 0 {
+		adminID = e.AdminID
+	}
+
+	res, err := ds.MySQL.Session.Exec(queries["insert-audit"],
+		e.ActorID, e.ActorName, e.Role, adminID, e.Method, e.Path, e.BodyDigest, e.Status, e.IP)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for _, en := range e.Entities {
+		_, err := ds.MySQL.Session.Exec(queries["insert-audit-entity"], id, en.Type, en.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Query returns the entries that match the filter, most recent first
+func Query(ds datastore.Datastore, f Filter) ([]Entry, error) {
+
+	query := queries["select-audit"]
+	c := datastore.NewClause()
+	if f.ActorID > 0 {
+		c.Equal("a.actor_id", f.ActorID)
+	}
+	if f.Role != "" {
+		c.Equal("a.role", f.Role)
+	}
+	if f.EntityType != "" || f.EntityID > 0 {
+		query = queries["select-audit-by-entity"]
+		if f.EntityType != "" {
+			c.Equal("e.entity", f.EntityType)
+		}
+		if f.EntityID > 0 {
+			c.Equal("e.entity_id", f.EntityID)
+		}
+	}
+	if !f.From.IsZero() {
+		c.GreaterOrEqual("a.created_at", f.From.Format("2006-01-02 15:04:05"))
+	}
+	if !f.To.IsZero() {
+		c.LessThan("a.created_at", f.To.Format("2006-01-02 15:04:05"))
+	}
+	c.OrderBy("a.id", true).Limit(f.Limit).Offset(f.Offset)
+
+	clause, args, err := c.And()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := ds.MySQL.Session.Query(query+" "+clause, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Query() err = %s", err)
+	}
+	defer rows.Close()
+
+	var xe []Entry
+	for rows.Next() {
+		var e Entry
+		var createdAt string
+		err := rows.Scan(&e.ID, &createdAt, &e.ActorID, &e.ActorName, &e.Role, &e.AdminID, &e.Method, &e.Path,
+			&e.BodyDigest, &e.Status, &e.IP)
+		if err != nil {
+			return nil, err
+		}
+		e.CreatedAt, err = time.Parse("2006-01-02 15:04:05", createdAt)
+		if err != nil {
+			return nil, err
+		}
+		xe = append(xe, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	err = entities(ds, xe)
+	if err != nil {
+		return nil, fmt.Errorf("entities() err = %s", err)
+	}
+
+	return xe, nil
+}
+
+// entities fetches the target entities for all of the entries with a single query
+func entities(ds datastore.Datastore, xe []Entry) error {
+
+	if len(xe) == 0 {
+		return nil
+	}
+
+	ids := make([]int, len(xe))
+	index := make(map[int]*Entry, len(xe))
+	for i := range xe {
+		ids[i] = xe[i].ID
+		index[xe[i].ID] = &xe[i]
+	}
+
+	clause, args, err := datastore.NewClause().In("log_audit_id", ids).OrderBy("id", false).Where()
+	if err != nil {
+		return err
+	}
+
+	rows, err := ds.MySQL.Session.Query(queries["select-audit-entities"]+" "+clause, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var e Entity
+		if err := rows.Scan(&id, &e.Type, &e.ID); err != nil {
+			return err
+		}
+		if en, ok := index[id]; ok {
+			en.Entities = append(en.Entities, e)
+		}
+	}
+
+	return rows.Err()
+}
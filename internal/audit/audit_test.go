@@ -0,0 +1,182 @@
+package audit_test
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cardiacsociety/web-services/internal/audit"
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+	"github.com/cardiacsociety/web-services/testdata"
+)
+
+var ds datastore.Datastore
+
+func TestAll(t *testing.T) {
+
+	var teardown func()
+	ds, teardown = setup()
+	defer teardown()
+
+	t.Run("audit", func(t *testing.T) {
+		t.Run("testPingDatabase", testPingDatabase)
+		t.Run("testRecord", testRecord)
+		t.Run("testQueryByEntity", testQueryByEntity)
+		t.Run("testQueryByDate", testQueryByDate)
+		t.Run("testQueryLimit", testQueryLimit)
+	})
+}
+
+func setup() (datastore.Datastore, func()) {
+	var db = testdata.NewDataStore()
+	err := db.SetupMySQL()
+	if err != nil {
+		log.Fatalf("db.SetupMySQL() err = %s", err)
+	}
+	return db.Store, func() {
+		err := db.TearDownMySQL()
+		if err != nil {
+			log.Fatalf("db.TearDownMySQL() err = %s", err)
+		}
+	}
+}
+
+func testPingDatabase(t *testing.T) {
+	err := ds.MySQL.Session.Ping()
+	if err != nil {
+		t.Fatalf("Ping() err = %s", err)
+	}
+}
+
+func testRecord(t *testing.T) {
+	e := audit.Entry{
+		ActorID:    1,
+		ActorName:  "Demo Admin",
+		Role:       "admin",
+		Method:     "PUT",
+		Path:       "/v1/a/lapsedmembers",
+		BodyDigest: audit.Digest([]byte("[1, 2]")),
+		Status:     200,
+		IP:         "10.0.0.1",
+		Entities:   []audit.Entity{{Type: "members", ID: 1}, {Type: "members", ID: 2}},
+	}
+	err := audit.Record(ds, e)
+	if err != nil {
+		t.Fatalf("audit.Record() err = %s", err)
+	}
+
+	xe, err := audit.Query(ds, audit.Filter{ActorID: 1, Role: "admin"})
+	if err != nil {
+		t.Fatalf("audit.Query() err = %s", err)
+	}
+	if len(xe) != 1 {
+		t.Fatalf("audit.Query() returned %d entries, want 1", len(xe))
+	}
+	got := xe[0]
+	if got.Path != e.Path || got.BodyDigest != e.BodyDigest || got.Status != e.Status || got.AdminID != 0 {
+		t.Errorf("audit.Query() = %+v, want %+v", got, e)
+	}
+	if !reflect.DeepEqual(got.Entities, e.Entities) {
+		t.Errorf("audit.Query() entities = %v, want %v", got.Entities, e.Entities)
+	}
+}
+
+func testQueryByEntity(t *testing.T) {
+	e := audit.Entry{
+		ActorID:   1,
+		ActorName: "Michael Donnici",
+		Role:      "member",
+		AdminID:   1,
+		Method:    "PUT",
+		Path:      "/v1/m/activities/5",
+		Status:    200,
+		Entities:  []audit.Entity{{Type: "activities", ID: 5}},
+	}
+	err := audit.Record(ds, e)
+	if err != nil {
+		t.Fatalf("audit.Record() err = %s", err)
+	}
+
+	cases := []struct {
+		filter audit.Filter
+		want   int
+	}{
+		{audit.Filter{EntityType: "members", EntityID: 2}, 1},
+		{audit.Filter{EntityType: "members"}, 1},
+		{audit.Filter{EntityType: "activities", EntityID: 5}, 1},
+		{audit.Filter{EntityType: "activities", EntityID: 6}, 0},
+		{audit.Filter{Role: "member", ActorID: 1}, 1},
+	}
+	for _, c := range cases {
+		xe, err := audit.Query(ds, c.filter)
+		if err != nil {
+			t.Fatalf("audit.Query(%+v) err = %s", c.filter, err)
+		}
+		if len(xe) != c.want {
+			t.Errorf("audit.Query(%+v) returned %d entries, want %d", c.filter, len(xe), c.want)
+		}
+	}
+}
+
+func testQueryByDate(t *testing.T) {
+	xe, err := audit.Query(ds, audit.Filter{From: time.Now().Add(24 * time.Hour)})
+	if err != nil {
+		t.Fatalf("audit.Query() err = %s", err)
+	}
+	if len(xe) != 0 {
+		t.Errorf("audit.Query() returned %d entries from tomorrow, want 0", len(xe))
+	}
+}
+
+func testQueryLimit(t *testing.T) {
+	xe, err := audit.Query(ds, audit.Filter{Limit: 1})
+	if err != nil {
+		t.Fatalf("audit.Query() err = %s", err)
+	}
+	if len(xe) != 1 || xe[0].Path != "/v1/m/activities/5" {
+		t.Fatalf("audit.Query() with limit 1 = %+v, want the most recent entry", xe)
+	}
+
+	// the entry before it, with its entities
+	xe, err = audit.Query(ds, audit.Filter{Limit: 1, Offset: 1})
+	if err != nil {
+		t.Fatalf("audit.Query() err = %s", err)
+	}
+	if len(xe) != 1 || xe[0].Path != "/v1/a/lapsedmembers" || len(xe[0].Entities) != 2 {
+		t.Errorf("audit.Query() with offset 1 = %+v, want the first entry with 2 entities", xe)
+	}
+}
+
+func TestPathEntities(t *testing.T) {
+	cases := []struct {
+		path string
+		want []audit.Entity
+	}{
+		{"/v1/a/lapsedmembers", nil},
+		{"/v1/a/members/123", []audit.Entity{{Type: "members", ID: 123}}},
+		{"/v1/a/notes/45/attachments", []audit.Entity{{Type: "notes", ID: 45}}},
+		{"/v1/a/members/123/notes/45/", []audit.Entity{{Type: "members", ID: 123}, {Type: "notes", ID: 45}}},
+		{"/v1/m/reports/cpd/2019", []audit.Entity{{Type: "cpd", ID: 2019}}},
+	}
+	for _, c := range cases {
+		got := audit.PathEntities(c.path)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("audit.PathEntities(%q) = %v, want %v", c.path, got, c.want)
+		}
+	}
+}
+
+func TestAddEntity(t *testing.T) {
+	// does nothing when the request is not being audited
+	audit.AddEntity(context.Background(), "members", 1)
+
+	e := &audit.Entry{}
+	ctx := audit.NewContext(context.Background(), e)
+	audit.AddEntity(ctx, "members", 1, 2)
+	want := []audit.Entity{{Type: "members", ID: 1}, {Type: "members", ID: 2}}
+	if !reflect.DeepEqual(e.Entities, want) {
+		t.Errorf("audit.AddEntity() entities = %v, want %v", e.Entities, want)
+	}
+}
@@ -0,0 +1,39 @@
+package audit
+
+var queries = map[string]string{
+	"insert-audit":           insertAudit,
+	"insert-audit-entity":    insertAuditEntity,
+	"select-audit":           selectAudit,
+	"select-audit-by-entity": selectAuditByEntity,
+	"select-audit-entities":  selectAuditEntities,
+}
+
+const insertAudit = `
+INSERT INTO log_audit (created_at, actor_id, actor_name, role, ad_user_id, method, path, body_digest, status, ip)
+VALUES (NOW(), ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+const insertAuditEntity = `
+INSERT INTO log_audit_entity (log_audit_id, entity, entity_id) VALUES (?, ?, ?)`
+
+const selectAuditFields = `
+SELECT DISTINCT
+  a.id,
+  a.created_at,
+  a.actor_id,
+  a.actor_name,
+  a.role,
+  COALESCE(a.ad_user_id, 0),
+  a.method,
+  a.path,
+  a.body_digest,
+  a.status,
+  a.ip
+FROM log_audit a`
+
+const selectAudit = selectAuditFields + ` WHERE 1`
+
+const selectAuditByEntity = selectAuditFields + `
+  INNER JOIN log_audit_entity e ON e.log_audit_id = a.id
+WHERE 1`
+
+const selectAuditEntities = `SELECT log_audit_id, entity, entity_id FROM log_audit_entity`
@@ -0,0 +1,71 @@
+package audit
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/360EntSecGroup-Skylar/excelize"
+	"github.com/cardiacsociety/web-services/internal/platform/excel"
+)
+
+// ExcelReport returns an excel audit log report File
+func ExcelReport(entries []Entry) (*excelize.File, error) {
+
+	f := excel.New([]string{
+		"ID",
+		"Time",
+		"Actor",
+		"Role",
+		"Admin ID",
+		"Method",
+		"Path",
+		"Entities",
+		"Status",
+		"IP",
+		"Body digest",
+	})
+
+	for _, e := range entries {
+
+		var xs []string
+		for _, en := range e.Entities {
+			xs = append(xs, en.Type+" "+strconv.Itoa(en.ID))
+		}
+
+		var adminID interface{}
+		if e.AdminID > 0 {
+			adminID = e.AdminID
+		}
+
+		data := []interface{}{
+			e.ID,
+			e.CreatedAt,
+			e.ActorName + " [" + strconv.Itoa(e.ActorID) + "]",
+			e.Role,
+			adminID,
+			e.Method,
+			e.Path,
+			strings.Join(xs, ", "),
+			e.Status,
+			e.IP,
+			e.BodyDigest,
+		}
+		err := f.AddRow(data)
+		if err != nil {
+			msg := fmt.Sprintf("AddRow() err = %s", err)
+			log.Printf(msg)
+			f.AddError(e.ID, msg)
+		}
+	}
+
+	// style
+	f.SetColStyleByHeading("Time", `{"custom_number_format": "dd mmm yyyy hh:mm:ss"}`)
+	f.SetColWidthByHeading("Time", 20)
+	f.SetColWidthByHeading("Actor", 24)
+	f.SetColWidthByHeading("Path", 36)
+	f.SetColWidthByHeading("Entities", 24)
+
+	return f.XLSX, nil
+}
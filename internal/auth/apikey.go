@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/cardiacsociety/web-services/internal/date"
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+	"github.com/pkg/errors"
+)
+
+// APIKeyPrefix starts every API key, so that a key can be told apart from a JWT
+const APIKeyPrefix = "mk_"
+
+// ErrInvalidAPIKey is returned when an API key is unknown, has expired or has been revoked
+var ErrInvalidAPIKey = errors.New("api key is invalid, has expired or has been revoked")
+
+// APIKey is a key issued to a service account, such as one of the worker services, that is used in place of
+// an admin login. The key itself is only available when it is created, as only a hash is stored. The hint
+// is the start of the key, to help identify it.
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Key        string     `json:"key,omitempty"`
+	Hint       string     `json:"hint"`
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  int        `json:"createdBy"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+}
+
+// NewAPIKey creates an API key with the scopes, on behalf of the admin identified by adminID. The key
+// expires after the number of days, or never if days is 0. The returned value includes the key, which is
+// not available again.
+func NewAPIKey(ds datastore.Datastore, name string, scopes []string, days int, adminID int) (APIKey, error) {
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return APIKey{}, errors.New("api key requires a name")
+	}
+	if len(scopes) == 0 {
+		return APIKey{}, errors.New("api key requires at least one scope")
+	}
+	for _, s := range scopes {
+		if s == "" || strings.Contains(s, ",") {
+			return APIKey{}, errors.New("invalid scope: " + s)
+		}
+	}
+	if days < 0 {
+		return APIKey{}, errors.New("api key expiry cannot be in the past")
+	}
+
+	key, hint, err := newAPIKeyString()
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	var expiry interface{}
+	if days > 0 {
+		expiry = days
+	}
+	res, err := ds.MySQL.Session.Exec(queries["insert-api-key"], expiry, name, hint, hashToken(key), strings.Join(scopes, ","), adminID)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	return createdAPIKey(ds, res, key)
+}
+
+// RotateAPIKey replaces an API key with a new key that has the same name, scopes and expiry, and revokes
+// the old key, on behalf of the admin identified by adminID. Both are done in one transaction, so a key
+// cannot be rotated twice at the same time. The returned value includes the new key, which is not available
+// again.
+func RotateAPIKey(ds datastore.Datastore, id int, adminID int) (APIKey, error) {
+
+	key, hint, err := newAPIKeyString()
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	var newID int64
+	err = ds.MySQL.InTx(func(ex datastore.Execer) error {
+
+		res, err := ex.Exec(queries["insert-api-key-rotation"], hint, hashToken(key), adminID, id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n != 1 {
+			return sql.ErrNoRows
+		}
+		newID, err = res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		res, err = ex.Exec(queries["revoke-api-key"], newID, id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n != 1 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	k, err := APIKeyByID(ds, int(newID))
+	k.Key = key
+	return k, err
+}
+
+// RevokeAPIKey revokes an API key so it cannot be used again
+func RevokeAPIKey(ds datastore.Datastore, id int) error {
+	res, err := ds.MySQL.Session.Exec(queries["revoke-api-key"], nil, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// APIKeyByID fetches an API key, without the key itself
+func APIKeyByID(ds datastore.Datastore, id int) (APIKey, error) {
+	return scanAPIKey(ds.MySQL.Session.QueryRow(queries["select-api-key"], id))
+}
+
+// APIKeys fetches all API keys, without the keys themselves
+func APIKeys(ds datastore.Datastore) ([]APIKey, error) {
+
+	rows, err := ds.MySQL.Session.Query(queries["select-api-keys"])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var xk []APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		xk = append(xk, k)
+	}
+
+	return xk, rows.Err()
+}
+
+// CheckAPIKey returns the id, name and scopes of the API key presented with a request, and records the time
+// it was used. A key that is unknown, has expired or has been revoked returns ErrInvalidAPIKey.
+func CheckAPIKey(ds datastore.Datastore, key string) (APIKey, error) {
+
+	var k APIKey
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return k, ErrInvalidAPIKey
+	}
+
+	var scopes string
+	var valid bool
+	err := ds.MySQL.Session.QueryRow(queries["select-api-key-by-hash"], hashToken(key)).Scan(&k.ID, &k.Name, &scopes, &valid)
+	if err == sql.ErrNoRows || (err == nil && !valid) {
+		return k, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return k, err
+	}
+	k.Scopes = strings.Split(scopes, ",")
+
+	_, err = ds.MySQL.Session.Exec(queries["update-api-key-used"], k.ID)
+	return k, err
+}
+
+// newAPIKeyString returns a new random API key, and the hint used to identify it
+func newAPIKeyString() (string, string, error) {
+	xb := make([]byte, 32)
+	if _, err := rand.Read(xb); err != nil {
+		return "", "", err
+	}
+	key := APIKeyPrefix + base64.RawURLEncoding.EncodeToString(xb)
+	return key, key[:len(APIKeyPrefix)+4], nil
+}
+
+// createdAPIKey fetches the record for a key that has just been inserted, and adds the key itself
+func createdAPIKey(ds datastore.Datastore, res sql.Result, key string) (APIKey, error) {
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return APIKey{}, err
+	}
+	k, err := APIKeyByID(ds, int(id))
+	k.Key = key
+	return k, err
+}
+
+// scanAPIKey scans a row from one of the api key select queries
+func scanAPIKey(row interface {
+	Scan(dest ...interface{}) error
+}) (APIKey, error) {
+
+	var k APIKey
+	var scopes, createdAt string
+	var expiresAt, lastUsedAt, revokedAt sql.NullString
+	err := row.Scan(&k.ID, &k.Name, &k.Hint, &scopes, &k.CreatedBy, &createdAt, &expiresAt, &lastUsedAt, &revokedAt)
+	if err != nil {
+		return k, err
+	}
+	k.Scopes = strings.Split(scopes, ",")
+
+	k.CreatedAt, err = date.StringToTime(createdAt)
+	if err != nil {
+		return k, err
+	}
+	for _, t := range []struct {
+		s sql.NullString
+		p **time.Time
+	}{{expiresAt, &k.ExpiresAt}, {lastUsedAt, &k.LastUsedAt}, {revokedAt, &k.RevokedAt}} {
+		if !t.s.Valid {
+			continue
+		}
+		v, err := date.StringToTime(t.s.String)
+		if err != nil {
+			return k, err
+		}
+		*t.p = &v
+	}
+
+	return k, nil
+}
@@ -1,39 +1,180 @@
 package auth
 
 import (
-	"fmt"
+	"database/sql"
+	"log"
+	"time"
 
 	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+	"github.com/cardiacsociety/web-services/internal/platform/jwt"
+	"github.com/pkg/errors"
 )
 
-// AuthMember checks login & pass against db. Check for md5() or encrypted string.
-// Latter is a workaround to allow the old member app to get a token for file uploads.
-func AuthMember(ds datastore.Datastore, u, p string) (int, string, error) {
+// maxExchangeTTL is the longest validity period accepted for a token presented for exchange
+const maxExchangeTTL = time.Hour
+
+// ErrAccountInactive is returned when the credentials are correct but the account has been deactivated
+var ErrAccountInactive = errors.New("account is not active")
 
-	query := `SELECT id, concat(first_name, ' ', last_name) as name
-		  FROM member WHERE primary_email = "%s" AND (password = MD5("%s") OR password = "%s")`
-	query = fmt.Sprintf(query, u, p, p)
+// ErrAccountLocked is returned when the credentials are correct but the account has been locked
+var ErrAccountLocked = errors.New("account is locked")
+
+// AuthMember checks login & pass against db. Passwords are stored as bcrypt hashes, legacy MD5
+// hashes are still accepted but are upgraded to bcrypt on a successful login.
+func AuthMember(ds datastore.Datastore, u, p string) (int, string, error) {
 
 	var id int
 	var name string
-	err := ds.MySQL.Session.QueryRow(query).Scan(&id, &name)
-	// Note: err == sql.ErrorNoRows for a failed login
-	return id, name, err
+	var hash string
+	err := ds.MySQL.Session.QueryRow(queries["select-member-auth"], u).Scan(&id, &name, &hash)
+	if err == sql.ErrNoRows {
+		checkDummyPassword(p)
+	}
+	if err != nil {
+		// Note: err == sql.ErrorNoRows for a failed login
+		return 0, "", err
+	}
+
+	match, legacy := checkPassword(hash, p)
+	if !match {
+		return 0, "", sql.ErrNoRows
+	}
+	if legacy {
+		if err := upgradePassword(ds, queries["update-member-password"], id, p); err != nil {
+			log.Printf("Could not upgrade password hash for member id %d - %s", id, err)
+		}
+	}
+
+	return id, name, nil
 }
 
 // AdminAuth authenticates an admin user against the db. It received username and password
-// strings and returns the id and name of the authenticated admin
+// strings and returns the id and name of the authenticated admin. An admin that is not active, or
+// has been locked, cannot be authenticated even with the correct password.
 func AdminAuth(ds datastore.Datastore, u, p string) (int, string, error) {
 
-	query := `SELECT id, name, active, locked FROM ad_user WHERE
-	          username = "%s" AND (password = MD5("%s") OR password = "%s")`
-	query = fmt.Sprintf(query, u, p, p)
-
 	var id int
 	var name string
 	var active int
 	var locked int
-	err := ds.MySQL.Session.QueryRow(query).Scan(&id, &name, &active, &locked)
+	var hash string
+	err := ds.MySQL.Session.QueryRow(queries["select-admin-auth"], u).Scan(&id, &name, &active, &locked, &hash)
+	if err == sql.ErrNoRows {
+		checkDummyPassword(p)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	match, legacy := checkPassword(hash, p)
+	if !match {
+		return 0, "", sql.ErrNoRows
+	}
+	if legacy {
+		if err := upgradePassword(ds, queries["update-admin-password"], id, p); err != nil {
+			log.Printf("Could not upgrade password hash for admin id %d - %s", id, err)
+		}
+	}
+
+	// Only disclose the state of the account once the password has been verified
+	if active != 1 {
+		return 0, "", ErrAccountInactive
+	}
+	if locked != 0 {
+		return 0, "", ErrAccountLocked
+	}
+
+	return id, name, nil
+}
+
+// ExchangeMember verifies a short-lived token issued to a member by a trusted application, such as the
+// legacy member app, and signed with the shared exchange key. It returns the id and name of the member
+// so that a regular member token can be issued in its place.
+func ExchangeMember(ds datastore.Datastore, token, key string) (int, string, error) {
+
+	if key == "" {
+		return 0, "", errors.New("token exchange is not configured")
+	}
 
+	t, err := jwt.Decode(token, key)
+	if err != nil {
+		return 0, "", err
+	}
+	if t.Claims.Role != "member" {
+		return 0, "", errors.New("token exchange is only available for member tokens")
+	}
+	if t.ExpiresAt.Sub(t.IssuedAt) > maxExchangeTTL {
+		return 0, "", errors.New("token presented for exchange must expire within " + maxExchangeTTL.String())
+	}
+
+	var id int
+	var name string
+	err = ds.MySQL.Session.QueryRow(queries["select-member-by-id"], t.Claims.ID).Scan(&id, &name)
 	return id, name, err
 }
+
+// upgradePassword replaces a legacy password hash with a bcrypt hash of the plain text password p,
+// using the update query for the relevant table
+func upgradePassword(ds datastore.Datastore, query string, id int, p string) error {
+
+	hash, err := HashPassword(p)
+	if err != nil {
+		return err
+	}
+
+	_, err = ds.MySQL.Session.Exec(query, hash, id)
+	return err
+}
+
+// WrapPasswords wraps the legacy MD5 password hashes of members and admin users in a bcrypt hash, so that
+// unsalted hashes are not left in the database for users who do not log in. Wrapped hashes are upgraded to
+// a plain bcrypt hash on the next successful login. It returns the number of passwords wrapped.
+func WrapPasswords(ds datastore.Datastore) (int, error) {
+
+	var n int
+	tables := []struct {
+		selectQuery string
+		updateQuery string
+	}{
+		{queries["select-member-md5-passwords"], queries["wrap-member-password"]},
+		{queries["select-admin-md5-passwords"], queries["wrap-admin-password"]},
+	}
+
+	for _, t := range tables {
+		hashes := map[int]string{}
+		rows, err := ds.MySQL.Session.Query(t.selectQuery)
+		if err != nil {
+			return n, err
+		}
+		for rows.Next() {
+			var id int
+			var hash string
+			if err := rows.Scan(&id, &hash); err != nil {
+				rows.Close()
+				return n, err
+			}
+			hashes[id] = hash
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return n, err
+		}
+
+		for id, hash := range hashes {
+			wrapped, err := wrapHash(hash)
+			if err != nil {
+				return n, err
+			}
+			// the hash is only replaced if it has not been upgraded by a login in the meantime
+			res, err := ds.MySQL.Session.Exec(t.updateQuery, wrapped, id, hash)
+			if err != nil {
+				return n, errors.Wrapf(err, "could not wrap password hash for id %d", id)
+			}
+			if c, _ := res.RowsAffected(); c > 0 {
+				n++
+			}
+		}
+	}
+
+	return n, nil
+}
@@ -3,10 +3,15 @@ package auth_test
 import (
 	"database/sql"
 	"log"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cardiacsociety/web-services/internal/auth"
 	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+	"github.com/cardiacsociety/web-services/internal/platform/jwt"
+	"github.com/cardiacsociety/web-services/internal/platform/totp"
 	"github.com/cardiacsociety/web-services/testdata"
 )
 
@@ -21,11 +26,45 @@ func TestAuth(t *testing.T) {
 	t.Run("auth", func(t *testing.T) {
 		t.Run("testPingDatabase", testPingDatabase)
 		t.Run("testAuthMemberClearPass", testAuthMemberClearPass)
-		t.Run("testAuthMemberMD5Pass", testAuthMemberMD5Pass)
+		t.Run("testAuthMemberHashUpgraded", testAuthMemberHashUpgraded)
+		t.Run("testAuthMemberStoredHashRejected", testAuthMemberStoredHashRejected)
+		t.Run("testWrapPasswords", testWrapPasswords)
 		t.Run("testAuthMemberFail", testAuthMemberFail)
+		t.Run("testAuthMemberInjection", testAuthMemberInjection)
 		t.Run("testAuthAdminClearPass", testAuthAdminClearPass)
-		t.Run("testAuthAdminMD5Pass", testAuthAdminMD5Pass)
+		t.Run("testAuthAdminHashUpgraded", testAuthAdminHashUpgraded)
+		t.Run("testAuthAdminStoredHashRejected", testAuthAdminStoredHashRejected)
 		t.Run("testAuthAdminFail", testAuthAdminFail)
+		t.Run("testAuthAdminInjection", testAuthAdminInjection)
+		t.Run("testAuthAdminInactive", testAuthAdminInactive)
+		t.Run("testAuthAdminLocked", testAuthAdminLocked)
+		t.Run("testLoginThrottle", testLoginThrottle)
+		t.Run("testLoginThrottleIP", testLoginThrottleIP)
+		t.Run("testExchangeMember", testExchangeMember)
+		t.Run("testExchangeMemberWrongKey", testExchangeMemberWrongKey)
+		t.Run("testExchangeMemberNotConfigured", testExchangeMemberNotConfigured)
+		t.Run("testRotateRefreshToken", testRotateRefreshToken)
+		t.Run("testRotateRefreshTokenReused", testRotateRefreshTokenReused)
+		t.Run("testRevokeAccessToken", testRevokeAccessToken)
+		t.Run("testRevokeAll", testRevokeAll)
+		t.Run("testForgotPasswordUnknown", testForgotPasswordUnknown)
+		t.Run("testResetRequestThrottle", testResetRequestThrottle)
+		t.Run("testResetPassword", testResetPassword)
+		t.Run("testResetPasswordSuperseded", testResetPasswordSuperseded)
+		t.Run("testResetPasswordExpired", testResetPasswordExpired)
+		t.Run("testResetPasswordTooShort", testResetPasswordTooShort)
+		t.Run("testChangeEmail", testChangeEmail)
+		t.Run("testChangeEmailInvalid", testChangeEmailInvalid)
+		t.Run("testMFA", testMFA)
+		t.Run("testMFARecoveryCode", testMFARecoveryCode)
+		t.Run("testLoginMFAThrottle", testLoginMFAThrottle)
+		t.Run("testLoginMFAFail", testLoginMFAFail)
+		t.Run("testAdminPermissions", testAdminPermissions)
+		t.Run("testAPIKey", testAPIKey)
+		t.Run("testAPIKeyRotate", testAPIKeyRotate)
+		t.Run("testAPIKeyRevoke", testAPIKeyRevoke)
+		t.Run("testAPIKeyExpired", testAPIKeyExpired)
+		t.Run("testImpersonation", testImpersonation)
 	})
 }
 
@@ -65,8 +104,17 @@ func testAuthMemberClearPass(t *testing.T) {
 	}
 }
 
-func testAuthMemberMD5Pass(t *testing.T) {
-	gotId, gotName, err := auth.AuthMember(ds, "michael@mesa.net.au", "5f4dcc3b5aa765d61d8327deb882cf99")
+func testAuthMemberHashUpgraded(t *testing.T) {
+	// testAuthMemberClearPass logged in with the legacy MD5 hash, which should now be bcrypt
+	var hash string
+	err := ds.MySQL.Session.QueryRow("SELECT password FROM member WHERE id = 1").Scan(&hash)
+	if err != nil {
+		t.Fatalf("QueryRow() err = %s", err)
+	}
+	if !strings.HasPrefix(hash, "$2") {
+		t.Errorf("member.password = %q, want bcrypt hash", hash)
+	}
+	gotId, _, err := auth.AuthMember(ds, "michael@mesa.net.au", "password")
 	if err != nil {
 		t.Fatalf("auth.AuthMember() err = %s", err)
 	}
@@ -74,9 +122,55 @@ func testAuthMemberMD5Pass(t *testing.T) {
 	if gotId != wantId {
 		t.Errorf("Auth.AuthMember() id = %d, want %d", gotId, wantId)
 	}
-	wantName := "Michael Donnici"
-	if gotName != wantName {
-		t.Errorf("Auth.AuthMember() name = %q, want %q", gotName, wantName)
+}
+
+func testAuthMemberStoredHashRejected(t *testing.T) {
+	_, _, err := auth.AuthMember(ds, "michael@mesa.net.au", "5f4dcc3b5aa765d61d8327deb882cf99")
+	if err != sql.ErrNoRows {
+		t.Errorf("auth.AuthMember() err = %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func testWrapPasswords(t *testing.T) {
+	// put back the legacy MD5 hash of 'password'
+	_, err := ds.MySQL.Session.Exec("UPDATE member SET password = '5f4dcc3b5aa765d61d8327deb882cf99' WHERE id = 1")
+	if err != nil {
+		t.Fatalf("Exec() err = %s", err)
+	}
+	n, err := auth.WrapPasswords(ds)
+	if err != nil {
+		t.Fatalf("auth.WrapPasswords() err = %s", err)
+	}
+	if n < 1 {
+		t.Errorf("auth.WrapPasswords() = %d, want at least 1", n)
+	}
+
+	var hash string
+	err = ds.MySQL.Session.QueryRow("SELECT password FROM member WHERE id = 1").Scan(&hash)
+	if err != nil {
+		t.Fatalf("QueryRow() err = %s", err)
+	}
+	if !strings.HasPrefix(hash, "md5$2") {
+		t.Errorf("member.password = %q, want wrapped MD5 hash", hash)
+	}
+	_, _, err = auth.AuthMember(ds, "michael@mesa.net.au", "5f4dcc3b5aa765d61d8327deb882cf99")
+	if err != sql.ErrNoRows {
+		t.Errorf("auth.AuthMember() with the MD5 hash err = %v, want %v", err, sql.ErrNoRows)
+	}
+
+	gotId, _, err := auth.AuthMember(ds, "michael@mesa.net.au", "password")
+	if err != nil {
+		t.Fatalf("auth.AuthMember() err = %s", err)
+	}
+	if gotId != 1 {
+		t.Errorf("Auth.AuthMember() id = %d, want %d", gotId, 1)
+	}
+	err = ds.MySQL.Session.QueryRow("SELECT password FROM member WHERE id = 1").Scan(&hash)
+	if err != nil {
+		t.Fatalf("QueryRow() err = %s", err)
+	}
+	if !strings.HasPrefix(hash, "$2") {
+		t.Errorf("member.password = %q, want bcrypt hash after login", hash)
 	}
 }
 
@@ -90,6 +184,13 @@ func testAuthMemberFail(t *testing.T) {
 	}
 }
 
+func testAuthMemberInjection(t *testing.T) {
+	_, _, err := auth.AuthMember(ds, `michael@mesa.net.au" OR "1"="1" -- `, "wrongPassword")
+	if err != sql.ErrNoRows {
+		t.Errorf("auth.AuthMember() err = %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
 func testAuthAdminClearPass(t *testing.T) {
 	gotId, gotName, err := auth.AdminAuth(ds, "demo-admin", "demo-admin")
 	if err != nil {
@@ -105,8 +206,17 @@ func testAuthAdminClearPass(t *testing.T) {
 	}
 }
 
-func testAuthAdminMD5Pass(t *testing.T) {
-	gotId, gotName, err := auth.AdminAuth(ds, "demo-admin", "41d0510a9067999b72f38ba0ce9f6195")
+func testAuthAdminHashUpgraded(t *testing.T) {
+	// testAuthAdminClearPass logged in with the legacy MD5 hash, which should now be bcrypt
+	var hash string
+	err := ds.MySQL.Session.QueryRow("SELECT password FROM ad_user WHERE id = 1").Scan(&hash)
+	if err != nil {
+		t.Fatalf("QueryRow() err = %s", err)
+	}
+	if !strings.HasPrefix(hash, "$2") {
+		t.Errorf("ad_user.password = %q, want bcrypt hash", hash)
+	}
+	gotId, _, err := auth.AdminAuth(ds, "demo-admin", "demo-admin")
 	if err != nil {
 		t.Fatalf("auth.AdminAuth() err = %s", err)
 	}
@@ -114,9 +224,12 @@ func testAuthAdminMD5Pass(t *testing.T) {
 	if gotId != wantId {
 		t.Errorf("Auth.AdminAuth() id = %d, want %d", gotId, wantId)
 	}
-	wantName := "Demo Admin"
-	if gotName != wantName {
-		t.Errorf("Auth.AdminAuth() name = %q, want %q", gotName, wantName)
+}
+
+func testAuthAdminStoredHashRejected(t *testing.T) {
+	_, _, err := auth.AdminAuth(ds, "demo-admin", "41d0510a9067999b72f38ba0ce9f6195")
+	if err != sql.ErrNoRows {
+		t.Errorf("auth.AdminAuth() err = %v, want %v", err, sql.ErrNoRows)
 	}
 }
 
@@ -132,3 +245,772 @@ func testAuthAdminFail(t *testing.T) {
 		t.Errorf("auth.AdminAuth() err = %v, want %v", err, sql.ErrNoRows)
 	}
 }
+
+func testAuthAdminInjection(t *testing.T) {
+	_, _, err := auth.AdminAuth(ds, `demo-admin" OR "1"="1" -- `, "wrongPassword")
+	if err != sql.ErrNoRows {
+		t.Errorf("auth.AdminAuth() err = %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func testAuthAdminInactive(t *testing.T) {
+	_, err := ds.MySQL.Session.Exec("UPDATE ad_user SET active = 0 WHERE id = 1")
+	if err != nil {
+		t.Fatalf("Exec() err = %s", err)
+	}
+	defer ds.MySQL.Session.Exec("UPDATE ad_user SET active = 1 WHERE id = 1")
+
+	_, _, err = auth.AdminAuth(ds, "demo-admin", "demo-admin")
+	if err != auth.ErrAccountInactive {
+		t.Errorf("auth.AdminAuth() err = %v, want %v", err, auth.ErrAccountInactive)
+	}
+}
+
+func testAuthAdminLocked(t *testing.T) {
+	_, err := ds.MySQL.Session.Exec("UPDATE ad_user SET locked = 1 WHERE id = 1")
+	if err != nil {
+		t.Fatalf("Exec() err = %s", err)
+	}
+
+	_, _, err = auth.AdminAuth(ds, "demo-admin", "demo-admin")
+	if err != auth.ErrAccountLocked {
+		t.Errorf("auth.AdminAuth() err = %v, want %v", err, auth.ErrAccountLocked)
+	}
+
+	err = auth.Unlock(ds, auth.UserAdmin, "demo-admin", 1)
+	if err != nil {
+		t.Fatalf("auth.Unlock() err = %s", err)
+	}
+	_, _, err = auth.AdminAuth(ds, "demo-admin", "demo-admin")
+	if err != nil {
+		t.Errorf("auth.AdminAuth() after unlock err = %s", err)
+	}
+}
+
+func testLoginThrottle(t *testing.T) {
+	login := "michael@mesa.net.au"
+	ip := "10.0.0.1"
+
+	for i := 0; i < 5; i++ {
+		_, _, err := auth.Login(ds, auth.UserMember, login, "wrongPassword", ip)
+		if err != sql.ErrNoRows {
+			t.Fatalf("auth.Login() attempt %d err = %v, want %v", i+1, err, sql.ErrNoRows)
+		}
+	}
+
+	// correct password is refused while locked out, from any ip
+	_, _, err := auth.Login(ds, auth.UserMember, login, "password", "10.0.0.99")
+	te, ok := err.(*auth.ThrottledError)
+	if !ok {
+		t.Fatalf("auth.Login() err = %v, want *auth.ThrottledError", err)
+	}
+	if te.Wait <= 0 || te.Wait > 30*time.Second {
+		t.Errorf("ThrottledError.Wait = %s, want (0, 30s]", te.Wait)
+	}
+
+	err = auth.Unlock(ds, auth.UserMember, login, 1)
+	if err != nil {
+		t.Fatalf("auth.Unlock() err = %s", err)
+	}
+	gotId, _, err := auth.Login(ds, auth.UserMember, login, "password", ip)
+	if err != nil {
+		t.Fatalf("auth.Login() after unlock err = %s", err)
+	}
+	wantId := 1
+	if gotId != wantId {
+		t.Errorf("auth.Login() id = %d, want %d", gotId, wantId)
+	}
+
+	var count int
+	err = ds.MySQL.Session.QueryRow("SELECT COUNT(*) FROM log_auth_attempt WHERE login = ?", login).Scan(&count)
+	if err != nil {
+		t.Fatalf("QueryRow() err = %s", err)
+	}
+	wantCount := 8 // 5 failures, throttled, unlock and success
+	if count != wantCount {
+		t.Errorf("log_auth_attempt count = %d, want %d", count, wantCount)
+	}
+}
+
+func testLoginThrottleIP(t *testing.T) {
+	ip := "10.0.0.2"
+
+	for i := 0; i < 20; i++ {
+		login := "nobody" + strconv.Itoa(i) + "@example.com"
+		_, _, err := auth.Login(ds, auth.UserMember, login, "wrongPassword", ip)
+		if err != sql.ErrNoRows {
+			t.Fatalf("auth.Login() attempt %d err = %v, want %v", i+1, err, sql.ErrNoRows)
+		}
+
+		// a successful login between guesses does not reset the count for the ip
+		if i == 10 {
+			_, _, err := auth.Login(ds, auth.UserAdmin, "demo-admin", "demo-admin", ip)
+			if err != nil {
+				t.Fatalf("auth.Login() err = %s", err)
+			}
+		}
+	}
+
+	_, _, err := auth.Login(ds, auth.UserAdmin, "demo-admin", "demo-admin", ip)
+	if _, ok := err.(*auth.ThrottledError); !ok {
+		t.Errorf("auth.Login() err = %v, want *auth.ThrottledError", err)
+	}
+
+	// same login from another ip is fine
+	_, _, err = auth.Login(ds, auth.UserAdmin, "demo-admin", "demo-admin", "10.0.0.3")
+	if err != nil {
+		t.Errorf("auth.Login() err = %s", err)
+	}
+
+	err = auth.UnlockIP(ds, ip, 1)
+	if err != nil {
+		t.Fatalf("auth.UnlockIP() err = %s", err)
+	}
+	_, _, err = auth.Login(ds, auth.UserAdmin, "demo-admin", "demo-admin", ip)
+	if err != nil {
+		t.Errorf("auth.Login() after UnlockIP() err = %s", err)
+	}
+}
+
+func exchangeToken(t *testing.T, key string) string {
+	c := map[string]interface{}{"id": 1, "name": "Michael Donnici", "role": "member"}
+	tk, err := jwt.New("https://member.app", key, 1).CustomClaims(c).Encode()
+	if err != nil {
+		t.Fatalf("jwt.Encode() err = %s", err)
+	}
+	return tk.Encoded
+}
+
+func testExchangeMember(t *testing.T) {
+	gotId, gotName, err := auth.ExchangeMember(ds, exchangeToken(t, "exchangeKey"), "exchangeKey")
+	if err != nil {
+		t.Fatalf("auth.ExchangeMember() err = %s", err)
+	}
+	wantId := 1
+	if gotId != wantId {
+		t.Errorf("auth.ExchangeMember() id = %d, want %d", gotId, wantId)
+	}
+	wantName := "Michael Donnici"
+	if gotName != wantName {
+		t.Errorf("auth.ExchangeMember() name = %q, want %q", gotName, wantName)
+	}
+}
+
+func testExchangeMemberWrongKey(t *testing.T) {
+	_, _, err := auth.ExchangeMember(ds, exchangeToken(t, "otherKey"), "exchangeKey")
+	if err == nil {
+		t.Errorf("auth.ExchangeMember() err = nil, want invalid signature error")
+	}
+}
+
+func testExchangeMemberNotConfigured(t *testing.T) {
+	_, _, err := auth.ExchangeMember(ds, exchangeToken(t, "exchangeKey"), "")
+	if err == nil {
+		t.Errorf("auth.ExchangeMember() err = nil, want error when no exchange key is set")
+	}
+}
+
+func testRotateRefreshToken(t *testing.T) {
+	rt, err := auth.NewRefreshToken(ds, auth.UserMember, 1, false, time.Hour)
+	if err != nil {
+		t.Fatalf("auth.NewRefreshToken() err = %s", err)
+	}
+	r, err := auth.RotateRefreshToken(ds, rt, time.Hour)
+	if err != nil {
+		t.Fatalf("auth.RotateRefreshToken() err = %s", err)
+	}
+	if r.UserType != auth.UserMember || r.UserID != 1 {
+		t.Errorf("auth.RotateRefreshToken() user = %s %d, want %s %d", r.UserType, r.UserID, auth.UserMember, 1)
+	}
+	wantName := "Michael Donnici"
+	if r.Name != wantName {
+		t.Errorf("auth.RotateRefreshToken() name = %q, want %q", r.Name, wantName)
+	}
+	if r.Token == "" || r.Token == rt {
+		t.Errorf("auth.RotateRefreshToken() token = %q, want a new token", r.Token)
+	}
+
+	// logout revokes the new token without affecting anything else
+	err = auth.RevokeRefreshToken(ds, r.Token)
+	if err != nil {
+		t.Fatalf("auth.RevokeRefreshToken() err = %s", err)
+	}
+	_, err = auth.RotateRefreshToken(ds, r.Token, time.Hour)
+	if err != auth.ErrInvalidRefreshToken {
+		t.Errorf("auth.RotateRefreshToken() err = %v, want %v", err, auth.ErrInvalidRefreshToken)
+	}
+}
+
+func testRotateRefreshTokenReused(t *testing.T) {
+	rt, err := auth.NewRefreshToken(ds, auth.UserMember, 1, false, time.Hour)
+	if err != nil {
+		t.Fatalf("auth.NewRefreshToken() err = %s", err)
+	}
+	other, err := auth.NewRefreshToken(ds, auth.UserMember, 1, false, time.Hour)
+	if err != nil {
+		t.Fatalf("auth.NewRefreshToken() err = %s", err)
+	}
+	_, err = auth.RotateRefreshToken(ds, rt, time.Hour)
+	if err != nil {
+		t.Fatalf("auth.RotateRefreshToken() err = %s", err)
+	}
+
+	_, err = auth.RotateRefreshToken(ds, rt, time.Hour)
+	if err != auth.ErrRefreshTokenReused {
+		t.Errorf("auth.RotateRefreshToken() err = %v, want %v", err, auth.ErrRefreshTokenReused)
+	}
+
+	// reuse revokes all other sessions
+	_, err = auth.RotateRefreshToken(ds, other, time.Hour)
+	if err != auth.ErrInvalidRefreshToken {
+		t.Errorf("auth.RotateRefreshToken() other session err = %v, want %v", err, auth.ErrInvalidRefreshToken)
+	}
+}
+
+func accessToken(t *testing.T, id int, role string) jwt.Token {
+	c := map[string]interface{}{"id": id, "name": "Test User", "role": role}
+	tk, err := jwt.New("https://test.api", "testSigningKey", 1).CustomClaims(c).Encode()
+	if err != nil {
+		t.Fatalf("jwt.Encode() err = %s", err)
+	}
+	return tk
+}
+
+func testRevokeAccessToken(t *testing.T) {
+	tk := accessToken(t, 1, auth.UserMember)
+	other := accessToken(t, 1, auth.UserMember)
+
+	err := auth.RevokeAccessToken(ds, tk)
+	if err != nil {
+		t.Fatalf("auth.RevokeAccessToken() err = %s", err)
+	}
+	got, err := auth.Revoked(ds, tk)
+	if err != nil {
+		t.Fatalf("auth.Revoked() err = %s", err)
+	}
+	if !got {
+		t.Errorf("auth.Revoked() = false, want true")
+	}
+	got, err = auth.Revoked(ds, other)
+	if err != nil {
+		t.Fatalf("auth.Revoked() err = %s", err)
+	}
+	if got {
+		t.Errorf("auth.Revoked() other token = true, want false")
+	}
+}
+
+func testRevokeAll(t *testing.T) {
+	tk := accessToken(t, 1, auth.UserAdmin)
+	member := accessToken(t, 1, auth.UserMember)
+	rt, err := auth.NewRefreshToken(ds, auth.UserAdmin, 1, false, time.Hour)
+	if err != nil {
+		t.Fatalf("auth.NewRefreshToken() err = %s", err)
+	}
+
+	err = auth.RevokeAll(ds, auth.UserAdmin, 1, time.Hour)
+	if err != nil {
+		t.Fatalf("auth.RevokeAll() err = %s", err)
+	}
+
+	got, err := auth.Revoked(ds, tk)
+	if err != nil {
+		t.Fatalf("auth.Revoked() err = %s", err)
+	}
+	if !got {
+		t.Errorf("auth.Revoked() = false, want true")
+	}
+	// member with the same id is a different user
+	got, err = auth.Revoked(ds, member)
+	if err != nil {
+		t.Fatalf("auth.Revoked() err = %s", err)
+	}
+	if got {
+		t.Errorf("auth.Revoked() member token = true, want false")
+	}
+	_, err = auth.RotateRefreshToken(ds, rt, time.Hour)
+	if err != auth.ErrInvalidRefreshToken {
+		t.Errorf("auth.RotateRefreshToken() err = %v, want %v", err, auth.ErrInvalidRefreshToken)
+	}
+}
+
+func testForgotPasswordUnknown(t *testing.T) {
+	_, err := auth.ForgotPassword(ds, "nobody@nowhere.com", time.Hour)
+	if err != sql.ErrNoRows {
+		t.Errorf("auth.ForgotPassword() err = %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func testResetRequestThrottle(t *testing.T) {
+	email := "nobody@nowhere.com"
+
+	for i := 0; i < 5; i++ {
+		err := auth.ResetRequest(ds, email, "10.0.0.4")
+		if err != nil {
+			t.Fatalf("auth.ResetRequest() attempt %d err = %s", i+1, err)
+		}
+	}
+
+	// throttled for the email address, from any ip
+	err := auth.ResetRequest(ds, email, "10.0.0.5")
+	if _, ok := err.(*auth.ThrottledError); !ok {
+		t.Errorf("auth.ResetRequest() err = %v, want *auth.ThrottledError", err)
+	}
+
+	// member logins are counted separately
+	_, _, err = auth.Login(ds, auth.UserMember, email, "wrongPassword", "10.0.0.5")
+	if err != sql.ErrNoRows {
+		t.Errorf("auth.Login() err = %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func testResetPassword(t *testing.T) {
+	tk := accessToken(t, 1, auth.UserMember)
+	rt, err := auth.NewRefreshToken(ds, auth.UserMember, 1, false, time.Hour)
+	if err != nil {
+		t.Fatalf("auth.NewRefreshToken() err = %s", err)
+	}
+
+	rcp, err := auth.ForgotPassword(ds, "michael@mesa.net.au", time.Hour)
+	if err != nil {
+		t.Fatalf("auth.ForgotPassword() err = %s", err)
+	}
+	if rcp.MemberID != 1 || rcp.Name != "Michael Donnici" || rcp.Token == "" {
+		t.Fatalf("auth.ForgotPassword() = %+v, want member 1 with a token", rcp)
+	}
+
+	id, err := auth.ResetPassword(ds, rcp.Token, "newPassword", time.Hour)
+	if err != nil {
+		t.Fatalf("auth.ResetPassword() err = %s", err)
+	}
+	if id != 1 {
+		t.Errorf("auth.ResetPassword() id = %d, want 1", id)
+	}
+	_, _, err = auth.AuthMember(ds, "michael@mesa.net.au", "newPassword")
+	if err != nil {
+		t.Errorf("auth.AuthMember() new password err = %s", err)
+	}
+	_, _, err = auth.AuthMember(ds, "michael@mesa.net.au", "password")
+	if err != sql.ErrNoRows {
+		t.Errorf("auth.AuthMember() old password err = %v, want %v", err, sql.ErrNoRows)
+	}
+
+	// existing sessions are ended
+	got, err := auth.Revoked(ds, tk)
+	if err != nil {
+		t.Fatalf("auth.Revoked() err = %s", err)
+	}
+	if !got {
+		t.Errorf("auth.Revoked() = false, want true")
+	}
+	_, err = auth.RotateRefreshToken(ds, rt, time.Hour)
+	if err != auth.ErrInvalidRefreshToken {
+		t.Errorf("auth.RotateRefreshToken() err = %v, want %v", err, auth.ErrInvalidRefreshToken)
+	}
+
+	// single use
+	_, err = auth.ResetPassword(ds, rcp.Token, "password", time.Hour)
+	if err != auth.ErrInvalidMemberToken {
+		t.Errorf("auth.ResetPassword() reused err = %v, want %v", err, auth.ErrInvalidMemberToken)
+	}
+
+	resetPassword(t, "password")
+}
+
+func testResetPasswordSuperseded(t *testing.T) {
+	first, err := auth.ForgotPassword(ds, "michael@mesa.net.au", time.Hour)
+	if err != nil {
+		t.Fatalf("auth.ForgotPassword() err = %s", err)
+	}
+	second, err := auth.ForgotPassword(ds, "michael@mesa.net.au", time.Hour)
+	if err != nil {
+		t.Fatalf("auth.ForgotPassword() err = %s", err)
+	}
+
+	_, err = auth.ResetPassword(ds, first.Token, "password", time.Hour)
+	if err != auth.ErrInvalidMemberToken {
+		t.Errorf("auth.ResetPassword() superseded err = %v, want %v", err, auth.ErrInvalidMemberToken)
+	}
+	_, err = auth.ResetPassword(ds, second.Token, "password", time.Hour)
+	if err != nil {
+		t.Errorf("auth.ResetPassword() err = %s", err)
+	}
+}
+
+func testResetPasswordExpired(t *testing.T) {
+	rcp, err := auth.ForgotPassword(ds, "michael@mesa.net.au", time.Second)
+	if err != nil {
+		t.Fatalf("auth.ForgotPassword() err = %s", err)
+	}
+	time.Sleep(2 * time.Second)
+	_, err = auth.ResetPassword(ds, rcp.Token, "password", time.Hour)
+	if err != auth.ErrInvalidMemberToken {
+		t.Errorf("auth.ResetPassword() err = %v, want %v", err, auth.ErrInvalidMemberToken)
+	}
+}
+
+func testResetPasswordTooShort(t *testing.T) {
+	rcp, err := auth.ForgotPassword(ds, "michael@mesa.net.au", time.Hour)
+	if err != nil {
+		t.Fatalf("auth.ForgotPassword() err = %s", err)
+	}
+	_, err = auth.ResetPassword(ds, rcp.Token, "short", time.Hour)
+	if err != auth.ErrPasswordTooShort {
+		t.Errorf("auth.ResetPassword() err = %v, want %v", err, auth.ErrPasswordTooShort)
+	}
+	// the token was not used up
+	_, err = auth.ResetPassword(ds, rcp.Token, "password", time.Hour)
+	if err != nil {
+		t.Errorf("auth.ResetPassword() err = %s", err)
+	}
+}
+
+func testChangeEmail(t *testing.T) {
+	rcp, err := auth.ChangeEmail(ds, 1, "michael@new.com", time.Hour)
+	if err != nil {
+		t.Fatalf("auth.ChangeEmail() err = %s", err)
+	}
+	if rcp.Email != "michael@new.com" || rcp.Token == "" {
+		t.Fatalf("auth.ChangeEmail() = %+v, want new email with a token", rcp)
+	}
+
+	// not changed until verified
+	_, _, err = auth.AuthMember(ds, "michael@mesa.net.au", "password")
+	if err != nil {
+		t.Errorf("auth.AuthMember() before verify err = %s", err)
+	}
+
+	id, err := auth.VerifyEmail(ds, rcp.Token)
+	if err != nil {
+		t.Fatalf("auth.VerifyEmail() err = %s", err)
+	}
+	if id != 1 {
+		t.Errorf("auth.VerifyEmail() id = %d, want 1", id)
+	}
+	_, _, err = auth.AuthMember(ds, "michael@new.com", "password")
+	if err != nil {
+		t.Errorf("auth.AuthMember() after verify err = %s", err)
+	}
+
+	_, err = auth.VerifyEmail(ds, rcp.Token)
+	if err != auth.ErrInvalidMemberToken {
+		t.Errorf("auth.VerifyEmail() reused err = %v, want %v", err, auth.ErrInvalidMemberToken)
+	}
+
+	// change it back
+	rcp, err = auth.ChangeEmail(ds, 1, "michael@mesa.net.au", time.Hour)
+	if err != nil {
+		t.Fatalf("auth.ChangeEmail() err = %s", err)
+	}
+	_, err = auth.VerifyEmail(ds, rcp.Token)
+	if err != nil {
+		t.Fatalf("auth.VerifyEmail() err = %s", err)
+	}
+}
+
+func testChangeEmailInvalid(t *testing.T) {
+	_, err := auth.ChangeEmail(ds, 1, "not an email", time.Hour)
+	if err != auth.ErrInvalidEmail {
+		t.Errorf("auth.ChangeEmail() err = %v, want %v", err, auth.ErrInvalidEmail)
+	}
+}
+
+// resetPassword sets a member password back to a known value
+func resetPassword(t *testing.T, p string) {
+	rcp, err := auth.ForgotPassword(ds, "michael@mesa.net.au", time.Hour)
+	if err != nil {
+		t.Fatalf("auth.ForgotPassword() err = %s", err)
+	}
+	_, err = auth.ResetPassword(ds, rcp.Token, p, time.Hour)
+	if err != nil {
+		t.Fatalf("auth.ResetPassword() err = %s", err)
+	}
+}
+
+func testMFA(t *testing.T) {
+	e, err := auth.EnrolMFA(ds, 1, "Test")
+	if err != nil {
+		t.Fatalf("auth.EnrolMFA() err = %s", err)
+	}
+	if !strings.HasPrefix(e.URI, "otpauth://totp/Test:demo-admin?") {
+		t.Errorf("auth.EnrolMFA() uri = %s, want otpauth://totp/Test:demo-admin?...", e.URI)
+	}
+
+	// not enabled until confirmed
+	enabled, err := auth.MFAEnabled(ds, 1)
+	if err != nil {
+		t.Fatalf("auth.MFAEnabled() err = %s", err)
+	}
+	if enabled {
+		t.Errorf("auth.MFAEnabled() before confirm = true, want false")
+	}
+
+	now := time.Now()
+	c, err := totp.Code(e.Secret, now)
+	if err != nil {
+		t.Fatalf("totp.Code() err = %s", err)
+	}
+	codes, err := auth.ConfirmMFA(ds, 1, c)
+	if err != nil {
+		t.Fatalf("auth.ConfirmMFA() err = %s", err)
+	}
+	if len(codes) != 10 {
+		t.Errorf("auth.ConfirmMFA() recovery codes = %d, want 10", len(codes))
+	}
+	enabled, err = auth.MFAEnabled(ds, 1)
+	if err != nil {
+		t.Fatalf("auth.MFAEnabled() err = %s", err)
+	}
+	if !enabled {
+		t.Errorf("auth.MFAEnabled() after confirm = false, want true")
+	}
+
+	_, err = auth.EnrolMFA(ds, 1, "Test")
+	if err != auth.ErrMFAEnabled {
+		t.Errorf("auth.EnrolMFA() again err = %v, want %v", err, auth.ErrMFAEnabled)
+	}
+
+	// the code used to confirm cannot be replayed, the next one is accepted
+	err = auth.VerifyMFA(ds, 1, c)
+	if err != auth.ErrInvalidMFACode {
+		t.Errorf("auth.VerifyMFA() replay err = %v, want %v", err, auth.ErrInvalidMFACode)
+	}
+	next, err := totp.Code(e.Secret, now.Add(30*time.Second))
+	if err != nil {
+		t.Fatalf("totp.Code() err = %s", err)
+	}
+	err = auth.VerifyMFA(ds, 1, next)
+	if err != nil {
+		t.Errorf("auth.VerifyMFA() err = %s", err)
+	}
+}
+
+func testMFARecoveryCode(t *testing.T) {
+	codes, err := auth.NewRecoveryCodes(ds, 1)
+	if err != nil {
+		t.Fatalf("auth.NewRecoveryCodes() err = %s", err)
+	}
+
+	// formatting is ignored
+	c := strings.ToUpper(strings.Replace(codes[0], "-", " ", -1))
+	err = auth.VerifyMFA(ds, 1, c)
+	if err != nil {
+		t.Errorf("auth.VerifyMFA() recovery code err = %s", err)
+	}
+	err = auth.VerifyMFA(ds, 1, codes[0])
+	if err != auth.ErrInvalidMFACode {
+		t.Errorf("auth.VerifyMFA() used recovery code err = %v, want %v", err, auth.ErrInvalidMFACode)
+	}
+}
+
+func testLoginMFAThrottle(t *testing.T) {
+	err := auth.Unlock(ds, auth.UserAdmin, "demo-admin", 1)
+	if err != nil {
+		t.Fatalf("auth.Unlock() err = %s", err)
+	}
+	start := time.Now().Add(-time.Second)
+	ip := "10.0.0.4"
+
+	// a successful password between rounds of codes does not reset the count of failed codes, which is
+	// throttled after 5 failures
+	for i := 0; i < 3; i++ {
+		_, _, err := auth.Login(ds, auth.UserAdmin, "demo-admin", "demo-admin", ip)
+		if err != nil {
+			t.Fatalf("auth.Login() round %d err = %s", i+1, err)
+		}
+		for j := 0; j < 2; j++ {
+			err = auth.LoginMFA(ds, 1, "000000", ip)
+			n := i*2 + j + 1
+			if n <= 5 && err != auth.ErrInvalidMFACode {
+				t.Errorf("auth.LoginMFA() attempt %d err = %v, want %v", n, err, auth.ErrInvalidMFACode)
+			}
+			if _, ok := err.(*auth.ThrottledError); n > 5 && !ok {
+				t.Errorf("auth.LoginMFA() attempt %d err = %v, want *auth.ThrottledError", n, err)
+			}
+		}
+	}
+
+	n, err := auth.MFAFailures(ds, 1, start)
+	if err != nil {
+		t.Fatalf("auth.MFAFailures() err = %s", err)
+	}
+	if n != 5 {
+		t.Errorf("auth.MFAFailures() = %d, want 5", n)
+	}
+
+	err = auth.Unlock(ds, auth.UserAdmin, "demo-admin", 1)
+	if err != nil {
+		t.Fatalf("auth.Unlock() err = %s", err)
+	}
+	err = auth.LoginMFA(ds, 1, "000000", ip)
+	if err != auth.ErrInvalidMFACode {
+		t.Errorf("auth.LoginMFA() after unlock err = %v, want %v", err, auth.ErrInvalidMFACode)
+	}
+}
+
+func testLoginMFAFail(t *testing.T) {
+	err := auth.Unlock(ds, auth.UserAdmin, "demo-admin", 1)
+	if err != nil {
+		t.Fatalf("auth.Unlock() err = %s", err)
+	}
+	err = auth.LoginMFA(ds, 1, "000000", "127.0.0.1")
+	if err != auth.ErrInvalidMFACode {
+		t.Errorf("auth.LoginMFA() err = %v, want %v", err, auth.ErrInvalidMFACode)
+	}
+
+	err = auth.DisableMFA(ds, 1)
+	if err != nil {
+		t.Fatalf("auth.DisableMFA() err = %s", err)
+	}
+	err = auth.LoginMFA(ds, 1, "000000", "127.0.0.1")
+	if err != auth.ErrMFANotEnabled {
+		t.Errorf("auth.LoginMFA() disabled err = %v, want %v", err, auth.ErrMFANotEnabled)
+	}
+}
+
+func testAdminPermissions(t *testing.T) {
+	got, err := auth.AdminPermissions(ds, 1)
+	if err != nil {
+		t.Fatalf("auth.AdminPermissions() err = %s", err)
+	}
+	// demo-admin is in the Administrator role, which has every permission
+	want := []string{
+		auth.PermAPIKeys,
+		auth.PermAdminUsers,
+		auth.PermAuditRead,
+		auth.PermMembersImpersonate,
+		auth.PermMembersLapse,
+		auth.PermMembersRead,
+		auth.PermMembersWrite,
+		auth.PermNotificationsSend,
+		auth.PermReportsFinance,
+		auth.PermReportsMembers,
+		auth.PermResourcesWrite,
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("auth.AdminPermissions() = %v, want %v", got, want)
+	}
+}
+
+func testAPIKey(t *testing.T) {
+	k, err := auth.NewAPIKey(ds, "pubmedr", []string{auth.PermResourcesWrite}, 0, 1)
+	if err != nil {
+		t.Fatalf("auth.NewAPIKey() err = %s", err)
+	}
+	if !strings.HasPrefix(k.Key, auth.APIKeyPrefix) || !strings.HasPrefix(k.Key, k.Hint) {
+		t.Errorf("auth.NewAPIKey() key = %q, hint = %q", k.Key, k.Hint)
+	}
+	if k.ExpiresAt != nil {
+		t.Errorf("auth.NewAPIKey() expiresAt = %v, want nil", k.ExpiresAt)
+	}
+
+	got, err := auth.CheckAPIKey(ds, k.Key)
+	if err != nil {
+		t.Fatalf("auth.CheckAPIKey() err = %s", err)
+	}
+	if got.ID != k.ID || got.Name != "pubmedr" || strings.Join(got.Scopes, ",") != auth.PermResourcesWrite {
+		t.Errorf("auth.CheckAPIKey() = %+v, want id %d with scope %s", got, k.ID, auth.PermResourcesWrite)
+	}
+
+	k, err = auth.APIKeyByID(ds, k.ID)
+	if err != nil {
+		t.Fatalf("auth.APIKeyByID() err = %s", err)
+	}
+	if k.Key != "" || k.LastUsedAt == nil {
+		t.Errorf("auth.APIKeyByID() key = %q, lastUsedAt = %v, want no key and a last used time", k.Key, k.LastUsedAt)
+	}
+
+	_, err = auth.CheckAPIKey(ds, auth.APIKeyPrefix+"notAKey")
+	if err != auth.ErrInvalidAPIKey {
+		t.Errorf("auth.CheckAPIKey() err = %v, want %v", err, auth.ErrInvalidAPIKey)
+	}
+}
+
+func testAPIKeyRotate(t *testing.T) {
+	old, err := auth.NewAPIKey(ds, "mailr", []string{auth.PermMembersRead}, 90, 1)
+	if err != nil {
+		t.Fatalf("auth.NewAPIKey() err = %s", err)
+	}
+	k, err := auth.RotateAPIKey(ds, old.ID, 1)
+	if err != nil {
+		t.Fatalf("auth.RotateAPIKey() err = %s", err)
+	}
+	if k.ID == old.ID || k.Name != old.Name || k.ExpiresAt == nil || !k.ExpiresAt.Equal(*old.ExpiresAt) {
+		t.Errorf("auth.RotateAPIKey() = %+v, want a new key like %+v", k, old)
+	}
+	_, err = auth.CheckAPIKey(ds, old.Key)
+	if err != auth.ErrInvalidAPIKey {
+		t.Errorf("auth.CheckAPIKey() old key err = %v, want %v", err, auth.ErrInvalidAPIKey)
+	}
+	_, err = auth.CheckAPIKey(ds, k.Key)
+	if err != nil {
+		t.Errorf("auth.CheckAPIKey() new key err = %s", err)
+	}
+	// a revoked key cannot be rotated again
+	_, err = auth.RotateAPIKey(ds, old.ID, 1)
+	if err != sql.ErrNoRows {
+		t.Errorf("auth.RotateAPIKey() err = %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func testAPIKeyRevoke(t *testing.T) {
+	k, err := auth.NewAPIKey(ds, "fixr", []string{auth.PermMembersWrite}, 0, 1)
+	if err != nil {
+		t.Fatalf("auth.NewAPIKey() err = %s", err)
+	}
+	err = auth.RevokeAPIKey(ds, k.ID)
+	if err != nil {
+		t.Fatalf("auth.RevokeAPIKey() err = %s", err)
+	}
+	_, err = auth.CheckAPIKey(ds, k.Key)
+	if err != auth.ErrInvalidAPIKey {
+		t.Errorf("auth.CheckAPIKey() err = %v, want %v", err, auth.ErrInvalidAPIKey)
+	}
+	err = auth.RevokeAPIKey(ds, k.ID)
+	if err != sql.ErrNoRows {
+		t.Errorf("auth.RevokeAPIKey() err = %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func testAPIKeyExpired(t *testing.T) {
+	k, err := auth.NewAPIKey(ds, "syncr", []string{auth.PermMembersRead}, 1, 1)
+	if err != nil {
+		t.Fatalf("auth.NewAPIKey() err = %s", err)
+	}
+	_, err = ds.MySQL.Session.Exec("UPDATE auth_api_key SET expires_at = NOW() - INTERVAL 1 MINUTE WHERE id = ?", k.ID)
+	if err != nil {
+		t.Fatalf("Exec() err = %s", err)
+	}
+	_, err = auth.CheckAPIKey(ds, k.Key)
+	if err != auth.ErrInvalidAPIKey {
+		t.Errorf("auth.CheckAPIKey() err = %v, want %v", err, auth.ErrInvalidAPIKey)
+	}
+}
+
+func testImpersonation(t *testing.T) {
+	name, err := auth.MemberName(ds, 1)
+	if err != nil {
+		t.Fatalf("auth.MemberName() err = %s", err)
+	}
+	if name != "Michael Donnici" {
+		t.Errorf("auth.MemberName() = %q, want %q", name, "Michael Donnici")
+	}
+	_, err = auth.MemberName(ds, 99999)
+	if err != sql.ErrNoRows {
+		t.Errorf("auth.MemberName() err = %v, want %v", err, sql.ErrNoRows)
+	}
+
+	i := auth.Impersonation{AdminID: 1, MemberID: 1, TokenID: "test-jti", Method: "GET", Path: "/v1/m/activities", IP: "10.0.0.1"}
+	err = auth.LogImpersonation(ds, i)
+	if err != nil {
+		t.Fatalf("auth.LogImpersonation() err = %s", err)
+	}
+	var n int
+	err = ds.MySQL.Session.QueryRow("SELECT COUNT(*) FROM log_impersonation WHERE jti = ? AND ad_user_id = 1 AND member_id = 1", i.TokenID).Scan(&n)
+	if err != nil {
+		t.Fatalf("QueryRow() err = %s", err)
+	}
+	if n != 1 {
+		t.Errorf("log_impersonation count = %d, want 1", n)
+	}
+}
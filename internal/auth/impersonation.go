@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+)
+
+// ImpersonationTTL is the lifetime of a token issued so that an admin can view the system as a member sees
+// it. There is no refresh token, so the admin must ask for a new token when it expires.
+const ImpersonationTTL = 15 * time.Minute
+
+// Impersonation is a request made by an admin with a token issued to view the system as a member, or the
+// request that issued the token
+type Impersonation struct {
+	AdminID  int
+	MemberID int
+	TokenID  string
+	Method   string
+	Path     string
+	IP       string
+}
+
+// MemberName returns the name of a member, or sql.ErrNoRows if there is no such member
+func MemberName(ds datastore.Datastore, memberID int) (string, error) {
+	var id int
+	var name string
+	err := ds.MySQL.Session.QueryRow(queries["select-member-by-id"], memberID).Scan(&id, &name)
+	return name, err
+}
+
+// LogImpersonation records a request made by an admin viewing the system as a member. The request must not
+// go ahead if it cannot be recorded.
+func LogImpersonation(ds datastore.Datastore, i Impersonation) error {
+	_, err := ds.MySQL.Session.Exec(queries["insert-impersonation"], i.AdminID, i.MemberID, i.TokenID, i.Method, i.Path, i.IP)
+	return err
+}
@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cardiacsociety/web-services/internal/history"
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+	"github.com/pkg/errors"
+)
+
+// Purposes of single-use member tokens
+const (
+	purposeReset  = "reset"
+	purposeVerify = "verify"
+)
+
+// Default lifetimes of single-use member tokens
+const (
+	ResetTokenTTL  = time.Hour
+	VerifyTokenTTL = 24 * time.Hour
+)
+
+// MinPasswordLength is the shortest password accepted when a password is set
+const MinPasswordLength = 8
+
+// ErrInvalidMemberToken is returned when a password reset or email verification token is unknown, has
+// expired or has already been used
+var ErrInvalidMemberToken = errors.New("token is invalid, has expired or has already been used")
+
+// ErrPasswordTooShort is returned when a new password is shorter than MinPasswordLength
+var ErrPasswordTooShort = fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+
+// ErrInvalidEmail is returned when a new email address is obviously malformed
+var ErrInvalidEmail = errors.New("email address is not valid")
+
+// ErrEmailInUse is returned when a new email address is already the primary email of another member
+var ErrEmailInUse = errors.New("email address is already in use")
+
+// Recipient identifies the member, and the address, to which a single-use token should be sent. Only a
+// hash of the token is stored, so this is the only chance to deliver it.
+type Recipient struct {
+	MemberID int
+	Name     string
+	Email    string
+	Token    string
+}
+
+// ForgotPassword issues a password reset token, valid for ttl, for the member with the primary email. If
+// there is no such member the error is sql.ErrNoRows, which callers must not disclose.
+func ForgotPassword(ds datastore.Datastore, email string, ttl time.Duration) (Recipient, error) {
+
+	r := Recipient{Email: email}
+	err := ds.MySQL.Session.QueryRow(queries["select-member-by-email"], email).Scan(&r.MemberID, &r.Name)
+	if err != nil {
+		return r, err
+	}
+
+	r.Token, err = newMemberToken(ds, purposeReset, r.MemberID, "", ttl)
+	return r, err
+}
+
+// ResetPassword sets a new password for the member that was issued the reset token. The token can only be
+// used once. As the old password may have been compromised, all of the member's sessions are revoked. The
+// accessTTL is the lifetime of access tokens, as for RevokeAll.
+func ResetPassword(ds datastore.Datastore, token, p string, accessTTL time.Duration) (int, error) {
+
+	if len(p) < MinPasswordLength {
+		return 0, ErrPasswordTooShort
+	}
+
+	id, _, err := claimMemberToken(ds, purposeReset, token)
+	if err != nil {
+		return 0, err
+	}
+
+	hash, err := HashPassword(p)
+	if err != nil {
+		return 0, err
+	}
+	_, err = ds.MySQL.Session.Exec(queries["update-member-password-reset"], hash, id)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = ds.MySQL.Session.Exec(queries["cancel-member-tokens"], id, purposeReset)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, RevokeAll(ds, UserMember, id, accessTTL)
+}
+
+// ChangeEmail starts a change to the primary email of a member. The email is not changed until the
+// verification token, valid for ttl, is presented to VerifyEmail, and the token should be sent to the new
+// address.
+func ChangeEmail(ds datastore.Datastore, memberID int, email string, ttl time.Duration) (Recipient, error) {
+
+	r := Recipient{MemberID: memberID, Email: strings.TrimSpace(email)}
+	if !strings.Contains(r.Email, "@") || strings.ContainsAny(r.Email, " \t\r\n") {
+		return r, ErrInvalidEmail
+	}
+
+	err := ds.MySQL.Session.QueryRow(queries["select-member-by-id"], memberID).Scan(&r.MemberID, &r.Name)
+	if err != nil {
+		return r, err
+	}
+
+	err = emailAvailable(ds, memberID, r.Email)
+	if err != nil {
+		return r, err
+	}
+
+	r.Token, err = newMemberToken(ds, purposeVerify, memberID, r.Email, ttl)
+	return r, err
+}
+
+// VerifyEmail completes a change of primary email by presenting the token sent to the new address, and
+// returns the member id. The token can only be used once. The change is recorded in the member's history.
+func VerifyEmail(ds datastore.Datastore, token string) (int, error) {
+
+	id, email, err := claimMemberToken(ds, purposeVerify, token)
+	if err != nil {
+		return 0, err
+	}
+
+	// the address may have been taken since the token was issued
+	err = emailAvailable(ds, id, email)
+	if err != nil {
+		return 0, err
+	}
+
+	err = ds.MySQL.InTx(func(ex datastore.Execer) error {
+		s, err := history.TakeTx(ex, id, "member")
+		if err != nil {
+			return err
+		}
+		_, err = ex.Exec(queries["update-member-email"], email, id)
+		if err != nil {
+			return err
+		}
+		_, err = s.RecordTx(ex, history.Actor{ID: id, Type: UserMember}, "Primary email verified", "member")
+		return err
+	})
+	return id, err
+}
+
+// newMemberToken generates and stores a single-use token for a member, and returns the token. Any unused
+// tokens previously issued to the member for the same purpose are cancelled.
+func newMemberToken(ds datastore.Datastore, purpose string, memberID int, email string, ttl time.Duration) (string, error) {
+
+	xb := make([]byte, 32)
+	if _, err := rand.Read(xb); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(xb)
+
+	// only the most recent token for each purpose is valid
+	_, err := ds.MySQL.Session.Exec(queries["cancel-member-tokens"], memberID, purpose)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = ds.MySQL.Session.Exec(queries["insert-member-token"], int(ttl.Seconds()), purpose, memberID, hashToken(token), email)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// claimMemberToken marks a single-use token as used, and returns the member id and, for an email
+// verification token, the new email address. The token is claimed in a single update so that it cannot be
+// used by two concurrent requests.
+func claimMemberToken(ds datastore.Datastore, purpose, token string) (int, string, error) {
+
+	hash := hashToken(token)
+	res, err := ds.MySQL.Session.Exec(queries["use-member-token"], hash, purpose)
+	if err != nil {
+		return 0, "", err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return 0, "", ErrInvalidMemberToken
+	}
+
+	var id int
+	var email string
+	err = ds.MySQL.Session.QueryRow(queries["select-member-token"], hash, purpose).Scan(&id, &email)
+	return id, email, err
+}
+
+// emailAvailable returns ErrEmailInUse if the email is the primary email of a member other than memberID
+func emailAvailable(ds datastore.Datastore, memberID int, email string) error {
+
+	var n int
+	err := ds.MySQL.Session.QueryRow(queries["count-member-email"], email, memberID).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrEmailInUse
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+	"github.com/cardiacsociety/web-services/internal/platform/totp"
+	"github.com/pkg/errors"
+)
+
+// recoveryCodeCount is the number of recovery codes issued to an admin, each of which can be used once in
+// place of a TOTP code
+const recoveryCodeCount = 10
+
+// ErrMFAEnabled is returned when an admin that has already enrolled a TOTP authenticator tries to enrol again
+var ErrMFAEnabled = errors.New("two-factor authentication is already enabled")
+
+// ErrMFANotEnabled is returned when a TOTP code is presented by an admin that has not enrolled an authenticator
+var ErrMFANotEnabled = errors.New("two-factor authentication is not enabled")
+
+// ErrInvalidMFACode is returned when a TOTP code or recovery code is not valid
+var ErrInvalidMFACode = errors.New("authentication code is not valid")
+
+// Enrolment holds the secret for a new TOTP authenticator and the otpauth:// uri that provisions it, which
+// is usually shown to the user as a QR code.
+type Enrolment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// EnrolMFA starts enrolment of a TOTP authenticator for an admin. The authenticator is not enabled until a
+// code from it is presented to ConfirmMFA. The issuer is the name shown in the authenticator app.
+func EnrolMFA(ds datastore.Datastore, adminID int, issuer string) (Enrolment, error) {
+
+	var e Enrolment
+
+	enabled, err := MFAEnabled(ds, adminID)
+	if err != nil {
+		return e, err
+	}
+	if enabled {
+		return e, ErrMFAEnabled
+	}
+
+	var username string
+	err = ds.MySQL.Session.QueryRow(queries["select-admin-username"], adminID).Scan(&username)
+	if err != nil {
+		return e, err
+	}
+
+	e.Secret, err = totp.NewSecret()
+	if err != nil {
+		return e, err
+	}
+	e.URI = totp.URI(issuer, username, e.Secret)
+
+	_, err = ds.MySQL.Session.Exec(queries["upsert-admin-mfa"], adminID, e.Secret, e.Secret)
+	return e, err
+}
+
+// ConfirmMFA completes enrolment of a TOTP authenticator with a code from the authenticator, and returns a
+// set of recovery codes. The recovery codes are only stored as hashes, so this is the only time they are
+// available.
+func ConfirmMFA(ds datastore.Datastore, adminID int, code string) ([]string, error) {
+
+	var secret string
+	var enabled bool
+	var lastStep int64
+	err := ds.MySQL.Session.QueryRow(queries["select-admin-mfa"], adminID).Scan(&secret, &enabled, &lastStep)
+	if err == sql.ErrNoRows {
+		return nil, ErrMFANotEnabled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrMFAEnabled
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	_, err = ds.MySQL.Session.Exec(queries["enable-admin-mfa"], step, adminID)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRecoveryCodes(ds, adminID)
+}
+
+// MFAEnabled returns true if the admin has a confirmed TOTP authenticator
+func MFAEnabled(ds datastore.Datastore, adminID int) (bool, error) {
+
+	var secret string
+	var enabled bool
+	var lastStep int64
+	err := ds.MySQL.Session.QueryRow(queries["select-admin-mfa"], adminID).Scan(&secret, &enabled, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// VerifyMFA checks a TOTP code, or an unused recovery code, for an admin. Each TOTP code can only be used
+// once, and each recovery code is used up.
+func VerifyMFA(ds datastore.Datastore, adminID int, code string) error {
+
+	var secret string
+	var enabled bool
+	var lastStep int64
+	err := ds.MySQL.Session.QueryRow(queries["select-admin-mfa"], adminID).Scan(&secret, &enabled, &lastStep)
+	if err == sql.ErrNoRows || (err == nil && !enabled) {
+		return ErrMFANotEnabled
+	}
+	if err != nil {
+		return err
+	}
+
+	if step, ok := totp.Validate(secret, code, time.Now()); ok {
+		// the step is only updated if it is later than the last one used, so a code cannot be replayed
+		res, err := ds.MySQL.Session.Exec(queries["update-admin-mfa-step"], step, adminID, step)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n != 1 {
+			return ErrInvalidMFACode
+		}
+		return nil
+	}
+
+	res, err := ds.MySQL.Session.Exec(queries["use-recovery-code"], adminID, hashToken(normaliseRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return ErrInvalidMFACode
+	}
+
+	return nil
+}
+
+// LoginMFA is the second step of an admin login, after the password has been checked by Login. It verifies
+// a TOTP or recovery code and records the attempt in the auth log, so that codes are throttled in the same
+// way as passwords. Failed codes are counted separately from failed passwords, so a successful password
+// does not reset the count.
+func LoginMFA(ds datastore.Datastore, adminID int, code, ip string) error {
+
+	var username string
+	err := ds.MySQL.Session.QueryRow(queries["select-admin-username"], adminID).Scan(&username)
+	if err != nil {
+		return err
+	}
+
+	attemptID, wait, err := beginAttempt(ds, userAdminMFA, username, ip)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		settleAttempt(ds, attemptID, resultThrottled)
+		return &ThrottledError{Wait: wait}
+	}
+
+	err = VerifyMFA(ds, adminID, code)
+	if err == nil {
+		settleAttempt(ds, attemptID, resultSuccess)
+	}
+
+	return err
+}
+
+// MFAFailures returns the number of failed authentication codes presented by an admin since the time
+// since, eg since an MFA challenge was issued
+func MFAFailures(ds datastore.Datastore, adminID int, since time.Time) (int, error) {
+
+	var n int
+	err := ds.MySQL.Session.QueryRow(queries["count-admin-mfa-failures"], userAdminMFA, adminID, since.Unix()).Scan(&n)
+	return n, err
+}
+
+// NewRecoveryCodes replaces any recovery codes for an admin with a new set, and returns them
+func NewRecoveryCodes(ds datastore.Datastore, adminID int) ([]string, error) {
+
+	_, err := ds.MySQL.Session.Exec(queries["delete-recovery-codes"], adminID)
+	if err != nil {
+		return nil, err
+	}
+
+	var codes []string
+	for i := 0; i < recoveryCodeCount; i++ {
+		c, err := recoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		_, err = ds.MySQL.Session.Exec(queries["insert-recovery-code"], adminID, hashToken(normaliseRecoveryCode(c)))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, c)
+	}
+
+	return codes, nil
+}
+
+// DisableMFA removes the TOTP authenticator and recovery codes for an admin
+func DisableMFA(ds datastore.Datastore, adminID int) error {
+
+	_, err := ds.MySQL.Session.Exec(queries["delete-recovery-codes"], adminID)
+	if err != nil {
+		return err
+	}
+	_, err = ds.MySQL.Session.Exec(queries["delete-admin-mfa"], adminID)
+	return err
+}
+
+// recoveryCode returns a random recovery code in the format xxxxx-xxxxx
+func recoveryCode() (string, error) {
+	xb := make([]byte, 7)
+	if _, err := rand.Read(xb); err != nil {
+		return "", err
+	}
+	s := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(xb))[:10]
+	return s[:5] + "-" + s[5:], nil
+}
+
+// normaliseRecoveryCode removes formatting from a recovery code as entered by a user
+func normaliseRecoveryCode(c string) string {
+	c = strings.Replace(c, "-", "", -1)
+	c = strings.Replace(c, " ", "", -1)
+	return strings.ToLower(c)
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HashPassword returns a bcrypt hash of the plain text password p. Each hash is generated with its own
+// random salt, which is stored as part of the hash string.
+func HashPassword(p string) (string, error) {
+	xb, err := bcrypt.GenerateFromPassword([]byte(p), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(xb), nil
+}
+
+// RandomPasswordHash returns a bcrypt hash of a random password that is never disclosed. It is used for new
+// records so that they cannot be logged into until a password has been set.
+func RandomPasswordHash() (string, error) {
+	xb := make([]byte, 32)
+	if _, err := rand.Read(xb); err != nil {
+		return "", err
+	}
+	return HashPassword(hex.EncodeToString(xb))
+}
+
+// dummyHash is compared with the password when there is no such user, so that a failed login takes about as
+// long whether or not the username exists
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// checkDummyPassword spends the time of a bcrypt comparison, for a login with an unknown username
+func checkDummyPassword(p string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(p))
+}
+
+// wrappedPrefix marks a legacy MD5 hash that has been wrapped in a bcrypt hash, ie bcrypt(md5(p)), so that
+// the unsalted MD5 hash is no longer stored for users who have not logged in since the upgrade to bcrypt
+const wrappedPrefix = "md5"
+
+// checkPassword compares the plain text password p with the stored hash. The second return value is true
+// when the stored hash is a legacy, unsalted MD5 hash, or a wrapped MD5 hash, that should be upgraded.
+func checkPassword(hash, p string) (match bool, legacy bool) {
+
+	if isBcrypt(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(p)) == nil, false
+	}
+
+	if isWrapped(hash) {
+		wrapped := strings.TrimPrefix(hash, wrappedPrefix)
+		return bcrypt.CompareHashAndPassword([]byte(wrapped), []byte(md5Hex(p))) == nil, true
+	}
+
+	match = subtle.ConstantTimeCompare([]byte(md5Hex(p)), []byte(strings.ToLower(hash))) == 1
+	return match, true
+}
+
+// wrapHash returns a bcrypt hash of a legacy MD5 hash, marked with wrappedPrefix
+func wrapHash(md5Hash string) (string, error) {
+	hash, err := HashPassword(strings.ToLower(md5Hash))
+	if err != nil {
+		return "", err
+	}
+	return wrappedPrefix + hash, nil
+}
+
+// md5Hex returns the legacy, unsalted MD5 hash of the plain text password p
+func md5Hex(p string) string {
+	sum := md5.Sum([]byte(p))
+	return hex.EncodeToString(sum[:])
+}
+
+// isBcrypt returns true if the stored hash string looks like a bcrypt hash, eg $2a$10$...
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2")
+}
+
+// isWrapped returns true if the stored hash string is a wrapped MD5 hash, eg md5$2a$10$...
+func isWrapped(hash string) bool {
+	return strings.HasPrefix(hash, wrappedPrefix+"$2")
+}
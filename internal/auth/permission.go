@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+)
+
+// Admin permissions, stored in ad_permission and granted to admin users through their role or
+// individually. They are encoded as scopes in admin tokens.
+const (
+	PermMembersRead        = "members:read"
+	PermMembersWrite       = "members:write"
+	PermMembersLapse       = "members:lapse"
+	PermMembersImpersonate = "members:impersonate"
+	PermNotificationsSend  = "notifications:send"
+	PermReportsMembers     = "reports:members"
+	PermReportsFinance     = "reports:finance"
+	PermResourcesWrite     = "resources:write"
+	PermAdminUsers         = "admin:users"
+	PermAPIKeys            = "admin:apikeys"
+	PermAuditRead          = "audit:read"
+)
+
+// AdminPermissions returns the names of the permissions held by an admin user. These are the permissions
+// granted to the admin's role, plus any granted to the admin individually.
+func AdminPermissions(ds datastore.Datastore, adminID int) ([]string, error) {
+
+	rows, err := ds.MySQL.Session.Query(queries["select-admin-permissions"], adminID, adminID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var xp []string
+	for rows.Next() {
+		var p string
+		err := rows.Scan(&p)
+		if err != nil {
+			return nil, err
+		}
+		xp = append(xp, p)
+	}
+
+	return xp, rows.Err()
+}
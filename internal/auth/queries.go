@@ -0,0 +1,295 @@
+package auth
+
+// Queries is a map containing common queries for the package
+var queries = map[string]string{
+	"select-member-auth":            selectMemberAuth,
+	"select-member-by-id":           selectMemberByID,
+	"select-member-id-by-login":     selectMemberIDByLogin,
+	"select-admin-auth":             selectAdminAuth,
+	"select-admin-id-by-login":      selectAdminIDByLogin,
+	"update-member-password":        updateMemberPassword,
+	"update-admin-password":         updateAdminPassword,
+	"select-member-md5-passwords":   selectMemberMD5Passwords,
+	"select-admin-md5-passwords":    selectAdminMD5Passwords,
+	"wrap-member-password":          wrapMemberPassword,
+	"wrap-admin-password":           wrapAdminPassword,
+	"update-admin-unlock":           updateAdminUnlock,
+	"insert-auth-attempt":           insertAuthAttempt,
+	"update-auth-attempt":           updateAuthAttempt,
+	"select-login-failures":         selectLoginFailures,
+	"select-ip-failures":            selectIPFailures,
+	"count-admin-mfa-failures":      countAdminMFAFailures,
+	"select-admin-by-id":            selectAdminByID,
+	"insert-refresh-token":          insertRefreshToken,
+	"select-refresh-token":          selectRefreshToken,
+	"update-refresh-token":          updateRefreshToken,
+	"set-refresh-token-replaced-by": setRefreshTokenReplacedBy,
+	"revoke-refresh-token":          revokeRefreshToken,
+	"revoke-refresh-tokens":         revokeRefreshTokens,
+	"insert-revocation-jti":         insertRevocationJTI,
+	"insert-revocation-user":        insertRevocationUser,
+	"select-revocation":             selectRevocation,
+	"select-member-by-email":        selectMemberByEmail,
+	"count-member-email":            countMemberEmail,
+	"update-member-password-reset":  updateMemberPasswordReset,
+	"update-member-email":           updateMemberEmail,
+	"insert-member-token":           insertMemberToken,
+	"use-member-token":              useMemberToken,
+	"select-member-token":           selectMemberToken,
+	"cancel-member-tokens":          cancelMemberTokens,
+	"select-admin-username":         selectAdminUsername,
+	"select-admin-mfa":              selectAdminMFA,
+	"upsert-admin-mfa":              upsertAdminMFA,
+	"enable-admin-mfa":              enableAdminMFA,
+	"update-admin-mfa-step":         updateAdminMFAStep,
+	"delete-admin-mfa":              deleteAdminMFA,
+	"insert-recovery-code":          insertRecoveryCode,
+	"use-recovery-code":             useRecoveryCode,
+	"delete-recovery-codes":         deleteRecoveryCodes,
+	"select-admin-permissions":      selectAdminPermissions,
+	"insert-api-key":                insertAPIKey,
+	"insert-api-key-rotation":       insertAPIKeyRotation,
+	"revoke-api-key":                revokeAPIKey,
+	"select-api-key":                selectAPIKey,
+	"select-api-keys":               selectAPIKeys,
+	"select-api-key-by-hash":        selectAPIKeyByHash,
+	"update-api-key-used":           updateAPIKeyUsed,
+	"insert-impersonation":          insertImpersonation,
+}
+
+const selectMemberAuth = `
+SELECT id, concat(first_name, ' ', last_name) as name, password
+FROM member WHERE primary_email = ?`
+
+const selectMemberByID = `
+SELECT id, concat(first_name, ' ', last_name) as name FROM member WHERE id = ?`
+
+const selectMemberIDByLogin = `SELECT id FROM member WHERE primary_email = ?`
+
+const selectAdminAuth = `SELECT id, name, active, locked, password FROM ad_user WHERE username = ?`
+
+const selectAdminIDByLogin = `SELECT id FROM ad_user WHERE username = ?`
+
+const updateMemberPassword = `UPDATE member SET password = ? WHERE id = ?`
+
+const updateAdminPassword = `UPDATE ad_user SET password = ? WHERE id = ?`
+
+// selectMemberMD5Passwords selects the members with an unsalted MD5 password hash
+const selectMemberMD5Passwords = `
+SELECT id, password FROM member
+WHERE LENGTH(password) = 32 AND password NOT LIKE '$2%' AND password NOT LIKE 'md5$2%'`
+
+// selectAdminMD5Passwords selects the admin users with an unsalted MD5 password hash
+const selectAdminMD5Passwords = `
+SELECT id, password FROM ad_user
+WHERE LENGTH(password) = 32 AND password NOT LIKE '$2%' AND password NOT LIKE 'md5$2%'`
+
+const wrapMemberPassword = `UPDATE member SET password = ? WHERE id = ? AND password = ?`
+
+const wrapAdminPassword = `UPDATE ad_user SET password = ? WHERE id = ? AND password = ?`
+
+const updateAdminUnlock = `UPDATE ad_user SET locked = 0, updated_at = NOW() WHERE id = ?`
+
+const insertAuthAttempt = `
+INSERT INTO log_auth_attempt (created_at, user_type, login, ip, result, ad_user_id)
+VALUES (NOW(), ?, ?, ?, ?, ?)`
+
+const updateAuthAttempt = `UPDATE log_auth_attempt SET result = ? WHERE id = ?`
+
+// selectLoginFailures counts the failed attempts for a login since the last successful login or
+// unlock, within the last day, and the number of seconds since the most recent failure.
+const selectLoginFailures = `
+SELECT
+  COUNT(*),
+  COALESCE(TIMESTAMPDIFF(SECOND, MAX(created_at), NOW()), 0)
+FROM log_auth_attempt
+WHERE user_type = ? AND login = ? AND result = 'failure' AND id < ?
+  AND created_at > NOW() - INTERVAL 1 DAY
+  AND id > COALESCE((SELECT MAX(id) FROM log_auth_attempt
+                     WHERE user_type = ? AND login = ? AND result IN ('success', 'unlock')), 0)`
+
+// selectIPFailures counts the failed attempts from an ip address within the last day, since the last unlock
+// of the address, and the number of seconds since the most recent failure. A successful login does not reset
+// the count, as anyone with an account could log in between guesses.
+const selectIPFailures = `
+SELECT
+  COUNT(*),
+  COALESCE(TIMESTAMPDIFF(SECOND, MAX(created_at), NOW()), 0)
+FROM log_auth_attempt
+WHERE ip = ? AND result = 'failure' AND id < ?
+  AND created_at > NOW() - INTERVAL 1 DAY
+  AND id > COALESCE((SELECT MAX(id) FROM log_auth_attempt
+                     WHERE ip = ? AND user_type = 'ip' AND result = 'unlock'), 0)`
+
+// countAdminMFAFailures counts the failed authentication codes for an admin since a time
+const countAdminMFAFailures = `
+SELECT COUNT(*)
+FROM log_auth_attempt la
+  JOIN ad_user u ON u.username = la.login
+WHERE la.user_type = ? AND u.id = ? AND la.result = 'failure' AND la.created_at >= FROM_UNIXTIME(?)`
+
+const selectAdminByID = `SELECT id, name, active, locked FROM ad_user WHERE id = ?`
+
+const insertRefreshToken = `
+INSERT INTO auth_refresh_token (created_at, expires_at, user_type, user_id, mfa, token_hash)
+VALUES (NOW(), DATE_ADD(NOW(), INTERVAL ? SECOND), ?, ?, ?, ?)`
+
+// selectRefreshToken fetches a refresh token by hash, along with flags for revoked, already exchanged for
+// a new token, and expired
+const selectRefreshToken = `
+SELECT
+  id,
+  user_type,
+  user_id,
+  mfa,
+  revoked_at IS NOT NULL,
+  replaced_by_id IS NOT NULL,
+  expires_at <= NOW()
+FROM auth_refresh_token
+WHERE token_hash = ?`
+
+// updateRefreshToken marks a refresh token as used. The revoked_at check ensures that two concurrent
+// requests cannot both rotate the same token.
+const updateRefreshToken = `
+UPDATE auth_refresh_token SET revoked_at = NOW()
+WHERE id = ? AND revoked_at IS NULL`
+
+const setRefreshTokenReplacedBy = `UPDATE auth_refresh_token SET replaced_by_id = ? WHERE id = ?`
+
+const revokeRefreshToken = `
+UPDATE auth_refresh_token SET revoked_at = NOW()
+WHERE token_hash = ? AND revoked_at IS NULL`
+
+const revokeRefreshTokens = `
+UPDATE auth_refresh_token SET revoked_at = NOW()
+WHERE user_type = ? AND user_id = ? AND revoked_at IS NULL`
+
+// insertRevocationJTI revokes a single access token, until it expires anyway
+const insertRevocationJTI = `
+INSERT INTO auth_revocation (created_at, expires_at, jti, user_type, user_id)
+VALUES (NOW(), FROM_UNIXTIME(?), ?, ?, ?)`
+
+// insertRevocationUser revokes all access tokens issued to a user before a time, given in milliseconds. The
+// record is only needed until the last of those tokens expires.
+const insertRevocationUser = `
+INSERT INTO auth_revocation (created_at, expires_at, user_type, user_id, issued_before)
+VALUES (NOW(), DATE_ADD(NOW(), INTERVAL ? SECOND), ?, ?, FROM_UNIXTIME(? / 1000))`
+
+// selectRevocation counts revocations that apply to an access token, either by its id (jti) or because
+// all tokens for the user issued before a certain time have been revoked. The issue time is in milliseconds
+// so that a token issued in the same second as, but after, the revocation is still valid.
+const selectRevocation = `
+SELECT COUNT(*) FROM auth_revocation
+WHERE expires_at > NOW()
+  AND (jti = ? OR (user_type = ? AND user_id = ? AND issued_before > FROM_UNIXTIME(? / 1000)))`
+
+const selectMemberByEmail = `
+SELECT id, concat(first_name, ' ', last_name) as name FROM member WHERE primary_email = ?`
+
+const countMemberEmail = `SELECT COUNT(*) FROM member WHERE primary_email = ? AND id != ?`
+
+// updateMemberPasswordReset also clears the legacy reset token
+const updateMemberPasswordReset = `UPDATE member SET password = ?, token = NULL, updated_at = NOW() WHERE id = ?`
+
+const updateMemberEmail = `UPDATE member SET primary_email = ?, updated_at = NOW() WHERE id = ?`
+
+const insertMemberToken = `
+INSERT INTO auth_member_token (created_at, expires_at, purpose, member_id, token_hash, email)
+VALUES (NOW(), DATE_ADD(NOW(), INTERVAL ? SECOND), ?, ?, ?, ?)`
+
+// useMemberToken marks a token as used, provided it has not been used and has not expired
+const useMemberToken = `
+UPDATE auth_member_token SET used_at = NOW()
+WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > NOW()`
+
+const selectMemberToken = `
+SELECT member_id, email FROM auth_member_token WHERE token_hash = ? AND purpose = ?`
+
+// cancelMemberTokens marks any unused tokens for a member, for a purpose, as used
+const cancelMemberTokens = `
+UPDATE auth_member_token SET used_at = NOW()
+WHERE member_id = ? AND purpose = ? AND used_at IS NULL`
+
+const selectAdminUsername = `SELECT username FROM ad_user WHERE id = ?`
+
+const selectAdminMFA = `
+SELECT secret, enabled_at IS NOT NULL, last_step FROM ad_user_mfa WHERE ad_user_id = ?`
+
+// upsertAdminMFA stores a new secret for an admin that has not yet confirmed enrolment
+const upsertAdminMFA = `
+INSERT INTO ad_user_mfa (ad_user_id, created_at, secret) VALUES (?, NOW(), ?)
+ON DUPLICATE KEY UPDATE secret = ?, updated_at = NOW(), enabled_at = NULL, last_step = 0`
+
+const enableAdminMFA = `
+UPDATE ad_user_mfa SET enabled_at = NOW(), updated_at = NOW(), last_step = ? WHERE ad_user_id = ?`
+
+// updateAdminMFAStep records the time step of a TOTP code that has been used, provided it is later than the
+// last one
+const updateAdminMFAStep = `
+UPDATE ad_user_mfa SET last_step = ? WHERE ad_user_id = ? AND last_step < ?`
+
+const deleteAdminMFA = `DELETE FROM ad_user_mfa WHERE ad_user_id = ?`
+
+const insertRecoveryCode = `
+INSERT INTO ad_user_recovery_code (ad_user_id, created_at, code_hash) VALUES (?, NOW(), ?)`
+
+const useRecoveryCode = `
+UPDATE ad_user_recovery_code SET used_at = NOW()
+WHERE ad_user_id = ? AND code_hash = ? AND used_at IS NULL`
+
+const deleteRecoveryCodes = `DELETE FROM ad_user_recovery_code WHERE ad_user_id = ?`
+
+// selectAdminPermissions selects the active permissions granted to an admin's role, and to the admin
+// individually
+const selectAdminPermissions = `
+SELECT p.name FROM ad_permission p
+  JOIN acl_admin_role_permission rp ON rp.ad_permission_id = p.id AND rp.active = 1
+  JOIN ad_user u ON u.acl_admin_role_id = rp.acl_admin_role_id
+WHERE u.id = ? AND p.active = 1
+UNION
+SELECT p.name FROM ad_permission p
+  JOIN ad_user_permission up ON up.ad_permission_id = p.id AND up.active = 1
+WHERE up.ad_user_id = ? AND p.active = 1
+ORDER BY 1`
+
+// insertAPIKey creates an api key that expires after a number of days, or never if the interval is NULL
+const insertAPIKey = `
+INSERT INTO auth_api_key (created_at, expires_at, name, hint, key_hash, scopes, ad_user_id)
+VALUES (NOW(), DATE_ADD(NOW(), INTERVAL ? DAY), ?, ?, ?, ?, ?)`
+
+// insertAPIKeyRotation creates a new api key with the same name, scopes and expiry as an active key
+const insertAPIKeyRotation = `
+INSERT INTO auth_api_key (created_at, expires_at, name, hint, key_hash, scopes, ad_user_id)
+SELECT NOW(), expires_at, name, ?, ?, scopes, ? FROM auth_api_key WHERE id = ? AND revoked_at IS NULL`
+
+// revokeAPIKey revokes an active api key, and records the key that replaced it, if any
+const revokeAPIKey = `
+UPDATE auth_api_key SET revoked_at = NOW(), replaced_by_id = ?
+WHERE id = ? AND revoked_at IS NULL`
+
+const selectAPIKeyFields = `
+SELECT id, name, hint, scopes, ad_user_id, created_at, expires_at, last_used_at, revoked_at
+FROM auth_api_key`
+
+const selectAPIKey = selectAPIKeyFields + ` WHERE id = ?`
+
+const selectAPIKeys = selectAPIKeyFields + ` ORDER BY id`
+
+// selectAPIKeyByHash fetches an api key by hash, with a flag that is set if it has not expired or been revoked
+const selectAPIKeyByHash = `
+SELECT
+  id,
+  name,
+  scopes,
+  revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+FROM auth_api_key
+WHERE key_hash = ?`
+
+// updateAPIKeyUsed records when an api key was used, at most once a minute to save writes
+const updateAPIKeyUsed = `
+UPDATE auth_api_key SET last_used_at = NOW()
+WHERE id = ? AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL 1 MINUTE)`
+
+const insertImpersonation = `
+INSERT INTO log_impersonation (created_at, ad_user_id, member_id, jti, method, path, ip)
+VALUES (NOW(), ?, ?, ?, ?, ?, ?)`
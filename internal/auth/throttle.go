@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+	"github.com/pkg/errors"
+)
+
+// User types for login attempts
+const (
+	UserAdmin  = "admin"
+	UserMember = "member"
+)
+
+// userIP is the user type recorded when an admin clears the lockout on an ip address
+const userIP = "ip"
+
+// userAdminMFA is the user type recorded for the TOTP or recovery code step of an admin login. Codes have
+// their own count of failures, which is not reset by a successful password.
+const userAdminMFA = "admin-mfa"
+
+// userReset is the user type recorded for a password reset request, with the email address as the login.
+// Requests are throttled like logins, so that the endpoint cannot be used to flood a member with emails.
+const userReset = "reset"
+
+// Results recorded for each login attempt
+const (
+	resultSuccess   = "success"
+	resultFailure   = "failure"
+	resultDenied    = "denied"
+	resultThrottled = "throttled"
+	resultUnlock    = "unlock"
+)
+
+// Throttling kicks in after this many consecutive failures, for a login or from an ip address. Each
+// further failure doubles the lockout period, starting at baseLockout up to maxLockout.
+const (
+	loginFailureLimit = 5
+	ipFailureLimit    = 20
+	baseLockout       = 30 * time.Second
+	maxLockout        = time.Hour
+)
+
+// ThrottledError is returned when there have been too many failed login attempts. Wait is the time
+// remaining before another attempt will be accepted.
+type ThrottledError struct {
+	Wait time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("too many failed login attempts - try again in %s", e.Wait)
+}
+
+// Login authenticates a member or admin user, depending on userType. Attempts are refused while the login
+// or the ip address is locked out due to previous failures. Every attempt is recorded in the auth log.
+func Login(ds datastore.Datastore, userType, u, p, ip string) (int, string, error) {
+
+	var authenticate func(datastore.Datastore, string, string) (int, string, error)
+	switch userType {
+	case UserMember:
+		authenticate = AuthMember
+	case UserAdmin:
+		authenticate = AdminAuth
+	default:
+		return 0, "", errors.New("unknown user type: " + userType)
+	}
+
+	attemptID, wait, err := beginAttempt(ds, userType, u, ip)
+	if err != nil {
+		return 0, "", err
+	}
+	if wait > 0 {
+		settleAttempt(ds, attemptID, resultThrottled)
+		return 0, "", &ThrottledError{Wait: wait}
+	}
+
+	id, name, err := authenticate(ds, u, p)
+	switch {
+	case err == nil:
+		settleAttempt(ds, attemptID, resultSuccess)
+	case err == ErrAccountInactive, err == ErrAccountLocked:
+		settleAttempt(ds, attemptID, resultDenied)
+	}
+
+	return id, name, err
+}
+
+// ResetRequest records a password reset request for an email address, and returns a ThrottledError if there
+// have been too many requests for the address or failures from the ip address. As a request has no result
+// that should clear the count, each one is recorded as a failure.
+func ResetRequest(ds datastore.Datastore, email, ip string) error {
+
+	attemptID, wait, err := beginAttempt(ds, userReset, email, ip)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		settleAttempt(ds, attemptID, resultThrottled)
+		return &ThrottledError{Wait: wait}
+	}
+
+	return nil
+}
+
+// Unlock clears the temporary lockout for a login and, for an admin, the lockout on authentication codes and
+// the locked flag on the account. The id of the admin performing the unlock is recorded in the auth log.
+func Unlock(ds datastore.Datastore, userType, u string, adminID int) error {
+
+	var id int
+	switch userType {
+	case UserMember:
+		err := ds.MySQL.Session.QueryRow(queries["select-member-id-by-login"], u).Scan(&id)
+		if err != nil {
+			return err
+		}
+	case UserAdmin:
+		err := ds.MySQL.Session.QueryRow(queries["select-admin-id-by-login"], u).Scan(&id)
+		if err != nil {
+			return err
+		}
+		_, err = ds.MySQL.Session.Exec(queries["update-admin-unlock"], id)
+		if err != nil {
+			return err
+		}
+		_, err = ds.MySQL.Session.Exec(queries["insert-auth-attempt"], userAdminMFA, u, "", resultUnlock, adminID)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("unknown user type: " + userType)
+	}
+
+	_, err := ds.MySQL.Session.Exec(queries["insert-auth-attempt"], userType, u, "", resultUnlock, adminID)
+	return err
+}
+
+// UnlockIP clears the temporary lockout for an ip address, after too many failed logins from that address.
+// The id of the admin performing the unlock is recorded in the auth log.
+func UnlockIP(ds datastore.Datastore, ip string, adminID int) error {
+
+	if net.ParseIP(ip) == nil {
+		return errors.New("not a valid ip address: " + ip)
+	}
+
+	_, err := ds.MySQL.Session.Exec(queries["insert-auth-attempt"], userIP, "", ip, resultUnlock, adminID)
+	return err
+}
+
+// beginAttempt records a login attempt as a failure before the credentials are checked, and returns its id
+// and the time remaining before the login, or the ip address, can attempt to log in again. As each attempt
+// is counted before it is checked, attempts made at the same time cannot all get past the lockout. The
+// result is corrected with settleAttempt once it is known, so an attempt that ends in any other error stays
+// a failure.
+func beginAttempt(ds datastore.Datastore, userType, u, ip string) (int64, time.Duration, error) {
+
+	res, err := ds.MySQL.Session.Exec(queries["insert-auth-attempt"], userType, u, ip, resultFailure, nil)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "could not record login attempt")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "could not record login attempt")
+	}
+
+	wait, err := lockout(ds, userType, u, ip, id)
+	return id, wait, err
+}
+
+// settleAttempt sets the result of a login attempt recorded by beginAttempt. A failure to write the result is
+// logged rather than returned so that it does not prevent the login.
+func settleAttempt(ds datastore.Datastore, id int64, result string) {
+
+	_, err := ds.MySQL.Session.Exec(queries["update-auth-attempt"], result, id)
+	if err != nil {
+		log.Printf("Could not record %s result for login attempt id %d - %s", result, id, err)
+	}
+}
+
+// lockout returns the time remaining before the login, or the ip address, can attempt to log in again, from
+// the attempts recorded before the attempt with id before
+func lockout(ds datastore.Datastore, userType, u, ip string, before int64) (time.Duration, error) {
+
+	var count, since int
+	err := ds.MySQL.Session.QueryRow(queries["select-login-failures"], userType, u, before, userType, u).Scan(&count, &since)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not count failed logins")
+	}
+	wait := backoff(count, loginFailureLimit, since)
+
+	err = ds.MySQL.Session.QueryRow(queries["select-ip-failures"], ip, before, ip).Scan(&count, &since)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not count failed logins")
+	}
+	if w := backoff(count, ipFailureLimit, since); w > wait {
+		wait = w
+	}
+
+	return wait, nil
+}
+
+// backoff returns the remaining lockout after count consecutive failures, the most recent of which was
+// since seconds ago. The lockout doubles for each failure over the limit.
+func backoff(count, limit, since int) time.Duration {
+
+	if count < limit {
+		return 0
+	}
+
+	d := baseLockout
+	for i := limit; i < count && d < maxLockout; i++ {
+		d *= 2
+	}
+	if d > maxLockout {
+		d = maxLockout
+	}
+
+	return d - time.Duration(since)*time.Second
+}
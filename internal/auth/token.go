@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+	"github.com/cardiacsociety/web-services/internal/platform/jwt"
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidRefreshToken is returned when a refresh token is unknown, has expired or has been revoked
+var ErrInvalidRefreshToken = errors.New("refresh token is invalid or has expired")
+
+// ErrRefreshTokenReused is returned when a refresh token that has already been exchanged is presented
+// again. This suggests the token has been stolen, so all of the user's sessions are revoked.
+var ErrRefreshTokenReused = errors.New("refresh token has already been used - all sessions have been revoked")
+
+// Refresh is the result of exchanging a refresh token. It identifies the user for a new access token, and
+// holds the refresh token that replaces the one that was used.
+type Refresh struct {
+	UserType  string
+	UserID    int
+	Name      string
+	MFA       bool
+	Token     string
+	ExpiresAt time.Time
+}
+
+// NewRefreshToken issues an opaque refresh token for a user, valid for ttl. Only a hash of the token is
+// stored so the token itself cannot be recovered from the database. If mfa is true the user verified a
+// second factor when they logged in, and this carries over to access tokens issued on refresh.
+func NewRefreshToken(ds datastore.Datastore, userType string, userID int, mfa bool, ttl time.Duration) (string, error) {
+	token, _, err := storeRefreshToken(ds, userType, userID, mfa, ttl)
+	return token, err
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one, valid for ttl. Each refresh token can be used
+// only once. If a token that has already been exchanged is presented again, all refresh tokens for the
+// user are revoked.
+func RotateRefreshToken(ds datastore.Datastore, token string, ttl time.Duration) (Refresh, error) {
+
+	var r Refresh
+	var id int
+	var revoked, replaced, expired bool
+	err := ds.MySQL.Session.QueryRow(queries["select-refresh-token"], hashToken(token)).Scan(&id, &r.UserType, &r.UserID, &r.MFA, &revoked, &replaced, &expired)
+	if err == sql.ErrNoRows {
+		return r, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return r, err
+	}
+	if replaced {
+		return r, reused(ds, r.UserType, r.UserID)
+	}
+	if revoked || expired {
+		return r, ErrInvalidRefreshToken
+	}
+
+	// Claim the token, if another request got there first then this is also a reuse
+	res, err := ds.MySQL.Session.Exec(queries["update-refresh-token"], id)
+	if err != nil {
+		return r, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return r, reused(ds, r.UserType, r.UserID)
+	}
+
+	r.Name, err = activeUserName(ds, r.UserType, r.UserID)
+	if err != nil {
+		return r, err
+	}
+
+	var newID int
+	r.Token, newID, err = storeRefreshToken(ds, r.UserType, r.UserID, r.MFA, ttl)
+	if err != nil {
+		return r, err
+	}
+	r.ExpiresAt = time.Now().Add(ttl)
+
+	_, err = ds.MySQL.Session.Exec(queries["set-refresh-token-replaced-by"], newID, id)
+	return r, err
+}
+
+// RevokeRefreshToken revokes a single refresh token, eg on logout
+func RevokeRefreshToken(ds datastore.Datastore, token string) error {
+	_, err := ds.MySQL.Session.Exec(queries["revoke-refresh-token"], hashToken(token))
+	return err
+}
+
+// RevokeAccessToken revokes a single access token, identified by its jti claim, until it expires
+func RevokeAccessToken(ds datastore.Datastore, t jwt.Token) error {
+	if t.Claims.Id == "" {
+		return errors.New("cannot revoke a token without a jti claim")
+	}
+	_, err := ds.MySQL.Session.Exec(queries["insert-revocation-jti"], t.Claims.ExpiresAt, t.Claims.Id, t.Claims.Role, t.Claims.ID)
+	return err
+}
+
+// RevokeAll revokes all refresh tokens for a user, and all access tokens issued to the user up to now.
+// The accessTTL is the lifetime of access tokens, after which the revocation record is no longer needed.
+func RevokeAll(ds datastore.Datastore, userType string, userID int, accessTTL time.Duration) error {
+
+	_, err := ds.MySQL.Session.Exec(queries["revoke-refresh-tokens"], userType, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = ds.MySQL.Session.Exec(queries["insert-revocation-user"], int(accessTTL.Seconds())+1, userType, userID, nowMs())
+	return err
+}
+
+// Revoked returns true if the access token has been revoked
+func Revoked(ds datastore.Datastore, t jwt.Token) (bool, error) {
+	var n int
+	err := ds.MySQL.Session.QueryRow(queries["select-revocation"], t.Claims.Id, t.Claims.Role, t.Claims.ID, t.Claims.IssuedAtMs).Scan(&n)
+	return n > 0, err
+}
+
+// nowMs returns the current time in milliseconds, to compare with the iatms claim of an access token
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// storeRefreshToken generates and stores a new refresh token, and returns the token and its record id
+func storeRefreshToken(ds datastore.Datastore, userType string, userID int, mfa bool, ttl time.Duration) (string, int, error) {
+
+	xb := make([]byte, 32)
+	if _, err := rand.Read(xb); err != nil {
+		return "", 0, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(xb)
+
+	res, err := ds.MySQL.Session.Exec(queries["insert-refresh-token"], int(ttl.Seconds()), userType, userID, mfa, hashToken(token))
+	if err != nil {
+		return "", 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return "", 0, err
+	}
+
+	return token, int(id), nil
+}
+
+// reused revokes all refresh tokens for a user after a used refresh token was presented again
+func reused(ds datastore.Datastore, userType string, userID int) error {
+	_, err := ds.MySQL.Session.Exec(queries["revoke-refresh-tokens"], userType, userID)
+	if err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
+}
+
+// activeUserName returns the name of a member or admin user. An admin that is no longer active, or has
+// been locked, cannot refresh their session.
+func activeUserName(ds datastore.Datastore, userType string, userID int) (string, error) {
+
+	var id int
+	var name string
+
+	switch userType {
+	case UserMember:
+		err := ds.MySQL.Session.QueryRow(queries["select-member-by-id"], userID).Scan(&id, &name)
+		return name, err
+	case UserAdmin:
+		var active, locked int
+		err := ds.MySQL.Session.QueryRow(queries["select-admin-by-id"], userID).Scan(&id, &name, &active, &locked)
+		if err != nil {
+			return "", err
+		}
+		if active != 1 {
+			return "", ErrAccountInactive
+		}
+		if locked != 0 {
+			return "", ErrAccountLocked
+		}
+		return name, nil
+	}
+
+	return "", errors.New("unknown user type: " + userType)
+}
+
+// hashToken returns the hex encoded sha256 hash of a token. Refresh and member tokens are long and random
+// so a fast, unsalted hash is sufficient.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
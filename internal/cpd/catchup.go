@@ -0,0 +1,200 @@
+package cpd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cardiacsociety/web-services/internal/activity"
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+)
+
+// ErrCatchUp is returned when the occurrences to record or skip are not due, are in both lists, or would leave
+// an earlier due occurrence behind
+var ErrCatchUp = errors.New("occurrences to record or skip must be due, in one list only, and include every earlier due occurrence")
+
+// Occurrence is a due occurrence of a recurring activity. DuplicateOf is the id of an existing cpd record that
+// is the same as the one that would be recorded for the occurrence, or 0 if there is none.
+type Occurrence struct {
+	Date        string `json:"date"`
+	DuplicateOf int    `json:"duplicateOf"`
+}
+
+// Due returns the occurrences of the recurring activity identified by oid that are due on or before the date
+// upTo, starting at Next
+func (r *Recurring) Due(ds datastore.Datastore, oid string, upTo time.Time) ([]Occurrence, error) {
+
+	var xo []Occurrence
+
+	a, err := r.GetActivity(oid)
+	if err != nil {
+		return xo, err
+	}
+
+	xd, err := a.due(upTo)
+	if err != nil {
+		return xo, err
+	}
+
+	for _, d := range xd {
+		in, err := r.input(ds, a, d)
+		if err != nil {
+			return xo, err
+		}
+		id, err := duplicateOf(ds, in)
+		if err != nil {
+			return xo, err
+		}
+		xo = append(xo, Occurrence{Date: in.Date, DuplicateOf: id})
+	}
+
+	return xo, nil
+}
+
+// CatchUp records or skips the occurrences of the recurring activity identified by oid that are due today or
+// earlier. Each date to record is inserted as a cpd record, in a single transaction, unless the same record
+// already exists. Next is then moved past the last date recorded or skipped, and the ids of the new records
+// are returned. Dates before Next have already been handled and are ignored, so the same request can be
+// repeated safely. Existing records are found with a locking read, so that two requests at the same time
+// cannot both insert the same record.
+func (r *Recurring) CatchUp(ds datastore.Datastore, oid string, record, skip []string) ([]int, error) {
+
+	var ids []int
+
+	a, err := r.GetActivity(oid)
+	if err != nil {
+		return ids, err
+	}
+
+	xd, err := a.due(time.Now())
+	if err != nil {
+		return ids, err
+	}
+
+	// the dates to handle, true to record and false to skip
+	handle := map[string]bool{}
+	next := a.Next.Format("2006-01-02")
+	for _, d := range record {
+		if d >= next {
+			handle[d] = true
+		}
+	}
+	for _, d := range skip {
+		if _, ok := handle[d]; ok {
+			return ids, ErrCatchUp
+		}
+		if d >= next {
+			handle[d] = false
+		}
+	}
+	if len(handle) == 0 {
+		return ids, nil
+	}
+
+	// the dates handled must be the earliest due occurrences
+	var n int
+	for _, d := range xd {
+		if _, ok := handle[d.Format("2006-01-02")]; !ok {
+			break
+		}
+		n++
+	}
+	if n != len(handle) {
+		return ids, ErrCatchUp
+	}
+
+	// move Next on first, so that nothing is recorded if it cannot be
+	a.Next = xd[n-1]
+	err = a.UpdateNext()
+	if err != nil {
+		return ids, err
+	}
+
+	err = ds.MySQL.InTx(func(ex datastore.Execer) error {
+		for _, d := range xd[:n] {
+			if !handle[d.Format("2006-01-02")] {
+				continue
+			}
+			in, err := r.input(ds, a, d)
+			if err != nil {
+				return err
+			}
+			dup, err := duplicateOfLocked(ex, in)
+			if err != nil {
+				return err
+			}
+			if dup > 0 {
+				continue
+			}
+			id, err := addTx(ds, ex, in)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a.UpdatedAt = time.Now()
+	r.UpdateActivity(ds, a)
+
+	return ids, nil
+}
+
+// due returns the dates of the occurrences from Next up to and including the date upTo
+func (a RecurringActivity) due(upTo time.Time) ([]time.Time, error) {
+
+	var xd []time.Time
+	if a.Finished || a.Next.IsZero() {
+		return xd, nil
+	}
+
+	rule, err := ParseRRule(a.RRule)
+	if err != nil {
+		return xd, err
+	}
+
+	start := a.Start
+	if start.IsZero() {
+		start = a.Next
+	}
+	upTo = dateOf(upTo, a.Next.Location())
+
+	d, ok := dateOf(a.Next, a.Next.Location()), true
+	for ok && !d.After(upTo) {
+		xd = append(xd, d)
+		d, ok = rule.Next(start, d)
+	}
+
+	return xd, nil
+}
+
+// input returns the cpd record for an occurrence of a recurring activity. Recurring activities saved before
+// TypeID was added can only be recorded if the activity has a single type.
+func (r *Recurring) input(ds datastore.Datastore, a RecurringActivity, date time.Time) (Input, error) {
+
+	in := Input{
+		MemberID:    r.MemberID,
+		ActivityID:  a.ActivityID,
+		TypeID:      a.TypeID,
+		Date:        date.Format("2006-01-02"),
+		Quantity:    a.Quantity,
+		Description: a.Description,
+	}
+
+	if in.TypeID == 0 {
+		xt, err := activity.Types(ds, a.ActivityID)
+		if err != nil {
+			return in, err
+		}
+		if len(xt) != 1 {
+			return in, fmt.Errorf("recurring activity %s needs a typeId as activity %d has %d types", a.ID.Hex(), a.ActivityID, len(xt))
+		}
+		in.TypeID = xt[0].ID
+	}
+
+	return in, nil
+}
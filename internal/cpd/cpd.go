@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -13,6 +14,9 @@ import (
 	"github.com/cardiacsociety/web-services/internal/platform/datastore"
 )
 
+// RetentionDays is the number of days that a deleted record can be restored, before it can be purged
+const RetentionDays = 30
+
 // CPD represents an instance of a cpd activity recorded by a member - ie a CPD diary entry
 type CPD struct {
 	ID          int               `json:"id" bson:"id"`
@@ -30,6 +34,14 @@ type CPD struct {
 	CreditData  activity.Credit   `json:"creditData" bson:"creditData"`
 }
 
+// StoredFile is the location of a file in cloud storage
+type StoredFile struct {
+	// Volume is the name of the bucket
+	Volume string
+	// Key is the full path to the file in the bucket
+	Key string
+}
+
 // Input contains fields required to add or update a Member Activity
 type Input struct {
 	ID          int     `json:"ID"`
@@ -53,9 +65,9 @@ func ByMemberID(ds datastore.Datastore, memberID int) ([]CPD, error) {
 	return cpdByMemberID(ds, memberID)
 }
 
-// Query runs the base cpd query with any filter clause
-func Query(ds datastore.Datastore, sqlClause string) ([]CPD, error) {
-	return cpdQuery(ds, sqlClause)
+// Query runs the base cpd query with the filter clause c, which may be nil
+func Query(ds datastore.Datastore, c *datastore.Clause) ([]CPD, error) {
+	return cpdQuery(ds, c)
 }
 
 // Add inserts a new cpd record into the specified datastore, and returns the new id - used for testing
@@ -73,17 +85,38 @@ func DuplicateOf(ds datastore.Datastore, a Input) (int, error) {
 	return duplicateOf(ds, a)
 }
 
-// Delete ensures the record is owned by MemberID before deleting from specified datastore - used for testing
+// Delete ensures the record is owned by MemberID before deleting it. The record is only marked as deleted, and
+// can be restored for RetentionDays, after which it can be purged. If there is no such record for the member
+// the error is sql.ErrNoRows.
 func Delete(ds datastore.Datastore, memberID, activityID int) error {
 	return delete(ds, memberID, activityID)
 }
 
+// Restore undoes the deletion of a record owned by memberID, within RetentionDays of it being deleted. If there
+// is no such record the error is sql.ErrNoRows.
+func Restore(ds datastore.Datastore, memberID, activityID int) error {
+	return restore(ds, memberID, activityID)
+}
+
+// Deleted fetches the records belonging to a member that have been deleted and can still be restored, most
+// recently deleted first
+func Deleted(ds datastore.Datastore, memberID int) ([]CPD, error) {
+	return cpdRows(ds, Queries["select-member-activity-deleted"], RetentionDays, memberID)
+}
+
+// Purge permanently removes the records that were deleted more than RetentionDays ago, along with their
+// attachment records, and returns the number of records purged. It also returns the attached files, which are
+// no longer referenced and should be removed from cloud storage by the caller.
+func Purge(ds datastore.Datastore) (int, []StoredFile, error) {
+	return purge(ds)
+}
+
 func cpdByID(ds datastore.Datastore, id int) (CPD, error) {
 
 	a := CPD{}
 	var evidence int // stored as 0/1 in db - translate to bool
 
-	query := Queries["select-member-activity"] + ` WHERE cma.id = ?`
+	query := Queries["select-member-activity"] + ` AND cma.id = ?`
 	err := ds.MySQL.Session.QueryRow(query, id).Scan(
 		&a.ID,
 		&a.MemberID,
@@ -125,7 +158,7 @@ func cpdByMemberID(ds datastore.Datastore, id int) ([]CPD, error) {
 
 	var xc []CPD
 
-	query := Queries["select-member-activity"] + ` WHERE member_id = ? ORDER BY activity_on DESC`
+	query := Queries["select-member-activity"] + ` AND member_id = ? ORDER BY activity_on DESC`
 	rows, err := ds.MySQL.Session.Query(query, id)
 	if err != nil {
 		return xc, err
@@ -171,12 +204,25 @@ func cpdByMemberID(ds datastore.Datastore, id int) ([]CPD, error) {
 	return xc, nil
 }
 
-func cpdQuery(ds datastore.Datastore, clause string) ([]CPD, error) {
+func cpdQuery(ds datastore.Datastore, c *datastore.Clause) ([]CPD, error) {
 
 	var xc []CPD
 
+	clause, args, err := c.And()
+	if err != nil {
+		return xc, err
+	}
+
 	query := Queries["select-member-activity"] + ` ` + clause
-	rows, err := ds.MySQL.Session.Query(query)
+	return cpdRows(ds, query, args...)
+}
+
+// cpdRows runs a query based on select-member-activity and scans the rows
+func cpdRows(ds datastore.Datastore, query string, args ...interface{}) ([]CPD, error) {
+
+	var xc []CPD
+
+	rows, err := ds.MySQL.Session.Query(query, args...)
 	if err != nil {
 		return xc, err
 	}
@@ -222,6 +268,11 @@ func cpdQuery(ds datastore.Datastore, clause string) ([]CPD, error) {
 }
 
 func add(ds datastore.Datastore, a Input) (int, error) {
+	return addTx(ds, ds.MySQL.Session, a)
+}
+
+// addTx inserts the record using ex, so that it can be part of a transaction
+func addTx(ds datastore.Datastore, ex datastore.Execer, a Input) (int, error) {
 
 	validate := validator.New()
 	err := validate.Struct(a)
@@ -242,13 +293,8 @@ func add(ds datastore.Datastore, a Input) (int, error) {
 		evidence = 1
 	}
 
-	query := `INSERT INTO ce_m_activity
-	(member_id, ce_activity_id, ce_activity_type_id, evidence, created_at, updated_at,
-	activity_on, quantity, points_per_unit, description)
-	VALUES("%v", "%v", "%v", "%v", NOW(), NOW(), "%v", "%v", "%v", "%v")`
-	query = fmt.Sprintf(query, a.MemberID, a.ActivityID, a.TypeID, evidence, a.Date, a.Quantity, a.UnitCredit, a.Description)
-
-	r, err := ds.MySQL.Session.Exec(query)
+	r, err := ex.Exec(Queries["insert-member-activity"],
+		a.MemberID, a.ActivityID, a.TypeID, evidence, a.Date, a.Quantity, a.UnitCredit, a.Description)
 	if err != nil {
 		return 0, err
 	}
@@ -282,11 +328,8 @@ func update(ds datastore.Datastore, a Input) error {
 		evidence = 1
 	}
 
-	query := `UPDATE ce_m_activity SET ce_activity_id= "%v", ce_activity_type_id= "%v", evidence= "%v",
-    updated_at = NOW(), activity_on = "%v", quantity= "%v", points_per_unit= "%v", description = "%v"
-    WHERE id = %v LIMIT 1`
-	query = fmt.Sprintf(query, a.ActivityID, a.TypeID, evidence, a.Date, a.Quantity, a.UnitCredit, a.Description, a.ID)
-	_, err = ds.MySQL.Session.Exec(query)
+	_, err = ds.MySQL.Session.Exec(Queries["update-member-activity"],
+		a.ActivityID, a.TypeID, evidence, a.Date, a.Quantity, a.UnitCredit, a.Description, a.ID)
 	if err != nil {
 		return err
 	}
@@ -296,13 +339,111 @@ func update(ds datastore.Datastore, a Input) error {
 
 // delete requires memberID to ensure ownership of the cpd record
 func delete(ds datastore.Datastore, memberID, activityID int) error {
-	query := `DELETE FROM ce_m_activity WHERE member_id = %d AND id = %d LIMIT 1`
-	query = fmt.Sprintf(query, memberID, activityID)
-	_, err := ds.MySQL.Session.Exec(query)
-	return err
+	res, err := ds.MySQL.Session.Exec(Queries["delete-member-activity"], memberID, activityID)
+	if err != nil {
+		return err
+	}
+	return oneRowAffected(res)
+}
+
+// restore requires memberID to ensure ownership of the cpd record
+func restore(ds datastore.Datastore, memberID, activityID int) error {
+	res, err := ds.MySQL.Session.Exec(Queries["restore-member-activity"], memberID, activityID, RetentionDays)
+	if err != nil {
+		return err
+	}
+	return oneRowAffected(res)
+}
+
+func purge(ds datastore.Datastore) (int, []StoredFile, error) {
+
+	var ids []interface{}
+	var files []StoredFile
+	err := ds.MySQL.InTx(func(ex datastore.Execer) error {
+
+		rows, err := ex.Query(Queries["select-member-activity-purge-ids"], RetentionDays)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if len(ids) == 0 {
+			return nil
+		}
+
+		in := "?" + strings.Repeat(", ?", len(ids)-1)
+		files, err = purgeFiles(ex, in, ids)
+		if err != nil {
+			return err
+		}
+
+		for _, q := range []string{"purge-member-activity-attachments", "purge-member-activities"} {
+			_, err := ex.Exec(fmt.Sprintf(Queries[q], in), ids...)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return len(ids), files, nil
+}
+
+// purgeFiles fetches the stored files attached to the activities being purged. The in string is the list of
+// placeholders for ids.
+func purgeFiles(ex datastore.Execer, in string, ids []interface{}) ([]StoredFile, error) {
+
+	rows, err := ex.Query(fmt.Sprintf(Queries["select-member-activity-purge-files"], in), ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []StoredFile
+	for rows.Next() {
+		var f StoredFile
+		err := rows.Scan(&f.Volume, &f.Key)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// oneRowAffected returns sql.ErrNoRows if an update did not affect exactly one row
+func oneRowAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return sql.ErrNoRows
+	}
+	return nil
 }
 
 func duplicateOf(ds datastore.Datastore, a Input) (int, error) {
+	return duplicateOfTx(ds.MySQL.Session, a, "select-member-activity-duplicate")
+}
+
+// duplicateOfLocked checks for a duplicate with a locking read, so that inside a transaction another one cannot
+// insert the same record until this one is done
+func duplicateOfLocked(ex datastore.Execer, a Input) (int, error) {
+	return duplicateOfTx(ex, a, "lock-member-activity-duplicate")
+}
+
+func duplicateOfTx(ex datastore.Execer, a Input, query string) (int, error) {
 
 	var dupId int
 
@@ -312,11 +453,8 @@ func duplicateOf(ds datastore.Datastore, a Input) (int, error) {
 		return dupId, err
 	}
 
-	query := `SELECT id FROM ce_m_activity WHERE member_id = "%v" AND ce_activity_id = "%v" AND 
-		ce_activity_type_id = "%v" AND activity_on = "%v" AND description = "%v" LIMIT 1`
-	query = fmt.Sprintf(query, a.MemberID, a.ActivityID, a.TypeID, a.Date, a.Description)
-
-	err = ds.MySQL.Session.QueryRow(query).Scan(&dupId)
+	err = ex.QueryRow(Queries[query],
+		a.MemberID, a.ActivityID, a.TypeID, a.Date, a.Description).Scan(&dupId)
 	if err == sql.ErrNoRows {
 		return dupId, nil
 	}
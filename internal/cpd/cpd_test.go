@@ -1,12 +1,18 @@
 package cpd_test
 
 import (
+	"bytes"
+	"database/sql"
 	"log"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cardiacsociety/web-services/internal/cpd"
 	"github.com/cardiacsociety/web-services/internal/platform/datastore"
 	"github.com/cardiacsociety/web-services/testdata"
+	"gopkg.in/mgo.v2/bson"
 )
 
 var ds datastore.Datastore
@@ -26,9 +32,16 @@ func TestCPD(t *testing.T) {
 		t.Run("testCPDByMemberID", testCPDByMemberID)
 		t.Run("testCPDQuery", testCPDQuery)
 		t.Run("testAddCPD", testAddCPD)
+		t.Run("testAddCPDQuotedDescription", testAddCPDQuotedDescription)
 		t.Run("testUpdateCPD", testUpdateCPD)
 		t.Run("testDuplicateOf", testDuplicateOf)
 		t.Run("testDelete", testDelete)
+		t.Run("testRestore", testRestore)
+		t.Run("testPurge", testPurge)
+		t.Run("testImportCSV", testImportCSV)
+		t.Run("testImportICS", testImportICS)
+		t.Run("testExport", testExport)
+		t.Run("testRecurringCatchUp", testRecurringCatchUp)
 	})
 }
 
@@ -38,11 +51,19 @@ func setup() (datastore.Datastore, func()) {
 	if err != nil {
 		log.Fatalf("SetupMySQL() err = %s", err)
 	}
+	err = db.SetupMongoDB()
+	if err != nil {
+		log.Fatalf("SetupMongoDB() err = %s", err)
+	}
 	return db.Store, func() {
 		err := db.TearDownMySQL()
 		if err != nil {
 			log.Fatalf("TearDownMySQL() err = %s", err)
 		}
+		err = db.TearDownMongoDB()
+		if err != nil {
+			log.Fatalf("TearDownMongoDB() err = %s", err)
+		}
 	}
 }
 
@@ -90,7 +111,7 @@ func testCPDByMemberID(t *testing.T) {
 }
 
 func testCPDQuery(t *testing.T) {
-	xc, err := cpd.Query(ds, "WHERE cma.description LIKE '%Bruno%'")
+	xc, err := cpd.Query(ds, datastore.NewClause().Like("cma.description", "%Bruno%"))
 	if err != nil {
 		t.Fatalf("cpd.Query() err = %s", err)
 	}
@@ -128,6 +149,38 @@ func testAddCPD(t *testing.T) {
 	}
 }
 
+// description containing quotes should be stored as is
+func testAddCPDQuotedDescription(t *testing.T) {
+	c := cpd.Input{
+		MemberID:    1,
+		ActivityID:  24,
+		TypeID:      25,
+		Date:        "2018-05-08",
+		Quantity:    1,
+		Description: `Read "Heart" journal, then '); DELETE FROM ce_m_activity; --`,
+	}
+	id, err := cpd.Add(ds, c)
+	if err != nil {
+		t.Fatalf("cpd.Add() err = %s", err)
+	}
+
+	r, err := cpd.ByID(ds, id)
+	if err != nil {
+		t.Fatalf("cpd.ByID(%d) err = %s", id, err)
+	}
+	if r.Description != c.Description {
+		t.Fatalf("cpd.ByID(%d).Description = %q, want %q", id, r.Description, c.Description)
+	}
+
+	dupID, err := cpd.DuplicateOf(ds, c)
+	if err != nil {
+		t.Fatalf("cpd.DuplicateOf() err = %s", err)
+	}
+	if dupID != id {
+		t.Errorf("cpd.DuplicateOf() = %d, want %d", dupID, id)
+	}
+}
+
 func testUpdateCPD(t *testing.T) {
 	c := cpd.Input{
 		ID:          2,
@@ -191,7 +244,7 @@ func testDuplicateOf(t *testing.T) {
 func testDelete(t *testing.T) {
 
 	// get a count before deleting
-	xc, err := cpd.Query(ds, "")
+	xc, err := cpd.Query(ds, nil)
 	if err != nil {
 		t.Fatalf("cpd.Query() err = %s", err)
 	}
@@ -206,7 +259,7 @@ func testDelete(t *testing.T) {
 	}
 
 	// get the count after deleting
-	xc, err = cpd.Query(ds, "")
+	xc, err = cpd.Query(ds, nil)
 	if err != nil {
 		t.Fatalf("cpd.Query() err = %s", err)
 	}
@@ -217,4 +270,345 @@ func testDelete(t *testing.T) {
 	if got != want {
 		t.Errorf("cpd.Query() count = %d, want %d", got, want)
 	}
+
+	// a deleted record cannot be deleted again
+	err = cpd.Delete(ds, memberID, cpdID)
+	if err != sql.ErrNoRows {
+		t.Errorf("cpd.Delete() err = %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+// testRestore restores the record deleted by testDelete, and checks that a record deleted more than
+// RetentionDays ago cannot be restored
+func testRestore(t *testing.T) {
+
+	xc, err := cpd.Deleted(ds, 1)
+	if err != nil {
+		t.Fatalf("cpd.Deleted() err = %s", err)
+	}
+	if len(xc) != 1 || xc[0].ID != 3 {
+		t.Fatalf("cpd.Deleted() = %v, want record id 3 only", xc)
+	}
+
+	err = cpd.Restore(ds, 2, 3)
+	if err != sql.ErrNoRows {
+		t.Errorf("cpd.Restore() err = %v, want %v for another member", err, sql.ErrNoRows)
+	}
+
+	err = cpd.Restore(ds, 1, 3)
+	if err != nil {
+		t.Fatalf("cpd.Restore() err = %s", err)
+	}
+	_, err = cpd.ByID(ds, 3)
+	if err != nil {
+		t.Errorf("cpd.ByID(3) err = %s", err)
+	}
+
+	// record 4 was deleted in 2018
+	err = cpd.Restore(ds, 1, 4)
+	if err != sql.ErrNoRows {
+		t.Errorf("cpd.Restore() err = %v, want %v for expired record", err, sql.ErrNoRows)
+	}
+}
+
+// testPurge checks that only the record deleted more than RetentionDays ago, and its attachment, are purged, and
+// that the attached file is returned for removal from storage
+func testPurge(t *testing.T) {
+
+	err := cpd.Delete(ds, 1, 3)
+	if err != nil {
+		t.Fatalf("cpd.Delete() err = %s", err)
+	}
+
+	n, files, err := cpd.Purge(ds)
+	if err != nil {
+		t.Fatalf("cpd.Purge() err = %s", err)
+	}
+	if n != 1 {
+		t.Errorf("cpd.Purge() = %d, want 1", n)
+	}
+	want := []cpd.StoredFile{{Volume: "test-volume", Key: "/cpd/4/9b1e4f3a0c2d45e8b7f6a1c3d5e7f9a2.jpg"}}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("cpd.Purge() files = %v, want %v", files, want)
+	}
+
+	cases := []struct {
+		query string
+		want  int
+	}{
+		{"SELECT COUNT(*) FROM ce_m_activity WHERE id = 4", 0},
+		{"SELECT COUNT(*) FROM ce_m_activity_attachment WHERE ce_m_activity_id = 4", 0},
+		{"SELECT COUNT(*) FROM ce_m_activity WHERE id = 3", 1},
+	}
+	for _, c := range cases {
+		var got int
+		err := ds.MySQL.Session.QueryRow(c.query).Scan(&got)
+		if err != nil {
+			t.Fatalf("QueryRow(%s) err = %s", c.query, err)
+		}
+		if got != c.want {
+			t.Errorf("%s = %d, want %d", c.query, got, c.want)
+		}
+	}
+}
+
+func testImportCSV(t *testing.T) {
+
+	file := `Date,Activity Code,Type,Quantity,Description
+2018-02-03,RACP4,Seminars,1,BJJ like Bruno Malfacine
+03/04/2018,racp4,26,2,Cardiology conference
+2018-04-05,XYZ9,,1,Unknown activity
+2018-04-06,RACP4,,1,No type
+2018-04-03,RACP4,26,2,Cardiology conference
+`
+	im, err := cpd.ReadImport(ds, 1, strings.NewReader(file), cpd.ImportCSV, cpd.ImportDefaults{})
+	if err != nil {
+		t.Fatalf("cpd.ReadImport() err = %s", err)
+	}
+
+	cases := []struct {
+		line            int
+		duplicateOf     int
+		duplicateOfLine int
+		errors          int
+	}{
+		{2, 1, 0, 0},
+		{3, 0, 0, 0},
+		{4, 0, 0, 1},
+		{5, 0, 0, 1},
+		{6, 0, 3, 0},
+	}
+	if len(im.Rows) != len(cases) {
+		t.Fatalf("cpd.ReadImport() rows = %d, want %d", len(im.Rows), len(cases))
+	}
+	for i, c := range cases {
+		ir := im.Rows[i]
+		if ir.Line != c.line || ir.DuplicateOf != c.duplicateOf || ir.DuplicateOfLine != c.duplicateOfLine ||
+			len(ir.Errors) != c.errors {
+			t.Errorf("cpd.ReadImport() row = %+v, want line %d, duplicateOf %d, duplicateOfLine %d and %d errors",
+				ir, c.line, c.duplicateOf, c.duplicateOfLine, c.errors)
+		}
+	}
+	if im.Rows[1].Input.Date != "2018-04-03" || im.Rows[1].Input.TypeID != 26 {
+		t.Errorf("cpd.ReadImport() row 3 input = %+v, want date 2018-04-03 and type 26", im.Rows[1].Input)
+	}
+
+	_, err = im.Commit(ds, []int{3, 4})
+	if err != cpd.ErrImportSelection {
+		t.Errorf("Import.Commit() err = %v, want %v", err, cpd.ErrImportSelection)
+	}
+
+	ids, err := im.Commit(ds, nil)
+	if err != nil {
+		t.Fatalf("Import.Commit() err = %s", err)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("Import.Commit() ids = %v, want 1 id", ids)
+	}
+	c, err := cpd.ByID(ds, ids[0])
+	if err != nil {
+		t.Fatalf("cpd.ByID(%d) err = %s", ids[0], err)
+	}
+	if c.Description != "Cardiology conference" {
+		t.Errorf("cpd.ByID(%d).Description = %q, want %q", ids[0], c.Description, "Cardiology conference")
+	}
+
+	// a selected duplicate is inserted, but only once however many times the same row is selected
+	ids, err = im.Commit(ds, []int{3, 3, 6})
+	if err != nil {
+		t.Fatalf("Import.Commit() err = %s", err)
+	}
+	if len(ids) != 1 {
+		t.Errorf("Import.Commit() ids = %v, want 1 id", ids)
+	}
+}
+
+func testImportICS(t *testing.T) {
+
+	file := `BEGIN:VCALENDAR
+VERSION:2.0
+BEGIN:VEVENT
+DTSTART:20180601T090000Z
+DTEND:20180601T103000Z
+SUMMARY:Heart failure workshop
+CATEGORIES:RACP4,Workshops
+END:VEVENT
+BEGIN:VEVENT
+DTSTART;VALUE=DATE:20180602
+SUMMARY:Journal club\, cardiology
+DESCRIPTION:Monthly meeting
+CATEGORIES:Personal
+END:VEVENT
+END:VCALENDAR
+`
+	d := cpd.ImportDefaults{ActivityCode: "RACP4", Type: "Journal clubs"}
+	im, err := cpd.ReadImport(ds, 1, strings.NewReader(file), cpd.ImportICS, d)
+	if err != nil {
+		t.Fatalf("cpd.ReadImport() err = %s", err)
+	}
+	if len(im.Rows) != 2 || im.ErrorCount() != 0 {
+		t.Fatalf("cpd.ReadImport() = %+v, want 2 rows without errors", im.Rows)
+	}
+
+	cases := []cpd.Input{
+		{MemberID: 1, ActivityID: 23, TypeID: 27, Date: "2018-06-01", Quantity: 1.5, Description: "Heart failure workshop"},
+		{MemberID: 1, ActivityID: 23, TypeID: 29, Date: "2018-06-02", Quantity: 1, Description: "Journal club, cardiology - Monthly meeting"},
+	}
+	for i, want := range cases {
+		got := im.Rows[i].Input
+		if got != want {
+			t.Errorf("cpd.ReadImport() event %d input = %+v, want %+v", i+1, got, want)
+		}
+	}
+}
+
+func testExport(t *testing.T) {
+
+	f := cpd.ExportFilter{MemberIDs: []int{1}, From: "2018-02-03", To: "2018-02-03"}
+	xr, err := cpd.Export(ds, f)
+	if err != nil {
+		t.Fatalf("cpd.Export() err = %s", err)
+	}
+	if len(xr) != 1 || xr[0].ID != 1 {
+		t.Fatalf("cpd.Export() = %+v, want record id 1 only", xr)
+	}
+	want := "https://cdn.test.com/cpd/1/3c7d2a9e5b1f48d6a0e4c8b2f6d1a3e5.pdf"
+	if len(xr[0].AttachmentURLs) != 1 || xr[0].AttachmentURLs[0] != want {
+		t.Errorf("cpd.Export() AttachmentURLs = %v, want [%s]", xr[0].AttachmentURLs, want)
+	}
+
+	var b bytes.Buffer
+	err = cpd.WriteCSV(&b, xr)
+	if err != nil {
+		t.Fatalf("cpd.WriteCSV() err = %s", err)
+	}
+	for _, s := range []string{"id,memberId,date,category,activityCode", "1,1,2018-02-03,", ",RACP4,", want} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("cpd.WriteCSV() does not contain %q", s)
+		}
+	}
+
+	// an exported file can be imported
+	for _, format := range []string{cpd.ExportCSV, cpd.ExportICS} {
+		var b bytes.Buffer
+		write := cpd.WriteCSV
+		if format == cpd.ExportICS {
+			write = cpd.WriteICS
+		}
+		err := write(&b, xr)
+		if err != nil {
+			t.Fatalf("write %s err = %s", format, err)
+		}
+		im, err := cpd.ReadImport(ds, 1, &b, format, cpd.ImportDefaults{})
+		if err != nil {
+			t.Fatalf("cpd.ReadImport(%s) err = %s", format, err)
+		}
+		if len(im.Rows) != 1 || im.ErrorCount() != 0 {
+			t.Fatalf("cpd.ReadImport(%s) = %+v, want 1 row without errors", format, im.Rows)
+		}
+		got := im.Rows[0].Input
+		if got.ActivityID != 23 || got.TypeID != 25 || got.Date != "2018-02-03" {
+			t.Errorf("cpd.ReadImport(%s) input = %+v, want activity 23, type 25 and date 2018-02-03", format, got)
+		}
+	}
+
+	// the csv file has the same description so it is a duplicate
+	var csv bytes.Buffer
+	cpd.WriteCSV(&csv, xr)
+	im, err := cpd.ReadImport(ds, 1, &csv, cpd.ExportCSV, cpd.ImportDefaults{})
+	if err != nil {
+		t.Fatalf("cpd.ReadImport() err = %s", err)
+	}
+	if im.DuplicateCount() != 1 {
+		t.Errorf("cpd.ReadImport() DuplicateCount() = %d, want 1", im.DuplicateCount())
+	}
+}
+
+func TestWriteCSVFormula(t *testing.T) {
+
+	xr := make([]cpd.ExportRecord, 1)
+	xr[0].Date = "2018-02-03"
+	xr[0].Description = "=HYPERLINK(\"http://example.com\")"
+	xr[0].Activity.Name = "-2+3"
+	xr[0].Type.Name = "@SUM(A1)"
+	xr[0].Category.Name = "Seminars"
+
+	var b bytes.Buffer
+	err := cpd.WriteCSV(&b, xr)
+	if err != nil {
+		t.Fatalf("cpd.WriteCSV() err = %s", err)
+	}
+	for _, s := range []string{`"'=HYPERLINK(""http://example.com"")"`, ",'-2+3,", ",'@SUM(A1),", ",Seminars,"} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("cpd.WriteCSV() = %q, does not contain %q", b.String(), s)
+		}
+	}
+}
+
+// testRecurringCatchUp records and skips the missed occurrences of a weekly activity, one of which was
+// already recorded by hand
+func testRecurringCatchUp(t *testing.T) {
+
+	y, m, d := time.Now().Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+	start := today.AddDate(0, 0, -21)
+
+	oid := bson.NewObjectId()
+	r := cpd.Recurring{MemberID: 1, Activities: []cpd.RecurringActivity{{
+		ID:          oid,
+		ActivityID:  23,
+		TypeID:      26,
+		Quantity:    1,
+		Description: "Weekly cardiology meeting",
+		RRule:       "FREQ=WEEKLY",
+		Start:       start,
+		Next:        start,
+	}}}
+	err := r.Save(ds)
+	if err != nil {
+		t.Fatalf("Recurring.Save() err = %s", err)
+	}
+
+	xo, err := r.Due(ds, oid.Hex(), today)
+	if err != nil {
+		t.Fatalf("Recurring.Due() err = %s", err)
+	}
+	if len(xo) != 4 {
+		t.Fatalf("Recurring.Due() = %v, want 4 occurrences", xo)
+	}
+	dates := make([]string, len(xo))
+	for i, o := range xo {
+		dates[i] = o.Date
+	}
+
+	// recorded by hand
+	_, err = cpd.Add(ds, cpd.Input{MemberID: 1, ActivityID: 23, TypeID: 26, Date: dates[2], Quantity: 1, Description: "Weekly cardiology meeting"})
+	if err != nil {
+		t.Fatalf("cpd.Add() err = %s", err)
+	}
+
+	_, err = r.CatchUp(ds, oid.Hex(), dates[1:2], nil)
+	if err != cpd.ErrCatchUp {
+		t.Errorf("Recurring.CatchUp() err = %v, want %v when an earlier occurrence is left", err, cpd.ErrCatchUp)
+	}
+
+	record := []string{dates[0], dates[2]}
+	skip := []string{dates[1]}
+	for i, want := range []int{1, 0} {
+		ids, err := r.CatchUp(ds, oid.Hex(), record, skip)
+		if err != nil {
+			t.Fatalf("Recurring.CatchUp() call %d err = %s", i+1, err)
+		}
+		if len(ids) != want {
+			t.Errorf("Recurring.CatchUp() call %d ids = %v, want %d ids", i+1, ids, want)
+		}
+	}
+
+	a, err := r.GetActivity(oid.Hex())
+	if err != nil {
+		t.Fatalf("Recurring.GetActivity() err = %s", err)
+	}
+	if a.Next.Format("2006-01-02") != dates[3] {
+		t.Errorf("RecurringActivity.Next = %s, want %s", a.Next.Format("2006-01-02"), dates[3])
+	}
 }
@@ -0,0 +1,189 @@
+package cpd
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+)
+
+// Formats of export files
+const (
+	ExportCSV  = "csv"
+	ExportJSON = "json"
+	ExportICS  = "ics"
+)
+
+// ExportColumns are the column headings of a CSV export file. The columns that are also in ImportColumns
+// have the same headings, so an export file can be imported.
+var ExportColumns = []string{"id", "memberId", "date", "category", "activityCode", "activity", "type", "quantity",
+	"unit", "unitCredit", "credit", "evidence", "description", "attachments"}
+
+// ExportFilter selects the records to export. From and To are dates in the format yyyy-mm-dd, and are
+// ignored if empty.
+type ExportFilter struct {
+	MemberIDs []int
+	From      string
+	To        string
+}
+
+// ExportRecord is a cpd record with the urls of its attachments
+type ExportRecord struct {
+	CPD
+	AttachmentURLs []string `json:"attachmentUrls"`
+}
+
+// Export fetches the records selected by the filter, ordered by member and date, along with the urls of their
+// attachments
+func Export(ds datastore.Datastore, f ExportFilter) ([]ExportRecord, error) {
+
+	var xr []ExportRecord
+
+	c := datastore.NewClause().In("cma.member_id", f.MemberIDs)
+	if f.From != "" {
+		c.GreaterOrEqual("cma.activity_on", f.From)
+	}
+	if f.To != "" {
+		c.LessOrEqual("cma.activity_on", f.To)
+	}
+
+	xc, err := cpdQuery(ds, c.OrderBy("cma.member_id", false).OrderBy("cma.activity_on", false))
+	if err != nil {
+		return xr, err
+	}
+
+	urls, err := attachmentURLs(ds, c)
+	if err != nil {
+		return xr, err
+	}
+
+	for _, c := range xc {
+		xr = append(xr, ExportRecord{CPD: c, AttachmentURLs: urls[c.ID]})
+	}
+
+	return xr, nil
+}
+
+// formulaPrefixes start a formula when a spreadsheet opens a CSV file
+const formulaPrefixes = "=+-@"
+
+// WriteCSV writes the records as a CSV file with the ExportColumns headings. The attachment urls are
+// separated by spaces. Text that a spreadsheet would read as a formula is prefixed with a single quote, which
+// ReadImport removes.
+func WriteCSV(w io.Writer, xr []ExportRecord) error {
+
+	cw := csv.NewWriter(w)
+	cw.Write(ExportColumns)
+	for _, r := range xr {
+		cw.Write([]string{
+			strconv.Itoa(r.ID),
+			strconv.Itoa(r.MemberID),
+			r.Date,
+			csvText(r.Category.Name),
+			csvText(r.Activity.Code),
+			csvText(r.Activity.Name),
+			csvText(r.Type.Name),
+			floatString(r.CreditData.Quantity),
+			csvText(r.CreditData.UnitName),
+			floatString(r.CreditData.UnitCredit),
+			floatString(r.Credit),
+			strconv.FormatBool(r.Evidence),
+			csvText(r.Description),
+			csvText(strings.Join(r.AttachmentURLs, " ")),
+		})
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
+
+// WriteICS writes the records as an iCalendar file with an all-day event for each record. The categories of
+// each event are the activity code and the type, so the file can be imported.
+func WriteICS(w io.Writer, xr []ExportRecord) error {
+
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+
+	lines := []string{"BEGIN:VCALENDAR", "VERSION:2.0", "PRODID:-//cardiacsociety//CPD diary//EN", "CALSCALE:GREGORIAN"}
+	for _, r := range xr {
+
+		d, err := time.Parse("2006-01-02", r.Date)
+		if err != nil {
+			return fmt.Errorf("record id %d has an invalid date - %s", r.ID, err)
+		}
+
+		desc := fmt.Sprintf("%s\n%s - %s\nQuantity: %s %s\nCredit: %s\nEvidence: %t",
+			r.Category.Name, r.Activity.Name, r.Type.Name, floatString(r.CreditData.Quantity),
+			r.CreditData.UnitName, floatString(r.Credit), r.Evidence)
+		for _, u := range r.AttachmentURLs {
+			desc += "\n" + u
+		}
+
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			fmt.Sprintf("UID:cpd-%d-%d", r.MemberID, r.ID),
+			"DTSTAMP:"+stamp,
+			"DTSTART;VALUE=DATE:"+d.Format("20060102"),
+			"DTEND;VALUE=DATE:"+d.AddDate(0, 0, 1).Format("20060102"),
+			"SUMMARY:"+icsEscape(r.Description),
+			"DESCRIPTION:"+icsEscape(desc),
+			"CATEGORIES:"+icsEscape(r.Activity.Code)+","+icsEscape(r.Type.Name),
+			"END:VEVENT",
+		)
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	for _, l := range lines {
+		_, err := io.WriteString(w, icsFold(l))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// attachmentURLs returns the urls of the attachments of the records selected by the clause, by record id
+func attachmentURLs(ds datastore.Datastore, c *datastore.Clause) (map[int][]string, error) {
+
+	urls := map[int][]string{}
+
+	clause, args, err := c.And()
+	if err != nil {
+		return urls, err
+	}
+
+	rows, err := ds.MySQL.Session.Query(Queries["select-member-activity-attachment-urls"]+" "+clause, args...)
+	if err != nil {
+		return urls, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var url string
+		err := rows.Scan(&id, &url)
+		if err != nil {
+			return urls, err
+		}
+		urls[id] = append(urls[id], url)
+	}
+
+	return urls, rows.Err()
+}
+
+// floatString formats a number without trailing zeros
+// csvText returns s with a single quote in front if it starts with one of the formulaPrefixes
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune(formulaPrefixes, rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func floatString(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,190 @@
+package cpd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// icsEvent holds the properties of an iCalendar VEVENT that are needed for a cpd record
+type icsEvent struct {
+	Start       time.Time
+	AllDay      bool
+	Duration    time.Duration
+	Summary     string
+	Description string
+	Categories  []string
+}
+
+// icsDuration matches an iCalendar duration, eg PT1H30M or P1D
+var icsDuration = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// readICS reads the events from an iCalendar file. Only the properties in icsEvent are read, and times are
+// taken at face value, ie time zones are ignored, as only the date and duration of each event are used.
+func readICS(r io.Reader) ([]icsEvent, error) {
+
+	lines, err := icsLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var xe []icsEvent
+	var e *icsEvent
+	var end time.Time
+	for _, l := range lines {
+
+		name, params, value := icsProperty(l)
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			e = &icsEvent{}
+			end = time.Time{}
+			continue
+		case name == "END" && value == "VEVENT" && e != nil:
+			if e.Start.IsZero() {
+				return nil, fmt.Errorf("event %d has no DTSTART", len(xe)+1)
+			}
+			if e.Duration == 0 && !end.IsZero() {
+				e.Duration = end.Sub(e.Start)
+			}
+			xe = append(xe, *e)
+			e = nil
+			continue
+		case e == nil:
+			continue
+		}
+
+		switch name {
+		case "DTSTART":
+			e.Start, e.AllDay, err = icsTime(value, params)
+		case "DTEND":
+			end, _, err = icsTime(value, params)
+		case "DURATION":
+			e.Duration, err = icsParseDuration(value)
+		case "SUMMARY":
+			e.Summary = icsText(value)
+		case "DESCRIPTION":
+			e.Description = icsText(value)
+		case "CATEGORIES":
+			// escaped commas are part of a category
+			for _, c := range strings.Split(strings.Replace(value, `\,`, "\x00", -1), ",") {
+				e.Categories = append(e.Categories, strings.Replace(icsText(c), "\x00", ",", -1))
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("event %d %s - %s", len(xe)+1, name, err)
+		}
+	}
+
+	return xe, nil
+}
+
+// icsLines reads the content lines of an iCalendar file, joining folded lines
+func icsLines(r io.Reader) ([]string, error) {
+
+	var lines []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := strings.TrimRight(s.Text(), "\r")
+		if len(l) > 0 && (l[0] == ' ' || l[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += l[1:]
+			continue
+		}
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+
+	return lines, s.Err()
+}
+
+// icsProperty splits a content line into the upper case property name, the parameters and the value, eg
+// DTSTART;VALUE=DATE:20180203
+func icsProperty(line string) (string, map[string]string, string) {
+
+	params := map[string]string{}
+
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return strings.ToUpper(line), params, ""
+	}
+	xs := strings.Split(line[:i], ";")
+	for _, p := range xs[1:] {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToUpper(kv[0])] = kv[1]
+		}
+	}
+
+	return strings.ToUpper(xs[0]), params, line[i+1:]
+}
+
+// icsTime parses a DATE or DATE-TIME value, and reports whether it was a DATE
+func icsTime(value string, params map[string]string) (time.Time, bool, error) {
+
+	if params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err := time.Parse("20060102", value)
+		return t, true, err
+	}
+	t, err := time.Parse("20060102T150405", strings.TrimSuffix(value, "Z"))
+	return t, false, err
+}
+
+// icsParseDuration parses a duration value, eg PT1H30M
+func icsParseDuration(value string) (time.Duration, error) {
+
+	m := icsDuration.FindStringSubmatch(value)
+	if m == nil {
+		return 0, fmt.Errorf("'%s' is not a valid duration", value)
+	}
+
+	var d time.Duration
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	for i, u := range units {
+		if m[i+2] == "" {
+			continue
+		}
+		n, _ := strconv.Atoi(m[i+2])
+		d += time.Duration(n) * u
+	}
+	if m[1] == "-" {
+		d = -d
+	}
+
+	return d, nil
+}
+
+// icsText unescapes a TEXT value
+func icsText(value string) string {
+	r := strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+	return strings.TrimSpace(r.Replace(value))
+}
+
+// icsEscape escapes a TEXT value
+func icsEscape(value string) string {
+	r := strings.NewReplacer(`\`, `\\`, "\n", `\n`, ",", `\,`, ";", `\;`)
+	return r.Replace(value)
+}
+
+// icsFold ends a content line with CRLF, folding it so no line is longer than 75 octets without splitting a
+// multi-byte character
+func icsFold(line string) string {
+
+	var b strings.Builder
+	n := 0
+	for _, r := range line {
+		size := len(string(r))
+		if n+size > 75 {
+			b.WriteString("\r\n ")
+			n = 1
+		}
+		b.WriteRune(r)
+		n += size
+	}
+	b.WriteString("\r\n")
+
+	return b.String()
+}
@@ -0,0 +1,421 @@
+package cpd
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cardiacsociety/web-services/internal/activity"
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+	validator "gopkg.in/go-playground/validator.v9"
+)
+
+// Formats of import files
+const (
+	ImportCSV = "csv"
+	ImportICS = "ics"
+)
+
+// ErrImportSelection is returned when an import is committed with a selected row that has errors, or that is
+// not in the file
+var ErrImportSelection = errors.New("selected rows must be in the file and have no errors")
+
+// ImportColumns are the column headings recognised in a CSV import file. Headings are not case sensitive, may
+// contain spaces, eg Activity Code, and may be in any order. The type is the name or the id of an activity type.
+var ImportColumns = []string{"date", "activityCode", "type", "quantity", "description"}
+
+// importDateFormats are the formats accepted for the date column of a CSV import file
+var importDateFormats = []string{"2006-01-02", "2/1/2006", "2/1/06"}
+
+// ImportDefaults are the activity code and type used for rows that do not specify them. An iCalendar event
+// can specify them with its categories, otherwise the defaults are used.
+type ImportDefaults struct {
+	ActivityCode string
+	Type         string
+}
+
+// ImportRow is a row of a CSV file, or an event of an iCalendar file, with the Input it maps to. Line is the
+// number of the row, counting the headings as row 1 and skipping blank lines, or the number of the event. If
+// the row is the same as an existing record, DuplicateOf is the id of that record, and if it is the same as
+// an earlier row in the file, DuplicateOfLine is the line of that row.
+type ImportRow struct {
+	Line            int      `json:"line"`
+	ActivityCode    string   `json:"activityCode"`
+	Input           Input    `json:"input"`
+	DuplicateOf     int      `json:"duplicateOf"`
+	DuplicateOfLine int      `json:"duplicateOfLine"`
+	Errors          []string `json:"errors"`
+}
+
+// importKey is the part of an Input that is compared to find a duplicate record, as for DuplicateOf
+type importKey struct {
+	ActivityID  int
+	TypeID      int
+	Date        string
+	Description string
+}
+
+// keyOf returns the importKey of an Input
+func keyOf(a Input) importKey {
+	return importKey{a.ActivityID, a.TypeID, a.Date, a.Description}
+}
+
+// Import is the content of an import file for a member
+type Import struct {
+	MemberID int         `json:"memberId"`
+	Rows     []ImportRow `json:"rows"`
+}
+
+// ReadImport reads a CSV or iCalendar file of cpd records for a member, and checks each row. A row with an
+// unknown activity code, or any other problem, is reported in the errors for that row. An error is only
+// returned if the file as a whole could not be read.
+func ReadImport(ds datastore.Datastore, memberID int, r io.Reader, format string, d ImportDefaults) (Import, error) {
+
+	im := Import{MemberID: memberID}
+
+	var raw []importValues
+	var err error
+	switch format {
+	case ImportCSV:
+		raw, err = csvValues(r)
+	case ImportICS:
+		raw, err = icsValues(r)
+	default:
+		err = fmt.Errorf("import format '%s' is not supported - use %s or %s", format, ImportCSV, ImportICS)
+	}
+	if err != nil {
+		return im, err
+	}
+
+	m, err := newImportMapper(ds)
+	if err != nil {
+		return im, err
+	}
+
+	lines := map[importKey]int{}
+	for _, v := range raw {
+		ir := m.row(v, d)
+		ir.Input.MemberID = memberID
+		if len(ir.Errors) == 0 {
+			ir.DuplicateOf, err = DuplicateOf(ds, ir.Input)
+			if err != nil {
+				return im, err
+			}
+			k := keyOf(ir.Input)
+			if l, ok := lines[k]; ok {
+				ir.DuplicateOfLine = l
+			} else {
+				lines[k] = ir.Line
+			}
+		}
+		im.Rows = append(im.Rows, ir)
+	}
+
+	return im, nil
+}
+
+// ErrorCount returns the number of rows that have errors
+func (im Import) ErrorCount() int {
+	var n int
+	for _, ir := range im.Rows {
+		if len(ir.Errors) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// DuplicateCount returns the number of rows that are the same as an existing record, or an earlier row
+func (im Import) DuplicateCount() int {
+	var n int
+	for _, ir := range im.Rows {
+		if ir.DuplicateOf > 0 || ir.DuplicateOfLine > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Commit inserts the rows at the selected lines in a single transaction, and returns the new ids. If lines is
+// empty every row that has no errors, and is not a duplicate, is inserted. Selected duplicates of existing
+// records are inserted, but rows that are the same as each other, including a line selected twice, are only
+// inserted once. Nothing is inserted if a selected line has errors or is not in the file.
+func (im Import) Commit(ds datastore.Datastore, lines []int) ([]int, error) {
+
+	var xi []Input
+	selected := map[importKey]bool{}
+	add := func(a Input) {
+		if k := keyOf(a); !selected[k] {
+			selected[k] = true
+			xi = append(xi, a)
+		}
+	}
+
+	if len(lines) == 0 {
+		for _, ir := range im.Rows {
+			if len(ir.Errors) == 0 && ir.DuplicateOf == 0 {
+				add(ir.Input)
+			}
+		}
+	}
+	for _, l := range lines {
+		var found bool
+		for _, ir := range im.Rows {
+			if ir.Line == l && len(ir.Errors) == 0 {
+				add(ir.Input)
+				found = true
+			}
+		}
+		if !found {
+			return nil, ErrImportSelection
+		}
+	}
+
+	var ids []int
+	err := ds.MySQL.InTx(func(ex datastore.Execer) error {
+		for _, a := range xi {
+			id, err := addTx(ds, ex, a)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// importValues are the values of a row of an import file, before they are checked
+type importValues struct {
+	line         int
+	date         string
+	activityCode string
+	typ          string
+	quantity     string
+	description  string
+	categories   bool // activityCode and typ are the categories of an iCalendar event
+}
+
+// csvValues reads the rows of a CSV file, with headings in the first row
+func csvValues(r io.Reader) ([]importValues, error) {
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1 // allow short rows
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 2 {
+		return nil, errors.New("import file has no rows below the headings")
+	}
+
+	cols := map[string]int{}
+	for i, h := range records[0] {
+		for _, c := range ImportColumns {
+			if strings.EqualFold(strings.Replace(h, " ", "", -1), c) {
+				cols[c] = i
+			}
+		}
+	}
+	for _, c := range []string{"date", "quantity", "description"} {
+		if _, ok := cols[c]; !ok {
+			return nil, fmt.Errorf("import file has no %s column", c)
+		}
+	}
+
+	var xv []importValues
+	for i, rec := range records[1:] {
+		if strings.Join(rec, "") == "" {
+			continue // empty row
+		}
+		value := func(col string) string {
+			if j, ok := cols[col]; ok && j < len(rec) {
+				s := strings.TrimSpace(rec[j])
+				// remove the quote added by WriteCSV in front of a formula
+				if len(s) > 1 && s[0] == '\'' && strings.ContainsRune(formulaPrefixes, rune(s[1])) {
+					s = s[1:]
+				}
+				return s
+			}
+			return ""
+		}
+		xv = append(xv, importValues{
+			line:         i + 2,
+			date:         value("date"),
+			activityCode: value("activityCode"),
+			typ:          value("type"),
+			quantity:     value("quantity"),
+			description:  value("description"),
+		})
+	}
+
+	return xv, nil
+}
+
+// icsValues reads the events of an iCalendar file. The quantity is the duration of the event in hours, or 1
+// for an all-day event. If the first category of an event is an activity code it is used instead of the
+// default, along with the second category as the type.
+func icsValues(r io.Reader) ([]importValues, error) {
+
+	xe, err := readICS(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(xe) == 0 {
+		return nil, errors.New("import file has no events")
+	}
+
+	var xv []importValues
+	for i, e := range xe {
+		v := importValues{
+			line:        i + 1,
+			date:        e.Start.Format("2006-01-02"),
+			quantity:    "1",
+			description: e.Summary,
+			categories:  true,
+		}
+		if !e.AllDay && e.Duration > 0 {
+			v.quantity = strconv.FormatFloat(math.Round(e.Duration.Hours()*100)/100, 'f', -1, 64)
+		}
+		if e.Description != "" {
+			v.description = strings.TrimSpace(v.description + " - " + e.Description)
+		}
+		if len(e.Categories) > 0 {
+			v.activityCode = e.Categories[0]
+		}
+		if len(e.Categories) > 1 {
+			v.typ = e.Categories[1]
+		}
+		xv = append(xv, v)
+	}
+
+	return xv, nil
+}
+
+// importMapper maps import values to an Input, using the activity codes and types
+type importMapper struct {
+	ds         datastore.Datastore
+	activities map[string]activity.Activity
+	types      map[int][]activity.Type
+}
+
+func newImportMapper(ds datastore.Datastore) (*importMapper, error) {
+
+	xa, err := activity.All(ds)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &importMapper{ds: ds, activities: map[string]activity.Activity{}, types: map[int][]activity.Type{}}
+	for _, a := range xa {
+		m.activities[strings.ToUpper(a.Code)] = a
+	}
+	return m, nil
+}
+
+// row maps the values to an Input, and records any problems
+func (m *importMapper) row(v importValues, d ImportDefaults) ImportRow {
+
+	ir := ImportRow{Line: v.line, ActivityCode: v.activityCode}
+	typ := v.typ
+
+	// the categories of an iCalendar event are not necessarily an activity code and type
+	_, known := m.activities[strings.ToUpper(ir.ActivityCode)]
+	if ir.ActivityCode == "" || v.categories && !known {
+		ir.ActivityCode = d.ActivityCode
+		typ = d.Type
+	}
+	if typ == "" {
+		typ = d.Type
+	}
+
+	a, ok := m.activities[strings.ToUpper(ir.ActivityCode)]
+	switch {
+	case ir.ActivityCode == "":
+		ir.Errors = append(ir.Errors, "activityCode is required")
+	case !ok:
+		ir.Errors = append(ir.Errors, fmt.Sprintf("activityCode '%s' does not exist", ir.ActivityCode))
+	default:
+		ir.Input.ActivityID = a.ID
+		typeID, err := m.typeID(a.ID, typ)
+		if err != nil {
+			ir.Errors = append(ir.Errors, err.Error())
+		}
+		ir.Input.TypeID = typeID
+	}
+
+	ir.Input.Date = importDate(v.date)
+	if ir.Input.Date == "" {
+		ir.Errors = append(ir.Errors, fmt.Sprintf("date '%s' is not a date in the format yyyy-mm-dd or dd/mm/yyyy", v.date))
+	}
+
+	q, err := strconv.ParseFloat(v.quantity, 64)
+	if err != nil || q <= 0 {
+		ir.Errors = append(ir.Errors, fmt.Sprintf("quantity '%s' is not a number greater than 0", v.quantity))
+	}
+	ir.Input.Quantity = q
+
+	ir.Input.Description = v.description
+	if ir.Input.Description == "" {
+		ir.Errors = append(ir.Errors, "description is required")
+	}
+
+	// anything else that would fail validation when the row is committed
+	if len(ir.Errors) == 0 {
+		err := validator.New().Struct(ir.Input)
+		if err != nil {
+			ir.Errors = append(ir.Errors, err.Error())
+		}
+	}
+
+	return ir
+}
+
+// typeID returns the id of the activity type with the name or id typ. If typ is empty the activity must have
+// only one type.
+func (m *importMapper) typeID(activityID int, typ string) (int, error) {
+
+	xt, ok := m.types[activityID]
+	if !ok {
+		var err error
+		xt, err = activity.Types(m.ds, activityID)
+		if err != nil {
+			return 0, err
+		}
+		m.types[activityID] = xt
+	}
+
+	if typ == "" {
+		if len(xt) == 1 {
+			return xt[0].ID, nil
+		}
+		return 0, errors.New("type is required for this activity")
+	}
+	for _, t := range xt {
+		if strings.EqualFold(t.Name, typ) || strconv.Itoa(t.ID) == typ {
+			return t.ID, nil
+		}
+	}
+
+	return 0, fmt.Errorf("type '%s' is not a type of this activity", typ)
+}
+
+// importDate returns the date in the format yyyy-mm-dd, or an empty string if it is not a valid date
+func importDate(s string) string {
+	for _, f := range importDateFormats {
+		t, err := time.Parse(f, s)
+		if err == nil {
+			return t.Format("2006-01-02")
+		}
+	}
+	return ""
+}
@@ -1,11 +1,23 @@
 package cpd
 
 var Queries = map[string]string{
-	"select-member-activity":            selectMemberActivity,
-	"select-cpd-summary-by-activity-id": selectCPDSummaryByActivityID,
+	"select-member-activity":                 selectMemberActivity,
+	"select-cpd-summary-by-activity-id":      selectCPDSummaryByActivityID,
+	"select-member-activity-duplicate":       selectMemberActivityDuplicate,
+	"lock-member-activity-duplicate":         selectMemberActivityDuplicate + " FOR UPDATE",
+	"insert-member-activity":                 insertMemberActivity,
+	"update-member-activity":                 updateMemberActivity,
+	"delete-member-activity":                 deleteMemberActivity,
+	"restore-member-activity":                restoreMemberActivity,
+	"select-member-activity-deleted":         selectMemberActivityDeleted,
+	"select-member-activity-purge-ids":       selectMemberActivityPurgeIDs,
+	"select-member-activity-purge-files":     selectMemberActivityPurgeFiles,
+	"purge-member-activity-attachments":      purgeMemberActivityAttachments,
+	"purge-member-activities":                purgeMemberActivities,
+	"select-member-activity-attachment-urls": selectMemberActivityAttachmentURLs,
 }
 
-const selectMemberActivity = `SELECT
+const selectMemberActivityAll = `SELECT
   cma.id                               AS 'memberActivityId',
   cma.member_id                        AS 'memberId',
   cma.activity_on                      AS 'memberActivityDate',
@@ -35,6 +47,18 @@ FROM
   LEFT JOIN
   ce_activity_type cat ON cma.ce_activity_type_id = cat.id`
 
+// deleted records are hidden from the default query
+const selectMemberActivity = selectMemberActivityAll + `
+WHERE
+  cma.deleted_at IS NULL`
+
+// deleted records that can still be restored
+const selectMemberActivityDeleted = selectMemberActivityAll + `
+WHERE
+  cma.deleted_at > DATE_SUB(NOW(), INTERVAL ? DAY)
+  AND cma.member_id = ?
+ORDER BY cma.deleted_at DESC`
+
 const selectCPDSummaryByActivityID = `SELECT
   SUM(cma.quantity)                       AS TotalUnits,
   cma.points_per_unit                     AS UnitCredit,
@@ -43,8 +67,80 @@ FROM
   ce_m_activity cma
 WHERE
   cma.active = 1
+  AND cma.deleted_at IS NULL
   AND cma.activity_on >= ?
   AND cma.activity_on <= ?
   AND cma.member_id = ?
   AND cma.ce_activity_id = ?
 GROUP BY cma.ce_activity_id`
+
+const selectMemberActivityDuplicate = `SELECT id FROM ce_m_activity
+WHERE
+  member_id = ?
+  AND ce_activity_id = ?
+  AND ce_activity_type_id = ?
+  AND activity_on = ?
+  AND description = ?
+  AND deleted_at IS NULL
+LIMIT 1`
+
+const insertMemberActivity = `INSERT INTO ce_m_activity (
+  member_id,
+  ce_activity_id,
+  ce_activity_type_id,
+  evidence,
+  created_at,
+  updated_at,
+  activity_on,
+  quantity,
+  points_per_unit,
+  description
+) VALUES (?, ?, ?, ?, NOW(), NOW(), ?, ?, ?, ?)`
+
+const updateMemberActivity = `UPDATE ce_m_activity SET
+  ce_activity_id = ?,
+  ce_activity_type_id = ?,
+  evidence = ?,
+  updated_at = NOW(),
+  activity_on = ?,
+  quantity = ?,
+  points_per_unit = ?,
+  description = ?
+WHERE id = ? AND deleted_at IS NULL LIMIT 1`
+
+const deleteMemberActivity = `UPDATE ce_m_activity SET deleted_at = NOW(), updated_at = NOW()
+WHERE member_id = ? AND id = ? AND deleted_at IS NULL LIMIT 1`
+
+const restoreMemberActivity = `UPDATE ce_m_activity SET deleted_at = NULL, updated_at = NOW()
+WHERE member_id = ? AND id = ? AND deleted_at > DATE_SUB(NOW(), INTERVAL ? DAY) LIMIT 1`
+
+const selectMemberActivityPurgeIDs = `SELECT id FROM ce_m_activity
+WHERE deleted_at <= DATE_SUB(NOW(), INTERVAL ? DAY)
+FOR UPDATE`
+
+// the %s is a list of placeholders for the ids of the activities being purged
+const selectMemberActivityPurgeFiles = `SELECT
+  fs.volume_name,
+  CONCAT(fs.set_path, a.ce_m_activity_id, '/', a.cloudy_filename)
+FROM
+  ce_m_activity_attachment a
+  INNER JOIN fs_set fs ON a.fs_set_id = fs.id
+WHERE
+  a.ce_m_activity_id IN (%s)`
+
+// the %s is a list of placeholders for the ids of the activities being purged
+const purgeMemberActivityAttachments = `DELETE FROM ce_m_activity_attachment WHERE ce_m_activity_id IN (%s)`
+
+const purgeMemberActivities = `DELETE FROM ce_m_activity WHERE id IN (%s)`
+
+// filtered by a clause on ce_m_activity cma, as for select-member-activity
+const selectMemberActivityAttachmentURLs = `SELECT
+  a.ce_m_activity_id,
+  CONCAT(fu.base_url, fs.set_path, a.ce_m_activity_id, '/', a.cloudy_filename)
+FROM
+  ce_m_activity_attachment a
+  INNER JOIN ce_m_activity cma ON a.ce_m_activity_id = cma.id
+  INNER JOIN fs_set fs ON a.fs_set_id = fs.id
+  INNER JOIN fs_url fu ON fs.id = fu.fs_set_id
+WHERE
+  a.active = 1 AND cma.deleted_at IS NULL`
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"time"
 
+	"gopkg.in/go-playground/validator.v9"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
@@ -26,12 +27,19 @@ type Recurring struct {
 type RecurringActivity struct {
 	ID          bson.ObjectId `json:"_id" bson:"_id"`
 	ActivityID  int           `json:"activityId" bson:"activityId" validate:"required,min=1"`
+	TypeID      int           `json:"typeId" bson:"typeId"`
 	CreatedAt   time.Time     `json:"createdAt" bson:"createdAt"`
 	UpdatedAt   time.Time     `json:"updatedAt" bson:"updatedAt"`
 	Quantity    float64       `json:"quantity" validate:"required"`
 	Description string        `json:"description" validate:"required"`
-	Type        string        `json:"type" validate:"required"`
+	RRule       string        `json:"rrule" validate:"required"`
+	Start       time.Time     `json:"start"`
 	Next        time.Time     `json:"next"`
+	Finished    bool          `json:"finished"`
+
+	// Type is the schedule used before recurrence rules - daily, weekly or monthly. It is replaced by the
+	// equivalent RRule when the activity is migrated.
+	Type string `json:"type,omitempty" bson:"type,omitempty"`
 }
 
 // MemberRecurring initialises a value of type Recurring and returns a pointer to same.
@@ -58,9 +66,47 @@ func MemberRecurring(ds datastore.Datastore, id int) (*Recurring, error) {
 		return &r, errors.New("MemberRecurring() database error -" + err.Error())
 	}
 
+	// Activities with an old schedule type are migrated in memory, and saved with the next change
+	for i := range r.Activities {
+		r.Activities[i].Migrate()
+	}
+
 	return &r, nil
 }
 
+// MigrateRecurring replaces the old schedule types, daily, weekly and monthly, with the equivalent recurrence
+// rule in all of the Recurring docs, and returns the number of docs that were changed
+func MigrateRecurring(ds datastore.Datastore) (int, error) {
+
+	c, err := ds.MongoDB.RecurringCol()
+	if err != nil {
+		return 0, errors.New("MigrateRecurring() could not get a pointer to collection -" + err.Error())
+	}
+
+	var types []string
+	for t := range legacyRRules {
+		types = append(types, t)
+	}
+
+	var xr []Recurring
+	err = c.Find(bson.M{"activities.type": bson.M{"$in": types}}).All(&xr)
+	if err != nil {
+		return 0, errors.New("MigrateRecurring() database error -" + err.Error())
+	}
+
+	for _, r := range xr {
+		for i := range r.Activities {
+			r.Activities[i].Migrate()
+		}
+		err := r.Save(ds)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(xr), nil
+}
+
 // Save saves the Recurring value to MongoDB
 func (r *Recurring) Save(ds datastore.Datastore) error {
 
@@ -140,17 +186,25 @@ func (r *Recurring) Record(ds datastore.Datastore, oid string) error {
 		return err
 	}
 
+	if a.Finished {
+		return errors.New(".CPD() cannot record a recurring activity that has finished")
+	}
+
 	// Make idempotent by not allowing to skip if date is in the future
 	if a.Next.After(time.Now()) {
 		return errors.New(".CPD() cannot record a recurring activity if .Next is in the future")
 	}
 
-	ar := Input{}
-	ar.MemberID = r.MemberID
-	ar.ActivityID = a.ActivityID
-	ar.Date = a.Next.Format("2006-01-02")
-	ar.Quantity = a.Quantity
-	ar.Description = a.Description
+	ar, err := r.input(ds, a, a.Next)
+	if err != nil {
+		return err
+	}
+
+	// Increment next, before the activity is added so that a bad rule records nothing
+	err = a.UpdateNext()
+	if err != nil {
+		return err
+	}
 
 	// Add activity to database
 	_, err = Add(ds, ar)
@@ -159,8 +213,6 @@ func (r *Recurring) Record(ds datastore.Datastore, oid string) error {
 		return err
 	}
 
-	// Increment next
-	a.UpdateNext()
 	r.UpdateActivity(ds, a)
 
 	return nil
@@ -174,13 +226,20 @@ func (r *Recurring) Skip(ds datastore.Datastore, oid string) error {
 		return err
 	}
 
+	if a.Finished {
+		return errors.New(".Skip() cannot skip a recurring activity that has finished")
+	}
+
 	// Make idempotent by not allowing to skip if date is in the future
 	if a.Next.After(time.Now()) {
 		return errors.New(".Skip() cannot skip a recurring activity if .Next is in the future")
 	}
 
 	// Increment next
-	a.UpdateNext()
+	err = a.UpdateNext()
+	if err != nil {
+		return err
+	}
 	r.UpdateActivity(ds, a)
 
 	return nil
@@ -202,15 +261,76 @@ func (r *Recurring) UpdateActivity(ds datastore.Datastore, a RecurringActivity)
 	r.Save(ds)
 }
 
-// UpdateNext pushed RecurringActivity.Next schedule forward
-func (a *RecurringActivity) UpdateNext() {
+// Validate checks the fields and the recurrence rule. An activity with an old schedule type, and no rule, is
+// migrated first.
+func (a *RecurringActivity) Validate() error {
+
+	a.Migrate()
+
+	err := validator.New().Struct(a)
+	if err != nil {
+		return err
+	}
+
+	_, err = ParseRRule(a.RRule)
+	return err
+}
+
+// Schedule starts the series on the date from, and sets Next to the first occurrence of the rule on or after
+// that date
+func (a *RecurringActivity) Schedule(from time.Time) error {
+
+	rule, err := ParseRRule(a.RRule)
+	if err != nil {
+		return err
+	}
+
+	a.Start = dateOf(from, from.Location())
+	a.Next, _ = rule.Next(a.Start, a.Start.AddDate(0, 0, -1))
+	a.Finished = a.Next.IsZero()
+
+	return nil
+}
+
+// UpdateNext pushes RecurringActivity.Next forward to the following occurrence of the rule, or sets Finished
+// if there are no more occurrences. An error is returned, and Next is left as it is, if the rule is not valid.
+func (a *RecurringActivity) UpdateNext() error {
+
+	a.Migrate()
+
+	rule, err := ParseRRule(a.RRule)
+	if err != nil {
+		return fmt.Errorf("RecurringActivity.UpdateNext() invalid rule - %s", err)
+	}
+
+	start := a.Start
+	if start.IsZero() {
+		start = a.Next
+	}
+	next, ok := rule.Next(start, a.Next)
+	if !ok {
+		a.Finished = true
+		return nil
+	}
+	a.Next = next
+
+	return nil
+}
+
+// Migrate replaces an old schedule type with the equivalent recurrence rule, starting on the next scheduled
+// date, and reports whether the activity was changed
+func (a *RecurringActivity) Migrate() bool {
+
+	rule, ok := legacyRRules[a.Type]
+	if !ok || a.RRule != "" {
+		return false
+	}
 
-	switch a.Type {
-	case "daily":
-		a.Next = a.Next.AddDate(0, 0, 1)
-	case "weekly":
-		a.Next = a.Next.AddDate(0, 0, 7)
-	case "monthly":
-		a.Next = a.Next.AddDate(0, 1, 0)
+	a.RRule = rule
+	a.Type = ""
+	if a.Start.IsZero() {
+		a.Start = a.Next
 	}
+
+	return true
 }
@@ -146,9 +146,12 @@ func (a *activityReport) summary(ds datastore.Datastore, e MemberActivityReport)
 }
 
 func (a *activityReport) fetchActivityRecords(ds datastore.Datastore, memberID int, startDate, endDate string) {
-	clause := `WHERE member_id = %d AND cma.activity_on >= "%s" AND cma.activity_on <= "%s" ORDER BY cma.activity_on DESC`
-	clause = fmt.Sprintf(clause, memberID, startDate, endDate)
-	ma, err := Query(ds, clause)
+	c := datastore.NewClause().
+		Equal("member_id", memberID).
+		GreaterOrEqual("cma.activity_on", startDate).
+		LessOrEqual("cma.activity_on", endDate).
+		OrderBy("cma.activity_on", true)
+	ma, err := Query(ds, c)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -0,0 +1,367 @@
+package cpd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Frequencies of a recurrence rule
+const (
+	FreqDaily   = "DAILY"
+	FreqWeekly  = "WEEKLY"
+	FreqMonthly = "MONTHLY"
+	FreqYearly  = "YEARLY"
+)
+
+// legacyRRules maps the schedule types used before recurrence rules to the equivalent rule
+var legacyRRules = map[string]string{
+	"daily":   "FREQ=DAILY",
+	"weekly":  "FREQ=WEEKLY",
+	"monthly": "FREQ=MONTHLY",
+}
+
+// maxEmptyPeriods limits the search for an occurrence of a rule that may never match, eg every 31st of
+// February
+const maxEmptyPeriods = 1000
+
+var rruleWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// RRule is a recurrence rule as per RFC 5545, limited to the parts FREQ, INTERVAL, BYDAY, BYMONTHDAY, COUNT
+// and UNTIL. Occurrences are dates, and weeks start on Monday. For example, a fortnightly journal club is
+// FREQ=WEEKLY;INTERVAL=2, and the first Tuesday of every month is FREQ=MONTHLY;BYDAY=1TU.
+type RRule struct {
+	Freq       string
+	Interval   int
+	ByDay      []WeekdayNum
+	ByMonthDay []int
+	Count      int
+	Until      time.Time
+}
+
+// WeekdayNum is a day in the BYDAY part of a rule. N is the occurrence of the day within the month, eg 1 for
+// the first Tuesday or -1 for the last Friday, and is 0 for every such day.
+type WeekdayNum struct {
+	N   int
+	Day time.Weekday
+}
+
+// ParseRRule parses and checks a recurrence rule, eg FREQ=WEEKLY;INTERVAL=2;BYDAY=TU,TH;UNTIL=20191231. The
+// RRULE: prefix is optional.
+func ParseRRule(s string) (RRule, error) {
+
+	r := RRule{Interval: 1}
+
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+	if s == "" {
+		return r, fmt.Errorf("recurrence rule is empty")
+	}
+
+	seen := map[string]bool{}
+	for _, part := range strings.Split(s, ";") {
+
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return r, fmt.Errorf("recurrence rule part '%s' should be NAME=VALUE", part)
+		}
+		name, value := strings.ToUpper(kv[0]), strings.ToUpper(kv[1])
+		if seen[name] {
+			return r, fmt.Errorf("recurrence rule has more than one %s", name)
+		}
+		seen[name] = true
+
+		var err error
+		switch name {
+		case "FREQ":
+			r.Freq = value
+		case "INTERVAL":
+			r.Interval, err = positiveInt(value)
+		case "COUNT":
+			r.Count, err = positiveInt(value)
+		case "UNTIL":
+			r.Until, _, err = icsTime(value, nil)
+		case "BYDAY":
+			for _, v := range strings.Split(value, ",") {
+				wd, err := parseWeekdayNum(v)
+				if err != nil {
+					return r, err
+				}
+				r.ByDay = append(r.ByDay, wd)
+			}
+		case "BYMONTHDAY":
+			for _, v := range strings.Split(value, ",") {
+				n, err := strconv.Atoi(v)
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return r, fmt.Errorf("BYMONTHDAY value '%s' should be 1 to 31, or -31 to -1", v)
+				}
+				r.ByMonthDay = append(r.ByMonthDay, n)
+			}
+		default:
+			return r, fmt.Errorf("recurrence rule part %s is not supported", name)
+		}
+		if err != nil {
+			return r, fmt.Errorf("%s value '%s' is not valid - %s", name, value, err)
+		}
+	}
+
+	return r, r.check()
+}
+
+// check reports combinations of parts that are not valid
+func (r RRule) check() error {
+
+	switch r.Freq {
+	case FreqDaily, FreqWeekly, FreqMonthly, FreqYearly:
+	case "":
+		return fmt.Errorf("recurrence rule must have a FREQ")
+	default:
+		return fmt.Errorf("FREQ should be %s, %s, %s or %s", FreqDaily, FreqWeekly, FreqMonthly, FreqYearly)
+	}
+
+	if r.Count > 0 && !r.Until.IsZero() {
+		return fmt.Errorf("recurrence rule cannot have both COUNT and UNTIL")
+	}
+	if r.Freq == FreqYearly && (len(r.ByDay) > 0 || len(r.ByMonthDay) > 0) {
+		return fmt.Errorf("BYDAY and BYMONTHDAY are not supported with FREQ=%s", FreqYearly)
+	}
+	if r.Freq == FreqWeekly && len(r.ByMonthDay) > 0 {
+		return fmt.Errorf("BYMONTHDAY cannot be used with FREQ=%s", FreqWeekly)
+	}
+	for _, wd := range r.ByDay {
+		if wd.N != 0 && r.Freq != FreqMonthly {
+			return fmt.Errorf("BYDAY with a number, eg 1TU, can only be used with FREQ=%s", FreqMonthly)
+		}
+	}
+
+	return nil
+}
+
+// String returns the rule in the RRULE format, without the prefix
+func (r RRule) String() string {
+
+	xs := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		xs = append(xs, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		var days []string
+		for _, wd := range r.ByDay {
+			days = append(days, wd.String())
+		}
+		xs = append(xs, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		var days []string
+		for _, n := range r.ByMonthDay {
+			days = append(days, strconv.Itoa(n))
+		}
+		xs = append(xs, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	if r.Count > 0 {
+		xs = append(xs, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if !r.Until.IsZero() {
+		xs = append(xs, "UNTIL="+r.Until.Format("20060102"))
+	}
+
+	return strings.Join(xs, ";")
+}
+
+// String returns the day in the BYDAY format, eg TU or -1FR
+func (wd WeekdayNum) String() string {
+	s := strings.ToUpper(wd.Day.String()[:2])
+	if wd.N != 0 {
+		s = strconv.Itoa(wd.N) + s
+	}
+	return s
+}
+
+// Next returns the first occurrence of the rule after the date after, for a series that starts on the date
+// start. COUNT counts the occurrences on or after start. It returns false if there are no more occurrences.
+// Times of day are ignored, and the occurrence is midnight in the location of start.
+func (r RRule) Next(start, after time.Time) (time.Time, bool) {
+
+	start = dateOf(start, start.Location())
+	after = dateOf(after, start.Location())
+	var until time.Time
+	if !r.Until.IsZero() {
+		until = dateOf(r.Until, start.Location())
+	}
+
+	var n, empty int
+	for k := 0; empty < maxEmptyPeriods; k++ {
+
+		xd := r.period(start, k)
+		if len(xd) == 0 {
+			empty++
+			continue
+		}
+		empty = 0
+
+		for _, d := range xd {
+			if d.Before(start) {
+				continue
+			}
+			if !until.IsZero() && d.After(until) {
+				return time.Time{}, false
+			}
+			n++
+			if r.Count > 0 && n > r.Count {
+				return time.Time{}, false
+			}
+			if d.After(after) {
+				return d, true
+			}
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// period returns the dates in the kth period of the series, in order. The periods are days, weeks, months or
+// years, depending on FREQ, and INTERVAL periods apart.
+func (r RRule) period(start time.Time, k int) []time.Time {
+
+	i := k
+	if r.Interval > 1 {
+		i = k * r.Interval
+	}
+	y, m, d := start.Date()
+	loc := start.Location()
+
+	switch r.Freq {
+
+	case FreqDaily:
+		day := time.Date(y, m, d+i, 0, 0, 0, 0, loc)
+		last := lastDayOfMonth(day)
+		if r.matchWeekday(day, last) && r.matchMonthDay(day.Day(), last) {
+			return []time.Time{day}
+		}
+
+	case FreqWeekly:
+		offset := (int(start.Weekday()) + 6) % 7 // days since Monday
+		monday := time.Date(y, m, d-offset+7*i, 0, 0, 0, 0, loc)
+		var xd []time.Time
+		for j := 0; j < 7; j++ {
+			day := monday.AddDate(0, 0, j)
+			match := day.Weekday() == start.Weekday()
+			if len(r.ByDay) > 0 {
+				match = r.matchWeekday(day, lastDayOfMonth(day))
+			}
+			if match {
+				xd = append(xd, day)
+			}
+		}
+		return xd
+
+	case FreqMonthly:
+		first := time.Date(y, m+time.Month(i), 1, 0, 0, 0, 0, loc)
+		last := lastDayOfMonth(first)
+		var xd []time.Time
+		for day := 1; day <= last; day++ {
+			t := first.AddDate(0, 0, day-1)
+			match := day == d
+			if len(r.ByDay) > 0 || len(r.ByMonthDay) > 0 {
+				match = r.matchWeekday(t, last) && r.matchMonthDay(day, last)
+			}
+			if match {
+				xd = append(xd, t)
+			}
+		}
+		return xd
+
+	case FreqYearly:
+		day := time.Date(y+i, m, d, 0, 0, 0, 0, loc)
+		if day.Day() == d { // not 29 February in other years
+			return []time.Time{day}
+		}
+	}
+
+	return nil
+}
+
+// matchWeekday reports whether the date matches BYDAY, which is true if there is no BYDAY. The last day of
+// the month is used for days counted from the end of the month, eg -1FR.
+func (r RRule) matchWeekday(t time.Time, last int) bool {
+
+	if len(r.ByDay) == 0 {
+		return true
+	}
+	for _, wd := range r.ByDay {
+		if wd.Day != t.Weekday() {
+			continue
+		}
+		if wd.N == 0 || wd.N == (t.Day()-1)/7+1 || wd.N == -((last-t.Day())/7+1) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchMonthDay reports whether the day of the month matches BYMONTHDAY, which is true if there is no
+// BYMONTHDAY
+func (r RRule) matchMonthDay(day, last int) bool {
+
+	if len(r.ByMonthDay) == 0 {
+		return true
+	}
+	for _, n := range r.ByMonthDay {
+		if n == day || n < 0 && last+n+1 == day {
+			return true
+		}
+	}
+	return false
+}
+
+// parseWeekdayNum parses a BYDAY value, eg TU, 1TU or -1FR
+func parseWeekdayNum(s string) (WeekdayNum, error) {
+
+	var wd WeekdayNum
+	if len(s) < 2 {
+		return wd, fmt.Errorf("BYDAY value '%s' is not valid", s)
+	}
+
+	day, ok := rruleWeekdays[s[len(s)-2:]]
+	if !ok {
+		return wd, fmt.Errorf("BYDAY value '%s' should end with a day, eg MO or TU", s)
+	}
+	wd.Day = day
+
+	if n := s[:len(s)-2]; n != "" {
+		var err error
+		wd.N, err = strconv.Atoi(n)
+		if err != nil || wd.N == 0 || wd.N < -5 || wd.N > 5 {
+			return wd, fmt.Errorf("BYDAY value '%s' should have a number from 1 to 5, or -5 to -1", s)
+		}
+	}
+
+	return wd, nil
+}
+
+func positiveInt(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("should be a whole number greater than 0")
+	}
+	return n, nil
+}
+
+// dateOf returns midnight at the start of the date of t, in the location loc
+func dateOf(t time.Time, loc *time.Location) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, loc)
+}
+
+// lastDayOfMonth returns the number of days in the month of t
+func lastDayOfMonth(t time.Time) int {
+	return time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, t.Location()).Day()
+}
@@ -0,0 +1,140 @@
+package cpd_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cardiacsociety/web-services/internal/cpd"
+)
+
+func TestParseRRule(t *testing.T) {
+
+	cases := []struct {
+		arg  string
+		want string // empty if arg is not valid
+	}{
+		{"FREQ=WEEKLY", "FREQ=WEEKLY"},
+		{"RRULE:freq=weekly;interval=2", "FREQ=WEEKLY;INTERVAL=2"},
+		{"FREQ=MONTHLY;BYDAY=1TU", "FREQ=MONTHLY;BYDAY=1TU"},
+		{"FREQ=MONTHLY;BYMONTHDAY=1,-1;COUNT=6", "FREQ=MONTHLY;BYMONTHDAY=1,-1;COUNT=6"},
+		{"FREQ=DAILY;BYDAY=MO,TU,WE,TH,FR;UNTIL=20191231T235959Z", "FREQ=DAILY;BYDAY=MO,TU,WE,TH,FR;UNTIL=20191231"},
+		{"", ""},
+		{"INTERVAL=2", ""},
+		{"FREQ=HOURLY", ""},
+		{"FREQ=WEEKLY;INTERVAL=0", ""},
+		{"FREQ=WEEKLY;BYDAY=1TU", ""},
+		{"FREQ=WEEKLY;BYMONTHDAY=1", ""},
+		{"FREQ=MONTHLY;BYDAY=6TU", ""},
+		{"FREQ=MONTHLY;BYMONTHDAY=32", ""},
+		{"FREQ=MONTHLY;COUNT=2;UNTIL=20191231", ""},
+		{"FREQ=YEARLY;BYDAY=MO", ""},
+		{"FREQ=WEEKLY;WKST=SU", ""},
+		{"FREQ=WEEKLY;FREQ=DAILY", ""},
+	}
+
+	for _, c := range cases {
+		r, err := cpd.ParseRRule(c.arg)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("ParseRRule(%q) err = nil, want an error", c.arg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRRule(%q) err = %s", c.arg, err)
+			continue
+		}
+		if r.String() != c.want {
+			t.Errorf("ParseRRule(%q).String() = %q, want %q", c.arg, r.String(), c.want)
+		}
+	}
+}
+
+func TestRRuleNext(t *testing.T) {
+
+	date := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+
+	cases := []struct {
+		rule  string
+		start string
+		after string
+		want  []string // the following occurrences, ending if there are no more
+	}{
+		{"FREQ=DAILY", "2019-01-30", "2019-01-30", []string{"2019-01-31", "2019-02-01"}},
+		{"FREQ=DAILY;BYDAY=MO,FR", "2019-01-01", "2019-01-01", []string{"2019-01-04", "2019-01-07", "2019-01-11"}},
+		{"FREQ=WEEKLY;INTERVAL=2", "2019-01-01", "2019-01-01", []string{"2019-01-15", "2019-01-29"}},
+		{"FREQ=WEEKLY;BYDAY=TU,TH", "2019-01-03", "2019-01-01", []string{"2019-01-03", "2019-01-08", "2019-01-10"}},
+		{"FREQ=MONTHLY", "2019-01-31", "2019-01-31", []string{"2019-03-31", "2019-05-31"}},
+		{"FREQ=MONTHLY;BYDAY=1TU", "2019-01-01", "2019-01-01", []string{"2019-02-05", "2019-03-05"}},
+		{"FREQ=MONTHLY;BYDAY=-1FR", "2019-01-01", "2019-01-01", []string{"2019-01-25", "2019-02-22"}},
+		{"FREQ=MONTHLY;BYMONTHDAY=-1", "2019-01-15", "2019-01-15", []string{"2019-01-31", "2019-02-28"}},
+		{"FREQ=YEARLY", "2016-02-29", "2016-02-29", []string{"2020-02-29"}},
+		{"FREQ=WEEKLY;COUNT=3", "2019-01-01", "2019-01-01", []string{"2019-01-08", "2019-01-15"}},
+		{"FREQ=WEEKLY;UNTIL=20190115", "2019-01-01", "2019-01-07", []string{"2019-01-08", "2019-01-15"}},
+	}
+
+	for _, c := range cases {
+		r, err := cpd.ParseRRule(c.rule)
+		if err != nil {
+			t.Fatalf("ParseRRule(%q) err = %s", c.rule, err)
+		}
+		start, after := date(c.start), date(c.after)
+		var got []string
+		for i := 0; i < len(c.want)+1; i++ {
+			next, ok := r.Next(start, after)
+			if !ok {
+				break
+			}
+			got = append(got, next.Format("2006-01-02"))
+			after = next
+		}
+		if len(got) > len(c.want) {
+			got = got[:len(c.want)]
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("%s from %s after %s = %v, want %v", c.rule, c.start, c.after, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s from %s after %s = %v, want %v", c.rule, c.start, c.after, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+func TestRecurringActivityMigrate(t *testing.T) {
+
+	next := time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC)
+	a := cpd.RecurringActivity{Type: "weekly", Next: next}
+	if !a.Migrate() {
+		t.Fatalf("RecurringActivity.Migrate() = false, want true")
+	}
+	if a.RRule != "FREQ=WEEKLY" || a.Type != "" || !a.Start.Equal(next) {
+		t.Errorf("RecurringActivity.Migrate() = %+v, want RRule FREQ=WEEKLY, no Type and Start %s", a, next)
+	}
+	if a.Migrate() {
+		t.Errorf("RecurringActivity.Migrate() = true for a migrated activity, want false")
+	}
+
+	err := a.UpdateNext()
+	if err != nil {
+		t.Fatalf("RecurringActivity.UpdateNext() err = %s", err)
+	}
+	want := next.AddDate(0, 0, 7)
+	if !a.Next.Equal(want) {
+		t.Errorf("RecurringActivity.UpdateNext() Next = %s, want %s", a.Next, want)
+	}
+
+	bad := cpd.RecurringActivity{RRule: "FREQ=HOURLY", Next: next}
+	if bad.UpdateNext() == nil {
+		t.Errorf("RecurringActivity.UpdateNext() err = nil for rule %s, want an error", bad.RRule)
+	}
+	if !bad.Next.Equal(next) {
+		t.Errorf("RecurringActivity.UpdateNext() Next = %s for a bad rule, want %s", bad.Next, next)
+	}
+}
@@ -6,20 +6,32 @@ import (
 	"github.com/cardiacsociety/web-services/internal/platform/datastore"
 )
 
-// GetIDs returns a list of primary keys (id) from any table. Takes the table name and an sql
-// clause.
-func GetIDs(ds datastore.Datastore, table string, clause string) ([]int, error) {
+// GetIDs returns a list of primary keys (id) from any table. Takes the table name and an optional
+// sql clause, nil for all rows.
+func GetIDs(ds datastore.Datastore, table string, clause *datastore.Clause) ([]int, error) {
 	return GetIntCol(ds, table, "id", clause)
 }
 
 // GetIntCol will return integer values from a table, from the specified column.
 // It is used for fetching ids or fk ids based on the sql clause.
-func GetIntCol(ds datastore.Datastore, table, column, clause string, ) ([]int, error) {
+func GetIntCol(ds datastore.Datastore, table, column string, clause *datastore.Clause) ([]int, error) {
 
 	var ids []int
 
-	sql := fmt.Sprintf("SELECT %s FROM %s %s", column, table, clause)
-	rows, err := ds.MySQL.Session.Query(sql)
+	// table and column cannot be placeholders so make sure they are plain identifiers
+	if err := datastore.ValidIdentifier(table); err != nil {
+		return ids, err
+	}
+	if err := datastore.ValidIdentifier(column); err != nil {
+		return ids, err
+	}
+	where, args, err := clause.Where()
+	if err != nil {
+		return ids, err
+	}
+
+	sql := fmt.Sprintf("SELECT %s FROM %s %s", column, table, where)
+	rows, err := ds.MySQL.Session.Query(sql, args...)
 	if err != nil {
 		return ids, err
 	}
@@ -34,11 +46,11 @@ func GetIntCol(ds datastore.Datastore, table, column, clause string, ) ([]int, e
 	return ids, nil
 }
 
+// GetRows runs any query, with optional arguments for placeholders, and returns a map slice where
+// each slice is a row
+func GetRows(ds datastore.Datastore, sql string, args ...interface{}) ([]map[string]string, error) {
 
-// GetRows runs any query and returns a map slice where each slice is a row
-func GetRows(ds datastore.Datastore, sql string) ([]map[string]string, error) {
-
-	rows, e := ds.MySQL.Session.Query(sql)
+	rows, e := ds.MySQL.Session.Query(sql, args...)
 	if e != nil {
 		return nil, e
 	}
@@ -0,0 +1,388 @@
+// Package history records the changes made to member records over time, as the before and after values of
+// each field that changed. Changes are recorded in the log_data_action and log_data_field tables, for the
+// tables listed in log_data_table.
+package history
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+)
+
+// Actions recorded for a change to a row
+const (
+	ActionInsert = "insert"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+// MemberTables are the member table and the junction tables that hold member data. Only those that are also
+// listed in log_data_table are tracked, see migrations/003-history-tables.sql, and a warning is logged for
+// each one that is not.
+var MemberTables = []string{
+	"member",
+	"mp_m_accreditation",
+	"mp_m_contact",
+	"mp_m_position",
+	"mp_m_qualification",
+	"mp_m_speciality",
+	"mp_m_tag",
+	"ms_m_status",
+	"ms_m_title",
+}
+
+// ignoredColumns are not recorded, as they change on every write or hold credentials
+var ignoredColumns = map[string]bool{
+	"created_at":    true,
+	"updated_at":    true,
+	"last_login_at": true,
+	"password":      true,
+	"token":         true,
+}
+
+// Actor is the user that made a change, with a user type of 'admin', 'member' or 'service'. The id is an
+// ad_user, member or auth_api_key id respectively.
+type Actor struct {
+	ID   int
+	Type string
+}
+
+// Change is a change to a single row
+type Change struct {
+	ID        int       `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	Table     string    `json:"table"`
+	RecordID  int       `json:"recordId"`
+	MemberID  int       `json:"memberId"`
+	UserID    int       `json:"userId"`
+	UserType  string    `json:"userType"`
+	Action    string    `json:"action"`
+	Message   string    `json:"message"`
+	Fields    []Field   `json:"fields"`
+}
+
+// Field is the value of a column before and after a change. Before is empty for an insert, and After is
+// empty for a delete.
+type Field struct {
+	Name   string `json:"name"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// rows are the rows of one table, keyed by id, with the value of each column as a string
+type rows map[int]map[string]string
+
+// Snapshot is the state of a member's rows, in each tracked table, before a change is made
+type Snapshot struct {
+	MemberID int
+	tables   map[string]rows
+}
+
+// Take returns a Snapshot of the member's rows in the tables that are tracked
+func Take(ds datastore.Datastore, memberID int, tables ...string) (Snapshot, error) {
+	return TakeTx(ds.MySQL.Session, memberID, tables...)
+}
+
+// TakeTx returns a Snapshot of the member's rows using ex. Inside a transaction the rows are locked until it
+// ends, so a change made and recorded with RecordTx in the same transaction cannot be mixed up with another.
+func TakeTx(ex datastore.Execer, memberID int, tables ...string) (Snapshot, error) {
+
+	s := Empty(memberID)
+
+	tracked, err := trackedTables(ex)
+	if err != nil {
+		return s, err
+	}
+
+	for _, t := range tables {
+		if _, ok := tracked[t]; !ok {
+			warnUntracked(t)
+			continue
+		}
+		s.tables[t], err = memberRows(ex, t, memberID)
+		if err != nil {
+			return s, fmt.Errorf("memberRows() table %s err = %s", t, err)
+		}
+	}
+
+	return s, nil
+}
+
+// Empty returns a Snapshot with no rows, for recording the rows of a new member as inserts
+func Empty(memberID int) Snapshot {
+	return Snapshot{MemberID: memberID, tables: map[string]rows{}}
+}
+
+// Record compares the snapshot with the current state of the member's rows, in the tables given, and
+// records a Change for each row that was inserted, updated or deleted. The message describes the reason for
+// the changes, eg "Updated by admin". It returns the changes that were recorded.
+func (s Snapshot) Record(ds datastore.Datastore, by Actor, message string, tables ...string) ([]Change, error) {
+	return s.RecordTx(ds.MySQL.Session, by, message, tables...)
+}
+
+// RecordTx is Record using ex, so that the changes are recorded in the same transaction as they are made
+func (s Snapshot) RecordTx(ex datastore.Execer, by Actor, message string, tables ...string) ([]Change, error) {
+
+	tracked, err := trackedTables(ex)
+	if err != nil {
+		return nil, err
+	}
+
+	var xc []Change
+	for _, t := range tables {
+		tableID, ok := tracked[t]
+		if !ok {
+			warnUntracked(t)
+			continue
+		}
+		after, err := memberRows(ex, t, s.MemberID)
+		if err != nil {
+			return xc, fmt.Errorf("memberRows() table %s err = %s", t, err)
+		}
+		for _, c := range diff(t, s.tables[t], after) {
+			c.MemberID = s.MemberID
+			c.UserID = by.ID
+			c.UserType = by.Type
+			c.Message = message
+			err := c.insert(ex, tableID)
+			if err != nil {
+				return xc, err
+			}
+			xc = append(xc, c)
+		}
+	}
+
+	return xc, nil
+}
+
+// ByMember returns the changes to a member's records, most recent first
+func ByMember(ds datastore.Datastore, memberID int) ([]Change, error) {
+
+	rs, err := ds.MySQL.Session.Query(queries["select-member-changes"], memberID)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	var xc []Change
+	for rs.Next() {
+		var c Change
+		var createdAt string
+		err := rs.Scan(&c.ID, &createdAt, &c.Table, &c.RecordID, &c.MemberID, &c.UserID, &c.UserType, &c.Action, &c.Message)
+		if err != nil {
+			return nil, err
+		}
+		c.CreatedAt, err = time.Parse("2006-01-02 15:04:05", createdAt)
+		if err != nil {
+			return nil, err
+		}
+		xc = append(xc, c)
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range xc {
+		xc[i].Fields, err = changeFields(ds, xc[i].ID)
+		if err != nil {
+			return nil, fmt.Errorf("changeFields() err = %s", err)
+		}
+	}
+
+	return xc, nil
+}
+
+// diff compares the rows of a table before and after a change, and returns a Change, without the member
+// or user, for each row that differs
+func diff(table string, before, after rows) []Change {
+
+	ids := map[int]bool{}
+	for id := range before {
+		ids[id] = true
+	}
+	for id := range after {
+		ids[id] = true
+	}
+	var xi []int
+	for id := range ids {
+		xi = append(xi, id)
+	}
+	sort.Ints(xi)
+
+	var xc []Change
+	for _, id := range xi {
+		b, inBefore := before[id]
+		a, inAfter := after[id]
+
+		c := Change{Table: table, RecordID: id, Action: ActionUpdate}
+		switch {
+		case !inBefore:
+			c.Action = ActionInsert
+		case !inAfter:
+			c.Action = ActionDelete
+		}
+
+		c.Fields = diffFields(b, a)
+		if len(c.Fields) > 0 || c.Action != ActionUpdate {
+			xc = append(xc, c)
+		}
+	}
+
+	return xc
+}
+
+// diffFields returns the columns with different values before and after, sorted by name
+func diffFields(before, after map[string]string) []Field {
+
+	names := map[string]bool{}
+	for k := range before {
+		names[k] = true
+	}
+	for k := range after {
+		names[k] = true
+	}
+	var xn []string
+	for k := range names {
+		if !ignoredColumns[k] {
+			xn = append(xn, k)
+		}
+	}
+	sort.Strings(xn)
+
+	var xf []Field
+	for _, n := range xn {
+		if before[n] != after[n] {
+			xf = append(xf, Field{Name: n, Before: before[n], After: after[n]})
+		}
+	}
+	return xf
+}
+
+// untrackedWarnings holds the tables that have been logged as not tracked, so each is only logged once
+var untrackedWarnings sync.Map
+
+// warnUntracked logs, once, that changes to a member table are not recorded as it is not in log_data_table
+func warnUntracked(table string) {
+	if _, logged := untrackedWarnings.LoadOrStore(table, true); !logged {
+		log.Printf("Warning: member table %s is not listed in log_data_table, so its history is not recorded", table)
+	}
+}
+
+// trackedTables returns the ids of the tables listed in log_data_table, keyed by name
+func trackedTables(ex datastore.Execer) (map[string]int, error) {
+
+	rs, err := ex.Query(queries["select-tracked-tables"])
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	m := map[string]int{}
+	for rs.Next() {
+		var id int
+		var name string
+		if err := rs.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		m[name] = id
+	}
+	return m, rs.Err()
+}
+
+// memberRows fetches the rows of a table that belong to a member, that is the member record itself or the
+// rows with the member id in a junction table. It is a locking read, which only holds the locks when ex is a
+// transaction.
+func memberRows(ex datastore.Execer, table string, memberID int) (rows, error) {
+
+	err := datastore.ValidIdentifier(table)
+	if err != nil {
+		return nil, err
+	}
+	column := "member_id"
+	if table == "member" {
+		column = "id"
+	}
+
+	rs, err := ex.Query("SELECT * FROM "+table+" WHERE "+column+" = ? FOR UPDATE", memberID)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	cols, err := rs.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	r := rows{}
+	for rs.Next() {
+		values := make([]sql.NullString, len(cols))
+		dest := make([]interface{}, len(cols))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rs.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		row := map[string]string{}
+		var id int
+		for i, c := range cols {
+			row[c] = values[i].String
+			if c == "id" {
+				id, _ = strconv.Atoi(values[i].String)
+			}
+		}
+		r[id] = row
+	}
+
+	return r, rs.Err()
+}
+
+// insert records a Change and its fields
+func (c Change) insert(ex datastore.Execer, tableID int) error {
+
+	res, err := ex.Exec(queries["insert-change"], tableID, c.RecordID, c.UserID, c.MemberID, c.UserType, c.Action, c.Message)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range c.Fields {
+		_, err := ex.Exec(queries["insert-change-field"], id, f.Name, f.Before, f.After)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// changeFields fetches the fields for the change identified by id
+func changeFields(ds datastore.Datastore, id int) ([]Field, error) {
+
+	rs, err := ds.MySQL.Session.Query(queries["select-change-fields"], id)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	var xf []Field
+	for rs.Next() {
+		var f Field
+		if err := rs.Scan(&f.Name, &f.Before, &f.After); err != nil {
+			return nil, err
+		}
+		xf = append(xf, f)
+	}
+	return xf, rs.Err()
+}
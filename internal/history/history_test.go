@@ -0,0 +1,171 @@
+package history_test
+
+import (
+	"errors"
+	"log"
+	"testing"
+
+	"github.com/cardiacsociety/web-services/internal/history"
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+	"github.com/cardiacsociety/web-services/testdata"
+)
+
+var ds datastore.Datastore
+
+func TestAll(t *testing.T) {
+
+	var teardown func()
+	ds, teardown = setup()
+	defer teardown()
+
+	t.Run("history", func(t *testing.T) {
+		t.Run("testPingDatabase", testPingDatabase)
+		t.Run("testRecordUpdate", testRecordUpdate)
+		t.Run("testRecordInsertDelete", testRecordInsertDelete)
+		t.Run("testRecordNoChange", testRecordNoChange)
+		t.Run("testByMember", testByMember)
+		t.Run("testRecordTxRollback", testRecordTxRollback)
+	})
+}
+
+func setup() (datastore.Datastore, func()) {
+	var db = testdata.NewDataStore()
+	err := db.SetupMySQL()
+	if err != nil {
+		log.Fatalf("db.SetupMySQL() err = %s", err)
+	}
+	return db.Store, func() {
+		err := db.TearDownMySQL()
+		if err != nil {
+			log.Fatalf("db.TearDownMySQL() err = %s", err)
+		}
+	}
+}
+
+func testPingDatabase(t *testing.T) {
+	err := ds.MySQL.Session.Ping()
+	if err != nil {
+		t.Fatalf("Ping() err = %s", err)
+	}
+}
+
+var admin = history.Actor{ID: 1, Type: "admin"}
+
+func testRecordUpdate(t *testing.T) {
+	s, err := history.Take(ds, 1, history.MemberTables...)
+	if err != nil {
+		t.Fatalf("history.Take() err = %s", err)
+	}
+	_, err = ds.MySQL.Session.Exec("UPDATE member SET mobile_phone = '0400 111 222', updated_at = NOW() WHERE id = 1")
+	if err != nil {
+		t.Fatalf("Exec() err = %s", err)
+	}
+	xc, err := s.Record(ds, admin, "test update", history.MemberTables...)
+	if err != nil {
+		t.Fatalf("Snapshot.Record() err = %s", err)
+	}
+
+	// updated_at is ignored so only the mobile should be recorded
+	if len(xc) != 1 || len(xc[0].Fields) != 1 {
+		t.Fatalf("Snapshot.Record() = %+v, want one change with one field", xc)
+	}
+	c := xc[0]
+	if c.Table != "member" || c.RecordID != 1 || c.Action != history.ActionUpdate {
+		t.Errorf("Snapshot.Record() change = %+v, want update to member 1", c)
+	}
+	if c.Fields[0].Name != "mobile_phone" || c.Fields[0].After != "0400 111 222" {
+		t.Errorf("Snapshot.Record() field = %+v, want mobile_phone changed", c.Fields[0])
+	}
+}
+
+func testRecordInsertDelete(t *testing.T) {
+	tables := []string{"mp_m_qualification"}
+	s, err := history.Take(ds, 1, tables...)
+	if err != nil {
+		t.Fatalf("history.Take() err = %s", err)
+	}
+	_, err = ds.MySQL.Session.Exec("DELETE FROM mp_m_qualification WHERE id = 1")
+	if err != nil {
+		t.Fatalf("Exec() err = %s", err)
+	}
+	_, err = ds.MySQL.Session.Exec(`INSERT INTO mp_m_qualification (member_id, mp_qualification_id, organisation_id, year, qualification_suffix)
+		VALUES (1, 21, 0, 1994, 'MBBS')`)
+	if err != nil {
+		t.Fatalf("Exec() err = %s", err)
+	}
+	xc, err := s.Record(ds, admin, "test replace", tables...)
+	if err != nil {
+		t.Fatalf("Snapshot.Record() err = %s", err)
+	}
+	if len(xc) != 2 {
+		t.Fatalf("Snapshot.Record() returned %d changes, want 2", len(xc))
+	}
+	if xc[0].Action != history.ActionDelete || xc[0].RecordID != 1 {
+		t.Errorf("Snapshot.Record() change = %+v, want delete of record 1", xc[0])
+	}
+	if xc[1].Action != history.ActionInsert {
+		t.Errorf("Snapshot.Record() change = %+v, want insert", xc[1])
+	}
+}
+
+func testRecordNoChange(t *testing.T) {
+	s, err := history.Take(ds, 1, history.MemberTables...)
+	if err != nil {
+		t.Fatalf("history.Take() err = %s", err)
+	}
+	xc, err := s.Record(ds, admin, "no change", history.MemberTables...)
+	if err != nil {
+		t.Fatalf("Snapshot.Record() err = %s", err)
+	}
+	if len(xc) != 0 {
+		t.Errorf("Snapshot.Record() returned %d changes, want 0", len(xc))
+	}
+}
+
+func testByMember(t *testing.T) {
+	xc, err := history.ByMember(ds, 1)
+	if err != nil {
+		t.Fatalf("history.ByMember() err = %s", err)
+	}
+	// the update, and the delete and insert, most recent first
+	if len(xc) != 3 {
+		t.Fatalf("history.ByMember() returned %d changes, want 3", len(xc))
+	}
+	if xc[2].Message != "test update" || xc[2].UserType != "admin" || len(xc[2].Fields) != 1 {
+		t.Errorf("history.ByMember() oldest change = %+v", xc[2])
+	}
+}
+
+func testRecordTxRollback(t *testing.T) {
+	errRollback := errors.New("rollback")
+	err := ds.MySQL.InTx(func(ex datastore.Execer) error {
+		s, err := history.TakeTx(ex, 1, history.MemberTables...)
+		if err != nil {
+			return err
+		}
+		_, err = ex.Exec("UPDATE member SET mobile_phone = '0400 333 444' WHERE id = 1")
+		if err != nil {
+			return err
+		}
+		xc, err := s.RecordTx(ex, admin, "test rollback", history.MemberTables...)
+		if err != nil {
+			return err
+		}
+		if len(xc) != 1 {
+			t.Errorf("Snapshot.RecordTx() = %+v, want one change", xc)
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatalf("InTx() err = %v, want %v", err, errRollback)
+	}
+
+	// the change and its history are rolled back together
+	xc, err := history.ByMember(ds, 1)
+	if err != nil {
+		t.Fatalf("history.ByMember() err = %s", err)
+	}
+	if len(xc) != 3 {
+		t.Errorf("history.ByMember() returned %d changes after rollback, want 3", len(xc))
+	}
+}
@@ -0,0 +1,39 @@
+package history
+
+var queries = map[string]string{
+	"select-tracked-tables": selectTrackedTables,
+	"insert-change":         insertChange,
+	"insert-change-field":   insertChangeField,
+	"select-member-changes": selectMemberChanges,
+	"select-change-fields":  selectChangeFields,
+}
+
+const selectTrackedTables = `SELECT id, table_name FROM log_data_table WHERE active = 1`
+
+const insertChange = `
+INSERT INTO log_data_action (log_data_table_id, record_id, user_id, member_id, user_type, action, message, created_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, NOW())`
+
+const insertChangeField = `
+INSERT INTO log_data_field (log_data_action_id, field_name, value_before, value_after, created_at)
+VALUES (?, ?, ?, ?, NOW())`
+
+const selectMemberChanges = `
+SELECT
+  a.id,
+  a.created_at,
+  t.table_name,
+  a.record_id,
+  a.member_id,
+  a.user_id,
+  a.user_type,
+  a.action,
+  a.message
+FROM log_data_action a
+  INNER JOIN log_data_table t ON t.id = a.log_data_table_id
+WHERE a.member_id = ? AND a.active = 1
+ORDER BY a.id DESC`
+
+const selectChangeFields = `
+SELECT field_name, value_before, value_after FROM log_data_field
+WHERE log_data_action_id = ? AND active = 1 ORDER BY id`
@@ -28,4 +28,4 @@ WHERE 1
 
 const selectActiveInvoices = selectInvoices + ` AND i.active = 1 `
 
-const selectInvoiceByID = selectActiveInvoices + ` AND i.id = %v `
+const selectInvoiceByID = selectActiveInvoices + ` AND i.id = ? `
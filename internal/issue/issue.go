@@ -3,7 +3,6 @@ package issue
 
 import (
 	"errors"
-	"fmt"
 
 	"github.com/cardiacsociety/web-services/internal/note"
 	"github.com/cardiacsociety/web-services/internal/platform/datastore"
@@ -59,6 +58,11 @@ type Category struct {
 
 // InsertRow creates a new issue row with fields from Issue
 func (i *Issue) InsertRow(ds datastore.Datastore) error {
+	return i.InsertRowTx(ds.MySQL.Session)
+}
+
+// InsertRowTx inserts a new issue row, using ex so that the issue can be created as part of a transaction
+func (i *Issue) InsertRowTx(ex datastore.Execer) error {
 	switch {
 	case i.ID > 0:
 		return errors.New(ErrorIDNotNil)
@@ -67,8 +71,7 @@ func (i *Issue) InsertRow(ds datastore.Datastore) error {
 	case i.Description == "":
 		return errors.New(ErrorNoDescription)
 	}
-	q := fmt.Sprintf(queries["insert-issue"], i.Type.ID, i.Description, i.Action)
-	res, err := ds.MySQL.Session.Exec(q)
+	res, err := ex.Exec(queries["insert-issue"], i.Type.ID, i.Description, i.Action)
 	if err != nil {
 		return err
 	}
@@ -84,8 +87,7 @@ func (i *Issue) InsertRow(ds datastore.Datastore) error {
 		if err != nil {
 			return err
 		}
-		q := fmt.Sprintf(queries["insert-issue-association"], i.ID, i.MemberID, i.AssociationID, i.Association)
-		_, err = ds.MySQL.Session.Exec(q)
+		_, err = ex.Exec(queries["insert-issue-association"], i.ID, i.MemberID, i.AssociationID, i.Association)
 		if err != nil {
 			return err
 		}
@@ -151,9 +153,14 @@ func ByID(ds datastore.Datastore, id int) (Issue, error) {
 
 // TypeByID fetches an issue type by id
 func TypeByID(ds datastore.Datastore, id int) (Type, error) {
+	return TypeByIDTx(ds.MySQL.Session, id)
+}
+
+// TypeByIDTx fetches an issue type using ex, so that it can be part of a transaction
+func TypeByIDTx(ex datastore.Execer, id int) (Type, error) {
 	t := Type{}
 	q := queries["select-issue-type-by-id"]
-	err := ds.MySQL.Session.QueryRow(q, id).Scan(
+	err := ex.QueryRow(q, id).Scan(
 		&t.ID,
 		&t.Name,
 		&t.Description,
@@ -14,7 +14,7 @@ INSERT INTO wf_issue (
 	live_on, 
 	description, 
 	required_action
-) VALUES (%d, NOW(), NOW(), %q, %q)`
+) VALUES (?, NOW(), NOW(), ?, ?)`
 
 const insertIssueAssociation = `
 INSERT INTO wf_issue_association (
@@ -23,7 +23,7 @@ INSERT INTO wf_issue_association (
 	association_entity_id, 
 	updated_at, 
 	association
-) VALUES (%d, %d, %d, NOW(), %q)`
+) VALUES (?, ?, ?, NOW(), ?)`
 
 const selectIssue = `
 SELECT 
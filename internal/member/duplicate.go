@@ -0,0 +1,267 @@
+package member
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/cardiacsociety/web-services/internal/note"
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+)
+
+// DefaultMinDuplicateScore is the lowest score for a pair of members to be a duplicate candidate
+const DefaultMinDuplicateScore = 40
+
+// Scores for each field that two members have in common. A pair scores a maximum of 100.
+const (
+	scoreEmail         = 40
+	scoreEmailUser     = 20
+	scoreJournalNumber = 40
+	scoreMobile        = 30
+	scoreDateOfBirth   = 25
+	scoreFirstName     = 15
+	scoreLastName      = 15
+)
+
+// ErrMergeSelf is returned when a member is merged with itself
+var ErrMergeSelf = errors.New("a member cannot be merged with itself")
+
+// mergeQueries re-point the records of the duplicate member to the surviving member. Attachments belong to
+// notes and activities, so they move with them. Titles, evaluation periods and subscriptions are first
+// reconciled with the survivor's, so that the survivor keeps one current title, and does not get overlapping
+// evaluation periods or a second subscription of the same kind.
+var mergeQueries = []string{
+	"merge-member-activities",
+	"merge-member-invoices",
+	"merge-member-payments",
+	"merge-member-notes",
+	"merge-member-issues",
+	"merge-member-statuses",
+	"reconcile-member-titles",
+	"merge-member-titles",
+	"reconcile-member-evaluations",
+	"merge-member-evaluations",
+	"reconcile-member-subscriptions",
+	"merge-member-subscriptions",
+}
+
+// Candidate is a pair of members that may be the same person. MemberID is the older record.
+type Candidate struct {
+	MemberID    int      `json:"memberId"`
+	DuplicateID int      `json:"duplicateId"`
+	Score       int      `json:"score"`
+	Reasons     []string `json:"reasons"`
+}
+
+// matchFields are the fields compared to find duplicate members, normalised for comparison
+type matchFields struct {
+	ID            int
+	FirstName     string
+	LastName      string
+	DateOfBirth   string
+	Email         string
+	Mobile        string
+	JournalNumber string
+}
+
+// Duplicates finds pairs of active members that may be the same person, eg someone who re-applied with a
+// new email, or with a married name. Each pair is scored on the names, date of birth, email, mobile and
+// journal number they have in common, and pairs that score at least minScore are returned, highest first.
+func Duplicates(ds datastore.Datastore, minScore int) ([]Candidate, error) {
+
+	var xc []Candidate
+
+	xm, err := duplicateMatchFields(ds)
+	if err != nil {
+		return xc, err
+	}
+
+	// only compare members that have something in common, rather than every pair
+	buckets := map[string][]int{}
+	add := func(key, value string, i int) {
+		if value != "" {
+			buckets[key+":"+value] = append(buckets[key+":"+value], i)
+		}
+	}
+	for i, m := range xm {
+		add("email", m.Email, i)
+		add("user", emailUser(m.Email), i)
+		add("mobile", m.Mobile, i)
+		add("journal", m.JournalNumber, i)
+		add("name", m.FirstName+" "+m.LastName, i)
+		if m.DateOfBirth != "" {
+			add("first", m.FirstName+" "+m.DateOfBirth, i)
+			add("last", m.LastName+" "+m.DateOfBirth, i)
+		}
+	}
+
+	seen := map[[2]int]bool{}
+	for _, xi := range buckets {
+		for a := 0; a < len(xi); a++ {
+			for b := a + 1; b < len(xi); b++ {
+				m1, m2 := xm[xi[a]], xm[xi[b]]
+				if m1.ID > m2.ID {
+					m1, m2 = m2, m1
+				}
+				pair := [2]int{m1.ID, m2.ID}
+				if seen[pair] {
+					continue
+				}
+				seen[pair] = true
+
+				c := scoreDuplicate(m1, m2)
+				if c.Score >= minScore {
+					xc = append(xc, c)
+				}
+			}
+		}
+	}
+
+	sort.Slice(xc, func(i, j int) bool {
+		if xc[i].Score != xc[j].Score {
+			return xc[i].Score > xc[j].Score
+		}
+		return xc[i].MemberID < xc[j].MemberID
+	})
+
+	return xc, nil
+}
+
+// Merge merges the duplicate member into the surviving member, in a single transaction. The activities,
+// invoices, payments, notes, issues, status and title history, evaluation periods and subscriptions of the
+// duplicate are re-pointed to the survivor, the duplicate is deactivated and a note is added to both members.
+// The caller should re-sync both member docs.
+func Merge(ds datastore.Datastore, survivorID, duplicateID int) error {
+	return ds.MySQL.InTx(func(ex datastore.Execer) error {
+		return MergeTx(ex, survivorID, duplicateID)
+	})
+}
+
+// MergeTx merges the duplicate member into the surviving member using ex, so that it can be part of a larger
+// transaction
+func MergeTx(ex datastore.Execer, survivorID, duplicateID int) error {
+
+	if survivorID == duplicateID {
+		return ErrMergeSelf
+	}
+
+	for _, id := range []int{survivorID, duplicateID} {
+		var active int
+		err := ex.QueryRow(queries["select-member-active"], id).Scan(&active)
+		if err != nil {
+			return err
+		}
+		if active != 1 {
+			return fmt.Errorf("member id %d is not active", id)
+		}
+	}
+
+	for _, q := range mergeQueries {
+		_, err := ex.Exec(queries[q], survivorID, duplicateID)
+		if err != nil {
+			return fmt.Errorf("%s err = %s", q, err)
+		}
+	}
+
+	_, err := ex.Exec(queries["update-member-deactivate"], duplicateID)
+	if err != nil {
+		return err
+	}
+
+	xn := []note.Note{
+		{MemberID: survivorID, Content: fmt.Sprintf("Merged with duplicate member id %d", duplicateID)},
+		{MemberID: duplicateID, Content: fmt.Sprintf("Merged into member id %d and deactivated", survivorID)},
+	}
+	for _, n := range xn {
+		n.TypeID = profileNoteTypeID
+		err := n.InsertRowTx(ex)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scoreDuplicate scores a pair of members on the fields they have in common
+func scoreDuplicate(m1, m2 matchFields) Candidate {
+
+	c := Candidate{MemberID: m1.ID, DuplicateID: m2.ID}
+	match := func(a, b string, score int, reason string) bool {
+		if a == "" || a != b {
+			return false
+		}
+		c.Score += score
+		c.Reasons = append(c.Reasons, reason)
+		return true
+	}
+
+	if !match(m1.Email, m2.Email, scoreEmail, "email") {
+		match(emailUser(m1.Email), emailUser(m2.Email), scoreEmailUser, "email user name")
+	}
+	match(m1.JournalNumber, m2.JournalNumber, scoreJournalNumber, "journal number")
+	match(m1.Mobile, m2.Mobile, scoreMobile, "mobile")
+	match(m1.DateOfBirth, m2.DateOfBirth, scoreDateOfBirth, "date of birth")
+	match(m1.FirstName, m2.FirstName, scoreFirstName, "first name")
+	match(m1.LastName, m2.LastName, scoreLastName, "last name")
+
+	if c.Score > 100 {
+		c.Score = 100
+	}
+	return c
+}
+
+// duplicateMatchFields fetches the fields of all active members that are compared to find duplicates
+func duplicateMatchFields(ds datastore.Datastore) ([]matchFields, error) {
+
+	var xm []matchFields
+
+	rows, err := ds.MySQL.Session.Query(queries["select-member-match-fields"])
+	if err != nil {
+		return xm, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m matchFields
+		err := rows.Scan(&m.ID, &m.FirstName, &m.LastName, &m.DateOfBirth, &m.Email, &m.Mobile, &m.JournalNumber)
+		if err != nil {
+			return xm, err
+		}
+		m.FirstName = strings.ToLower(strings.TrimSpace(m.FirstName))
+		m.LastName = strings.ToLower(strings.TrimSpace(m.LastName))
+		m.Email = strings.ToLower(strings.TrimSpace(m.Email))
+		m.Mobile = digits(m.Mobile)
+		m.JournalNumber = strings.ToLower(strings.TrimSpace(m.JournalNumber))
+		xm = append(xm, m)
+	}
+
+	return xm, rows.Err()
+}
+
+// emailUser returns the part of an email address before the @
+func emailUser(email string) string {
+	i := strings.Index(email, "@")
+	if i < 1 {
+		return ""
+	}
+	return email[:i]
+}
+
+// digits returns the last 9 digits of a phone number, so that numbers with and without a country code,
+// eg +61 402 123 123 and 0402 123 123, are the same
+func digits(phone string) string {
+	var b strings.Builder
+	for _, r := range phone {
+		if unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	s := b.String()
+	if len(s) > 9 {
+		s = s[len(s)-9:]
+	}
+	return s
+}
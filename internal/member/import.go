@@ -0,0 +1,386 @@
+package member
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/360EntSecGroup-Skylar/excelize"
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+	"github.com/cardiacsociety/web-services/internal/platform/excel"
+)
+
+// Formats of import files
+const (
+	ImportCSV  = "csv"
+	ImportXLSX = "xlsx"
+)
+
+// ErrImportInvalid is returned when an import is committed while some rows have errors
+var ErrImportInvalid = errors.New("import has rows with errors - fix them and try again")
+
+// ImportColumns are the column headings recognised in an import file. Headings are not case sensitive and
+// may be in any order. The id columns refer to reference data, eg titleId is the id of a name prefix. tagIds
+// is a list of tag ids separated by semicolons. Each row may have one contact location and one qualification.
+var ImportColumns = []string{
+	"roleId", "titleId", "countryId", "firstName", "middleNames", "lastName", "gender", "dateOfBirth",
+	"primaryEmail", "mobile", "postNominal", "consentDirectory", "consentContact",
+	"contactTypeId", "address1", "address2", "address3", "locality", "state", "postcode", "contactCountryId",
+	"phone", "qualificationId", "qualificationOrganisationId", "qualificationYear", "tagIds",
+}
+
+// requiredImportColumns must be present in an import file
+var requiredImportColumns = []string{"roleId", "titleId", "countryId", "firstName", "lastName", "primaryEmail"}
+
+// referenceTables are the tables that hold the reference data for the id columns of an import file
+var referenceTables = map[string]string{
+	"roleId":                      "acl_member_role",
+	"titleId":                     "a_name_prefix",
+	"countryId":                   "country",
+	"contactTypeId":               "mp_contact_type",
+	"contactCountryId":            "country",
+	"qualificationId":             "mp_qualification",
+	"qualificationOrganisationId": "organisation",
+	"tagIds":                      "mp_tag",
+}
+
+// ImportRow is a row of an import file, with the member Row it maps to and any problems with it. Errors stop
+// the import from being committed, warnings do not.
+type ImportRow struct {
+	Line     int      `json:"line"`
+	Row      Row      `json:"row"`
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+}
+
+// Import is the content of an import file, validated against reference data and existing members
+type Import struct {
+	Rows []ImportRow `json:"rows"`
+}
+
+// ReadImport reads a CSV or XLSX import file, with headings in the first row, and validates each row. A row
+// with the same email as an existing member or an earlier row in the file is a duplicate, and has an error.
+// As different people can share a name, a row with the same first and last name only has a warning. An
+// error is only returned if the file as a whole could not be read.
+func ReadImport(ds datastore.Datastore, r io.Reader, format string) (Import, error) {
+
+	var im Import
+
+	records, err := importRecords(r, format)
+	if err != nil {
+		return im, err
+	}
+	if len(records) < 2 {
+		return im, errors.New("import file has no rows below the headings")
+	}
+
+	cols := map[string]int{}
+	for i, h := range records[0] {
+		for _, c := range ImportColumns {
+			if strings.EqualFold(strings.TrimSpace(h), c) {
+				cols[c] = i
+			}
+		}
+	}
+	for _, c := range requiredImportColumns {
+		if _, ok := cols[c]; !ok {
+			return im, fmt.Errorf("import file has no %s column", c)
+		}
+	}
+
+	refs, err := referenceIDs(ds)
+	if err != nil {
+		return im, err
+	}
+
+	emails := map[string]int{}
+	names := map[string]int{}
+	for i, rec := range records[1:] {
+
+		ir := ImportRow{Line: i + 2}
+		value := func(col string) string {
+			if j, ok := cols[col]; ok && j < len(rec) {
+				return strings.TrimSpace(rec[j])
+			}
+			return ""
+		}
+		if strings.Join(rec, "") == "" {
+			continue // blank line
+		}
+
+		ir.mapRow(value, refs)
+
+		err := ir.Row.Validate()
+		if xs, ok := err.(RowError); ok {
+			ir.Errors = append(ir.Errors, xs...)
+		}
+
+		// duplicates in the file
+		email := strings.ToLower(ir.Row.PrimaryEmail)
+		name := strings.ToLower(ir.Row.FirstName + " " + ir.Row.LastName)
+		if line, ok := emails[email]; ok && email != "" {
+			ir.Errors = append(ir.Errors, fmt.Sprintf("primaryEmail is the same as line %d", line))
+		}
+		if line, ok := names[name]; ok {
+			ir.Warnings = append(ir.Warnings, fmt.Sprintf("name is the same as line %d", line))
+		}
+		if _, ok := emails[email]; !ok {
+			emails[email] = ir.Line
+		}
+		if _, ok := names[name]; !ok {
+			names[name] = ir.Line
+		}
+
+		// duplicates in the database
+		err = ir.duplicates(ds)
+		if err != nil {
+			return im, err
+		}
+
+		im.Rows = append(im.Rows, ir)
+	}
+
+	return im, nil
+}
+
+// ErrorCount returns the number of rows that have errors
+func (im Import) ErrorCount() int {
+	var n int
+	for _, ir := range im.Rows {
+		if len(ir.Errors) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// WarningCount returns the number of rows that have warnings
+func (im Import) WarningCount() int {
+	var n int
+	for _, ir := range im.Rows {
+		if len(ir.Warnings) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Commit inserts all of the import rows in a single transaction, as for ImportRows, and returns the new
+// member ids. Nothing is inserted if any row has errors.
+func (im Import) Commit(ds datastore.Datastore) ([]int, error) {
+
+	if im.ErrorCount() > 0 {
+		return nil, ErrImportInvalid
+	}
+
+	rows := make([]*Row, len(im.Rows))
+	for i := range im.Rows {
+		rows[i] = &im.Rows[i].Row
+	}
+
+	err := ImportRows(ds, rows)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, len(rows))
+	for i, r := range rows {
+		ids[i] = r.ID
+	}
+	return ids, nil
+}
+
+// ErrorReport returns an excel file listing each row of the import, with the errors and warnings for each
+// line on a separate sheet
+func (im Import) ErrorReport() *excelize.File {
+
+	f := excel.New([]string{"Line", "First Name", "Last Name", "Email", "Status"})
+	for _, ir := range im.Rows {
+		status := "OK"
+		switch {
+		case len(ir.Errors) > 0:
+			status = fmt.Sprintf("%d error(s)", len(ir.Errors))
+		case len(ir.Warnings) > 0:
+			status = fmt.Sprintf("%d warning(s)", len(ir.Warnings))
+		}
+		err := f.AddRow([]interface{}{ir.Line, ir.Row.FirstName, ir.Row.LastName, ir.Row.PrimaryEmail, status})
+		if err != nil {
+			f.AddError(ir.Line, fmt.Sprintf("AddRow() err = %s", err))
+		}
+		for _, e := range ir.Errors {
+			f.AddError(ir.Line, e)
+		}
+		for _, e := range ir.Warnings {
+			f.AddError(ir.Line, "Warning: "+e)
+		}
+	}
+
+	f.SetColWidthByHeading("First Name", 20)
+	f.SetColWidthByHeading("Last Name", 20)
+	f.SetColWidthByHeading("Email", 32)
+
+	return f.XLSX
+}
+
+// mapRow sets the fields of the member Row from the column values, and records any value that is not a
+// valid number, boolean or reference data id
+func (ir *ImportRow) mapRow(value func(string) string, refs map[string]map[int]bool) {
+
+	id := func(col string) int {
+		s := value(col)
+		if s == "" {
+			return 0
+		}
+		n, err := strconv.Atoi(s)
+		switch {
+		case err != nil:
+			ir.Errors = append(ir.Errors, fmt.Sprintf("%s '%s' is not a number", col, s))
+		case refs[col] != nil && !refs[col][n]:
+			ir.Errors = append(ir.Errors, fmt.Sprintf("%s %d does not exist", col, n))
+		}
+		return n
+	}
+	flag := func(col string) bool {
+		switch strings.ToLower(value(col)) {
+		case "", "0", "n", "no", "false":
+			return false
+		case "1", "y", "yes", "true":
+			return true
+		}
+		ir.Errors = append(ir.Errors, fmt.Sprintf("%s '%s' is not yes or no", col, value(col)))
+		return false
+	}
+
+	r := &ir.Row
+	r.RoleID = id("roleId")
+	r.NamePrefixID = id("titleId")
+	r.CountryID = id("countryId")
+	r.FirstName = value("firstName")
+	r.MiddleNames = value("middleNames")
+	r.LastName = value("lastName")
+	r.Gender = value("gender")
+	r.DateOfBirth = value("dateOfBirth")
+	r.PrimaryEmail = value("primaryEmail")
+	r.Mobile = value("mobile")
+	r.PostNominal = value("postNominal")
+	r.ConsentDirectory = flag("consentDirectory")
+	r.ConsentContact = flag("consentContact")
+
+	if typeID := id("contactTypeId"); typeID > 0 {
+		r.Contacts = append(r.Contacts, ContactRow{
+			TypeID:    typeID,
+			Address1:  value("address1"),
+			Address2:  value("address2"),
+			Address3:  value("address3"),
+			Locality:  value("locality"),
+			State:     value("state"),
+			Postcode:  value("postcode"),
+			CountryID: id("contactCountryId"),
+			Phone:     value("phone"),
+		})
+	}
+
+	if qualificationID := id("qualificationId"); qualificationID > 0 {
+		r.Qualifications = append(r.Qualifications, QualificationRow{
+			QualificationID: qualificationID,
+			OrganisationID:  id("qualificationOrganisationId"),
+			YearObtained:    id("qualificationYear"),
+		})
+	}
+
+	for _, s := range strings.Split(value("tagIds"), ";") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || !refs["tagIds"][n] {
+			ir.Errors = append(ir.Errors, fmt.Sprintf("tagIds '%s' is not a valid tag id", s))
+			continue
+		}
+		r.Tags = append(r.Tags, TagRow{TagID: n})
+	}
+}
+
+// duplicates adds an error for an existing member with the same email as the row, and a warning for each
+// existing member with the same first and last name
+func (ir *ImportRow) duplicates(ds datastore.Datastore) error {
+
+	var id int
+	if ir.Row.PrimaryEmail != "" {
+		err := ds.MySQL.Session.QueryRow(queries["select-member-id-by-email"], ir.Row.PrimaryEmail).Scan(&id)
+		switch {
+		case err == nil:
+			ir.Errors = append(ir.Errors, fmt.Sprintf("primaryEmail is the same as member id %d", id))
+		case err != sql.ErrNoRows:
+			return err
+		}
+	}
+
+	rows, err := ds.MySQL.Session.Query(queries["select-member-ids-by-name"], ir.Row.FirstName, ir.Row.LastName)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err := rows.Scan(&id)
+		if err != nil {
+			return err
+		}
+		ir.Warnings = append(ir.Warnings, fmt.Sprintf("name is the same as member id %d", id))
+	}
+
+	return rows.Err()
+}
+
+// referenceIDs fetches the active ids of the reference data for each id column
+func referenceIDs(ds datastore.Datastore) (map[string]map[int]bool, error) {
+
+	refs := map[string]map[int]bool{}
+	for col, table := range referenceTables {
+		refs[col] = map[int]bool{}
+		rows, err := ds.MySQL.Session.Query(fmt.Sprintf(queries["select-reference-ids"], table))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int
+			err := rows.Scan(&id)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			refs[col][id] = true
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return refs, nil
+}
+
+// importRecords reads all of the records from a CSV file, or from the first sheet of an XLSX file
+func importRecords(r io.Reader, format string) ([][]string, error) {
+
+	switch format {
+	case ImportCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1 // allow short rows
+		return cr.ReadAll()
+	case ImportXLSX:
+		x, err := excelize.OpenReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return x.GetRows(x.GetSheetName(1)), nil
+	}
+
+	return nil, fmt.Errorf("import format '%s' is not supported - use %s or %s", format, ImportCSV, ImportXLSX)
+}
@@ -0,0 +1,211 @@
+package member
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/360EntSecGroup-Skylar/excelize"
+	"github.com/cardiacsociety/web-services/internal/issue"
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+	"github.com/cardiacsociety/web-services/internal/platform/excel"
+)
+
+// lapseIssueTypeID is the type of issue raised for each member lapsed by a lapse run
+const lapseIssueTypeID = 2 // Invoice Past Due
+
+// Default notice sent to each member lapsed by a lapse run
+const (
+	DefaultLapseNoticeSubject = "Your membership has lapsed"
+	DefaultLapseNoticeText    = `Hi {{.Name}},
+
+Your membership has lapsed because {{len .InvoiceIDs}} subscription invoice(s), totalling ${{printf "%.2f" .Overdue}}, remain unpaid.
+
+To reinstate your membership please pay the outstanding invoice(s), or contact us if you believe this is an error.
+`
+)
+
+// ErrLapseCriteria is returned when the criteria for a lapse run are not valid
+var ErrLapseCriteria = errors.New("daysOverdue cannot be negative")
+
+// LapseCriteria selects the members to lapse in a lapse run. A member is selected if they have a subscription
+// invoice that is unpaid more than DaysOverdue days after its due date, with no payments allocated to it, unless
+// their current title is one of ExcludeTitleIDs. Members that are already lapsed are never selected. If
+// MemberIDs is set only those members can be selected, so that a run lapses no more than its preview listed.
+type LapseCriteria struct {
+	DaysOverdue     int   `json:"daysOverdue"`
+	ExcludeTitleIDs []int `json:"excludeTitleIds"`
+	MemberIDs       []int `json:"memberIds"`
+}
+
+// LapseCandidate is a member selected by a lapse run, with the overdue invoices that are the reason for it
+type LapseCandidate struct {
+	MemberID    int     `json:"memberId"`
+	Name        string  `json:"name"`
+	Email       string  `json:"email"`
+	Title       string  `json:"title"`
+	InvoiceIDs  []int   `json:"invoiceIds"`
+	Overdue     float64 `json:"overdue"`
+	DaysOverdue int     `json:"daysOverdue"`
+	Reason      string  `json:"reason"`
+}
+
+// LapseNotice is the email sent to each member lapsed by a lapse run. Subject and Text are text/templates
+// executed with the LapseCandidate, eg {{.Name}} or {{.Overdue}}.
+type LapseNotice struct {
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+}
+
+// LapseCandidates returns the members selected by the lapse run criteria, ordered by member id
+func LapseCandidates(ds datastore.Datastore, lc LapseCriteria) ([]LapseCandidate, error) {
+
+	var xc []LapseCandidate
+
+	if lc.DaysOverdue < 0 {
+		return xc, ErrLapseCriteria
+	}
+
+	args := []interface{}{lc.DaysOverdue, lapsedStatusID}
+	var filter string
+	if len(lc.ExcludeTitleIDs) > 0 {
+		filter = "AND COALESCE(mmt.ms_title_id, 0) NOT IN (?" + strings.Repeat(", ?", len(lc.ExcludeTitleIDs)-1) + ")"
+		for _, id := range lc.ExcludeTitleIDs {
+			args = append(args, id)
+		}
+	}
+	if len(lc.MemberIDs) > 0 {
+		filter += " AND m.id IN (?" + strings.Repeat(", ?", len(lc.MemberIDs)-1) + ")"
+		for _, id := range lc.MemberIDs {
+			args = append(args, id)
+		}
+	}
+
+	rows, err := ds.MySQL.Session.Query(fmt.Sprintf(queries["select-lapse-invoices"], filter), args...)
+	if err != nil {
+		return xc, err
+	}
+	defer rows.Close()
+
+	// one row for each overdue invoice, oldest first for each member
+	var dueOn []string
+	for rows.Next() {
+		var c LapseCandidate
+		var invoiceID, days int
+		var due string
+		var amount float64
+		err := rows.Scan(&c.MemberID, &c.Name, &c.Email, &c.Title, &invoiceID, &due, &days, &amount)
+		if err != nil {
+			return xc, err
+		}
+		if len(xc) == 0 || xc[len(xc)-1].MemberID != c.MemberID {
+			c.DaysOverdue = days
+			xc = append(xc, c)
+			dueOn = append(dueOn, due)
+		}
+		last := &xc[len(xc)-1]
+		last.InvoiceIDs = append(last.InvoiceIDs, invoiceID)
+		last.Overdue += amount
+	}
+	if err := rows.Err(); err != nil {
+		return xc, err
+	}
+
+	for i := range xc {
+		c := &xc[i]
+		c.Reason = fmt.Sprintf("%d unpaid subscription invoice(s) totalling $%.2f - invoice id %d was due on %s, %d days ago",
+			len(c.InvoiceIDs), c.Overdue, c.InvoiceIDs[0], dueOn[i], c.DaysOverdue)
+	}
+
+	return xc, nil
+}
+
+// LapseReport returns an excel file listing the members selected by a lapse run, and the reason for each
+func LapseReport(xc []LapseCandidate) *excelize.File {
+
+	f := excel.New([]string{"Member ID", "Name", "Email", "Title", "Invoice IDs", "Overdue", "Days Overdue", "Reason"})
+	for i, c := range xc {
+		ids := make([]string, len(c.InvoiceIDs))
+		for j, id := range c.InvoiceIDs {
+			ids[j] = strconv.Itoa(id)
+		}
+		err := f.AddRow([]interface{}{c.MemberID, c.Name, c.Email, c.Title, strings.Join(ids, ", "), c.Overdue,
+			c.DaysOverdue, c.Reason})
+		if err != nil {
+			f.AddError(i+2, fmt.Sprintf("AddRow() err = %s", err))
+		}
+	}
+
+	f.SetColWidthByHeading("Name", 24)
+	f.SetColWidthByHeading("Email", 32)
+	f.SetColWidthByHeading("Title", 16)
+	f.SetColWidthByHeading("Reason", 80)
+
+	return f.XLSX
+}
+
+// Lapse lapses the member and raises an issue against their oldest overdue invoice, in a single transaction
+func (c LapseCandidate) Lapse(ds datastore.Datastore) error {
+	return ds.MySQL.InTx(c.LapseTx)
+}
+
+// LapseTx lapses the member and raises the issue using ex, so that it can be part of a larger transaction
+func (c LapseCandidate) LapseTx(ex datastore.Execer) error {
+
+	if len(c.InvoiceIDs) == 0 {
+		return fmt.Errorf("member id %d has no overdue invoices", c.MemberID)
+	}
+
+	// get default action for the issue type
+	issType, err := issue.TypeByIDTx(ex, lapseIssueTypeID)
+	if err != nil {
+		return err
+	}
+
+	m := Member{ID: c.MemberID}
+	err = m.LapseTx(ex)
+	if err != nil {
+		return err
+	}
+
+	i := issue.Issue{
+		Type:          issue.Type{ID: lapseIssueTypeID},
+		MemberID:      c.MemberID,
+		Association:   "invoice",
+		AssociationID: c.InvoiceIDs[0],
+		Description:   "Membership lapsed by lapse run: " + c.Reason,
+		Action:        issType.Action,
+	}
+	return i.InsertRowTx(ex)
+}
+
+// Render returns the subject and text of the notice for a member. An empty Subject or Text is replaced with
+// the default.
+func (n LapseNotice) Render(c LapseCandidate) (string, string, error) {
+
+	if n.Subject == "" {
+		n.Subject = DefaultLapseNoticeSubject
+	}
+	if n.Text == "" {
+		n.Text = DefaultLapseNoticeText
+	}
+
+	var xs []string
+	for _, s := range []string{n.Subject, n.Text} {
+		t, err := template.New("notice").Option("missingkey=error").Parse(s)
+		if err != nil {
+			return "", "", err
+		}
+		var b bytes.Buffer
+		err = t.Execute(&b, c)
+		if err != nil {
+			return "", "", err
+		}
+		xs = append(xs, b.String())
+	}
+
+	return xs[0], xs[1], nil
+}
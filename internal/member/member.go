@@ -758,18 +758,23 @@ func SearchDocDB(ds datastore.Datastore, query bson.M) ([]Member, error) {
 // Lapse will lapse a member by setting their status to 'lapsed' and
 // soft-deleting their subcription(s)
 func (m *Member)Lapse(ds datastore.Datastore) error {
+	return m.LapseTx(ds.MySQL.Session)
+}
+
+// LapseTx lapses a member using ex, so that it can be part of a transaction
+func (m *Member) LapseTx(ex datastore.Execer) error {
 
 	// This creates new status of lapsed, and sets others to current = 0
 	sr := StatusRow{
 		StatusID: lapsedStatusID,
 		Current: true, 
 	}
-	if err := sr.insert(ds, m.ID); err != nil {
+	if err := sr.insert(ex, m.ID); err != nil {
 		return err
 	}
 
 	// De-activate all financial subscriptions
-	_, err := ds.MySQL.Session.Exec(queries["update-member-deactivate-subscriptions"], m.ID)
+	_, err := ex.Exec(queries["update-member-deactivate-subscriptions"], m.ID)
 	if err != nil {
 		return err
 	}
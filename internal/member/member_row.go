@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/cardiacsociety/web-services/internal/auth"
 	"github.com/cardiacsociety/web-services/internal/issue"
 	"github.com/cardiacsociety/web-services/internal/note"
 	"github.com/cardiacsociety/web-services/internal/platform/datastore"
@@ -16,6 +18,13 @@ const (
 	newApplicationIssueTypeID = 10
 )
 
+// RowError is returned when a Row is not valid, and lists the problem with each field
+type RowError []string
+
+func (e RowError) Error() string {
+	return "member row is not valid: " + strings.Join(e, "; ")
+}
+
 // Row represents a raw record from the member table in the SQL database. This
 // type is primarily for inserting new records. Junction table data are
 // represented with []int containing a list of foreign key ids for the relevant
@@ -133,9 +142,111 @@ type StatusRow struct {
 	Comment  string
 }
 
-// Insert inserts a member row into the database. If successful it will set the
-// member id.
+// Insert inserts a member row, and the related junction table rows, application, file note and issue, into
+// the database in a single transaction. If successful it will set the member id.
 func (r *Row) Insert(ds datastore.Datastore) error {
+	return InsertRows(ds, []*Row{r})
+}
+
+// InsertRows inserts a number of member rows, as for Row.Insert, in a single transaction so that either all
+// of the rows are saved or none are
+func InsertRows(ds datastore.Datastore, rows []*Row) error {
+	return insertRows(ds, rows, (*Row).insert)
+}
+
+// ImportRows inserts a number of member rows, and the related junction table rows, in a single transaction.
+// Unlike InsertRows it does not create an application, file note or issue for each member, as imported
+// members are already members.
+func ImportRows(ds datastore.Datastore, rows []*Row) error {
+	return insertRows(ds, rows, (*Row).insertMember)
+}
+
+// insertRows inserts each of the rows with insert, in a single transaction
+func insertRows(ds datastore.Datastore, rows []*Row, insert func(*Row, datastore.Execer, string) error) error {
+
+	passwords := make([]string, len(rows))
+	for i, r := range rows {
+		var err error
+		passwords[i], err = r.prepare()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := ds.MySQL.InTx(func(ex datastore.Execer) error {
+		for i, r := range rows {
+			err := insert(r, ex, passwords[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// nothing was saved
+		for _, r := range rows {
+			r.ID = 0
+			r.Application.ID = 0
+			r.Application.FileNoteID = 0
+		}
+	}
+	return err
+}
+
+// InsertTx inserts a member row, as for Row.Insert, using ex so that it can be part of a larger transaction.
+// If it fails the caller is expected to roll back ex.
+func (r *Row) InsertTx(ex datastore.Execer) error {
+	password, err := r.prepare()
+	if err != nil {
+		return err
+	}
+	return r.insert(ex, password)
+}
+
+// prepare tidies the row values for saving and returns a password hash for the new member
+func (r *Row) prepare() (string, error) {
+
+	// gender stored as 'M' or 'F', so capitalise first letter of gender string
+	if g := strings.TrimSpace(r.Gender); g != "" {
+		r.Gender = strings.ToUpper(g[:1])
+	}
+
+	// new members have no usable password until they set one
+	password, err := auth.RandomPasswordHash()
+	if err != nil {
+		return "", fmt.Errorf("RandomPasswordHash() err = %s", err)
+	}
+	return password, nil
+}
+
+// insert writes the member row, the related rows and the new application using ex
+func (r *Row) insert(ex datastore.Execer, password string) error {
+
+	err := r.insertMember(ex, password)
+	if err != nil {
+		return err
+	}
+
+	err = r.insertApplication(ex)
+	if err != nil {
+		return fmt.Errorf("insertApplication() err = %s", err)
+	}
+
+	err = r.insertFileNote(ex)
+	if err != nil {
+		return fmt.Errorf("insertFileNote() err = %s", err)
+	}
+
+	err = r.insertIssue(ex)
+	if err != nil {
+		return fmt.Errorf("insertIssue() err = %s", err)
+	}
+
+	return nil
+}
+
+// insertMember writes the member row and the related junction table rows using ex
+func (r *Row) insertMember(ex datastore.Execer, password string) error {
 
 	// convert bools to 0/1
 	var consentDirectory, consentContact int
@@ -146,10 +257,7 @@ func (r *Row) Insert(ds datastore.Datastore) error {
 		consentContact = 1
 	}
 
-	// gender stored as 'M' or 'F', so capitalise first letter of gender string
-	r.Gender = strings.ToUpper(string(strings.TrimSpace(r.Gender)[0]))
-
-	res, err := ds.MySQL.Session.Exec(queries["insert-member-row"],
+	res, err := ex.Exec(queries["insert-member-row"],
 		r.RoleID,
 		r.NamePrefixID,
 		r.CountryID,
@@ -162,7 +270,8 @@ func (r *Row) Insert(ds datastore.Datastore) error {
 		r.LastName,
 		r.PostNominal,
 		r.Mobile,
-		r.PrimaryEmail)
+		r.PrimaryEmail,
+		password)
 	if err != nil {
 		return err
 	}
@@ -172,58 +281,43 @@ func (r *Row) Insert(ds datastore.Datastore) error {
 	}
 	r.ID = int(id) // from int64
 
-	err = r.insertQualifications(ds)
+	err = r.insertQualifications(ex)
 	if err != nil {
 		return fmt.Errorf("insertQualifications() err = %s", err)
 	}
 
-	err = r.insertPositions(ds)
+	err = r.insertPositions(ex)
 	if err != nil {
 		return fmt.Errorf("insertPositions() err = %s", err)
 	}
 
-	err = r.insertSpecialities(ds)
+	err = r.insertSpecialities(ex)
 	if err != nil {
 		return fmt.Errorf("insertSpecialities() err = %s", err)
 	}
 
-	err = r.insertAccreditations(ds)
+	err = r.insertAccreditations(ex)
 	if err != nil {
 		return fmt.Errorf("insertAccreditations() err = %s", err)
 	}
 
-	err = r.insertTags(ds)
+	err = r.insertTags(ex)
 	if err != nil {
 		return fmt.Errorf("insertTags() err = %s", err)
 	}
 
-	err = r.insertContacts(ds)
+	err = r.insertContacts(ex)
 	if err != nil {
 		return fmt.Errorf("insertContacts() err = %s", err)
 	}
 
-	err = r.insertApplication(ds)
-	if err != nil {
-		return fmt.Errorf("insertApplication() err = %s", err)
-	}
-
-	err = r.insertFileNote(ds)
-	if err != nil {
-		return fmt.Errorf("insertFileNote() err = %s", err)
-	}
-
-	err = r.insertIssue(ds)
-	if err != nil {
-		return fmt.Errorf("insertIssue() err = %s", err)
-	}
-
 	return nil
 }
 
 // insertQualifications inserts the member qualifications present in the Row value
-func (r *Row) insertQualifications(ds datastore.Datastore) error {
+func (r *Row) insertQualifications(ex datastore.Execer) error {
 	for _, q := range r.Qualifications {
-		err := q.insert(ds, r.ID)
+		err := q.insert(ex, r.ID)
 		if err != nil {
 			return err
 		}
@@ -232,9 +326,9 @@ func (r *Row) insertQualifications(ds datastore.Datastore) error {
 }
 
 // insertPositions inserts the member positions present in the Row value
-func (r *Row) insertPositions(ds datastore.Datastore) error {
+func (r *Row) insertPositions(ex datastore.Execer) error {
 	for _, p := range r.Positions {
-		err := p.insert(ds, r.ID)
+		err := p.insert(ex, r.ID)
 		if err != nil {
 			return err
 		}
@@ -243,9 +337,9 @@ func (r *Row) insertPositions(ds datastore.Datastore) error {
 }
 
 // insertSpecialities inserts the member specialities present in the Row value
-func (r *Row) insertSpecialities(ds datastore.Datastore) error {
+func (r *Row) insertSpecialities(ex datastore.Execer) error {
 	for _, s := range r.Specialities {
-		err := s.insert(ds, r.ID)
+		err := s.insert(ex, r.ID)
 		if err != nil {
 			return err
 		}
@@ -254,9 +348,9 @@ func (r *Row) insertSpecialities(ds datastore.Datastore) error {
 }
 
 // insertAccreditations inserts the member accreditations present in the Row value
-func (r *Row) insertAccreditations(ds datastore.Datastore) error {
+func (r *Row) insertAccreditations(ex datastore.Execer) error {
 	for _, a := range r.Accreditations {
-		err := a.insert(ds, r.ID)
+		err := a.insert(ex, r.ID)
 		if err != nil {
 			return err
 		}
@@ -265,9 +359,9 @@ func (r *Row) insertAccreditations(ds datastore.Datastore) error {
 }
 
 // insertTags inserts the member tags present in the Row value
-func (r *Row) insertTags(ds datastore.Datastore) error {
+func (r *Row) insertTags(ex datastore.Execer) error {
 	for _, t := range r.Tags {
-		err := t.insert(ds, r.ID)
+		err := t.insert(ex, r.ID)
 		if err != nil {
 			return err
 		}
@@ -277,8 +371,8 @@ func (r *Row) insertTags(ds datastore.Datastore) error {
 
 // insertApplication creates an application record for the member and sets the
 // Application ID on success.
-func (r *Row) insertApplication(ds datastore.Datastore) error {
-	id, err := r.Application.insert(ds, r.ID)
+func (r *Row) insertApplication(ex datastore.Execer) error {
+	id, err := r.Application.insert(ex, r.ID)
 	if err != nil {
 		return err
 	}
@@ -287,9 +381,9 @@ func (r *Row) insertApplication(ds datastore.Datastore) error {
 }
 
 // insertContacts inserts the member contact rows
-func (r *Row) insertContacts(ds datastore.Datastore) error {
+func (r *Row) insertContacts(ex datastore.Execer) error {
 	for _, c := range r.Contacts {
-		err := c.insert(ds, r.ID)
+		err := c.insert(ex, r.ID)
 		if err != nil {
 			return err
 		}
@@ -299,7 +393,7 @@ func (r *Row) insertContacts(ds datastore.Datastore) error {
 
 // insertFileNote creates a note record associated with this member id and sets
 // the Application.FileNoteID on success.
-func (r *Row) insertFileNote(ds datastore.Datastore) error {
+func (r *Row) insertFileNote(ex datastore.Execer) error {
 
 	// Empty note content will return an error, so ensure it has a value
 	if r.Application.FileNote == "" {
@@ -312,8 +406,8 @@ func (r *Row) insertFileNote(ds datastore.Datastore) error {
 		Content:  r.Application.FileNote,
 	}
 
-	// noteInsertRow will set note.ID
-	err := n.InsertRow(ds)
+	// InsertRowTx will set note.ID
+	err := n.InsertRowTx(ex)
 	if err != nil {
 		return err
 	}
@@ -323,10 +417,10 @@ func (r *Row) insertFileNote(ds datastore.Datastore) error {
 
 // insertIssue raises an issue, of the appropriate type, relating to the new
 // application
-func (r *Row) insertIssue(ds datastore.Datastore) error {
+func (r *Row) insertIssue(ex datastore.Execer) error {
 
 	// get default deescription and action for the issue type
-	issType, err := issue.TypeByID(ds, newApplicationIssueTypeID)
+	issType, err := issue.TypeByIDTx(ex, newApplicationIssueTypeID)
 	if err != nil {
 		return err
 	}
@@ -337,12 +431,12 @@ func (r *Row) insertIssue(ds datastore.Datastore) error {
 		Description: issType.Description,
 		Action:      issType.Action,
 	}
-	return i.InsertRow(ds)
+	return i.InsertRowTx(ex)
 }
 
 // insert a member qualification row in the junction table
-func (qr QualificationRow) insert(ds datastore.Datastore, memberID int) error {
-	_, err := ds.MySQL.Session.Exec(queries["insert-member-qualification-row"],
+func (qr QualificationRow) insert(ex datastore.Execer, memberID int) error {
+	_, err := ex.Exec(queries["insert-member-qualification-row"],
 		memberID,
 		qr.QualificationID,
 		qr.OrganisationID,
@@ -353,8 +447,8 @@ func (qr QualificationRow) insert(ds datastore.Datastore, memberID int) error {
 }
 
 // insert a member position row in the junction table
-func (pr PositionRow) insert(ds datastore.Datastore, memberID int) error {
-	_, err := ds.MySQL.Session.Exec(queries["insert-member-position-row"],
+func (pr PositionRow) insert(ex datastore.Execer, memberID int) error {
+	_, err := ex.Exec(queries["insert-member-position-row"],
 		memberID,
 		pr.PositionID,
 		pr.OrganisationID,
@@ -363,8 +457,8 @@ func (pr PositionRow) insert(ds datastore.Datastore, memberID int) error {
 }
 
 // insert a member speciality row in the junction table
-func (sr SpecialityRow) insert(ds datastore.Datastore, memberID int) error {
-	_, err := ds.MySQL.Session.Exec(queries["insert-member-speciality-row"],
+func (sr SpecialityRow) insert(ex datastore.Execer, memberID int) error {
+	_, err := ex.Exec(queries["insert-member-speciality-row"],
 		memberID,
 		sr.SpecialityID,
 		sr.Preference,
@@ -373,8 +467,8 @@ func (sr SpecialityRow) insert(ds datastore.Datastore, memberID int) error {
 }
 
 // insert a member accreditation row in the junction table
-func (ar AccreditationRow) insert(ds datastore.Datastore, memberID int) error {
-	_, err := ds.MySQL.Session.Exec(queries["insert-member-accreditation-row"],
+func (ar AccreditationRow) insert(ex datastore.Execer, memberID int) error {
+	_, err := ex.Exec(queries["insert-member-accreditation-row"],
 		memberID,
 		ar.AccreditationID,
 		ar.StartDate,
@@ -384,16 +478,16 @@ func (ar AccreditationRow) insert(ds datastore.Datastore, memberID int) error {
 }
 
 // insert a member tag row in the junction table
-func (tr TagRow) insert(ds datastore.Datastore, memberID int) error {
-	_, err := ds.MySQL.Session.Exec(queries["insert-member-tag-row"],
+func (tr TagRow) insert(ex datastore.Execer, memberID int) error {
+	_, err := ex.Exec(queries["insert-member-tag-row"],
 		memberID,
 		tr.TagID)
 	return err
 }
 
 // insert methods creates a new application record, returns id on success
-func (ar ApplicationRow) insert(ds datastore.Datastore, memberID int) (int, error) {
-	res, err := ds.MySQL.Session.Exec(queries["insert-member-application-row"],
+func (ar ApplicationRow) insert(ex datastore.Execer, memberID int) (int, error) {
+	res, err := ex.Exec(queries["insert-member-application-row"],
 		memberID,
 		ar.NominatorID,
 		ar.SeconderID,
@@ -406,8 +500,9 @@ func (ar ApplicationRow) insert(ds datastore.Datastore, memberID int) (int, erro
 	return int(id), err
 }
 
-func (cr ContactRow) insert(ds datastore.Datastore, memberID int) error {
-	_, err := ds.MySQL.Session.Exec(queries["insert-member-contact-row"],
+// insert a member contact row in the junction table
+func (cr ContactRow) insert(ex datastore.Execer, memberID int) error {
+	_, err := ex.Exec(queries["insert-member-contact-row"],
 		memberID,
 		cr.TypeID,
 		cr.CountryID,
@@ -427,7 +522,7 @@ func (cr ContactRow) insert(ds datastore.Datastore, memberID int) error {
 
 // insert a member status row and, if it is set to current, ensure it is the
 // only record with current = 1
-func (sr StatusRow) insert(ds datastore.Datastore, memberID int) error {
+func (sr StatusRow) insert(ex datastore.Execer, memberID int) error {
 
 	sr.MemberID = memberID
 
@@ -436,7 +531,7 @@ func (sr StatusRow) insert(ds datastore.Datastore, memberID int) error {
 	if sr.Current {
 		current = 1
 	}
-	res, err := ds.MySQL.Session.Exec(queries["insert-member-status-row"],
+	res, err := ex.Exec(queries["insert-member-status-row"],
 		memberID,
 		sr.StatusID,
 		current,
@@ -455,7 +550,7 @@ func (sr StatusRow) insert(ds datastore.Datastore, memberID int) error {
 	// If true also need to set current = 0 for all other status
 	// records for the member - can only have one status at a time.
 	if sr.Current {
-		_, err := ds.MySQL.Session.Exec(queries["update-member-current-status"], sr.ID, memberID)
+		_, err := ex.Exec(queries["update-member-current-status"], sr.ID, memberID)
 		if err != nil {
 			return err
 		}
@@ -465,7 +560,7 @@ func (sr StatusRow) insert(ds datastore.Datastore, memberID int) error {
 }
 
 // InsertRowFromJSON creates a new member (applicant) Row from a JSON object as well as various
-// related rows required for the application process.
+// related rows required for the application process. Either all of the rows are created or none are.
 func InsertRowFromJSON(ds datastore.Datastore, s string) (Row, error) {
 	r := Row{}
 
@@ -479,3 +574,174 @@ func InsertRowFromJSON(ds datastore.Datastore, s string) (Row, error) {
 	}
 	return r, nil
 }
+
+// RowByID fetches the member record as a Row. Only the fields of the member table are set, and the junction
+// table collections are nil.
+func RowByID(ds datastore.Datastore, id int) (Row, error) {
+
+	r := Row{ID: id}
+	var consentDirectory, consentContact int
+	err := ds.MySQL.Session.QueryRow(queries["select-member-row"], id).Scan(
+		&r.RoleID,
+		&r.NamePrefixID,
+		&r.CountryID,
+		&consentDirectory,
+		&consentContact,
+		&r.UpdatedAt,
+		&r.DateOfBirth,
+		&r.Gender,
+		&r.FirstName,
+		&r.MiddleNames,
+		&r.LastName,
+		&r.PostNominal,
+		&r.Mobile,
+		&r.PrimaryEmail,
+	)
+	r.ConsentDirectory = consentDirectory == 1
+	r.ConsentContact = consentContact == 1
+
+	return r, err
+}
+
+// Validate checks the fields of a Row before it is written to the database, and returns a RowError listing
+// any problems. Gender is normalised to 'M' or 'F'.
+func (r *Row) Validate() error {
+
+	var xs RowError
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			xs = append(xs, fmt.Sprintf(format, args...))
+		}
+	}
+	validDate := func(s string) bool {
+		if s == "" {
+			return true
+		}
+		_, err := time.Parse("2006-01-02", s)
+		return err == nil
+	}
+
+	check(r.RoleID > 0, "roleId is required")
+	check(r.NamePrefixID > 0, "titleId is required")
+	check(r.CountryID > 0, "countryId is required")
+	check(strings.TrimSpace(r.FirstName) != "", "firstName is required")
+	check(strings.TrimSpace(r.LastName) != "", "lastName is required")
+	check(len(r.FirstName) <= 45, "firstName must be at most 45 characters")
+	check(len(r.MiddleNames) <= 100, "middleNames must be at most 100 characters")
+	check(len(r.LastName) <= 45, "lastName must be at most 45 characters")
+	check(len(r.PostNominal) <= 100, "postNominal must be at most 100 characters")
+	check(len(r.Mobile) <= 45, "mobile must be at most 45 characters")
+	check(validDate(r.DateOfBirth), "dateOfBirth must be in the format yyyy-mm-dd")
+
+	email := strings.TrimSpace(r.PrimaryEmail)
+	check(strings.Contains(email, "@") && !strings.ContainsAny(email, " \t\r\n") && len(email) <= 100,
+		"primaryEmail is not a valid email address")
+
+	if g := strings.TrimSpace(r.Gender); g != "" {
+		r.Gender = strings.ToUpper(g[:1])
+		check(r.Gender == "M" || r.Gender == "F", "gender must be M or F")
+	}
+
+	for i, q := range r.Qualifications {
+		check(q.QualificationID > 0, "qualifications[%d].qualificationId is required", i)
+	}
+	for i, p := range r.Positions {
+		check(p.PositionID > 0, "positions[%d].positionId is required", i)
+	}
+	for i, s := range r.Specialities {
+		check(s.SpecialityID > 0, "interests[%d].specialityId is required", i)
+	}
+	for i, a := range r.Accreditations {
+		check(a.AccreditationID > 0, "accreditations[%d].accreditationID is required", i)
+		check(validDate(a.StartDate) && validDate(a.EndDate), "accreditations[%d] dates must be in the format yyyy-mm-dd", i)
+	}
+	for i, t := range r.Tags {
+		check(t.TagID > 0, "tags[%d].tagID is required", i)
+	}
+	for i, c := range r.Contacts {
+		check(c.TypeID > 0, "contacts[%d].contactTypeId is required", i)
+	}
+
+	if len(xs) > 0 {
+		return xs
+	}
+	return nil
+}
+
+// Update validates the Row and saves it to the member record with the same id. Each junction table
+// collection that is not nil replaces the member's existing rows in that table, and a nil collection is
+// left as it is. All of the changes are made in a single transaction. The primary email is not changed, as a
+// new address must be verified by the member first.
+func (r *Row) Update(ds datastore.Datastore) error {
+	return ds.MySQL.InTx(r.UpdateTx)
+}
+
+// UpdateTx validates the Row and saves it using ex, so that it can be part of a larger transaction
+func (r *Row) UpdateTx(ex datastore.Execer) error {
+
+	err := r.Validate()
+	if err != nil {
+		return err
+	}
+
+	return r.update(ex)
+}
+
+// update writes the member fields and replaces the junction table collections
+func (r *Row) update(ex datastore.Execer) error {
+
+	// convert bools to 0/1
+	var consentDirectory, consentContact int
+	if r.ConsentDirectory {
+		consentDirectory = 1
+	}
+	if r.ConsentContact {
+		consentContact = 1
+	}
+
+	_, err := ex.Exec(queries["update-member-row"],
+		r.RoleID,
+		r.NamePrefixID,
+		r.CountryID,
+		consentDirectory,
+		consentContact,
+		r.DateOfBirth,
+		r.Gender,
+		r.FirstName,
+		r.MiddleNames,
+		r.LastName,
+		r.PostNominal,
+		r.Mobile,
+		r.ID)
+	if err != nil {
+		return err
+	}
+
+	collections := []struct {
+		name    string
+		replace bool
+		insert  func(datastore.Execer) error
+	}{
+		{"qualification", r.Qualifications != nil, r.insertQualifications},
+		{"position", r.Positions != nil, r.insertPositions},
+		{"speciality", r.Specialities != nil, r.insertSpecialities},
+		{"accreditation", r.Accreditations != nil, r.insertAccreditations},
+		{"tag", r.Tags != nil, r.insertTags},
+		{"contact", r.Contacts != nil, r.insertContacts},
+	}
+	for _, c := range collections {
+		if !c.replace {
+			continue
+		}
+		_, err := ex.Exec(queries["delete-member-"+c.name+"-rows"], r.ID)
+		if err != nil {
+			return fmt.Errorf("delete %s rows err = %s", c.name, err)
+		}
+		err = c.insert(ex)
+		if err != nil {
+			return fmt.Errorf("insert %s rows err = %s", c.name, err)
+		}
+	}
+
+	return nil
+}
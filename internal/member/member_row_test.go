@@ -1,9 +1,13 @@
 package member_test
 
 import (
+	"database/sql"
+	"errors"
 	"log"
+	"strings"
 	"testing"
 
+	"github.com/cardiacsociety/web-services/internal/history"
 	"github.com/cardiacsociety/web-services/internal/member"
 	"github.com/cardiacsociety/web-services/internal/note"
 	"github.com/cardiacsociety/web-services/internal/platform/datastore"
@@ -24,6 +28,12 @@ func TestMemberRow(t *testing.T) {
 	t.Run("member_row", func(t *testing.T) {
 		t.Run("testInsertRow", testInsertRow)
 		t.Run("testInsertRowJSON", testInsertRowJSON)
+		t.Run("testInsertRowRollback", testInsertRowRollback)
+		t.Run("testRowByID", testRowByID)
+		t.Run("testUpdateRow", testUpdateRow)
+		t.Run("testProfileSave", testProfileSave)
+		t.Run("testReadImport", testReadImport)
+		t.Run("testCommitImport", testCommitImport)
 	})
 }
 
@@ -375,3 +385,314 @@ func testInsertRowJSON(t *testing.T) {
 		t.Errorf("note.ByMemberID() count = %d, want %d", got, want)
 	}
 }
+
+// testRowByID tests fetching a member record as a Row
+func testRowByID(t *testing.T) {
+	r, err := member.RowByID(ds2, 1)
+	if err != nil {
+		t.Fatalf("member.RowByID() err = %s", err)
+	}
+	if r.FirstName != "Michael" {
+		t.Errorf("Row.FirstName = %q, want %q", r.FirstName, "Michael")
+	}
+	if r.Qualifications != nil {
+		t.Errorf("Row.Qualifications = %v, want nil", r.Qualifications)
+	}
+}
+
+// testUpdateRow tests that an update replaces the collections that are set and leaves the others alone
+func testUpdateRow(t *testing.T) {
+	before, err := member.ByID(ds2, 1)
+	if err != nil {
+		t.Fatalf("member.ByID() err = %s", err)
+	}
+
+	r, err := member.RowByID(ds2, 1)
+	if err != nil {
+		t.Fatalf("member.RowByID() err = %s", err)
+	}
+	r.Mobile = "0400 000 000"
+	r.Qualifications = []member.QualificationRow{
+		{QualificationID: 1, OrganisationID: 1, YearObtained: 2001, Abbreviation: "MBBS"},
+	}
+	r.Tags = []member.TagRow{}
+	err = r.Update(ds2)
+	if err != nil {
+		t.Fatalf("member.Row.Update() err = %s", err)
+	}
+
+	after, err := member.ByID(ds2, 1)
+	if err != nil {
+		t.Fatalf("member.ByID() err = %s", err)
+	}
+	if after.Contact.Mobile != r.Mobile {
+		t.Errorf("Member.Contact.Mobile = %q, want %q", after.Contact.Mobile, r.Mobile)
+	}
+	if len(after.Qualifications) != 1 {
+		t.Errorf("Member.Qualifications count = %d, want 1", len(after.Qualifications))
+	}
+	if len(after.Tags) != 0 {
+		t.Errorf("Member.Tags count = %d, want 0", len(after.Tags))
+	}
+	if len(after.Positions) != len(before.Positions) {
+		t.Errorf("Member.Positions count = %d, want %d", len(after.Positions), len(before.Positions))
+	}
+}
+
+func TestRowValidate(t *testing.T) {
+	cases := []struct {
+		row  member.Row
+		want bool
+	}{
+		{member.Row{RoleID: 1, NamePrefixID: 1, CountryID: 1, FirstName: "Mike", LastName: "Donnici", PrimaryEmail: "mike@example.com", Gender: "male"}, true},
+		{member.Row{RoleID: 1, NamePrefixID: 1, CountryID: 1, FirstName: "Mike", LastName: "", PrimaryEmail: "mike@example.com"}, false},
+		{member.Row{RoleID: 1, NamePrefixID: 1, CountryID: 1, FirstName: "Mike", LastName: "Donnici", PrimaryEmail: "mike"}, false},
+		{member.Row{RoleID: 1, NamePrefixID: 1, CountryID: 1, FirstName: "Mike", LastName: "Donnici", PrimaryEmail: "mike@example.com", DateOfBirth: "03/11/1970"}, false},
+		{member.Row{RoleID: 1, NamePrefixID: 1, CountryID: 1, FirstName: "Mike", LastName: "Donnici", PrimaryEmail: "mike@example.com", Tags: []member.TagRow{{TagID: 0}}}, false},
+	}
+	for _, c := range cases {
+		err := c.row.Validate()
+		if (err == nil) != c.want {
+			t.Errorf("member.Row.Validate() err = %v, want valid %v", err, c.want)
+		}
+		if _, ok := err.(member.RowError); err != nil && !ok {
+			t.Errorf("member.Row.Validate() err type = %T, want member.RowError", err)
+		}
+	}
+}
+
+// testProfileSave tests that a member's changes to their profile are saved with a note for each change
+func testProfileSave(t *testing.T) {
+	xn, err := note.ByMemberID(ds2, 1)
+	if err != nil {
+		t.Fatalf("note.ByMemberID() err = %s", err)
+	}
+
+	pf, err := member.ProfileFromJSON([]byte(`{"postNominal": "FRACP", "consentDirectory": false, "interests": [{"specialityId": 1, "preference": 1}]}`))
+	if err != nil {
+		t.Fatalf("member.ProfileFromJSON() err = %s", err)
+	}
+	changes, err := pf.Save(ds2, 1, history.Actor{ID: 1, Type: "member"})
+	if err != nil {
+		t.Fatalf("member.Profile.Save() err = %s", err)
+	}
+
+	r, err := member.RowByID(ds2, 1)
+	if err != nil {
+		t.Fatalf("member.RowByID() err = %s", err)
+	}
+	if r.PostNominal != "FRACP" {
+		t.Errorf("Row.PostNominal = %q, want %q", r.PostNominal, "FRACP")
+	}
+
+	xn2, err := note.ByMemberID(ds2, 1)
+	if err != nil {
+		t.Fatalf("note.ByMemberID() err = %s", err)
+	}
+	got := len(xn2) - len(xn)
+	if got != len(changes) {
+		t.Errorf("note.ByMemberID() new notes = %d, want %d", got, len(changes))
+	}
+
+	// saving the same values again is not a change
+	changes, err = pf.Save(ds2, 1, history.Actor{ID: 1, Type: "member"})
+	if err != nil {
+		t.Fatalf("member.Profile.Save() err = %s", err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("member.Profile.Save() repeated changes = %v, want none", changes)
+	}
+}
+
+func TestProfileFromJSON(t *testing.T) {
+	cases := []struct {
+		json      string
+		protected bool
+	}{
+		{`{"postNominal": "FRACP", "consentContact": true}`, false},
+		{`{"contacts": [{"contactTypeId": 1, "locality": "Sydney"}]}`, false},
+		{`{"postNominal": "FRACP", "titleId": 2}`, true},
+		{`{"status": "Active"}`, true},
+	}
+	for _, c := range cases {
+		_, err := member.ProfileFromJSON([]byte(c.json))
+		_, protected := err.(member.ProtectedFieldError)
+		if protected != c.protected {
+			t.Errorf("member.ProfileFromJSON(%s) err = %v, want protected %v", c.json, err, c.protected)
+		}
+	}
+}
+
+// failingExecer fails the nth call to Exec, to test that a transaction is rolled back
+type failingExecer struct {
+	datastore.Execer
+	n     int
+	calls *int
+}
+
+func (f failingExecer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	*f.calls++
+	if *f.calls == f.n {
+		return nil, errors.New("injected failure")
+	}
+	return f.Execer.Exec(query, args...)
+}
+
+// testInsertRowRollback injects a failure at each step of a member row insert, and checks that nothing is
+// saved until every step succeeds
+func testInsertRowRollback(t *testing.T) {
+
+	tables := []string{"member", "mp_m_qualification", "mp_m_position", "mp_m_speciality", "mp_m_accreditation",
+		"mp_m_tag", "mp_m_contact", "ms_m_application", "wf_note", "wf_note_association", "wf_issue",
+		"wf_issue_association"}
+	counts := func() map[string]int {
+		c := map[string]int{}
+		for _, tbl := range tables {
+			var n int
+			err := ds2.MySQL.Session.QueryRow("SELECT COUNT(*) FROM " + tbl).Scan(&n)
+			if err != nil {
+				t.Fatalf("count %s err = %s", tbl, err)
+			}
+			c[tbl] = n
+		}
+		return c
+	}
+	before := counts()
+
+	// keep failing one step later until the insert succeeds
+	for n := 1; ; n++ {
+		calls := 0
+
+		r := member.Row{
+			RoleID:         2,
+			NamePrefixID:   1,
+			CountryID:      14,
+			Gender:         "F",
+			FirstName:      "Roll",
+			LastName:       "Back",
+			PrimaryEmail:   "rollback@example.com",
+			Qualifications: []member.QualificationRow{{QualificationID: 2, OrganisationID: 237, YearObtained: 2000}},
+			Positions:      []member.PositionRow{{PositionID: 2, OrganisationID: 1}},
+			Specialities:   []member.SpecialityRow{{SpecialityID: 1, Preference: 1}},
+			Accreditations: []member.AccreditationRow{{AccreditationID: 1, StartDate: "2019-01-01"}},
+			Tags:           []member.TagRow{{TagID: 1}},
+			Contacts:       []member.ContactRow{{TypeID: 1, CountryID: 14, Locality: "CityTown"}},
+		}
+		err := ds2.MySQL.InTx(func(ex datastore.Execer) error {
+			return r.InsertTx(failingExecer{Execer: ex, n: n, calls: &calls})
+		})
+		if err == nil {
+			if n <= 1 {
+				t.Fatalf("member.Row.InsertTx() did not use the transaction")
+			}
+			break
+		}
+		if n > 50 {
+			t.Fatalf("member.Row.InsertTx() err = %s, want success after %d steps", err, n)
+		}
+
+		after := counts()
+		for _, tbl := range tables {
+			if after[tbl] != before[tbl] {
+				t.Errorf("member.Row.InsertTx() failed at step %d, %s count = %d, want %d", n, tbl, after[tbl], before[tbl])
+			}
+		}
+	}
+
+	after := counts()
+	for _, tbl := range tables {
+		if after[tbl] <= before[tbl] {
+			t.Errorf("member.Row.Insert() %s count = %d, want > %d", tbl, after[tbl], before[tbl])
+		}
+	}
+}
+
+// importCSV has a valid row, a row with bad reference data, a row with the name of an existing member and a
+// row with the name of the first row
+const importCSV = `firstName,lastName,primaryEmail,roleId,titleId,countryId,contactTypeId,locality,tagIds
+Ima,Trainee,ima.trainee@example.com,2,1,14,1,Sydney,1;2
+Bad,Reference,bad.reference@example.com,2,9999,14,,,
+Michael,Donnici,someone.else@example.com,2,1,14,,,
+Ima,Trainee,ima.again@example.com,2,1,14,,,`
+
+// testReadImport tests the validation of an import file
+func testReadImport(t *testing.T) {
+	im, err := member.ReadImport(ds2, strings.NewReader(importCSV), member.ImportCSV)
+	if err != nil {
+		t.Fatalf("member.ReadImport() err = %s", err)
+	}
+
+	want := 4
+	got := len(im.Rows)
+	if got != want {
+		t.Fatalf("member.ReadImport() rows = %d, want %d", got, want)
+	}
+
+	// only the second row has errors, and the last two rows have warnings for the names
+	for i, ir := range im.Rows {
+		if (len(ir.Errors) > 0) != (i == 1) {
+			t.Errorf("ImportRow line %d errors = %v", ir.Line, ir.Errors)
+		}
+		if (len(ir.Warnings) > 0) != (i >= 2) {
+			t.Errorf("ImportRow line %d warnings = %v", ir.Line, ir.Warnings)
+		}
+	}
+	if len(im.Rows[0].Row.Tags) != 2 {
+		t.Errorf("ImportRow.Row.Tags count = %d, want 2", len(im.Rows[0].Row.Tags))
+	}
+
+	_, err = im.Commit(ds2)
+	if err != member.ErrImportInvalid {
+		t.Errorf("member.Import.Commit() err = %v, want %v", err, member.ErrImportInvalid)
+	}
+
+	if im.ErrorReport() == nil {
+		t.Errorf("member.Import.ErrorReport() = nil")
+	}
+}
+
+// testCommitImport tests that the rows of a valid import file are inserted
+func testCommitImport(t *testing.T) {
+	valid := strings.Join(strings.Split(importCSV, "\n")[:2], "\n")
+	im, err := member.ReadImport(ds2, strings.NewReader(valid), member.ImportCSV)
+	if err != nil {
+		t.Fatalf("member.ReadImport() err = %s", err)
+	}
+
+	ids, err := im.Commit(ds2)
+	if err != nil {
+		t.Fatalf("member.Import.Commit() err = %s", err)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("member.Import.Commit() ids = %v, want 1 id", ids)
+	}
+
+	mem, err := member.ByID(ds2, ids[0])
+	if err != nil {
+		t.Fatalf("member.ByID(%d) err = %s", ids[0], err)
+	}
+	if mem.LastName != "Trainee" {
+		t.Errorf("Member.LastName = %q, want %q", mem.LastName, "Trainee")
+	}
+
+	// imported members are not applicants
+	for _, tbl := range []string{"ms_m_application", "wf_issue_association"} {
+		var n int
+		err := ds2.MySQL.Session.QueryRow("SELECT COUNT(*) FROM "+tbl+" WHERE member_id = ?", ids[0]).Scan(&n)
+		if err != nil {
+			t.Fatalf("count %s err = %s", tbl, err)
+		}
+		if n != 0 {
+			t.Errorf("member.Import.Commit() %s count = %d, want 0", tbl, n)
+		}
+	}
+
+	// importing the same file again finds the duplicate
+	im, err = member.ReadImport(ds2, strings.NewReader(valid), member.ImportCSV)
+	if err != nil {
+		t.Fatalf("member.ReadImport() err = %s", err)
+	}
+	if im.ErrorCount() != 1 {
+		t.Errorf("member.Import.ErrorCount() = %d, want 1", im.ErrorCount())
+	}
+}
@@ -1,9 +1,12 @@
 package member_test
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -36,7 +39,13 @@ func TestMember(t *testing.T) {
 		t.Run("testSyncUpdated", testSyncUpdated)
 		t.Run("testExcelReport", testExcelReport)
 		t.Run("testExcelReportJournal", testExcelReportJournal)
+		t.Run("testStateAt", testStateAt)
+		t.Run("testCountsAt", testCountsAt)
 		t.Run("testLapse", testLapse)
+		t.Run("testReinstate", testReinstate)
+		t.Run("testLapseRun", testLapseRun)
+		t.Run("testDuplicates", testDuplicates)
+		t.Run("testMerge", testMerge)
 	})
 }
 
@@ -197,6 +206,78 @@ func testExcelReportJournal(t *testing.T) {
 	}
 }
 
+// testStateAt checks the state of member 1 at dates through the status and title history in testdata. The
+// status changed to Active on 2015-08-30 but the title was not granted until 2015-08-31.
+func testStateAt(t *testing.T) {
+	cases := []struct {
+		date   string
+		status string
+		title  string
+	}{
+		{"2014-05-31", "", ""},
+		{"2014-06-01", "Pending", "Applicant"},
+		{"2014-07-01", "Active", "Applicant"},
+		{"2015-06-30", "Lapsed", "Applicant"},
+		{"2015-08-30", "Active", "Applicant"},
+		{"2015-08-31", "Active", "Associate"},
+	}
+
+	for _, c := range cases {
+		d, _ := time.Parse("2006-01-02", c.date)
+		s, err := member.StateAt(ds, 1, d)
+		if err != nil {
+			t.Fatalf("member.StateAt(%s) err = %s", c.date, err)
+		}
+		if s.Status != c.status || s.Title != c.title {
+			t.Errorf("member.StateAt(%s) = %q %q, want %q %q", c.date, s.Status, s.Title, c.status, c.title)
+		}
+	}
+
+	_, err := member.StateAt(ds, 999999, time.Now())
+	if err != sql.ErrNoRows {
+		t.Errorf("member.StateAt() err = %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+// testCountsAt checks the member counts on dates when member 1 was the only member with a status
+func testCountsAt(t *testing.T) {
+	cases := []struct {
+		date string
+		want []member.StateCount
+	}{
+		{"2014-05-31", nil},
+		{"2015-06-30", []member.StateCount{{TitleID: 1, Title: "Applicant", StatusID: 10004, Status: "Lapsed", Count: 1}}},
+		{"2015-08-31", []member.StateCount{{TitleID: 2, Title: "Associate", StatusID: 1, Status: "Active", Count: 1}}},
+	}
+
+	for _, c := range cases {
+		d, _ := time.Parse("2006-01-02", c.date)
+		got, err := member.CountsAt(ds, d)
+		if err != nil {
+			t.Fatalf("member.CountsAt(%s) err = %s", c.date, err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("member.CountsAt(%s) = %v, want %v", c.date, got, c.want)
+		}
+	}
+
+	// deactivating the member now does not change the counts at an earlier date
+	_, err := ds.MySQL.Session.Exec("UPDATE member SET active = 0 WHERE id = 1")
+	if err != nil {
+		t.Fatalf("Exec() err = %s", err)
+	}
+	defer ds.MySQL.Session.Exec("UPDATE member SET active = 1 WHERE id = 1")
+	c := cases[len(cases)-1]
+	d, _ := time.Parse("2006-01-02", c.date)
+	got, err := member.CountsAt(ds, d)
+	if err != nil {
+		t.Fatalf("member.CountsAt(%s) err = %s", c.date, err)
+	}
+	if !reflect.DeepEqual(got, c.want) {
+		t.Errorf("member.CountsAt(%s) = %v after deactivation, want %v", c.date, got, c.want)
+	}
+}
+
 // test lapsing a member - @todo: check the actual result
 func testLapse(t *testing.T) {
 	m, err := member.ByID(ds, 1)
@@ -209,6 +290,249 @@ func testLapse(t *testing.T) {
 	}
 }
 
+// testReinstate reinstates member 1, lapsed by testLapse, to their previous status of Active
+func testReinstate(t *testing.T) {
+	m, err := member.ByID(ds, 1)
+	if err != nil {
+		t.Fatalf("ByID() err = %s", err)
+	}
+
+	// subscription 2 does not exist, so nothing is reinstated
+	_, err = m.Reinstate(ds, member.Reinstatement{SubscriptionIDs: []int{1, 2}})
+	if err == nil {
+		t.Errorf("member.Reinstate() err = nil, want error for unknown subscription")
+	}
+
+	invoiceID, err := m.Reinstate(ds, member.Reinstatement{SubscriptionIDs: []int{1}, Arrears: 110.11})
+	if err != nil {
+		t.Fatalf("member.Reinstate() err = %s", err)
+	}
+	if invoiceID == 0 {
+		t.Errorf("member.Reinstate() invoice id = 0, want arrears invoice")
+	}
+
+	m, err = member.ByID(ds, 1)
+	if err != nil {
+		t.Fatalf("ByID() err = %s", err)
+	}
+	got := m.Memberships[0].Status
+	want := "Active"
+	if got != want {
+		t.Errorf("Membership.Status = %q, want %q", got, want)
+	}
+
+	var active int
+	err = ds.MySQL.Session.QueryRow("SELECT active FROM fn_m_subscription WHERE id = 1").Scan(&active)
+	if err != nil {
+		t.Fatalf("QueryRow() err = %s", err)
+	}
+	if active != 1 {
+		t.Errorf("fn_m_subscription.active = %d, want 1", active)
+	}
+
+	// member is no longer lapsed
+	_, err = m.Reinstate(ds, member.Reinstatement{})
+	if err != member.ErrNotLapsed {
+		t.Errorf("member.Reinstate() err = %v, want %v", err, member.ErrNotLapsed)
+	}
+}
+
+// testLapseRun selects member 1, with an overdue subscription invoice, and lapses them
+func testLapseRun(t *testing.T) {
+	_, err := ds.MySQL.Session.Exec(`INSERT INTO fn_m_invoice (member_id, fn_subscription_id, paid, invoiced_on, 
+		due_on, invoice_total) VALUES (1, 1, 0, '2019-06-01', '2019-06-15', 330.33)`)
+	if err != nil {
+		t.Fatalf("Exec() err = %s", err)
+	}
+
+	// member 1 is an Associate, title id 2
+	xc, err := member.LapseCandidates(ds, member.LapseCriteria{DaysOverdue: 30, ExcludeTitleIDs: []int{2}})
+	if err != nil {
+		t.Fatalf("member.LapseCandidates() err = %s", err)
+	}
+	if len(xc) != 0 {
+		t.Errorf("member.LapseCandidates() count = %d, want 0 with title excluded", len(xc))
+	}
+
+	// members not listed in MemberIDs are not selected
+	xc, err = member.LapseCandidates(ds, member.LapseCriteria{DaysOverdue: 30, MemberIDs: []int{2}})
+	if err != nil {
+		t.Fatalf("member.LapseCandidates() err = %s", err)
+	}
+	if len(xc) != 0 {
+		t.Errorf("member.LapseCandidates() count = %d, want 0 for other member ids", len(xc))
+	}
+
+	xc, err = member.LapseCandidates(ds, member.LapseCriteria{DaysOverdue: 30, MemberIDs: []int{1, 2}})
+	if err != nil {
+		t.Fatalf("member.LapseCandidates() err = %s", err)
+	}
+	if len(xc) != 1 || xc[0].MemberID != 1 {
+		t.Fatalf("member.LapseCandidates() = %v, want member id 1", xc)
+	}
+	if xc[0].Overdue != 330.33 {
+		t.Errorf("LapseCandidate.Overdue = %.2f, want 330.33", xc[0].Overdue)
+	}
+
+	err = xc[0].Lapse(ds)
+	if err != nil {
+		t.Fatalf("LapseCandidate.Lapse() err = %s", err)
+	}
+
+	m, err := member.ByID(ds, 1)
+	if err != nil {
+		t.Fatalf("ByID() err = %s", err)
+	}
+	got := m.Memberships[0].Status
+	want := "Lapsed"
+	if got != want {
+		t.Errorf("Membership.Status = %q, want %q", got, want)
+	}
+
+	// lapsed members are not selected again
+	xc, err = member.LapseCandidates(ds, member.LapseCriteria{DaysOverdue: 30})
+	if err != nil {
+		t.Fatalf("member.LapseCandidates() err = %s", err)
+	}
+	if len(xc) != 0 {
+		t.Errorf("member.LapseCandidates() count = %d, want 0 after lapse", len(xc))
+	}
+}
+
+// duplicateID is the id of a member created by testDuplicates as a duplicate of member 1
+var duplicateID int
+
+// testDuplicates creates a member that re-applied with a different email, and checks that it is found as a
+// duplicate of member 1
+func testDuplicates(t *testing.T) {
+	r := member.Row{
+		RoleID:       2,
+		NamePrefixID: 1,
+		CountryID:    14,
+		FirstName:    "Michael",
+		LastName:     "Donnici",
+		DateOfBirth:  "1970-11-03",
+		Mobile:       "+61 402 123 123",
+		PrimaryEmail: "michael@example.com",
+	}
+	err := r.Insert(ds)
+	if err != nil {
+		t.Fatalf("member.Row.Insert() err = %s", err)
+	}
+	duplicateID = r.ID
+
+	xc, err := member.Duplicates(ds, member.DefaultMinDuplicateScore)
+	if err != nil {
+		t.Fatalf("member.Duplicates() err = %s", err)
+	}
+	var found bool
+	for _, c := range xc {
+		if c.MemberID == 1 && c.DuplicateID == duplicateID {
+			found = true
+			if c.Score != 100 {
+				t.Errorf("member.Duplicates() score = %d, want 100 - reasons %v", c.Score, c.Reasons)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("member.Duplicates() did not find member id %d as a duplicate of member id 1", duplicateID)
+	}
+}
+
+// testMerge merges the duplicate created by testDuplicates into member 1
+func testMerge(t *testing.T) {
+	err := member.Merge(ds, 1, 1)
+	if err != member.ErrMergeSelf {
+		t.Errorf("member.Merge() err = %v, want %v", err, member.ErrMergeSelf)
+	}
+
+	// the duplicate has a current title and the same subscription as member 1
+	for _, q := range []string{
+		"INSERT INTO ms_m_title (member_id, ms_title_id, current) VALUES (?, 1, 1)",
+		"INSERT INTO fn_m_subscription (member_id, fn_subscription_id, renew_on) VALUES (?, 1, '2020-01-01')",
+		"INSERT INTO ce_m_evaluation (member_id, ce_evaluation_id, cpd_points_required, start_on, end_on, comment) VALUES (?, 1, 50, '2019-01-01', '2019-12-31', '')",
+	} {
+		_, err := ds.MySQL.Session.Exec(q, duplicateID)
+		if err != nil {
+			t.Fatalf("Exec(%q) err = %s", q, err)
+		}
+	}
+
+	err = member.Merge(ds, 1, duplicateID)
+	if err != nil {
+		t.Fatalf("member.Merge() err = %s", err)
+	}
+
+	for _, tbl := range []string{"ms_m_title", "fn_m_subscription", "ce_m_evaluation"} {
+		var n int
+		err := ds.MySQL.Session.QueryRow("SELECT COUNT(*) FROM "+tbl+" WHERE member_id = ?", duplicateID).Scan(&n)
+		if err != nil {
+			t.Fatalf("count %s err = %s", tbl, err)
+		}
+		if n != 0 {
+			t.Errorf("%s rows for merged member = %d, want 0", tbl, n)
+		}
+	}
+	counts := map[string]int{
+		"SELECT COUNT(*) FROM ms_m_title WHERE member_id = 1 AND current = 1":       1,
+		"SELECT COUNT(*) FROM fn_m_subscription WHERE member_id = 1 AND active = 1": 1,
+	}
+	for q, want := range counts {
+		var n int
+		err := ds.MySQL.Session.QueryRow(q).Scan(&n)
+		if err != nil {
+			t.Fatalf("QueryRow(%q) err = %s", q, err)
+		}
+		if n != want {
+			t.Errorf("QueryRow(%q) = %d, want %d", q, n, want)
+		}
+	}
+
+	m, err := member.ByID(ds, duplicateID)
+	if err != nil {
+		t.Fatalf("member.ByID() err = %s", err)
+	}
+	if m.Active {
+		t.Errorf("Member.Active = true, want false for merged member")
+	}
+
+	// merging again fails as the duplicate is no longer active
+	err = member.Merge(ds, 1, duplicateID)
+	if err == nil {
+		t.Errorf("member.Merge() err = nil, want error for inactive member")
+	}
+}
+
+func TestLapseNoticeRender(t *testing.T) {
+	c := member.LapseCandidate{MemberID: 1, Name: "Michael Donnici", InvoiceIDs: []int{1, 2}, Overdue: 330.33}
+
+	subject, text, err := member.LapseNotice{}.Render(c)
+	if err != nil {
+		t.Fatalf("LapseNotice.Render() err = %s", err)
+	}
+	if subject != member.DefaultLapseNoticeSubject {
+		t.Errorf("LapseNotice.Render() subject = %q, want %q", subject, member.DefaultLapseNoticeSubject)
+	}
+	want := "2 subscription invoice(s), totalling $330.33"
+	if !strings.Contains(text, want) {
+		t.Errorf("LapseNotice.Render() text = %q, want it to contain %q", text, want)
+	}
+
+	n := member.LapseNotice{Subject: "Membership of {{.Name}}", Text: "Dear {{.Name}}"}
+	subject, text, err = n.Render(c)
+	if err != nil {
+		t.Fatalf("LapseNotice.Render() err = %s", err)
+	}
+	if subject != "Membership of Michael Donnici" || text != "Dear Michael Donnici" {
+		t.Errorf("LapseNotice.Render() = %q, %q", subject, text)
+	}
+
+	_, _, err = member.LapseNotice{Text: "Dear {{.Nickname}}"}.Render(c)
+	if err == nil {
+		t.Errorf("LapseNotice.Render() err = nil, want error for unknown field")
+	}
+}
+
 func printJSON(m member.Member) {
 	xb, _ := json.MarshalIndent(m, "", "  ")
 	fmt.Println("-------------------------------------------------------------------")
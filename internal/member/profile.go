@@ -0,0 +1,301 @@
+package member
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/cardiacsociety/web-services/internal/history"
+	"github.com/cardiacsociety/web-services/internal/note"
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+)
+
+// profileNoteTypeID is the note type used to record the changes members make to their own profile
+const profileNoteTypeID = 10007 // History
+
+// ProfileFields are the fields, by JSON name, that members may change in their own profile
+var ProfileFields = []string{"postNominal", "consentDirectory", "consentContact", "contacts", "interests"}
+
+// ProtectedFieldError is returned when a member attempts to change a field that is not in ProfileFields
+type ProtectedFieldError string
+
+func (e ProtectedFieldError) Error() string {
+	return fmt.Sprintf("%s cannot be changed by a member", string(e))
+}
+
+// Profile holds the changes a member is making to their own profile. A nil field is left as it is, and a
+// collection that is present replaces the member's existing rows.
+type Profile struct {
+	PostNominal      *string         `json:"postNominal"`
+	ConsentDirectory *bool           `json:"consentDirectory"`
+	ConsentContact   *bool           `json:"consentContact"`
+	Contacts         []ContactRow    `json:"contacts"`
+	Specialities     []SpecialityRow `json:"interests"`
+}
+
+// ProfileFromJSON creates a Profile from a JSON object, and returns a ProtectedFieldError if the object has
+// any field that is not in ProfileFields
+func ProfileFromJSON(b []byte) (Profile, error) {
+
+	var pf Profile
+
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(b, &fields)
+	if err != nil {
+		return pf, err
+	}
+	for k := range fields {
+		if !isProfileField(k) {
+			return pf, ProtectedFieldError(k)
+		}
+	}
+
+	err = json.Unmarshal(b, &pf)
+	return pf, err
+}
+
+// Save applies the profile changes to the member record and writes a note for each change, in a single
+// transaction. Only the fields in ProfileFields are written, and a collection is only replaced if it differs
+// from the member's existing rows. The changes are recorded in the member's history against the user by,
+// which is the member or an admin viewing the system as the member. It returns the content of the notes.
+// The caller should re-sync the member doc to MongoDB.
+func (pf Profile) Save(ds datastore.Datastore, memberID int, by history.Actor) ([]string, error) {
+
+	var changes []string
+
+	err := pf.validate()
+	if err != nil {
+		return changes, err
+	}
+
+	r, err := RowByID(ds, memberID)
+	if err != nil {
+		return changes, err
+	}
+
+	if pf.PostNominal != nil && *pf.PostNominal != r.PostNominal {
+		changes = append(changes, fmt.Sprintf("Post-nominal changed from '%s' to '%s'", r.PostNominal, *pf.PostNominal))
+		r.PostNominal = *pf.PostNominal
+	}
+	if pf.ConsentDirectory != nil && *pf.ConsentDirectory != r.ConsentDirectory {
+		changes = append(changes, "Consent to directory listing "+consentChange(*pf.ConsentDirectory))
+		r.ConsentDirectory = *pf.ConsentDirectory
+	}
+	if pf.ConsentContact != nil && *pf.ConsentContact != r.ConsentContact {
+		changes = append(changes, "Consent to contact by third parties "+consentChange(*pf.ConsentContact))
+		r.ConsentContact = *pf.ConsentContact
+	}
+	if pf.Contacts != nil {
+		xc, err := memberContacts(ds, memberID)
+		if err != nil {
+			return nil, err
+		}
+		if !sameContacts(xc, pf.Contacts) {
+			changes = append(changes, fmt.Sprintf("Contact locations replaced with %d location(s)", len(pf.Contacts)))
+			r.Contacts = pf.Contacts
+		}
+	}
+	if pf.Specialities != nil {
+		xs, err := memberSpecialities(ds, memberID)
+		if err != nil {
+			return nil, err
+		}
+		if !sameSpecialities(xs, pf.Specialities) {
+			changes = append(changes, fmt.Sprintf("Speciality preferences replaced with %d speciality(s)", len(pf.Specialities)))
+			r.Specialities = pf.Specialities
+		}
+	}
+
+	if len(changes) == 0 {
+		return changes, nil
+	}
+
+	message := "Profile updated by member"
+	if by.Type != "member" {
+		message = "Profile updated by " + by.Type + " viewing as member"
+	}
+
+	// the history is recorded in the same transaction, so no other change can come between the snapshot and
+	// the record
+	err = ds.MySQL.InTx(func(ex datastore.Execer) error {
+		s, err := history.TakeTx(ex, memberID, history.MemberTables...)
+		if err != nil {
+			return err
+		}
+		err = r.updateProfile(ex)
+		if err != nil {
+			return err
+		}
+		for _, c := range changes {
+			n := note.Note{
+				MemberID: memberID,
+				TypeID:   profileNoteTypeID,
+				Content:  message + ": " + c,
+			}
+			err := n.InsertRowTx(ex)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = s.RecordTx(ex, by, message, history.MemberTables...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// validate checks the profile fields, and returns a RowError listing any problems
+func (pf Profile) validate() error {
+
+	var xs RowError
+	if pf.PostNominal != nil && len(*pf.PostNominal) > 100 {
+		xs = append(xs, "postNominal must be at most 100 characters")
+	}
+	for i, c := range pf.Contacts {
+		if c.TypeID < 1 {
+			xs = append(xs, fmt.Sprintf("contacts[%d].contactTypeId is required", i))
+		}
+	}
+	for i, sr := range pf.Specialities {
+		if sr.SpecialityID < 1 {
+			xs = append(xs, fmt.Sprintf("interests[%d].specialityId is required", i))
+		}
+	}
+
+	if len(xs) > 0 {
+		return xs
+	}
+	return nil
+}
+
+// updateProfile writes the profile fields of the member record, and replaces the contacts and specialities
+// that are not nil
+func (r *Row) updateProfile(ex datastore.Execer) error {
+
+	var consentDirectory, consentContact int
+	if r.ConsentDirectory {
+		consentDirectory = 1
+	}
+	if r.ConsentContact {
+		consentContact = 1
+	}
+
+	_, err := ex.Exec(queries["update-member-profile"], consentDirectory, consentContact, r.PostNominal, r.ID)
+	if err != nil {
+		return err
+	}
+
+	if r.Contacts != nil {
+		_, err := ex.Exec(queries["delete-member-contact-rows"], r.ID)
+		if err != nil {
+			return fmt.Errorf("delete contact rows err = %s", err)
+		}
+		err = r.insertContacts(ex)
+		if err != nil {
+			return fmt.Errorf("insert contact rows err = %s", err)
+		}
+	}
+	if r.Specialities != nil {
+		_, err := ex.Exec(queries["delete-member-speciality-rows"], r.ID)
+		if err != nil {
+			return fmt.Errorf("delete speciality rows err = %s", err)
+		}
+		err = r.insertSpecialities(ex)
+		if err != nil {
+			return fmt.Errorf("insert speciality rows err = %s", err)
+		}
+	}
+
+	return nil
+}
+
+// memberContacts fetches the contact rows of a member, in the order they were added
+func memberContacts(ds datastore.Datastore, memberID int) ([]ContactRow, error) {
+
+	var xc []ContactRow
+	rows, err := ds.MySQL.Session.Query(queries["select-member-contact-rows"], memberID)
+	if err != nil {
+		return xc, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c ContactRow
+		err := rows.Scan(&c.TypeID, &c.CountryID, &c.Phone, &c.Fax, &c.Email, &c.Web, &c.Address1, &c.Address2,
+			&c.Address3, &c.Locality, &c.State, &c.Postcode)
+		if err != nil {
+			return xc, err
+		}
+		xc = append(xc, c)
+	}
+
+	return xc, rows.Err()
+}
+
+// memberSpecialities fetches the speciality rows of a member, in the order they were added
+func memberSpecialities(ds datastore.Datastore, memberID int) ([]SpecialityRow, error) {
+
+	var xs []SpecialityRow
+	rows, err := ds.MySQL.Session.Query(queries["select-member-speciality-rows"], memberID)
+	if err != nil {
+		return xs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sr SpecialityRow
+		err := rows.Scan(&sr.SpecialityID, &sr.Preference, &sr.Comment)
+		if err != nil {
+			return xs, err
+		}
+		xs = append(xs, sr)
+	}
+
+	return xs, rows.Err()
+}
+
+// sameContacts returns true if the two lists of contacts are the same, in the same order
+func sameContacts(a, b []ContactRow) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameSpecialities returns true if the two lists of specialities are the same, in the same order
+func sameSpecialities(a, b []SpecialityRow) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// consentChange describes a change to a consent flag
+func consentChange(given bool) string {
+	if given {
+		return "given"
+	}
+	return "withdrawn"
+}
+
+// isProfileField returns true if the JSON field name is in ProfileFields
+func isProfileField(name string) bool {
+	for _, f := range ProfileFields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
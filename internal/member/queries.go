@@ -10,6 +10,43 @@ var queries = map[string]string{
 	"insert-member-application-row":          insertMemberApplicationRow,
 	"insert-member-contact-row":              insertMemberContactRow,
 	"insert-member-status-row":               insertMemberStatusRow,
+	"select-member-row":                      selectMemberRow,
+	"update-member-row":                      updateMemberRow,
+	"update-member-profile":                  updateMemberProfile,
+	"select-member-contact-rows":             selectMemberContactRows,
+	"select-member-speciality-rows":          selectMemberSpecialityRows,
+	"delete-member-qualification-rows":       deleteMemberQualificationRows,
+	"delete-member-position-rows":            deleteMemberPositionRows,
+	"delete-member-speciality-rows":          deleteMemberSpecialityRows,
+	"delete-member-accreditation-rows":       deleteMemberAccreditationRows,
+	"delete-member-tag-rows":                 deleteMemberTagRows,
+	"delete-member-contact-rows":             deleteMemberContactRows,
+	"select-member-id-by-email":              selectMemberIDByEmail,
+	"select-member-ids-by-name":              selectMemberIDsByName,
+	"select-reference-ids":                   selectReferenceIDs,
+	"select-member-match-fields":             selectMemberMatchFields,
+	"select-member-active":                   selectMemberActive,
+	"update-member-deactivate":               updateMemberDeactivate,
+	"merge-member-activities":                mergeMemberActivities,
+	"merge-member-invoices":                  mergeMemberInvoices,
+	"merge-member-payments":                  mergeMemberPayments,
+	"merge-member-notes":                     mergeMemberNotes,
+	"merge-member-issues":                    mergeMemberIssues,
+	"merge-member-statuses":                  mergeMemberStatuses,
+	"reconcile-member-titles":                reconcileMemberTitles,
+	"merge-member-titles":                    mergeMemberTitles,
+	"reconcile-member-evaluations":           reconcileMemberEvaluations,
+	"merge-member-evaluations":               mergeMemberEvaluations,
+	"reconcile-member-subscriptions":         reconcileMemberSubscriptions,
+	"merge-member-subscriptions":             mergeMemberSubscriptions,
+	"select-member-current-status":           selectMemberCurrentStatus,
+	"select-member-previous-status":          selectMemberPreviousStatus,
+	"select-member-subscription":             selectMemberSubscription,
+	"update-member-reactivate-subscription":  updateMemberReactivateSubscription,
+	"insert-member-arrears-invoice":          insertMemberArrearsInvoice,
+	"select-lapse-invoices":                  selectLapseInvoices,
+	"select-member-state-at":                 selectMemberStateAt,
+	"select-member-counts-at":                selectMemberCountsAt,
 	"select-member":                          selectMember,
 	"select-member-honorific":                selectMemberHonorific,
 	"select-member-country":                  selectMemberCountry,
@@ -48,7 +85,7 @@ INSERT INTO member (
 ) VALUES (
     ?, ?, ?, ?, ?, 
     NOW(), NOW(), 
-    ?, ?, ?, ?, ?, ?, ?, ?, MD5("a-not-so-random-string")
+    NULLIF(?, ''), NULLIF(?, ''), ?, ?, ?, ?, ?, ?, ?
 )`
 
 const insertMemberQualificationRow = `
@@ -94,7 +131,7 @@ INSERT INTO mp_m_accreditation (
     start_on,
     end_on,
     comment
-) VALUES (?, ?, NOW(), NOW(), ?, ?, ?)
+) VALUES (?, ?, NOW(), NOW(), NULLIF(?, ''), NULLIF(?, ''), ?)
 `
 
 const insertMemberTagRow = `
@@ -136,6 +173,272 @@ INSERT INTO mp_m_contact(
   ) 
 VALUES (?, ?, ?, NOW(), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
+const selectMemberRow = `
+SELECT
+    acl_member_role_id,
+    a_name_prefix_id,
+    country_id,
+    consent_directory,
+    consent_contact,
+    COALESCE(updated_at, ''),
+    COALESCE(date_of_birth, ''),
+    COALESCE(gender, ''),
+    first_name,
+    middle_names,
+    last_name,
+    COALESCE(suffix, ''),
+    COALESCE(mobile_phone, ''),
+    COALESCE(primary_email, '')
+FROM member
+WHERE id = ?`
+
+const updateMemberRow = `
+UPDATE member SET
+    acl_member_role_id = ?,
+    a_name_prefix_id = ?,
+    country_id = ?,
+    consent_directory = ?,
+    consent_contact = ?,
+    updated_at = NOW(),
+    date_of_birth = NULLIF(?, ''),
+    gender = NULLIF(?, ''),
+    first_name = ?,
+    middle_names = ?,
+    last_name = ?,
+    suffix = ?,
+    mobile_phone = ?
+WHERE id = ?`
+
+// updateMemberProfile writes the fields a member may change in their own profile
+const updateMemberProfile = `
+UPDATE member SET
+    consent_directory = ?,
+    consent_contact = ?,
+    suffix = ?,
+    updated_at = NOW()
+WHERE id = ?`
+
+const selectMemberContactRows = `
+SELECT
+  mp_contact_type_id,
+  COALESCE(country_id, 0),
+  COALESCE(phone, ''),
+  COALESCE(fax, ''),
+  COALESCE(email, ''),
+  COALESCE(web, ''),
+  COALESCE(address1, ''),
+  COALESCE(address2, ''),
+  COALESCE(address3, ''),
+  COALESCE(locality, ''),
+  COALESCE(state, ''),
+  COALESCE(postcode, '')
+FROM mp_m_contact
+WHERE member_id = ?
+ORDER BY id`
+
+const selectMemberSpecialityRows = `
+SELECT mp_speciality_id, COALESCE(preference, 0), COALESCE(comment, '')
+FROM mp_m_speciality
+WHERE member_id = ?
+ORDER BY id`
+
+const deleteMemberQualificationRows = `DELETE FROM mp_m_qualification WHERE member_id = ?`
+
+const deleteMemberPositionRows = `DELETE FROM mp_m_position WHERE member_id = ?`
+
+const deleteMemberSpecialityRows = `DELETE FROM mp_m_speciality WHERE member_id = ?`
+
+const deleteMemberAccreditationRows = `DELETE FROM mp_m_accreditation WHERE member_id = ?`
+
+const deleteMemberTagRows = `DELETE FROM mp_m_tag WHERE member_id = ?`
+
+const deleteMemberContactRows = `DELETE FROM mp_m_contact WHERE member_id = ?`
+
+const selectMemberIDByEmail = `SELECT id FROM member WHERE primary_email = ?`
+
+const selectMemberIDsByName = `SELECT id FROM member WHERE first_name = ? AND last_name = ?`
+
+// selectReferenceIDs is formatted with the name of a reference data table
+const selectReferenceIDs = `SELECT id FROM %s WHERE active = 1`
+
+const selectMemberMatchFields = `
+SELECT
+    id,
+    first_name,
+    last_name,
+    COALESCE(date_of_birth, ''),
+    COALESCE(primary_email, ''),
+    COALESCE(mobile_phone, ''),
+    COALESCE(journal_number, '')
+FROM member
+WHERE active = 1`
+
+const selectMemberActive = `SELECT active FROM member WHERE id = ? FOR UPDATE`
+
+const updateMemberDeactivate = `UPDATE member SET active = 0, updated_at = NOW() WHERE id = ?`
+
+const mergeMemberActivities = `UPDATE ce_m_activity SET member_id = ?, updated_at = NOW() WHERE member_id = ?`
+
+const mergeMemberInvoices = `UPDATE fn_m_invoice SET member_id = ?, updated_at = NOW() WHERE member_id = ?`
+
+const mergeMemberPayments = `UPDATE fn_payment SET member_id = ?, updated_at = NOW() WHERE member_id = ?`
+
+const mergeMemberNotes = `UPDATE wf_note_association SET member_id = ?, updated_at = NOW() WHERE member_id = ?`
+
+const mergeMemberIssues = `UPDATE wf_issue_association SET member_id = ?, updated_at = NOW() WHERE member_id = ?`
+
+// the survivor keeps its current status, and the duplicate's statuses become history
+const mergeMemberStatuses = `UPDATE ms_m_status SET member_id = ?, current = 0, updated_at = NOW() WHERE member_id = ?`
+
+// the duplicate's titles become history if the survivor has a current title
+const reconcileMemberTitles = `
+UPDATE ms_m_title d
+    JOIN ms_m_title s ON s.member_id = ? AND s.current = 1 AND s.active = 1
+SET d.current = 0, d.updated_at = NOW()
+WHERE d.member_id = ?`
+
+const mergeMemberTitles = `UPDATE ms_m_title SET member_id = ?, updated_at = NOW() WHERE member_id = ?`
+
+// the duplicate's evaluation periods that overlap one of the survivor's are soft deleted, as the activities
+// that moved to the survivor fall within the survivor's period
+const reconcileMemberEvaluations = `
+UPDATE ce_m_evaluation d
+    JOIN ce_m_evaluation s ON s.member_id = ? AND s.active = 1 AND s.start_on <= d.end_on AND d.start_on <= s.end_on
+SET d.active = 0, d.updated_at = NOW()
+WHERE d.member_id = ? AND d.active = 1`
+
+const mergeMemberEvaluations = `UPDATE ce_m_evaluation SET member_id = ?, updated_at = NOW() WHERE member_id = ?`
+
+// the duplicate's subscriptions that the survivor also has are soft deleted, so they are not invoiced twice
+const reconcileMemberSubscriptions = `
+UPDATE fn_m_subscription d
+    JOIN fn_m_subscription s ON s.member_id = ? AND s.active = 1 AND s.fn_subscription_id = d.fn_subscription_id
+SET d.active = 0, d.updated_at = NOW()
+WHERE d.member_id = ? AND d.active = 1`
+
+const mergeMemberSubscriptions = `UPDATE fn_m_subscription SET member_id = ?, updated_at = NOW() WHERE member_id = ?`
+
+// the status a member has now, locked until a reinstatement is complete
+const selectMemberCurrentStatus = `
+SELECT ms_status_id FROM ms_m_status
+WHERE member_id = ? AND current = 1 AND active = 1
+ORDER BY id DESC
+LIMIT 1
+FOR UPDATE`
+
+// the most recent status, other than the one specified, that a member has had
+const selectMemberPreviousStatus = `
+SELECT
+    mms.ms_status_id,
+    COALESCE(ms.name, '')
+FROM
+    ms_m_status mms
+        INNER JOIN
+    ms_status ms ON ms.id = mms.ms_status_id
+WHERE
+    mms.member_id = ? AND mms.active = 1 AND mms.ms_status_id != ?
+ORDER BY mms.id DESC
+LIMIT 1`
+
+const selectMemberSubscription = `
+SELECT fn_subscription_id FROM fn_m_subscription WHERE id = ? AND member_id = ?`
+
+const updateMemberReactivateSubscription = `
+UPDATE fn_m_subscription SET active = 1, updated_at = NOW() WHERE id = ? AND member_id = ?`
+
+// an arrears invoice is completed when it is raised, so it is visible to the member and sent by housekeeping
+const insertMemberArrearsInvoice = `
+INSERT INTO fn_m_invoice (
+    member_id,
+    fn_subscription_id,
+    created_at,
+    updated_at,
+    completed_at,
+    invoiced_on,
+    due_on,
+    invoice_total,
+    comment
+)
+VALUES (?, NULLIF(?, 0), NOW(), NOW(), NOW(), CURDATE(), DATE_ADD(CURDATE(), INTERVAL 14 DAY), ?, ?)`
+
+// overdue subscription invoices with no payments allocated, for members that are not lapsed. The %s is for
+// excluding titles, and is either empty or a NOT IN clause.
+const selectLapseInvoices = `
+SELECT
+    m.id,
+    CONCAT(COALESCE(m.first_name, ''), ' ', COALESCE(m.last_name, '')),
+    COALESCE(m.primary_email, ''),
+    COALESCE(t.name, ''),
+    i.id,
+    i.due_on,
+    DATEDIFF(CURDATE(), i.due_on),
+    i.invoice_total
+FROM
+    fn_m_invoice i
+        INNER JOIN
+    member m ON m.id = i.member_id
+        LEFT JOIN
+    ms_m_status mms ON mms.member_id = m.id AND mms.current = 1 AND mms.active = 1
+        LEFT JOIN
+    ms_m_title mmt ON mmt.member_id = m.id AND mmt.current = 1 AND mmt.active = 1
+        LEFT JOIN
+    ms_title t ON t.id = mmt.ms_title_id
+WHERE
+    i.active = 1 AND i.paid = 0 AND i.fn_subscription_id IS NOT NULL
+    AND i.due_on < DATE_SUB(CURDATE(), INTERVAL ? DAY)
+    AND NOT EXISTS (SELECT 1 FROM fn_invoice_payment ip WHERE ip.fn_m_invoice_id = i.id AND ip.active = 1)
+    AND m.active = 1
+    AND COALESCE(mms.ms_status_id, 0) != ?
+    %s
+ORDER BY m.id, i.due_on, i.id`
+
+// the status and title id of each member as at a date, the first placeholder for the status and the second
+// for the title. A status takes effect when it is recorded, and a title when it is granted.
+const selectMemberStatesAt = `
+SELECT
+    m.id AS member_id,
+    (SELECT mms.ms_status_id FROM ms_m_status mms
+     WHERE mms.member_id = m.id AND mms.active = 1 AND DATE(mms.created_at) <= ?
+     ORDER BY DATE(mms.created_at) DESC, mms.id DESC
+     LIMIT 1) AS status_id,
+    (SELECT mmt.ms_title_id FROM ms_m_title mmt
+     WHERE mmt.member_id = m.id AND mmt.active = 1 AND COALESCE(mmt.granted_on, DATE(mmt.created_at)) <= ?
+     ORDER BY COALESCE(mmt.granted_on, DATE(mmt.created_at)) DESC, mmt.id DESC
+     LIMIT 1) AS title_id
+FROM
+    member m`
+
+const selectMemberStateAt = `
+SELECT
+    COALESCE(x.status_id, 0),
+    COALESCE(s.name, ''),
+    COALESCE(x.title_id, 0),
+    COALESCE(t.name, '')
+FROM
+    (` + selectMemberStatesAt + ` WHERE m.id = ?) x
+        LEFT JOIN
+    ms_status s ON s.id = x.status_id
+        LEFT JOIN
+    ms_title t ON t.id = x.title_id`
+
+const selectMemberCountsAt = `
+SELECT
+    COALESCE(x.title_id, 0),
+    COALESCE(t.name, ''),
+    x.status_id,
+    COALESCE(s.name, ''),
+    COUNT(*)
+FROM
+    (` + selectMemberStatesAt + `) x
+        LEFT JOIN
+    ms_status s ON s.id = x.status_id
+        LEFT JOIN
+    ms_title t ON t.id = x.title_id
+WHERE
+    x.status_id IS NOT NULL
+GROUP BY x.title_id, t.name, x.status_id, s.name
+ORDER BY x.title_id, x.status_id`
+
 const insertMemberStatusRow = `
 INSERT INTO ms_m_status(
     member_id, 
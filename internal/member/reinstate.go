@@ -0,0 +1,149 @@
+package member
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cardiacsociety/web-services/internal/note"
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+)
+
+// ErrNotLapsed is returned when a member that is not lapsed is reinstated
+var ErrNotLapsed = errors.New("member is not lapsed")
+
+// ErrNoPreviousStatus is returned when a lapsed member has no earlier status to be reinstated to
+var ErrNoPreviousStatus = errors.New("member has no status prior to being lapsed")
+
+// Reinstatement sets out how a lapsed member is reinstated. SubscriptionIDs are the ids of the member's own
+// subscription records to reactivate. If Arrears is more than zero an invoice is raised for that amount.
+type Reinstatement struct {
+	SubscriptionIDs []int   `json:"subscriptionIds"`
+	Arrears         float64 `json:"arrears"`
+	Comment         string  `json:"comment"`
+}
+
+// Reinstate reverses a Lapse, in a single transaction. The member is restored to the status they had before
+// they were lapsed, the chosen subscriptions are reactivated, an invoice is raised for any arrears and a file
+// note is written. It returns the id of the arrears invoice, or 0 if none was raised. The caller should
+// re-sync the member doc.
+func (m *Member) Reinstate(ds datastore.Datastore, rs Reinstatement) (int, error) {
+
+	var invoiceID int
+	err := ds.MySQL.InTx(func(ex datastore.Execer) error {
+		var err error
+		invoiceID, err = m.ReinstateTx(ex, rs)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return invoiceID, nil
+}
+
+// ReinstateTx reinstates a member using ex, so that it can be part of a larger transaction
+func (m *Member) ReinstateTx(ex datastore.Execer, rs Reinstatement) (int, error) {
+
+	if rs.Arrears < 0 {
+		return 0, fmt.Errorf("arrears of %.2f is not valid", rs.Arrears)
+	}
+
+	var current int
+	err := ex.QueryRow(queries["select-member-current-status"], m.ID).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if current != lapsedStatusID {
+		return 0, ErrNotLapsed
+	}
+
+	var statusID int
+	var status string
+	err = ex.QueryRow(queries["select-member-previous-status"], m.ID, lapsedStatusID).Scan(&statusID, &status)
+	if err == sql.ErrNoRows {
+		return 0, ErrNoPreviousStatus
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	sr := StatusRow{
+		StatusID: statusID,
+		Current:  true,
+		Comment:  "Reinstated",
+	}
+	err = sr.insert(ex, m.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	// the first subscription is the one the arrears invoice is raised against
+	var subscriptionID, invoiceID int
+	for i, id := range rs.SubscriptionIDs {
+		var sid int
+		err := ex.QueryRow(queries["select-member-subscription"], id, m.ID).Scan(&sid)
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf("subscription id %d does not belong to member id %d", id, m.ID)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if i == 0 {
+			subscriptionID = sid
+		}
+		_, err = ex.Exec(queries["update-member-reactivate-subscription"], id, m.ID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if rs.Arrears > 0 {
+		res, err := ex.Exec(queries["insert-member-arrears-invoice"], m.ID, subscriptionID, rs.Arrears,
+			"Arrears on reinstatement")
+		if err != nil {
+			return 0, err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		invoiceID = int(id)
+	}
+
+	n := note.Note{
+		MemberID: m.ID,
+		TypeID:   fileNoteTypeID,
+		Content:  rs.noteContent(status, invoiceID),
+	}
+	err = n.InsertRowTx(ex)
+	if err != nil {
+		return 0, err
+	}
+
+	return invoiceID, nil
+}
+
+// noteContent describes the reinstatement for the file note
+func (rs Reinstatement) noteContent(status string, invoiceID int) string {
+
+	xs := []string{fmt.Sprintf("Reinstated to status '%s'.", status)}
+
+	if len(rs.SubscriptionIDs) > 0 {
+		ids := make([]string, len(rs.SubscriptionIDs))
+		for i, id := range rs.SubscriptionIDs {
+			ids[i] = strconv.Itoa(id)
+		}
+		xs = append(xs, fmt.Sprintf("Subscription id(s) %s reactivated.", strings.Join(ids, ", ")))
+	}
+	if invoiceID > 0 {
+		xs = append(xs, fmt.Sprintf("Invoice id %d raised for arrears of $%.2f.", invoiceID, rs.Arrears))
+	}
+	if rs.Comment != "" {
+		xs = append(xs, rs.Comment)
+	}
+
+	return strings.Join(xs, " ")
+}
@@ -0,0 +1,71 @@
+package member
+
+import (
+	"time"
+
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+)
+
+// stateDateFormat is the format of dates in the state queries
+const stateDateFormat = "2006-01-02"
+
+// State is the membership status and title of a member as at a date. A status takes effect on the date it
+// was recorded, and a title on the date it was granted. The ids are 0 if the member had no status, or no
+// title, at that date.
+type State struct {
+	MemberID int    `json:"memberId"`
+	Date     string `json:"date"`
+	StatusID int    `json:"statusId"`
+	Status   string `json:"status"`
+	TitleID  int    `json:"titleId"`
+	Title    string `json:"title"`
+}
+
+// StateCount is the number of members with a particular title and status as at a date
+type StateCount struct {
+	TitleID  int    `json:"titleId"`
+	Title    string `json:"title"`
+	StatusID int    `json:"statusId"`
+	Status   string `json:"status"`
+	Count    int    `json:"count"`
+}
+
+// StateAt returns the membership state of a member as at the end of date, from the status and title history.
+// If there is no such member the error is sql.ErrNoRows.
+func StateAt(ds datastore.Datastore, memberID int, date time.Time) (State, error) {
+
+	s := State{MemberID: memberID, Date: date.Format(stateDateFormat)}
+	err := ds.MySQL.Session.QueryRow(queries["select-member-state-at"], s.Date, s.Date, memberID).Scan(
+		&s.StatusID,
+		&s.Status,
+		&s.TitleID,
+		&s.Title,
+	)
+	return s, err
+}
+
+// CountsAt returns the number of members with each title and status as at the end of date. Whether a member
+// counts is decided by their status history alone, so a member who has since been deactivated is counted
+// with the status they had then, and members that had no status at that date are not counted.
+func CountsAt(ds datastore.Datastore, date time.Time) ([]StateCount, error) {
+
+	var xc []StateCount
+
+	d := date.Format(stateDateFormat)
+	rows, err := ds.MySQL.Session.Query(queries["select-member-counts-at"], d, d)
+	if err != nil {
+		return xc, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c StateCount
+		err := rows.Scan(&c.TitleID, &c.Title, &c.StatusID, &c.Status, &c.Count)
+		if err != nil {
+			return xc, err
+		}
+		xc = append(xc, c)
+	}
+
+	return xc, rows.Err()
+}
@@ -44,6 +44,12 @@ type Attachment struct {
 
 // InsertRow creates a new note row with fields from Note
 func (n *Note) InsertRow(ds datastore.Datastore) error {
+	return n.InsertRowTx(ds.MySQL.Session)
+}
+
+// InsertRowTx creates a new note row with fields from Note, using ex so that the note can be created as part
+// of a transaction
+func (n *Note) InsertRowTx(ex datastore.Execer) error {
 	switch {
 	case n.ID > 0:
 		return errors.New(ErrorIDNotNil)
@@ -54,7 +60,7 @@ func (n *Note) InsertRow(ds datastore.Datastore) error {
 	case n.Content == "":
 		return errors.New(ErrorNoContent)
 	}
-	res, err := ds.MySQL.Session.Exec(queries["insert-note"], n.TypeID, n.Content)
+	res, err := ex.Exec(queries["insert-note"], n.TypeID, n.Content)
 	if err != nil {
 		return err
 	}
@@ -71,7 +77,7 @@ func (n *Note) InsertRow(ds datastore.Datastore) error {
 	if err != nil {
 		return err
 	}
-	_, err = ds.MySQL.Session.Exec(queries["insert-note-association"],
+	_, err = ex.Exec(queries["insert-note-association"],
 		n.ID,
 		n.MemberID,
 		NullInt(n.AssociationID),
@@ -0,0 +1,171 @@
+package datastore
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// identifier matches a column name, optionally qualified with a table alias, eg 'id' or 'cma.activity_on'
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// Clause builds the filter part of an SQL select statement - conditions, order and limit. Values are
+// never written into the SQL string, they are collected as arguments for the ? placeholders. Column
+// names are checked so a Clause cannot be used to smuggle SQL into a query.
+type Clause struct {
+	conditions []string
+	args       []interface{}
+	order      []string
+	limit      int
+	offset     int
+	err        error
+}
+
+// NewClause returns a pointer to an empty Clause
+func NewClause() *Clause {
+	return &Clause{}
+}
+
+// ValidIdentifier returns an error if s cannot be used as a table or column name
+func ValidIdentifier(s string) error {
+	if !identifier.MatchString(s) {
+		return errors.New("invalid identifier: " + strconv.Quote(s))
+	}
+	return nil
+}
+
+// Equal adds the condition column = value
+func (c *Clause) Equal(column string, value interface{}) *Clause {
+	return c.compare(column, "=", value)
+}
+
+// NotEqual adds the condition column != value
+func (c *Clause) NotEqual(column string, value interface{}) *Clause {
+	return c.compare(column, "!=", value)
+}
+
+// GreaterThan adds the condition column > value
+func (c *Clause) GreaterThan(column string, value interface{}) *Clause {
+	return c.compare(column, ">", value)
+}
+
+// GreaterOrEqual adds the condition column >= value
+func (c *Clause) GreaterOrEqual(column string, value interface{}) *Clause {
+	return c.compare(column, ">=", value)
+}
+
+// LessThan adds the condition column < value
+func (c *Clause) LessThan(column string, value interface{}) *Clause {
+	return c.compare(column, "<", value)
+}
+
+// LessOrEqual adds the condition column <= value
+func (c *Clause) LessOrEqual(column string, value interface{}) *Clause {
+	return c.compare(column, "<=", value)
+}
+
+// Like adds the condition column LIKE pattern
+func (c *Clause) Like(column string, pattern string) *Clause {
+	return c.compare(column, "LIKE", pattern)
+}
+
+// In adds the condition column IN (ids...). An empty list of ids will match nothing.
+func (c *Clause) In(column string, ids []int) *Clause {
+	if !c.column(column) {
+		return c
+	}
+	if len(ids) == 0 {
+		c.conditions = append(c.conditions, "1 = 0")
+		return c
+	}
+	c.conditions = append(c.conditions, column+" IN (?"+strings.Repeat(", ?", len(ids)-1)+")")
+	for _, id := range ids {
+		c.args = append(c.args, id)
+	}
+	return c
+}
+
+// OrderBy adds column to the sort order, descending if desc is true
+func (c *Clause) OrderBy(column string, desc bool) *Clause {
+	if !c.column(column) {
+		return c
+	}
+	if desc {
+		column += " DESC"
+	}
+	c.order = append(c.order, column)
+	return c
+}
+
+// Limit restricts the number of rows returned, n < 1 means no limit
+func (c *Clause) Limit(n int) *Clause {
+	c.limit = n
+	return c
+}
+
+// Offset skips the first n rows, it only applies along with a Limit
+func (c *Clause) Offset(n int) *Clause {
+	c.offset = n
+	return c
+}
+
+// Where returns the clause beginning with WHERE, for a base query that has no conditions of its own,
+// along with the arguments for the placeholders.
+func (c *Clause) Where() (string, []interface{}, error) {
+	return c.build("WHERE")
+}
+
+// And returns the clause beginning with AND, for a base query that already has a WHERE, along with the
+// arguments for the placeholders.
+func (c *Clause) And() (string, []interface{}, error) {
+	return c.build("AND")
+}
+
+func (c *Clause) compare(column, operator string, value interface{}) *Clause {
+	if !c.column(column) {
+		return c
+	}
+	c.conditions = append(c.conditions, column+" "+operator+" ?")
+	c.args = append(c.args, value)
+	return c
+}
+
+// column checks the column name and records the first error
+func (c *Clause) column(s string) bool {
+	if err := ValidIdentifier(s); err != nil {
+		if c.err == nil {
+			c.err = err
+		}
+		return false
+	}
+	return true
+}
+
+func (c *Clause) build(keyword string) (string, []interface{}, error) {
+
+	// a nil Clause is the same as an empty one
+	if c == nil {
+		return "", nil, nil
+	}
+	if c.err != nil {
+		return "", nil, c.err
+	}
+
+	var xs []string
+	if len(c.conditions) > 0 {
+		xs = append(xs, keyword+" "+strings.Join(c.conditions, " AND "))
+	}
+	if len(c.order) > 0 {
+		xs = append(xs, "ORDER BY "+strings.Join(c.order, ", "))
+	}
+	if c.limit > 0 {
+		xs = append(xs, "LIMIT "+strconv.Itoa(c.limit))
+		if c.offset > 0 {
+			xs = append(xs, "OFFSET "+strconv.Itoa(c.offset))
+		}
+	}
+
+	return strings.Join(xs, " "), c.args, nil
+}
@@ -0,0 +1,98 @@
+package datastore_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cardiacsociety/web-services/internal/platform/datastore"
+)
+
+func TestClause(t *testing.T) {
+	cases := []struct {
+		clause   *datastore.Clause
+		wantSQL  string
+		wantArgs []interface{}
+	}{
+		{nil, "", nil},
+		{datastore.NewClause(), "", nil},
+		{
+			datastore.NewClause().Equal("member_id", 1),
+			"WHERE member_id = ?",
+			[]interface{}{1},
+		},
+		{
+			datastore.NewClause().Equal("member_id", 1).GreaterOrEqual("cma.activity_on", "2018-01-01").OrderBy("cma.activity_on", true).Limit(5),
+			"WHERE member_id = ? AND cma.activity_on >= ? ORDER BY cma.activity_on DESC LIMIT 5",
+			[]interface{}{1, "2018-01-01"},
+		},
+		{
+			datastore.NewClause().OrderBy("id", true).Limit(10).Offset(20),
+			"ORDER BY id DESC LIMIT 10 OFFSET 20",
+			nil,
+		},
+		{
+			datastore.NewClause().Offset(20),
+			"",
+			nil,
+		},
+		{
+			datastore.NewClause().Like("description", `%"quoted"%`),
+			"WHERE description LIKE ?",
+			[]interface{}{`%"quoted"%`},
+		},
+		{
+			datastore.NewClause().In("id", []int{1, 2, 3}),
+			"WHERE id IN (?, ?, ?)",
+			[]interface{}{1, 2, 3},
+		},
+		{
+			datastore.NewClause().In("id", nil),
+			"WHERE 1 = 0",
+			nil,
+		},
+		{
+			datastore.NewClause().OrderBy("id", false),
+			"ORDER BY id",
+			nil,
+		},
+	}
+
+	for _, c := range cases {
+		gotSQL, gotArgs, err := c.clause.Where()
+		if err != nil {
+			t.Errorf("Clause.Where() err = %s", err)
+			continue
+		}
+		if gotSQL != c.wantSQL {
+			t.Errorf("Clause.Where() sql = %q, want %q", gotSQL, c.wantSQL)
+		}
+		if !reflect.DeepEqual(gotArgs, c.wantArgs) {
+			t.Errorf("Clause.Where() args = %v, want %v", gotArgs, c.wantArgs)
+		}
+	}
+}
+
+func TestClauseAnd(t *testing.T) {
+	got, _, err := datastore.NewClause().Equal("a.id", 1).NotEqual("a.status", 0).And()
+	if err != nil {
+		t.Fatalf("Clause.And() err = %s", err)
+	}
+	want := "AND a.id = ? AND a.status != ?"
+	if got != want {
+		t.Errorf("Clause.And() = %q, want %q", got, want)
+	}
+}
+
+func TestClauseInvalidColumn(t *testing.T) {
+	cases := []*datastore.Clause{
+		datastore.NewClause().Equal("id = 1 OR 1", 1),
+		datastore.NewClause().Equal("id", 1).OrderBy("id; DROP TABLE member", false),
+		datastore.NewClause().In("id)", []int{1}),
+	}
+	for _, c := range cases {
+		_, _, err := c.Where()
+		if err == nil {
+			t.Errorf("Clause.Where() err = nil, want error for invalid column")
+		}
+	}
+}
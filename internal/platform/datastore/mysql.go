@@ -13,6 +13,14 @@ type MySQLConnection struct {
 	Session *sql.DB
 }
 
+// Execer executes statements and queries. It is satisfied by both *sql.DB and *sql.Tx, so that the same
+// code can write rows either inside or outside of a transaction.
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 // NewMySQLConnection returns a pointer to an initialised MySQLConnection
 //func NewMySQLConnection(dsn, desc string) *MySQLConnection {
 //	return &MySQLConnection{
@@ -31,6 +39,23 @@ func (m *MySQLConnection) Connect() error {
 	return err
 }
 
+// InTx runs fn in a transaction, which is committed if fn returns nil and is otherwise rolled back
+func (m *MySQLConnection) InTx(fn func(Execer) error) error {
+
+	tx, err := m.Session.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
 // Close terminates the Session - don't really need?
 func (m *MySQLConnection) Close() {
 	m.Session.Close()
@@ -0,0 +1,20 @@
+package jwt
+
+import "context"
+
+// contextKey is unexported to prevent collisions with context keys defined in other packages
+type contextKey int
+
+// tokenKey is the context key for a decoded Token
+const tokenKey contextKey = 0
+
+// NewContext returns a copy of ctx that carries the decoded Token t
+func NewContext(ctx context.Context, t Token) context.Context {
+	return context.WithValue(ctx, tokenKey, t)
+}
+
+// FromContext returns the Token stored in ctx, if any
+func FromContext(ctx context.Context) (Token, bool) {
+	t, ok := ctx.Value(tokenKey).(Token)
+	return t, ok
+}
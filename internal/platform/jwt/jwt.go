@@ -5,12 +5,13 @@ import (
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/hashicorp/go-uuid"
 	"github.com/pkg/errors"
 )
 
 type Token struct {
 	signingKey []byte
-	ttlHours   int
+	ttl        time.Duration
 	Encoded    string      `json:"token"`
 	IssuedAt   time.Time   `json:"issuedAt"`
 	ExpiresAt  time.Time   `json:"expiresAt"`
@@ -21,19 +22,38 @@ type TokenClaims struct {
 	ID   int    `json:"id"`
 	Name string `json:"name"`
 	Role string `json:"role"`
+	// MFA is true when the user also verified a second factor, such as a TOTP code, to get the token
+	MFA bool `json:"mfa,omitempty"`
+	// Scopes lists the permissions granted to an admin user
+	Scopes []string `json:"scopes,omitempty"`
+	// Act identifies the admin acting as the user, for a token issued so that an admin can view the system
+	// as a member sees it
+	Act *Actor `json:"act,omitempty"`
+	// IssuedAtMs is the issue time in milliseconds, as iat is in whole seconds. It tells apart a token issued
+	// in the same second as a revocation of all tokens for the user.
+	IssuedAtMs int64 `json:"iatms,omitempty"`
 	jwt.StandardClaims
 }
 
-// New returns a pointer to a Token
+// Actor is the user acting on behalf of the user identified by a token, see the act claim in RFC 8693
+type Actor struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// New returns a pointer to a Token, with a unique id (jti claim)
 func New(issuer, signingKey string, ttlHours int) *Token {
 
 	var t Token
 
 	t.signingKey = []byte(signingKey)
-	t.ttlHours = ttlHours
+	t.ttl = time.Hour * time.Duration(ttlHours)
 
-	// Initialise standard claims
+	// Initialise standard claims, uuid only fails if the system random source fails
+	jti, _ := uuid.GenerateUUID()
 	t.Claims.StandardClaims = jwt.StandardClaims{
+		Id:     jti,
 		Issuer: issuer,
 	}
 
@@ -47,7 +67,8 @@ func New(issuer, signingKey string, ttlHours int) *Token {
 func (t *Token) SetTimes(iat time.Time) *Token {
 
 	t.Claims.StandardClaims.IssuedAt = iat.Unix()
-	t.Claims.StandardClaims.ExpiresAt = iat.Add(time.Hour * time.Duration(t.ttlHours)).Unix()
+	t.Claims.IssuedAtMs = iat.UnixNano() / int64(time.Millisecond)
+	t.Claims.StandardClaims.ExpiresAt = iat.Add(t.ttl).Unix()
 
 	// Set Unix dates at root of struct for convenience (??)
 	t.IssuedAt = time.Unix(int64(t.Claims.StandardClaims.IssuedAt), 0)
@@ -56,6 +77,12 @@ func (t *Token) SetTimes(iat time.Time) *Token {
 	return t
 }
 
+// SetTTL overrides the time to live set by New(), for tokens that should be valid for less than an hour
+func (t *Token) SetTTL(ttl time.Duration) *Token {
+	t.ttl = ttl
+	return t.SetTimes(time.Unix(0, t.Claims.IssuedAtMs*int64(time.Millisecond)))
+}
+
 // Encode finishes of the Token value and creates the encoded token string or JWS
 func (t *Token) Encode() (Token, error) {
 
@@ -65,8 +92,8 @@ func (t *Token) Encode() (Token, error) {
 	if len(t.signingKey) < 1 {
 		return *t, errors.New("Signing key cannot be blank")
 	}
-	if t.ttlHours < 1 {
-		return *t, errors.New("TTL hours must be a positive integer")
+	if t.ttl < time.Second {
+		return *t, errors.New("TTL must be at least one second")
 	}
 
 	var err error
@@ -86,10 +113,30 @@ func (t *Token) CustomClaims(claims map[string]interface{}) *Token {
 	if role, ok := claims["role"]; ok {
 		t.Claims.Role = role.(string)
 	}
+	if mfa, ok := claims["mfa"]; ok {
+		t.Claims.MFA = mfa.(bool)
+	}
+	if scopes, ok := claims["scopes"]; ok {
+		t.Claims.Scopes = scopes.([]string)
+	}
+	if act, ok := claims["act"]; ok {
+		a := act.(Actor)
+		t.Claims.Act = &a
+	}
 
 	return t
 }
 
+// HasScope returns true if the token claims include the scope
+func (t *Token) HasScope(scope string) bool {
+	for _, s := range t.Claims.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
 // Valid returns true if the Token.Encoded string is a valid JWT
 func (t *Token) Valid() bool {
 	_, err := jwt.Parse(t.Encoded, func(tok *jwt.Token) (interface{}, error) {
@@ -135,19 +182,46 @@ func Decode(token, signingKey string) (Token, error) {
 		t.Claims.ID = int(claims["id"].(float64))
 		t.Claims.Name = claims["name"].(string)
 		t.Claims.Role = claims["role"].(string)
+		if mfa, ok := claims["mfa"].(bool); ok {
+			t.Claims.MFA = mfa
+		}
+		if scopes, ok := claims["scopes"].([]interface{}); ok {
+			for _, s := range scopes {
+				if s, ok := s.(string); ok {
+					t.Claims.Scopes = append(t.Claims.Scopes, s)
+				}
+			}
+		}
+		if act, ok := claims["act"].(map[string]interface{}); ok {
+			a := Actor{}
+			if id, ok := act["id"].(float64); ok {
+				a.ID = int(id)
+			}
+			a.Name, _ = act["name"].(string)
+			a.Role, _ = act["role"].(string)
+			t.Claims.Act = &a
+		}
 
 		// Standard claims
 		t.Claims.ExpiresAt = int64(claims["exp"].(float64))
 		t.Claims.IssuedAt = int64(claims["iat"].(float64))
 		t.Claims.Issuer = claims["iss"].(string)
+		if jti, ok := claims["jti"].(string); ok {
+			t.Claims.Id = jti
+		}
 
-		// reverse engineer ttlHours from iat and exp
-		t.ttlHours = (int(t.Claims.ExpiresAt) - int(t.Claims.IssuedAt)) / 3600
+		// reverse engineer ttl from iat and exp
+		t.ttl = time.Duration(t.Claims.ExpiresAt-t.Claims.IssuedAt) * time.Second
 
 		// Set the friendly dates
 		issueTime := time.Unix(t.Claims.IssuedAt, 0)
 		t.SetTimes(issueTime)
 
+		// Tokens issued before the iatms claim was added keep the whole second from iat
+		if ms, ok := claims["iatms"].(float64); ok {
+			t.Claims.IssuedAtMs = int64(ms)
+		}
+
 		return t, nil
 	}
 
@@ -124,3 +124,115 @@ func TestTokenWithFutureDate(t *testing.T) {
 	expireTime := int(tk.Claims.ExpiresAt/3600) - int(time.Now().Unix()/3600)
 	is.True(expectExpireTime == expireTime) // Incorrect expire time
 }
+
+func TestTokenID(t *testing.T) {
+	is := is.New(t)
+
+	tk1, err := jwt.New(issuer, signingKey, ttlHours).Encode()
+	is.NoErr(err) // Error creating token
+	tk2, err := jwt.New(issuer, signingKey, ttlHours).Encode()
+	is.NoErr(err)                           // Error creating token
+	is.True(tk1.Claims.Id != "")            // Token should have a jti claim
+	is.True(tk1.Claims.Id != tk2.Claims.Id) // Each token should have a unique jti claim
+
+	tk3, err := jwt.Decode(tk1.Encoded, signingKey)
+	is.NoErr(err)                          // Error decoding token
+	is.Equal(tk3.Claims.Id, tk1.Claims.Id) // Decoded token should have the same jti claim
+}
+
+func TestSetTTL(t *testing.T) {
+	is := is.New(t)
+
+	c := map[string]interface{}{
+		"id":   userID,
+		"name": userName,
+		"role": userRole,
+	}
+
+	tk1, err := jwt.New(issuer, signingKey, 0).SetTTL(15 * time.Minute).CustomClaims(c).Encode()
+	is.NoErr(err)                                                    // Error creating token with a TTL in minutes
+	is.Equal(tk1.Claims.ExpiresAt-tk1.Claims.IssuedAt, int64(15*60)) // Incorrect TTL
+
+	tk2, err := jwt.Decode(tk1.Encoded, signingKey)
+	is.NoErr(err)                        // Error decoding token
+	is.True(reflect.DeepEqual(tk1, tk2)) // Token and decoded Token should be deeply equal
+}
+
+func TestMFAClaim(t *testing.T) {
+	is := is.New(t)
+
+	c := map[string]interface{}{
+		"id":   userID,
+		"name": userName,
+		"role": userRole,
+		"mfa":  true,
+	}
+
+	tk1, err := jwt.New(issuer, signingKey, ttlHours).CustomClaims(c).Encode()
+	is.NoErr(err) // Error creating token with mfa claim
+	tk2, err := jwt.Decode(tk1.Encoded, signingKey)
+	is.NoErr(err)           // Error decoding token
+	is.True(tk2.Claims.MFA) // Decoded token should have the mfa claim
+
+	delete(c, "mfa")
+	tk3, err := jwt.New(issuer, signingKey, ttlHours).CustomClaims(c).Encode()
+	is.NoErr(err) // Error creating token
+	tk4, err := jwt.Decode(tk3.Encoded, signingKey)
+	is.NoErr(err)            // Error decoding token
+	is.True(!tk4.Claims.MFA) // Token without mfa claim should not have MFA set
+}
+
+func TestScopesClaim(t *testing.T) {
+	is := is.New(t)
+
+	c := map[string]interface{}{
+		"id":     userID,
+		"name":   userName,
+		"role":   userRole,
+		"scopes": []string{"members:read", "reports:finance"},
+	}
+
+	tk1, err := jwt.New(issuer, signingKey, ttlHours).CustomClaims(c).Encode()
+	is.NoErr(err) // Error creating token with scopes claim
+	tk2, err := jwt.Decode(tk1.Encoded, signingKey)
+	is.NoErr(err)                                                            // Error decoding token
+	is.Equal(tk2.Claims.Scopes, []string{"members:read", "reports:finance"}) // Decoded token should have the scopes
+	is.True(tk2.HasScope("reports:finance"))                                 // Token should have the scope
+	is.True(!tk2.HasScope("members:lapse"))                                  // Token should not have the scope
+}
+
+func TestActClaim(t *testing.T) {
+	is := is.New(t)
+
+	c := map[string]interface{}{
+		"id":   userID,
+		"name": userName,
+		"role": userRole,
+	}
+
+	tk1, err := jwt.New(issuer, signingKey, ttlHours).CustomClaims(c).Encode()
+	is.NoErr(err)
+	tk2, err := jwt.Decode(tk1.Encoded, signingKey)
+	is.NoErr(err)
+	is.True(tk2.Claims.Act == nil) // Token should not have an act claim
+
+	c["act"] = jwt.Actor{ID: 1, Name: "Admin 1", Role: "admin"}
+	tk1, err = jwt.New(issuer, signingKey, ttlHours).CustomClaims(c).Encode()
+	is.NoErr(err) // Error creating token with act claim
+	tk2, err = jwt.Decode(tk1.Encoded, signingKey)
+	is.NoErr(err)                                                               // Error decoding token
+	is.Equal(tk2.Claims.Act, &jwt.Actor{ID: 1, Name: "Admin 1", Role: "admin"}) // Decoded token should have the actor
+}
+
+func TestIssuedAtMs(t *testing.T) {
+	is := is.New(t)
+
+	tk1, err := jwt.New(issuer, signingKey, 0).SetTTL(15 * time.Minute).Encode()
+	is.NoErr(err)                                                    // Error creating token
+	is.Equal(tk1.Claims.IssuedAtMs/1000, tk1.Claims.IssuedAt)        // iatms claim should be the iat claim in milliseconds
+	is.Equal(tk1.Claims.ExpiresAt-tk1.Claims.IssuedAt, int64(15*60)) // Incorrect TTL
+
+	tk2, err := jwt.Decode(tk1.Encoded, signingKey)
+	is.NoErr(err)                                          // Error decoding token
+	is.Equal(tk2.Claims.IssuedAtMs, tk1.Claims.IssuedAtMs) // Decoded token should have the same iatms claim
+}
@@ -34,3 +34,16 @@ func PutRequest(key, bucket string) (string, error) {
 
 	return req.Presign(15 * time.Minute)
 }
+
+// DeleteObject removes the object with the key from the bucket, using the same credentials as PutRequest
+func DeleteObject(key, bucket string) error {
+
+	sess := session.Must(session.NewSession())
+	svc := s3.New(sess, aws.NewConfig().WithRegion(os.Getenv("AWS_REGION")))
+	_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+
+	return err
+}
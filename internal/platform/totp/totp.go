@@ -0,0 +1,121 @@
+// Package totp implements time-based one-time passwords as described in RFC 6238, compatible with
+// authenticator apps such as Google Authenticator. Codes are 6 digits, using HMAC-SHA1 and a 30 second step.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	digits = 6
+	period = 30
+	// skew is the number of steps either side of the current one for which a code is accepted, to allow
+	// for clock drift and the time taken to type the code
+	skew = 1
+)
+
+// encoding is base32 without padding, as expected by authenticator apps
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a random 160 bit secret, base32 encoded
+func NewSecret() (string, error) {
+	xb := make([]byte, 20)
+	if _, err := rand.Read(xb); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(xb), nil
+}
+
+// URI returns the otpauth:// provisioning uri for a secret. Authenticator apps enrol by scanning the uri
+// as a QR code.
+func URI(issuer, account, secret string) string {
+
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(digits))
+	v.Set("period", fmt.Sprint(period))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
+
+// Code returns the code for a secret at time t
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decode(secret)
+	if err != nil {
+		return "", err
+	}
+	return code(key, Counter(t)), nil
+}
+
+// Counter returns the time step for t
+func Counter(t time.Time) int64 {
+	return t.Unix() / period
+}
+
+// Validate checks a code for a secret at time t, and returns the time step that it matched. Callers should
+// record the step and reject codes for the same or an earlier step, so that a code cannot be replayed.
+func Validate(secret, c string, t time.Time) (int64, bool) {
+
+	key, err := decode(secret)
+	if err != nil {
+		return 0, false
+	}
+	c = strings.Replace(c, " ", "", -1)
+	if len(c) != digits {
+		return 0, false
+	}
+
+	now := Counter(t)
+	for i := -skew; i <= skew; i++ {
+		if subtle.ConstantTimeCompare([]byte(code(key, now+int64(i))), []byte(c)) == 1 {
+			return now + int64(i), true
+		}
+	}
+
+	return 0, false
+}
+
+// decode decodes a base32 secret, ignoring case, spaces and padding
+func decode(secret string) ([]byte, error) {
+	s := strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	key, err := encoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid totp secret")
+	}
+	return key, nil
+}
+
+// code is the HOTP value (RFC 4226) for a key and counter, truncated to 6 digits
+func code(key []byte, counter int64) string {
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	h := hmac.New(sha1.New, key)
+	h.Write(msg)
+	sum := h.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", digits, bin%1000000)
+}
@@ -0,0 +1,91 @@
+package totp_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cardiacsociety/web-services/internal/platform/totp"
+)
+
+// secret is the RFC 6238 SHA1 test key "12345678901234567890", base32 encoded
+const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestCode checks codes against the RFC 6238 test vectors, which are 8 digits, so only the last 6 are
+// compared
+func TestCode(t *testing.T) {
+	cases := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, c := range cases {
+		got, err := totp.Code(secret, time.Unix(c.unix, 0))
+		if err != nil {
+			t.Fatalf("totp.Code() err = %s", err)
+		}
+		if got != c.want[2:] {
+			t.Errorf("totp.Code(%d) = %s, want %s", c.unix, got, c.want[2:])
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	c, err := totp.Code(secret, now)
+	if err != nil {
+		t.Fatalf("totp.Code() err = %s", err)
+	}
+
+	step, ok := totp.Validate(secret, c, now)
+	if !ok {
+		t.Fatalf("totp.Validate() ok = false, want true")
+	}
+	if step != totp.Counter(now) {
+		t.Errorf("totp.Validate() step = %d, want %d", step, totp.Counter(now))
+	}
+
+	// one step of drift is allowed, either way
+	if _, ok := totp.Validate(secret, c, now.Add(30*time.Second)); !ok {
+		t.Errorf("totp.Validate() next step ok = false, want true")
+	}
+	if _, ok := totp.Validate(secret, c, now.Add(-30*time.Second)); !ok {
+		t.Errorf("totp.Validate() previous step ok = false, want true")
+	}
+	if _, ok := totp.Validate(secret, c, now.Add(90*time.Second)); ok {
+		t.Errorf("totp.Validate() 3 steps later ok = true, want false")
+	}
+	if _, ok := totp.Validate(secret, "123", now); ok {
+		t.Errorf("totp.Validate() short code ok = true, want false")
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	s, err := totp.NewSecret()
+	if err != nil {
+		t.Fatalf("totp.NewSecret() err = %s", err)
+	}
+	if len(s) != 32 {
+		t.Errorf("totp.NewSecret() len = %d, want 32", len(s))
+	}
+	if _, err := totp.Code(s, time.Now()); err != nil {
+		t.Errorf("totp.Code() err = %s", err)
+	}
+}
+
+func TestURI(t *testing.T) {
+	got := totp.URI("MappCPD", "admin", secret)
+	want := "otpauth://totp/MappCPD:admin?"
+	if !strings.HasPrefix(got, want) {
+		t.Errorf("totp.URI() = %s, want prefix %s", got, want)
+	}
+	if !strings.Contains(got, "secret="+secret) {
+		t.Errorf("totp.URI() = %s, want secret %s", got, secret)
+	}
+}
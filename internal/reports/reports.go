@@ -35,6 +35,7 @@ func ReportPointsByRecordDate(ds datastore.Datastore) (map[string]float32, error
 	sql := `SELECT DATE_FORMAT(created_at, '%Y-%m') as 'Date',
   		SUM(quantity * points_per_unit) AS 'Points'
 		FROM ce_m_activity
+		WHERE deleted_at IS NULL
 		GROUP BY Year(created_at), Month(created_at)
 		ORDER BY Year(created_at), Month(created_at);`
 	rows, err := ds.MySQL.Session.Query(sql)
@@ -62,6 +63,7 @@ func ReportPointsByActivityDate(ds datastore.Datastore) (map[string]float32, err
 	sql := `SELECT DATE_FORMAT(activity_on, '%Y-%m') as 'Date',
   		SUM(quantity * points_per_unit) AS 'Points'
 		FROM ce_m_activity
+		WHERE deleted_at IS NULL
 		GROUP BY Year(activity_on), Month(created_at)
 		ORDER BY Year(activity_on), Month(created_at);`
 	rows, err := ds.MySQL.Session.Query(sql)
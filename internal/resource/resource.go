@@ -380,32 +380,27 @@ func (r *Resource) Add(ds datastore.Datastore) (int, error) {
 		`created_at, updated_at, presented_on, presented_year, presented_month, presented_date,
 		name, description, keywords,
 		resource_url, short_url, thumbnail_url, attributes)
-		VALUES (%v, %v, %v,
-		"%v", "%v", "%v", "%v", "%v", "%v",
-		"%v", "%v", "%v",
-		"%v", "%v", "%v", "%v")`
+		VALUES (?, ?, ?,
+		?, ?, ?, ?, ?, ?,
+		?, ?, ?,
+		?, ?, ?, ?)`
 
 	// Create comma separated keyword list for MySQL field from r.Keywords []string
 	keywords := strings.Join(r.Keywords, ",")
 
 	// Marshall the Attributes field to a string for MySQL
-	// The ugly strings.Replace() below is to be able to insert string literal JSON
-	// into ol_resource.attributes in MySQL.
-	// To store the JSON as a string, eg {"free": true, "public": true, "source": "Pubmed"}
-	// it needs to be escaped for the INSERT, thus:
-	// {\"free\": true, \"public\": true, \"source\": \"Pubmed\"}
 	attributes := ""
 	xb, err := json.Marshal(r.Attributes)
 	if err != nil {
 		log.Println("Could not marshal attributes prior to insert - ignoring attributes completely")
 	} else {
-		attributes = strings.Replace(string(xb), "\"", "\\\"", -1)
+		attributes = string(xb)
 	}
 
 	r.CreatedAt = time.Now()
 	r.UpdatedAt = time.Now()
 
-	query = fmt.Sprintf(query, r.TypeID, 1, r.Primary,
+	res, err := ds.MySQL.Session.Exec(query, r.TypeID, 1, r.Primary,
 		r.CreatedAt.Format("2006-01-02 15:04:05"),
 		r.UpdatedAt.Format("2006-01-02 15:04:05"),
 		r.PubDate.Date.Format("2006-01-02"),
@@ -414,8 +409,6 @@ func (r *Resource) Add(ds datastore.Datastore) (int, error) {
 		r.PubDate.Day,
 		r.Name, r.Description, keywords,
 		r.ResourceURL, r.ShortURL, r.ThumbnailURL, attributes)
-
-	res, err := ds.MySQL.Session.Exec(query)
 	if err != nil {
 		msg := fmt.Sprintf("Error with query: %s\nError: %s", query, err)
 		return 0, errors.New(msg)
@@ -441,18 +434,18 @@ func (r *Resource) Add(ds datastore.Datastore) (int, error) {
 func (r *Resource) Update(ds datastore.Datastore, id int) error {
 
 	// Only difference with Save() query is that created_at is not included
-	query := "UPDATE ol_resource SET ol_resource_type_id = %v, active = %v, `primary` = %v," +
-		`updated_at = "%v", presented_on = "%v", presented_year = "%v", presented_month = "%v", presented_date = "%v",
-		name = "%v", description= "%v", keywords= "%v",
-		resource_url = "%v", short_url = "%v", thumbnail_url = "%v"
-		WHERE id = %v`
+	query := "UPDATE ol_resource SET ol_resource_type_id = ?, active = ?, `primary` = ?," +
+		`updated_at = ?, presented_on = ?, presented_year = ?, presented_month = ?, presented_date = ?,
+		name = ?, description= ?, keywords= ?,
+		resource_url = ?, short_url = ?, thumbnail_url = ?
+		WHERE id = ?`
 
 	// Create comma separated keyword list for MySQL field from r.Keywords []string
 	keywords := strings.Join(r.Keywords, ",")
 
 	r.UpdatedAt = time.Now()
 
-	query = fmt.Sprintf(query, r.TypeID, 1, r.Primary,
+	_, err := ds.MySQL.Session.Exec(query, r.TypeID, 1, r.Primary,
 		r.UpdatedAt.Format("2006-01-02 15:04:05"),
 		r.PubDate.Date.Format("2006-01-02"),
 		r.PubDate.Year,
@@ -461,8 +454,6 @@ func (r *Resource) Update(ds datastore.Datastore, id int) error {
 		r.Name, r.Description, keywords,
 		r.ResourceURL, r.ShortURL, r.ThumbnailURL,
 		id)
-
-	_, err := ds.MySQL.Session.Exec(query)
 	if err != nil {
 		fmt.Println("Query error:")
 		return err
@@ -531,9 +522,9 @@ func (r *Resource) SetShortURL(ds datastore.Datastore) error {
 
 	// Finally, update the ol_resource.short_url value
 	shortUrl := os.Getenv("MAPPCPD_SHORT_LINK_URL") + "/" + os.Getenv("MAPPCPD_SHORT_LINK_PREFIX") + strconv.Itoa(r.ID)
-	query := fmt.Sprintf("UPDATE ol_resource SET short_url = \"%v\" WHERE id = %v", shortUrl, r.ID)
-	fmt.Println("SetShortLinkURL():", query)
-	_, err = ds.MySQL.Session.Exec(query)
+	query := "UPDATE ol_resource SET short_url = ? WHERE id = ?"
+	fmt.Println("SetShortLinkURL():", shortUrl, r.ID)
+	_, err = ds.MySQL.Session.Exec(query, shortUrl, r.ID)
 	if err != nil {
 		fmt.Println("SQL error with query: ", query, " -", err)
 		return err
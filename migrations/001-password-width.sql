@@ -0,0 +1,17 @@
+-- Widens the password columns to hold bcrypt hashes (60 characters), and wrapped
+-- MD5 hashes (63 characters), see internal/auth/password.go. With the old width of
+-- VARCHAR(45) the hash written on login is rejected in strict mode, or truncated
+-- otherwise, which locks the user out.
+--
+-- member.password is already VARCHAR(100) in the current schema, check with:
+--   SELECT table_name, column_name, character_maximum_length
+--   FROM information_schema.columns
+--   WHERE table_schema = DATABASE() AND column_name = 'password'
+--     AND table_name IN ('ad_user', 'member');
+-- and run the second statement if it is narrower than 100.
+
+ALTER TABLE `ad_user`
+  MODIFY `password` VARCHAR(100) NOT NULL COMMENT 'Admin user\'s password, stored as a bcrypt hash. Legacy MD5 hashes are upgraded on login.';
+
+-- ALTER TABLE `member`
+--   MODIFY `password` VARCHAR(100) NOT NULL COMMENT 'Password is stored as a bcrypt hash. Legacy MD5 hashes are upgraded on login.';
@@ -0,0 +1,19 @@
+-- Creates the log of requests made by an admin viewing the member system as a
+-- member, see internal/auth/impersonation.go. Every such request is logged, and
+-- is refused if it cannot be, so impersonation fails until it exists.
+
+CREATE TABLE IF NOT EXISTS `log_impersonation` (
+  `id` INT NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Time of the request',
+  `ad_user_id` INT NOT NULL COMMENT 'The admin user viewing the system as the member.',
+  `member_id` INT NOT NULL COMMENT 'The member being impersonated.',
+  `jti` VARCHAR(64) NOT NULL COMMENT 'The id (jti claim) of the impersonation token.',
+  `method` VARCHAR(10) NOT NULL COMMENT 'The http method of the request.',
+  `path` VARCHAR(255) NOT NULL COMMENT 'The path of the request.',
+  `ip` VARCHAR(45) NOT NULL COMMENT 'The ip address of the client that made the request.',
+  PRIMARY KEY (`id`),
+  INDEX `ad_user_id` (`ad_user_id` ASC),
+  INDEX `member_id` (`member_id` ASC),
+  INDEX `jti` (`jti` ASC))
+  ENGINE = InnoDB
+  COMMENT = 'Audit log of every request made by an admin viewing the system as a member, including the request that issued the token.';
@@ -0,0 +1,19 @@
+-- Tracks changes to the member tables in history.MemberTables. Member history is
+-- only recorded for tables listed in log_data_table, and the api logs a warning
+-- for each member table that is not listed. Tables that are already listed are
+-- left as they are, so this can be run more than once.
+
+INSERT INTO `log_data_table` (`active`, `created_at`, `updated_at`, `table_name`)
+SELECT 1, NOW(), NOW(), t.table_name
+FROM (
+  SELECT 'member' AS table_name
+  UNION SELECT 'mp_m_accreditation'
+  UNION SELECT 'mp_m_contact'
+  UNION SELECT 'mp_m_position'
+  UNION SELECT 'mp_m_qualification'
+  UNION SELECT 'mp_m_speciality'
+  UNION SELECT 'mp_m_tag'
+  UNION SELECT 'ms_m_status'
+  UNION SELECT 'ms_m_title'
+) t
+WHERE NOT EXISTS (SELECT 1 FROM `log_data_table` l WHERE l.table_name = t.table_name);
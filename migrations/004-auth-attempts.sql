@@ -0,0 +1,18 @@
+-- Creates the log of login attempts, which is used to throttle repeated failures
+-- for a login or from an ip address, see internal/auth/throttle.go. Every admin
+-- and member login, and every admin authentication code, writes to this table, so
+-- logins fail until it exists.
+
+CREATE TABLE IF NOT EXISTS `log_auth_attempt` (
+  `id` INT NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Time of the attempt',
+  `user_type` VARCHAR(20) NOT NULL COMMENT 'Defines if the login was for an \'admin\' or \'member\'.',
+  `login` VARCHAR(100) NOT NULL COMMENT 'The username or email address that was presented.',
+  `ip` VARCHAR(45) NOT NULL COMMENT 'The ip address of the client that made the attempt.',
+  `result` ENUM('success','failure','denied','throttled','unlock') NOT NULL COMMENT 'Outcome of the attempt. Denied means the credentials were correct but the account is inactive or locked. Unlock records an admin clearing a lockout.',
+  `ad_user_id` INT NULL COMMENT 'The admin user that performed an unlock.',
+  PRIMARY KEY (`id`),
+  INDEX `user_type_login` (`user_type` ASC, `login` ASC),
+  INDEX `ip` (`ip` ASC))
+  ENGINE = InnoDB
+  COMMENT = 'Audit log of every login attempt, also used to throttle repeated failures.';
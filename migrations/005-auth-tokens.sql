@@ -0,0 +1,35 @@
+-- Creates the tables for refresh tokens and revoked access tokens, see
+-- internal/auth/token.go. Every admin and member login issues a refresh token,
+-- and every request checks the access token against auth_revocation, so logins
+-- fail until they exist.
+
+CREATE TABLE IF NOT EXISTS `auth_refresh_token` (
+  `id` INT NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Record created',
+  `expires_at` TIMESTAMP NOT NULL COMMENT 'Time after which the refresh token can no longer be used.',
+  `revoked_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Time the token was used, or revoked by a logout. A refresh token can only be used once.',
+  `replaced_by_id` INT NULL COMMENT 'The refresh token that was issued when this one was used.',
+  `user_type` VARCHAR(20) NOT NULL COMMENT 'Defines if the user is an \'admin\' or \'member\'.',
+  `user_id` INT NOT NULL COMMENT 'The id of the admin or member.',
+  `mfa` TINYINT NOT NULL DEFAULT 0 COMMENT 'Set if the user verified a second factor at login, carried over to refreshed access tokens.',
+  `token_hash` CHAR(64) NOT NULL COMMENT 'SHA-256 hash of the refresh token, the token itself is not stored.',
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `token_hash_UNIQUE` (`token_hash` ASC),
+  INDEX `user_type_user_id` (`user_type` ASC, `user_id` ASC))
+  ENGINE = InnoDB
+  COMMENT = 'Opaque refresh tokens used to obtain new short-lived access tokens.';
+
+
+CREATE TABLE IF NOT EXISTS `auth_revocation` (
+  `id` INT NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Record created',
+  `expires_at` TIMESTAMP NOT NULL COMMENT 'Time after which the revoked tokens have expired anyway, and the record can be removed.',
+  `jti` VARCHAR(64) NULL COMMENT 'The id (jti claim) of a single revoked access token.',
+  `user_type` VARCHAR(20) NOT NULL COMMENT 'Defines if the user is an \'admin\' or \'member\'.',
+  `user_id` INT NOT NULL COMMENT 'The id of the admin or member.',
+  `issued_before` TIMESTAMP(3) NULL DEFAULT NULL COMMENT 'If set, all access tokens for the user issued before this time are revoked.',
+  PRIMARY KEY (`id`),
+  INDEX `jti` (`jti` ASC),
+  INDEX `user_type_user_id` (`user_type` ASC, `user_id` ASC))
+  ENGINE = InnoDB
+  COMMENT = 'Revoked access tokens, checked when validating a token.';
@@ -0,0 +1,18 @@
+-- Creates the table of single-use member tokens, for password resets and email
+-- address changes, see internal/auth/member_token.go. The password reset and
+-- email change endpoints fail until it exists.
+
+CREATE TABLE IF NOT EXISTS `auth_member_token` (
+  `id` INT NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Record created',
+  `expires_at` TIMESTAMP NOT NULL COMMENT 'Time after which the token can no longer be used.',
+  `used_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Time the token was used, or cancelled by a newer token. A token can only be used once.',
+  `purpose` ENUM('reset', 'verify') NOT NULL COMMENT 'A \'reset\' token sets a new password, a \'verify\' token confirms a change of primary email.',
+  `member_id` INT NOT NULL COMMENT 'The member to whom the token was issued.',
+  `token_hash` CHAR(64) NOT NULL COMMENT 'Hex encoded sha256 hash of the token, the token itself is never stored.',
+  `email` VARCHAR(100) NOT NULL DEFAULT '' COMMENT 'For a \'verify\' token, the new primary email that is set when the token is used.',
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `token_hash_UNIQUE` (`token_hash` ASC),
+  INDEX `member_id_purpose` (`member_id` ASC, `purpose` ASC))
+  ENGINE = InnoDB
+  COMMENT = 'Single-use tokens emailed to members to reset a password or verify a new email address.';
@@ -0,0 +1,26 @@
+-- Creates the tables for admin two-factor authentication, see internal/auth/mfa.go.
+-- Every admin login checks ad_user_mfa for an enrolled authenticator, so admin
+-- logins fail until these exist.
+
+CREATE TABLE IF NOT EXISTS `ad_user_mfa` (
+  `ad_user_id` INT NOT NULL COMMENT 'The admin user that enrolled the authenticator.',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Record created',
+  `updated_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Record last updated',
+  `enabled_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Time enrolment was confirmed with a valid code. Two-factor authentication is not required until this is set.',
+  `secret` VARCHAR(64) NOT NULL COMMENT 'Base32 encoded TOTP secret (RFC 6238) shared with the authenticator app.',
+  `last_step` BIGINT NOT NULL DEFAULT 0 COMMENT 'Time step of the last code used, codes for this or an earlier step are rejected so they cannot be replayed.',
+  PRIMARY KEY (`ad_user_id`))
+  ENGINE = InnoDB
+  COMMENT = 'TOTP authenticators enrolled by admin users for two-factor authentication.';
+
+
+CREATE TABLE IF NOT EXISTS `ad_user_recovery_code` (
+  `id` INT NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
+  `ad_user_id` INT NOT NULL COMMENT 'The admin user to whom the code was issued.',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Record created',
+  `used_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Time the code was used, each code can only be used once.',
+  `code_hash` CHAR(64) NOT NULL COMMENT 'SHA-256 hash of the recovery code, the code itself is not stored.',
+  PRIMARY KEY (`id`),
+  INDEX `ad_user_id` (`ad_user_id` ASC))
+  ENGINE = InnoDB
+  COMMENT = 'Single-use recovery codes that can be used in place of a TOTP code if an admin loses their authenticator.';
@@ -0,0 +1,73 @@
+-- Creates the grants of permissions to admin roles, and adds the permissions that
+-- are now checked for each admin route, see internal/auth/permission.go. An admin
+-- token carries the permissions of the admin's role, plus any granted individually
+-- in ad_user_permission, and admin requests are refused until this has been run.
+--
+-- So that no admin loses access, every existing role, and the role of every
+-- existing admin user, is granted all of the permissions. Narrower roles are added
+-- alongside them, move admin users into these, or restrict the existing roles,
+-- as required. Run this file once: a second run would grant every permission to
+-- the new roles as well.
+
+CREATE TABLE IF NOT EXISTS `acl_admin_role_permission` (
+  `id` INT(11) NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
+  `acl_admin_role_id` INT(11) NOT NULL COMMENT 'The role that is granted the permission.',
+  `ad_permission_id` INT(11) NOT NULL COMMENT 'The permission granted to all admin users in the role.',
+  `active` TINYINT(1) NOT NULL DEFAULT '1' COMMENT 'Soft delete',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Record created',
+  `updated_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Record updated',
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `acl_admin_role_permission_UNIQUE` (`acl_admin_role_id` ASC, `ad_permission_id` ASC))
+  ENGINE = InnoDB
+  COMMENT = 'Permissions granted to admin roles. An admin user has the permissions of their role plus any granted individually in ad_user_permission.';
+
+INSERT INTO `ad_permission` (`active`, `created_at`, `updated_at`, `name`, `description`)
+SELECT 1, NOW(), NOW(), v.name, v.description FROM (
+  SELECT 'members:read' AS name, 'Search and view member records and notes.' AS description
+  UNION ALL SELECT 'members:write', 'Create membership applications and add note attachments.'
+  UNION ALL SELECT 'members:lapse', 'Lapse member records.'
+  UNION ALL SELECT 'notifications:send', 'Send email notifications to members.'
+  UNION ALL SELECT 'reports:members', 'Download member, application, journal and position reports.'
+  UNION ALL SELECT 'reports:finance', 'Download invoice and payment reports.'
+  UNION ALL SELECT 'resources:write', 'Add resources and resource attachments.'
+  UNION ALL SELECT 'admin:users', 'Unlock admin and member logins.'
+) v
+WHERE NOT EXISTS (SELECT 1 FROM `ad_permission` p WHERE p.name = v.name);
+
+-- Existing roles, and the roles of existing admin users, keep full access
+INSERT IGNORE INTO `acl_admin_role_permission` (`acl_admin_role_id`, `ad_permission_id`)
+SELECT r.id, p.id FROM (
+  SELECT id FROM `acl_admin_role`
+  UNION SELECT acl_admin_role_id FROM `ad_user`
+) r, `ad_permission` p
+WHERE p.name IN ('members:read', 'members:write', 'members:lapse', 'notifications:send',
+                 'reports:members', 'reports:finance', 'resources:write', 'admin:users');
+
+-- Narrower roles, acl_admin_role.id is not an auto increment column
+INSERT INTO `acl_admin_role` (`id`, `active`, `is_default`, `created_at`, `updated_at`, `name`, `description`)
+SELECT COALESCE(MAX(id), 0) + 1, 1, 0, NOW(), NOW(), 'Finance', 'Member records and financial reports.'
+FROM `acl_admin_role`
+WHERE NOT EXISTS (SELECT 1 FROM `acl_admin_role` WHERE name = 'Finance');
+
+INSERT INTO `acl_admin_role` (`id`, `active`, `is_default`, `created_at`, `updated_at`, `name`, `description`)
+SELECT COALESCE(MAX(id), 0) + 1, 1, 0, NOW(), NOW(), 'Membership Officer', 'Member records, applications, lapsing and notifications.'
+FROM `acl_admin_role`
+WHERE NOT EXISTS (SELECT 1 FROM `acl_admin_role` WHERE name = 'Membership Officer');
+
+INSERT INTO `acl_admin_role` (`id`, `active`, `is_default`, `created_at`, `updated_at`, `name`, `description`)
+SELECT COALESCE(MAX(id), 0) + 1, 1, 0, NOW(), NOW(), 'CPD Officer', 'Member records, CPD resources and member reports.'
+FROM `acl_admin_role`
+WHERE NOT EXISTS (SELECT 1 FROM `acl_admin_role` WHERE name = 'CPD Officer');
+
+INSERT INTO `acl_admin_role` (`id`, `active`, `is_default`, `created_at`, `updated_at`, `name`, `description`)
+SELECT COALESCE(MAX(id), 0) + 1, 1, 0, NOW(), NOW(), 'Read Only', 'View member records only.'
+FROM `acl_admin_role`
+WHERE NOT EXISTS (SELECT 1 FROM `acl_admin_role` WHERE name = 'Read Only');
+
+INSERT IGNORE INTO `acl_admin_role_permission` (`acl_admin_role_id`, `ad_permission_id`)
+SELECT r.id, p.id FROM `acl_admin_role` r, `ad_permission` p
+WHERE (r.name = 'Finance' AND p.name IN ('members:read', 'reports:members', 'reports:finance'))
+   OR (r.name = 'Membership Officer' AND p.name IN ('members:read', 'members:write', 'members:lapse',
+                                                    'notifications:send', 'reports:members'))
+   OR (r.name = 'CPD Officer' AND p.name IN ('members:read', 'reports:members', 'resources:write'))
+   OR (r.name = 'Read Only' AND p.name = 'members:read');
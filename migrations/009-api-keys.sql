@@ -0,0 +1,30 @@
+-- Creates the table of API keys for service accounts, such as the worker
+-- services, see internal/auth/apikey.go, and adds the admin:apikeys permission to
+-- manage them. The permission is granted to the roles that can manage admin users.
+
+CREATE TABLE IF NOT EXISTS `auth_api_key` (
+  `id` INT NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Record created',
+  `expires_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Time after which the key can no longer be used, NULL if the key does not expire.',
+  `last_used_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Time the key was last used, to the nearest minute.',
+  `revoked_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Time the key was revoked, or replaced when it was rotated.',
+  `replaced_by_id` INT NULL COMMENT 'The key that was issued when this one was rotated.',
+  `name` VARCHAR(100) NOT NULL COMMENT 'Name of the service account that uses the key, e.g. pubmedr.',
+  `hint` VARCHAR(16) NOT NULL COMMENT 'The first few characters of the key, to help identify it.',
+  `key_hash` CHAR(64) NOT NULL COMMENT 'SHA-256 hash of the key, the key itself is not stored.',
+  `scopes` VARCHAR(1000) NOT NULL COMMENT 'Comma-separated admin permissions granted to the key, e.g. resources:write.',
+  `ad_user_id` INT NOT NULL COMMENT 'The admin user that created or last rotated the key.',
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `key_hash_UNIQUE` (`key_hash` ASC))
+  ENGINE = InnoDB
+  COMMENT = 'API keys for service accounts, such as the worker services, that are used in place of an admin login.';
+
+INSERT INTO `ad_permission` (`active`, `created_at`, `updated_at`, `name`, `description`)
+SELECT 1, NOW(), NOW(), 'admin:apikeys', 'Create, rotate and revoke API keys for service accounts.'
+FROM DUAL
+WHERE NOT EXISTS (SELECT 1 FROM `ad_permission` WHERE name = 'admin:apikeys');
+
+INSERT IGNORE INTO `acl_admin_role_permission` (`acl_admin_role_id`, `ad_permission_id`)
+SELECT rp.acl_admin_role_id, p.id FROM `acl_admin_role_permission` rp
+  JOIN `ad_permission` u ON u.id = rp.ad_permission_id AND u.name = 'admin:users'
+  JOIN `ad_permission` p ON p.name = 'admin:apikeys';
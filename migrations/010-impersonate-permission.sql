@@ -0,0 +1,13 @@
+-- Adds the permission to view the member system as a member, which is required
+-- by POST /v1/a/members/{id}/impersonation. It is granted to the roles that can
+-- manage admin users, grant it to other roles or admin users as required.
+
+INSERT INTO `ad_permission` (`active`, `created_at`, `updated_at`, `name`, `description`)
+SELECT 1, NOW(), NOW(), 'members:impersonate', 'View the member system as a member.'
+FROM DUAL
+WHERE NOT EXISTS (SELECT 1 FROM `ad_permission` WHERE name = 'members:impersonate');
+
+INSERT IGNORE INTO `acl_admin_role_permission` (`acl_admin_role_id`, `ad_permission_id`)
+SELECT rp.acl_admin_role_id, p.id FROM `acl_admin_role_permission` rp
+  JOIN `ad_permission` u ON u.id = rp.ad_permission_id AND u.name = 'admin:users'
+  JOIN `ad_permission` p ON p.name = 'members:impersonate';
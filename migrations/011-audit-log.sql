@@ -0,0 +1,44 @@
+-- Creates the audit log of mutating requests made to the api, see
+-- internal/audit, and adds the audit:read permission to search it. A request that
+-- cannot be recorded is still handled, so changes are not audited until these
+-- exist. The permission is granted to the roles that can manage admin users.
+
+CREATE TABLE IF NOT EXISTS `log_audit` (
+  `id` INT NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Time of the request',
+  `actor_id` INT NOT NULL COMMENT 'The id of the admin, member or API key that made the request.',
+  `actor_name` VARCHAR(255) NOT NULL COMMENT 'The name of the actor when the request was made.',
+  `role` VARCHAR(20) NOT NULL COMMENT 'The role in the token, \'admin\', \'member\' or \'service\'.',
+  `ad_user_id` INT NULL COMMENT 'The admin that made the request while viewing the system as the member.',
+  `method` VARCHAR(10) NOT NULL COMMENT 'The http method of the request.',
+  `path` VARCHAR(255) NOT NULL COMMENT 'The path of the request.',
+  `body_digest` CHAR(64) NOT NULL COMMENT 'SHA-256 digest of the request body.',
+  `status` SMALLINT NOT NULL COMMENT 'The http status of the response.',
+  `ip` VARCHAR(45) NOT NULL COMMENT 'The ip address of the client that made the request.',
+  PRIMARY KEY (`id`),
+  INDEX `role_actor_id` (`role` ASC, `actor_id` ASC),
+  INDEX `created_at` (`created_at` ASC))
+  ENGINE = InnoDB
+  COMMENT = 'Audit log of every mutating request made to the admin and member endpoints.';
+
+
+CREATE TABLE IF NOT EXISTS `log_audit_entity` (
+  `id` INT NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
+  `log_audit_id` INT NOT NULL COMMENT 'The audited request.',
+  `entity` VARCHAR(50) NOT NULL COMMENT 'The type of record targeted by the request, eg \'members\'.',
+  `entity_id` INT NOT NULL COMMENT 'The id of the record targeted by the request.',
+  PRIMARY KEY (`id`),
+  INDEX `log_audit_id` (`log_audit_id` ASC),
+  INDEX `entity_entity_id` (`entity` ASC, `entity_id` ASC))
+  ENGINE = InnoDB
+  COMMENT = 'Records targeted by an audited request, one row for each.';
+
+INSERT INTO `ad_permission` (`active`, `created_at`, `updated_at`, `name`, `description`)
+SELECT 1, NOW(), NOW(), 'audit:read', 'Search and download the audit log of changes made through the api.'
+FROM DUAL
+WHERE NOT EXISTS (SELECT 1 FROM `ad_permission` WHERE name = 'audit:read');
+
+INSERT IGNORE INTO `acl_admin_role_permission` (`acl_admin_role_id`, `ad_permission_id`)
+SELECT rp.acl_admin_role_id, p.id FROM `acl_admin_role_permission` rp
+  JOIN `ad_permission` u ON u.id = rp.ad_permission_id AND u.name = 'admin:users'
+  JOIN `ad_permission` p ON p.name = 'audit:read';
@@ -0,0 +1,7 @@
+-- Adds deleted_at to ce_m_activity, for cpd records deleted by the member, see
+-- internal/cpd. A deleted record can be restored for cpd.RetentionDays, after
+-- which it is removed by fixr -t "purgeActivities". Every cpd query checks this
+-- column, so cpd records cannot be read or written until it exists.
+
+ALTER TABLE `ce_m_activity`
+  ADD COLUMN `deleted_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Deleted by the member, and can be restored until it is purged. NULL if not deleted.' AFTER `description`;
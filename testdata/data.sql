@@ -28,13 +28,30 @@ INSERT INTO `%s`.`a_name_prefix` VALUES
 
 -- insert-data-acl_admin_resource
 
--- insert-data-acl_admin_role
+-- name: insert-data-acl_admin_role
+INSERT INTO `%s`.`acl_admin_role` VALUES
+  (1, 1, 1, NOW(), NOW(), 'Administrator', 'Full access to all admin functions.'),
+  (2, 1, 0, NOW(), NOW(), 'Finance', 'Member records and financial reports.'),
+  (3, 1, 0, NOW(), NOW(), 'Membership Officer', 'Member records, applications, lapsing and notifications.'),
+  (4, 1, 0, NOW(), NOW(), 'CPD Officer', 'Member records, CPD resources and member reports.'),
+  (5, 1, 0, NOW(), NOW(), 'Read Only', 'View member records only.');
+
+-- name: insert-data-acl_admin_role_permission
+INSERT INTO `%s`.`acl_admin_role_permission` (`acl_admin_role_id`, `ad_permission_id`) VALUES
+  (1, 1), (1, 2), (1, 3), (1, 4), (1, 5), (1, 6), (1, 7), (1, 8), (1, 9), (1, 10), (1, 11),
+  (2, 1), (2, 5), (2, 6),
+  (3, 1), (3, 2), (3, 3), (3, 4), (3, 5),
+  (4, 1), (4, 5), (4, 7),
+  (5, 1);
 
 -- insert-data-acl_admin_role_resource
 
 -- insert-data-acl_member_resource
 
--- insert-data-acl_member_role
+-- name: insert-data-acl_member_role
+INSERT INTO `%s`.`acl_member_role` (`id`,`active`,`is_default`,`created_at`,`updated_at`,`name`,`description`) VALUES
+  (1,1,0,NOW(),NOW(),'Restricted','Members that cannot log in'),
+  (2,1,1,NOW(),NOW(),'Member','Members with access to the member system');
 
 -- insert-data-acl_member_role_resource
 
@@ -42,7 +59,19 @@ INSERT INTO `%s`.`a_name_prefix` VALUES
 
 -- insert-data-ad_macro_transaction
 
--- insert-data-ad_permission
+-- name: insert-data-ad_permission
+INSERT INTO `%s`.`ad_permission` VALUES
+  (1, 1, NOW(), NOW(), 'members:read', 'Search and view member records and notes.'),
+  (2, 1, NOW(), NOW(), 'members:write', 'Create membership applications and add note attachments.'),
+  (3, 1, NOW(), NOW(), 'members:lapse', 'Lapse member records.'),
+  (4, 1, NOW(), NOW(), 'notifications:send', 'Send email notifications to members.'),
+  (5, 1, NOW(), NOW(), 'reports:members', 'Download member, application, journal and position reports.'),
+  (6, 1, NOW(), NOW(), 'reports:finance', 'Download invoice and payment reports.'),
+  (7, 1, NOW(), NOW(), 'resources:write', 'Add resources and resource attachments.'),
+  (8, 1, NOW(), NOW(), 'admin:users', 'Unlock admin and member logins.'),
+  (9, 1, NOW(), NOW(), 'admin:apikeys', 'Create, rotate and revoke API keys for service accounts.'),
+  (10, 1, NOW(), NOW(), 'audit:read', 'Search and download the audit log of changes made through the api.'),
+  (11, 1, NOW(), NOW(), 'members:impersonate', 'View the member system as a member.');
 
 -- name: insert-data-ad_user
 INSERT INTO `%s`.`ad_user` VALUES
@@ -136,16 +165,19 @@ INSERT INTO `%s`.`ce_evaluation` VALUES
 
 -- name: insert-data-ce_m_activity
 INSERT INTO `%s`.`ce_m_activity` VALUES
-  (1, 1, 23, 25, NULL, NULL, 1, 1, NOW(), NOW(), '2018-02-03', 1.00, 1.00, 0, 'BJJ like Bruno Malfacine'),
-  (2, 1, 23, 25, NULL, NULL, 1, 0, NOW(), NOW(), '2018-02-04', 1.00, 1.00, 0, 'Ate sausages and eggs'),
-  (3, 1, 20, 1, NULL, NULL, 1, 0, NOW(), NOW(), '2018-02-05', 1.00, 3.00, 0, 'Baked bread');
+  (1, 1, 23, 25, NULL, NULL, 1, 1, NOW(), NOW(), '2018-02-03', 1.00, 1.00, 0, 'BJJ like Bruno Malfacine', NULL),
+  (2, 1, 23, 25, NULL, NULL, 1, 0, NOW(), NOW(), '2018-02-04', 1.00, 1.00, 0, 'Ate sausages and eggs', NULL),
+  (3, 1, 20, 1, NULL, NULL, 1, 0, NOW(), NOW(), '2018-02-05', 1.00, 3.00, 0, 'Baked bread', NULL),
+  (4, 1, 20, 1, NULL, NULL, 1, 0, NOW(), NOW(), '2018-02-06', 1.00, 3.00, 0, 'Deleted long ago', '2018-03-01 10:00:00');
 
 -- name: insert-data-ce_m_activity_attachment
 INSERT INTO `%s`.`ce_m_activity_attachment` VALUES
   (74, 247, 4, 1, '2018-02-06 00:04:35', '2018-02-06 00:04:35', 'Derwent1.png', '04abe653d926a3ccb122245671e6c064.png'),
   (75, 247, 4, 1, '2018-02-06 00:05:17', '2018-02-06 00:05:17', 'headerbg.jpg', '5886e6ab4b3b7b71ad112e56ef65ed66.jpg'),
   (77, 250, 4, 1, '2018-02-06 01:18:08', '2018-02-06 01:18:08', 'Derwent1.png', '04abe653d926a3ccb122245671e6c064.png'),
-  (78, 249, 4, 1, '2018-02-06 02:55:29', '2018-02-06 02:55:29', 'Derwent1.png', '04abe653d926a3ccb122245671e6c064.png');
+  (78, 249, 4, 1, '2018-02-06 02:55:29', '2018-02-06 02:55:29', 'Derwent1.png', '04abe653d926a3ccb122245671e6c064.png'),
+  (79, 4, 4, 1, '2018-02-07 09:12:44', '2018-02-07 09:12:44', 'bread.jpg', '9b1e4f3a0c2d45e8b7f6a1c3d5e7f9a2.jpg'),
+  (80, 1, 4, 1, '2018-02-04 08:30:12', '2018-02-04 08:30:12', 'belt.pdf', '3c7d2a9e5b1f48d6a0e4c8b2f6d1a3e5.pdf');
 
 -- name: insert-data-ce_m_evaluation
 INSERT INTO `%s`.`ce_m_evaluation` VALUES
@@ -312,7 +344,17 @@ INSERT INTO `%s`.`fs_url` VALUES
 
 -- insert-data-log_data_field
 
--- insert-data-log_data_table
+-- name: insert-data-log_data_table
+INSERT INTO `%s`.`log_data_table` VALUES
+  (1, 1, NOW(), NOW(), 'member'),
+  (2, 1, NOW(), NOW(), 'mp_m_accreditation'),
+  (3, 1, NOW(), NOW(), 'mp_m_contact'),
+  (4, 1, NOW(), NOW(), 'mp_m_position'),
+  (5, 1, NOW(), NOW(), 'mp_m_qualification'),
+  (6, 1, NOW(), NOW(), 'mp_m_speciality'),
+  (7, 1, NOW(), NOW(), 'mp_m_tag'),
+  (8, 1, NOW(), NOW(), 'ms_m_status'),
+  (9, 1, NOW(), NOW(), 'ms_m_title');
 
 -- name: insert-data-member
 INSERT INTO `%s`.`member` VALUES
@@ -437,12 +479,15 @@ INSERT INTO `%s`.`ms_m_application_meeting` VALUES
 
 -- name: insert-data-ms_m_status
 INSERT INTO `%s`.`ms_m_status` VALUES
-  (1, 1, 1, 0, 1, 1, '2015-08-30 17:10:57', NOW(), NULL);
+  (1, 1, 10003, 0, 1, 0, '2014-06-01 09:30:00', '2014-07-01 10:00:00', 'Application received'),
+  (2, 1, 1, 0, 1, 0, '2014-07-01 10:00:00', '2015-03-01 08:00:00', NULL),
+  (3, 1, 10004, 0, 1, 0, '2015-03-01 08:00:00', '2015-08-30 17:10:57', 'Subscription unpaid'),
+  (4, 1, 1, 0, 1, 1, '2015-08-30 17:10:57', NOW(), NULL);
 
 -- name: insert-data-ms_m_title
 INSERT INTO `%s`.`ms_m_title` VALUES
-  (1, 1, 2, NULL, 1, 1, '2015-08-30 17:10:57', NOW(), '2015-08-31',
-   'Test data does will not show historic titles');
+  (1, 1, 1, NULL, 1, 0, '2014-06-01 09:30:00', '2015-08-30 17:10:57', '2014-06-01', NULL),
+  (2, 1, 2, NULL, 1, 1, '2015-08-30 17:10:57', NOW(), '2015-08-31', NULL);
 
 
 -- insert-data-ms_permission
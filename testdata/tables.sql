@@ -7,7 +7,7 @@ CREATE TABLE IF NOT EXISTS `%s`.`ad_user` (
   `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Record created',
   `updated_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Record last updated',
   `username` VARCHAR(45) NOT NULL COMMENT 'admin user\'s username',
-  `password` VARCHAR(45) NOT NULL COMMENT 'Admin user\'s password',
+  `password` VARCHAR(100) NOT NULL COMMENT 'Admin user\'s password, stored as a bcrypt hash. Legacy MD5 hashes are upgraded on login.',
   `name` VARCHAR(100) NOT NULL COMMENT 'Admin user full name',
   `short_name` VARCHAR(16) NOT NULL COMMENT 'Short name is for display in lists, e.g. can use initials, first or nick name.',
   `email` VARCHAR(100) NULL COMMENT 'Contact email for admin - not used for anything at present but may be used for alerts etc.',
@@ -94,7 +94,7 @@ CREATE TABLE IF NOT EXISTS `%s`.`member` (
   `mobile_phone` VARCHAR(45) NULL COMMENT 'Mobile phone number.',
   `primary_email` VARCHAR(100) NULL COMMENT 'Primary email address, also used for authentication to the member system.',
   `secondary_email` VARCHAR(100) NULL COMMENT 'Secondary email is used in case the primary email become inactive or gets forgotten. The user can also login with this email.',
-  `password` VARCHAR(100) NOT NULL COMMENT 'Password is stored as an MD5 hash.',
+  `password` VARCHAR(100) NOT NULL COMMENT 'Password is stored as a bcrypt hash. Legacy MD5 hashes are upgraded on login.',
   `token` VARCHAR(45) NULL COMMENT 'A temporary authentication token used to log the user in via a link so they can reset their password. This token should be cleared immediately as part of the login process.',
   `journal_number` VARCHAR(45) NULL COMMENT 'Journal number is given to the member as a reference for their subscription to a primary journal publication. (This should move to an external table later)',
   `bpay_number` VARCHAR(45) NULL COMMENT 'BPay number is generated by admin and allocated for Australian members only - for direct deposit of funds. (This should move to an external table later)',
@@ -122,6 +122,7 @@ CREATE TABLE IF NOT EXISTS `%s`.`ce_m_activity` (
   `points_per_unit` DECIMAL(5,2) NOT NULL COMMENT 'Points for each unit is copied from the ce_activity definition table at the time the activity is recorded. This is in case the value for the activity is changed at some stage in the future.\n\nWe copy the current value from the ce_activity table each time a new activity is entered, or each time the evaluation period report is generated for an OPEN EP.\n\nFor a closed EP we will NOT reset this value so the historical values are maintained. \n\nThis means that the value for an activity MAY change over time for the user. This is part of the rules and the final value will be the current value at the time the EP is closed.',
   `annual_points_cap` SMALLINT NOT NULL DEFAULT 0 COMMENT 'Standardised (per year) points cap for the activity. As for points_per_unit we copy the current value from the ce_activity table each time a new activity is entered, or each time the evaluation period report is generated for an OPEN EP.\n\nFor a closed EP we will NOT reset this value so the historical values are maintained. \n\nIn both cases we can use ANY value for the same activity type (they should all be the same anyway) for the applications of caps. Yes, this is very redundant data BUT we decide was better to do it this way as it saved us managing a separate table for the same purpose.',
   `description` TEXT NULL COMMENT 'Optional descriptive text about the activity.',
+  `deleted_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Deleted by the member, and can be restored until it is purged. NULL if not deleted.',
   PRIMARY KEY (`id`))
   ENGINE = InnoDB
   COMMENT = 'A record of a particular CPD activity undertaken by a member.';
@@ -150,7 +151,7 @@ CREATE TABLE IF NOT EXISTS `%s`.`ad_permission` (
   `active` TINYINT(1) NOT NULL DEFAULT '1' COMMENT 'Soft delete.',
   `created_at` TIMESTAMP NOT NULL COMMENT 'Record created',
   `updated_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'record last updated',
-  `name` VARCHAR(80) NOT NULL COMMENT 'Name of the permission.',
+  `name` VARCHAR(80) NOT NULL COMMENT 'Name of the permission, used as a scope in admin tokens, e.g. members:read.',
   `description` TEXT NOT NULL COMMENT 'Description of the permission.',
   PRIMARY KEY (`id`))
   ENGINE = InnoDB
@@ -1478,6 +1479,169 @@ CREATE TABLE IF NOT EXISTS `%s`.`log_data_table` (
   COMMENT = 'Defines the table names for which we will log data changes. These values need to be added as part of setup.';
 
 
+-- name: create-table-log_auth_attempt
+CREATE TABLE IF NOT EXISTS `%s`.`log_auth_attempt` (
+  `id` INT NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Time of the attempt',
+  `user_type` VARCHAR(20) NOT NULL COMMENT 'Defines if the login was for an \'admin\' or \'member\'.',
+  `login` VARCHAR(100) NOT NULL COMMENT 'The username or email address that was presented.',
+  `ip` VARCHAR(45) NOT NULL COMMENT 'The ip address of the client that made the attempt.',
+  `result` ENUM('success','failure','denied','throttled','unlock') NOT NULL COMMENT 'Outcome of the attempt. Denied means the credentials were correct but the account is inactive or locked. Unlock records an admin clearing a lockout.',
+  `ad_user_id` INT NULL COMMENT 'The admin user that performed an unlock.',
+  PRIMARY KEY (`id`),
+  INDEX `user_type_login` (`user_type` ASC, `login` ASC),
+  INDEX `ip` (`ip` ASC))
+  ENGINE = InnoDB
+  COMMENT = 'Audit log of every login attempt, also used to throttle repeated failures.';
+
+
+-- name: create-table-log_impersonation
+CREATE TABLE IF NOT EXISTS `%s`.`log_impersonation` (
+  `id` INT NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Time of the request',
+  `ad_user_id` INT NOT NULL COMMENT 'The admin user viewing the system as the member.',
+  `member_id` INT NOT NULL COMMENT 'The member being impersonated.',
+  `jti` VARCHAR(64) NOT NULL COMMENT 'The id (jti claim) of the impersonation token.',
+  `method` VARCHAR(10) NOT NULL COMMENT 'The http method of the request.',
+  `path` VARCHAR(255) NOT NULL COMMENT 'The path of the request.',
+  `ip` VARCHAR(45) NOT NULL COMMENT 'The ip address of the client that made the request.',
+  PRIMARY KEY (`id`),
+  INDEX `ad_user_id` (`ad_user_id` ASC),
+  INDEX `member_id` (`member_id` ASC),
+  INDEX `jti` (`jti` ASC))
+  ENGINE = InnoDB
+  COMMENT = 'Audit log of every request made by an admin viewing the system as a member, including the request that issued the token.';
+
+
+-- name: create-table-log_audit
+CREATE TABLE IF NOT EXISTS `%s`.`log_audit` (
+  `id` INT NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Time of the request',
+  `actor_id` INT NOT NULL COMMENT 'The id of the admin, member or API key that made the request.',
+  `actor_name` VARCHAR(255) NOT NULL COMMENT 'The name of the actor when the request was made.',
+  `role` VARCHAR(20) NOT NULL COMMENT 'The role in the token, \'admin\', \'member\' or \'service\'.',
+  `ad_user_id` INT NULL COMMENT 'The admin that made the request while viewing the system as the member.',
+  `method` VARCHAR(10) NOT NULL COMMENT 'The http method of the request.',
+  `path` VARCHAR(255) NOT NULL COMMENT 'The path of the request.',
+  `body_digest` CHAR(64) NOT NULL COMMENT 'SHA-256 digest of the request body.',
+  `status` SMALLINT NOT NULL COMMENT 'The http status of the response.',
+  `ip` VARCHAR(45) NOT NULL COMMENT 'The ip address of the client that made the request.',
+  PRIMARY KEY (`id`),
+  INDEX `role_actor_id` (`role` ASC, `actor_id` ASC),
+  INDEX `created_at` (`created_at` ASC))
+  ENGINE = InnoDB
+  COMMENT = 'Audit log of every mutating request made to the admin and member endpoints.';
+
+
+-- name: create-table-log_audit_entity
+CREATE TABLE IF NOT EXISTS `%s`.`log_audit_entity` (
+  `id` INT NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
+  `log_audit_id` INT NOT NULL COMMENT 'The audited request.',
+  `entity` VARCHAR(50) NOT NULL COMMENT 'The type of record targeted by the request, eg \'members\'.',
+  `entity_id` INT NOT NULL COMMENT 'The id of the record targeted by the request.',
+  PRIMARY KEY (`id`),
+  INDEX `log_audit_id` (`log_audit_id` ASC),
+  INDEX `entity_entity_id` (`entity` ASC, `entity_id` ASC))
+  ENGINE = InnoDB
+  COMMENT = 'Records targeted by an audited request, one row for each.';
+
+
+-- name: create-table-auth_refresh_token
+CREATE TABLE IF NOT EXISTS `%s`.`auth_refresh_token` (
+  `id` INT NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Record created',
+  `expires_at` TIMESTAMP NOT NULL COMMENT 'Time after which the refresh token can no longer be used.',
+  `revoked_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Time the token was used, or revoked by a logout. A refresh token can only be used once.',
+  `replaced_by_id` INT NULL COMMENT 'The refresh token that was issued when this one was used.',
+  `user_type` VARCHAR(20) NOT NULL COMMENT 'Defines if the user is an \'admin\' or \'member\'.',
+  `user_id` INT NOT NULL COMMENT 'The id of the admin or member.',
+  `mfa` TINYINT NOT NULL DEFAULT 0 COMMENT 'Set if the user verified a second factor at login, carried over to refreshed access tokens.',
+  `token_hash` CHAR(64) NOT NULL COMMENT 'SHA-256 hash of the refresh token, the token itself is not stored.',
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `token_hash_UNIQUE` (`token_hash` ASC),
+  INDEX `user_type_user_id` (`user_type` ASC, `user_id` ASC))
+  ENGINE = InnoDB
+  COMMENT = 'Opaque refresh tokens used to obtain new short-lived access tokens.';
+
+
+-- name: create-table-auth_revocation
+CREATE TABLE IF NOT EXISTS `%s`.`auth_revocation` (
+  `id` INT NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Record created',
+  `expires_at` TIMESTAMP NOT NULL COMMENT 'Time after which the revoked tokens have expired anyway, and the record can be removed.',
+  `jti` VARCHAR(64) NULL COMMENT 'The id (jti claim) of a single revoked access token.',
+  `user_type` VARCHAR(20) NOT NULL COMMENT 'Defines if the user is an \'admin\' or \'member\'.',
+  `user_id` INT NOT NULL COMMENT 'The id of the admin or member.',
+  `issued_before` TIMESTAMP(3) NULL DEFAULT NULL COMMENT 'If set, all access tokens for the user issued before this time are revoked.',
+  PRIMARY KEY (`id`),
+  INDEX `jti` (`jti` ASC),
+  INDEX `user_type_user_id` (`user_type` ASC, `user_id` ASC))
+  ENGINE = InnoDB
+  COMMENT = 'Revoked access tokens, checked when validating a token.';
+
+
+-- name: create-table-auth_member_token
+CREATE TABLE IF NOT EXISTS `%s`.`auth_member_token` (
+  `id` INT NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Record created',
+  `expires_at` TIMESTAMP NOT NULL COMMENT 'Time after which the token can no longer be used.',
+  `used_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Time the token was used, or cancelled by a newer token. A token can only be used once.',
+  `purpose` ENUM('reset', 'verify') NOT NULL COMMENT 'A \'reset\' token sets a new password, a \'verify\' token confirms a change of primary email.',
+  `member_id` INT NOT NULL COMMENT 'The member to whom the token was issued.',
+  `token_hash` CHAR(64) NOT NULL COMMENT 'Hex encoded sha256 hash of the token, the token itself is never stored.',
+  `email` VARCHAR(100) NOT NULL DEFAULT '' COMMENT 'For a \'verify\' token, the new primary email that is set when the token is used.',
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `token_hash_UNIQUE` (`token_hash` ASC),
+  INDEX `member_id_purpose` (`member_id` ASC, `purpose` ASC))
+  ENGINE = InnoDB
+  COMMENT = 'Single-use tokens emailed to members to reset a password or verify a new email address.';
+
+
+-- name: create-table-ad_user_mfa
+CREATE TABLE IF NOT EXISTS `%s`.`ad_user_mfa` (
+  `ad_user_id` INT NOT NULL COMMENT 'The admin user that enrolled the authenticator.',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Record created',
+  `updated_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Record last updated',
+  `enabled_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Time enrolment was confirmed with a valid code. Two-factor authentication is not required until this is set.',
+  `secret` VARCHAR(64) NOT NULL COMMENT 'Base32 encoded TOTP secret (RFC 6238) shared with the authenticator app.',
+  `last_step` BIGINT NOT NULL DEFAULT 0 COMMENT 'Time step of the last code used, codes for this or an earlier step are rejected so they cannot be replayed.',
+  PRIMARY KEY (`ad_user_id`))
+  ENGINE = InnoDB
+  COMMENT = 'TOTP authenticators enrolled by admin users for two-factor authentication.';
+
+
+-- name: create-table-ad_user_recovery_code
+CREATE TABLE IF NOT EXISTS `%s`.`ad_user_recovery_code` (
+  `id` INT NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
+  `ad_user_id` INT NOT NULL COMMENT 'The admin user to whom the code was issued.',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Record created',
+  `used_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Time the code was used, each code can only be used once.',
+  `code_hash` CHAR(64) NOT NULL COMMENT 'SHA-256 hash of the recovery code, the code itself is not stored.',
+  PRIMARY KEY (`id`),
+  INDEX `ad_user_id` (`ad_user_id` ASC))
+  ENGINE = InnoDB
+  COMMENT = 'Single-use recovery codes that can be used in place of a TOTP code if an admin loses their authenticator.';
+
+
+-- name: create-table-auth_api_key
+CREATE TABLE IF NOT EXISTS `%s`.`auth_api_key` (
+  `id` INT NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Record created',
+  `expires_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Time after which the key can no longer be used, NULL if the key does not expire.',
+  `last_used_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Time the key was last used, to the nearest minute.',
+  `revoked_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Time the key was revoked, or replaced when it was rotated.',
+  `replaced_by_id` INT NULL COMMENT 'The key that was issued when this one was rotated.',
+  `name` VARCHAR(100) NOT NULL COMMENT 'Name of the service account that uses the key, e.g. pubmedr.',
+  `hint` VARCHAR(16) NOT NULL COMMENT 'The first few characters of the key, to help identify it.',
+  `key_hash` CHAR(64) NOT NULL COMMENT 'SHA-256 hash of the key, the key itself is not stored.',
+  `scopes` VARCHAR(1000) NOT NULL COMMENT 'Comma-separated admin permissions granted to the key, e.g. resources:write.',
+  `ad_user_id` INT NOT NULL COMMENT 'The admin user that created or last rotated the key.',
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `key_hash_UNIQUE` (`key_hash` ASC))
+  ENGINE = InnoDB
+  COMMENT = 'API keys for service accounts, such as the worker services, that are used in place of an admin login.';
+
+
 -- name: create-table-a_name_prefix
 CREATE TABLE IF NOT EXISTS `%s`.`a_name_prefix` (
   `id` INT NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
@@ -1580,6 +1744,20 @@ CREATE TABLE IF NOT EXISTS `%s`.`acl_admin_role_resource` (
   AUTO_INCREMENT = 9;
 
 
+-- name: create-table-acl_admin_role_permission
+CREATE TABLE IF NOT EXISTS `%s`.`acl_admin_role_permission` (
+  `id` INT(11) NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',
+  `acl_admin_role_id` INT(11) NOT NULL COMMENT 'The role that is granted the permission.',
+  `ad_permission_id` INT(11) NOT NULL COMMENT 'The permission granted to all admin users in the role.',
+  `active` TINYINT(1) NOT NULL DEFAULT '1' COMMENT 'Soft delete',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'Record created',
+  `updated_at` TIMESTAMP NULL DEFAULT NULL COMMENT 'Record updated',
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `acl_admin_role_permission_UNIQUE` (`acl_admin_role_id` ASC, `ad_permission_id` ASC))
+  ENGINE = InnoDB
+  COMMENT = 'Permissions granted to admin roles. An admin user has the permissions of their role plus any granted individually in ad_user_permission.';
+
+
 -- name: create-table-cm_email_variable
 CREATE TABLE IF NOT EXISTS `%s`.`cm_email_variable` (
   `id` INT NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier',